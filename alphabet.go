@@ -0,0 +1,144 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// FlagMerges is the number of symbol pairs merged into the alphabet of a build
+var FlagMerges = flag.Int("merges", 0, "number of frequent symbol pairs merged into single symbols when building, the merged symbols reuse the byte values absent from the corpus, 0 keeps the byte alphabet")
+
+// MinMergeCount is the number of occurrences below which a pair isn't merged
+const MinMergeCount = 64
+
+// Merge replaces a pair of adjacent symbols with a symbol absent from the
+// corpus, a pair can contain merged symbols so symbols can stand for longer
+// sequences
+type Merge struct {
+	Symbol uint8    `json:"symbol"`
+	Pair   [2]uint8 `json:"pair"`
+}
+
+// Alphabet are the merges of a database in the order they are applied
+type Alphabet []Merge
+
+// CheckMerges checks the number of merges of a build
+func CheckMerges(merges int) error {
+	if merges < 0 || merges > 255 {
+		return fmt.Errorf("merges must be between 0 and 255")
+	}
+	return nil
+}
+
+// LearnAlphabet learns up to merges merges of the most frequent pairs of
+// symbols of data, the merged symbols are the byte values other than 0 that
+// don't occur in data
+func LearnAlphabet(data []byte, merges int) Alphabet {
+	var used [256]bool
+	for _, v := range data {
+		used[v] = true
+	}
+	var free []uint8
+	for i := 1; i < 256; i++ {
+		if !used[i] {
+			free = append(free, uint8(i))
+		}
+	}
+	var alphabet Alphabet
+	encoded := append([]byte{}, data...)
+	for len(alphabet) < merges && len(free) > 0 {
+		counts := make([]int, 256*256)
+		for i := 1; i < len(encoded); i++ {
+			counts[int(encoded[i-1])<<8|int(encoded[i])]++
+		}
+		best := 0
+		for pair, count := range counts {
+			if count > counts[best] {
+				best = pair
+			}
+		}
+		if counts[best] < MinMergeCount {
+			break
+		}
+		merge := Merge{
+			Symbol: free[0],
+			Pair:   [2]uint8{uint8(best >> 8), uint8(best)},
+		}
+		free = free[1:]
+		alphabet = append(alphabet, merge)
+		encoded = merge.Apply(encoded)
+	}
+	return alphabet
+}
+
+// Apply replaces the pairs of data from left to right in place
+func (m Merge) Apply(data []byte) []byte {
+	j := 0
+	for i := 0; i < len(data); i++ {
+		if i+1 < len(data) && data[i] == m.Pair[0] && data[i+1] == m.Pair[1] {
+			data[j] = m.Symbol
+			i++
+		} else {
+			data[j] = data[i]
+		}
+		j++
+	}
+	return data[:j]
+}
+
+// Encode encodes bytes as symbols of the alphabet
+func (a Alphabet) Encode(data []byte) []byte {
+	if len(a) == 0 {
+		return data
+	}
+	encoded := append([]byte{}, data...)
+	for _, merge := range a {
+		encoded = merge.Apply(encoded)
+	}
+	return encoded
+}
+
+// Expansions are the bytes each symbol of the alphabet stands for
+func (a Alphabet) Expansions() *[256][]byte {
+	var expansions [256][]byte
+	for i := range expansions {
+		expansions[i] = []byte{uint8(i)}
+	}
+	for _, merge := range a {
+		expansion := append([]byte{}, expansions[merge.Pair[0]]...)
+		expansions[merge.Symbol] = append(expansion, expansions[merge.Pair[1]]...)
+	}
+	return &expansions
+}
+
+// Offsets are the byte offsets of the symbols of encoded in the bytes it
+// was encoded from, nil without merges
+func (a Alphabet) Offsets(data, encoded []byte) []uint64 {
+	if len(a) == 0 {
+		return nil
+	}
+	expansions := a.Expansions()
+	offsets, offset := make([]uint64, len(encoded)), uint64(0)
+	for i, symbol := range encoded {
+		offsets[i] = offset
+		offset += uint64(len(expansions[symbol]))
+	}
+	return offsets
+}
+
+// Symbols extends a set of bytes to the symbols whose expansions start
+// with one of them
+func (a Alphabet) Symbols(set *SymbolSet) *SymbolSet {
+	if set == nil || len(a) == 0 {
+		return set
+	}
+	expansions, symbols := a.Expansions(), SymbolSet{}
+	for i, expansion := range expansions {
+		symbols[i] = set[expansion[0]]
+	}
+	return &symbols
+}
@@ -0,0 +1,210 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"unicode/utf8"
+)
+
+const (
+	// OutputText writes generations as text
+	OutputText = "text"
+	// OutputHTML writes generations as html annotated with the spans of the
+	// corpus they are copied from
+	OutputHTML = "html"
+)
+
+// FlagOutput is the format the generations of a query are written in
+var FlagOutput = flag.String("output", OutputText, "format the generations of -query are written to stdout in: text, or html with each span of the output colored by its confidence and linked to the source passage of the corpus it is copied from")
+
+// CheckOutput checks the output format
+func CheckOutput(output string) error {
+	switch output {
+	case OutputText, OutputHTML:
+		return nil
+	}
+	return fmt.Errorf("unknown output %s, it should be %s or %s", output, OutputText, OutputHTML)
+}
+
+// PassageContext is the number of runes of the corpus on each side of a span
+// in its source passage
+const PassageContext = 160
+
+// AnnotatedSpan is a run of outputs copied from consecutive runes of a
+// document of the corpus
+type AnnotatedSpan struct {
+	Text string
+	// Index is the rune index in the corpus of the first output
+	Index    uint64
+	Document uint64
+	// Confidence is the mean confidence of the outputs
+	Confidence float32
+	// Before, Source, and After are the source passage, Source is the runes
+	// the span is copied from, they are empty if the corpus isn't available
+	Before, Source, After string
+}
+
+// Confidence is the calibrated probability of an output, or one minus the
+// entropy of its context if the database isn't calibrated
+func Confidence(output Output) float32 {
+	if output.Probability > 0 {
+		return output.Probability
+	}
+	return 1 - output.Entropy
+}
+
+// Spans splits the outputs into annotated spans, outputs removed by
+// post-processing are skipped
+func Spans(outputs []Output) []AnnotatedSpan {
+	var spans []AnnotatedSpan
+	runes, next := 0, uint64(0)
+	for _, output := range Kept(outputs) {
+		last := len(spans) - 1
+		if last < 0 || output.Document != spans[last].Document || output.Index != next {
+			if last >= 0 {
+				spans[last].Confidence /= float32(runes)
+			}
+			spans = append(spans, AnnotatedSpan{Index: output.Index, Document: output.Document})
+			last, runes = last+1, 0
+		}
+		spans[last].Text += output.S
+		spans[last].Confidence += Confidence(output)
+		runes, next = runes+1, output.Index+1
+	}
+	if last := len(spans) - 1; last >= 0 {
+		spans[last].Confidence /= float32(runes)
+	}
+	return spans
+}
+
+// Passages sets the source passages of the spans from the corpus, the spans
+// are left without passages if the corpus isn't available
+func (m *Model) Passages(spans []AnnotatedSpan) error {
+	if _, err := m.Snippet(0, 0); err != nil {
+		return nil
+	}
+	for i := range spans {
+		length := utf8.RuneCountInString(spans[i].Text)
+		snippet, err := m.Snippet(spans[i].Index, PassageContext+length)
+		if err != nil {
+			return err
+		}
+		runes, at := []rune(snippet), int(min(spans[i].Index, uint64(PassageContext+length)))
+		at = min(at, len(runes))
+		end := min(at+length, len(runes))
+		spans[i].Before = string(runes[max(0, at-PassageContext):at])
+		spans[i].Source = string(runes[at:end])
+		spans[i].After = string(runes[end:min(end+PassageContext, len(runes))])
+	}
+	return nil
+}
+
+// Annotated is a generation annotated with the spans of its output
+type Annotated struct {
+	Rank         float64
+	FinishReason string
+	Spans        []AnnotatedSpan
+}
+
+// Annotation is the query and annotated generations of an html output
+type Annotation struct {
+	Query       string
+	Generations []Annotated
+}
+
+// Annotate annotates the generations of a query with the spans of their
+// outputs and their source passages
+func (m *Model) Annotate(query []byte, searches []Search) (Annotation, error) {
+	annotation := Annotation{Query: string(query)}
+	for _, search := range searches {
+		spans := Spans(search.Result)
+		err := m.Passages(spans)
+		if err != nil {
+			return annotation, err
+		}
+		annotation.Generations = append(annotation.Generations, Annotated{
+			Rank:         search.Rank,
+			FinishReason: search.FinishReason,
+			Spans:        spans,
+		})
+	}
+	return annotation, nil
+}
+
+// AnnotationTemplate renders an annotation, each span is linked to its source
+// passage and colored from red to green by its confidence
+var AnnotationTemplate = template.Must(template.New("annotation").Funcs(template.FuncMap{
+	"color": func(confidence float32) string {
+		confidence = max(0, min(1, confidence))
+		return fmt.Sprintf("#%02x%02xb0", 0xb0+int(0x4f*(1-confidence)), 0xb0+int(0x4f*confidence))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+ <head>
+  <meta charset="UTF-8">
+  <title>Soda</title>
+  <style>
+   pre {
+       white-space: pre-wrap;
+   }
+   a.span {
+       color: inherit;
+       text-decoration: none;
+   }
+  </style>
+ </head>
+ <body>
+  {{range $i, $generation := .Generations}}
+  <h3>generation {{$i}} rank {{printf "%.3f" $generation.Rank}} finished by {{$generation.FinishReason}}</h3>
+  <pre>{{$.Query}}{{range $j, $span := $generation.Spans}}<a class="span" href="#source-{{$i}}-{{$j}}" title="doc {{$span.Document}} rune {{$span.Index}} confidence {{printf "%.3f" $span.Confidence}}" style="background: {{color $span.Confidence}};">{{$span.Text}}</a>{{end}}</pre>
+  <h4>sources</h4>
+  <ol start="0">
+   {{range $j, $span := $generation.Spans}}
+   <li id="source-{{$i}}-{{$j}}">
+    <p>{{printf "%q" $span.Text}} doc {{$span.Document}} rune {{$span.Index}} confidence {{printf "%.3f" $span.Confidence}}</p>
+    {{if $span.Source}}<pre>{{$span.Before}}<mark>{{$span.Source}}</mark>{{$span.After}}</pre>{{end}}
+   </li>
+   {{end}}
+  </ol>
+  {{end}}
+ </body>
+</html>
+`))
+
+// WriteAnnotated writes the generations of a query as annotated html
+func (m *Model) WriteAnnotated(out io.Writer, query []byte, searches []Search) error {
+	annotation, err := m.Annotate(query, searches)
+	if err != nil {
+		return err
+	}
+	return AnnotationTemplate.Execute(out, annotation)
+}
+
+// GenerateHTML generates text and renders it as annotated html
+func (h Handler) GenerateHTML(response http.ResponseWriter, request *http.Request) {
+	query, options, ok := h.Parse(response, request)
+	if !ok {
+		return
+	}
+	if options.Request.DryRun {
+		http.Error(response, "dry runs are estimated by /v1/generate", http.StatusBadRequest)
+		return
+	}
+	searches := h.Soda(query, options)
+	annotation, err := h.Annotate(query, searches[:1])
+	if err != nil {
+		panic(err)
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = AnnotationTemplate.Execute(response, annotation)
+	if err != nil {
+		panic(err)
+	}
+}
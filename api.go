@@ -0,0 +1,372 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pointlander/soda/client"
+)
+
+// Outputs converts outputs into their api representation
+func Outputs(outputs []Output) []client.Output {
+	converted := make([]client.Output, len(outputs))
+	for i, output := range outputs {
+		converted[i] = client.Output{
+			Index:       output.Index,
+			Document:    output.Document,
+			Symbol:      output.S,
+			Context:     output.Context,
+			Entropy:     output.Entropy,
+			Probability: output.Probability,
+		}
+	}
+	return converted
+}
+
+// Text is the text of the outputs
+func Text(outputs []Output) string {
+	var text strings.Builder
+	for _, output := range outputs {
+		text.WriteString(output.S)
+	}
+	return text.String()
+}
+
+// Limit limits the request body to the maximum body size
+func Limit(response http.ResponseWriter, request *http.Request) io.Reader {
+	if *FlagMaxBody <= 0 {
+		return request.Body
+	}
+	return http.MaxBytesReader(response, request.Body, *FlagMaxBody)
+}
+
+// Strict decodes the single json value of reader into value, fields that
+// value doesn't have are rejected
+func Strict(reader io.Reader, value any) error {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err != nil {
+		return BodyError(err)
+	}
+	var extra json.RawMessage
+	err = decoder.Decode(&extra)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return BodyError(err)
+	}
+	return fmt.Errorf("invalid json: unexpected data after the request at byte %d", decoder.InputOffset()-int64(len(extra)))
+}
+
+// BodyError describes an error reading or decoding a request body
+func BodyError(err error) error {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	var size *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("request body is empty")
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("invalid json: request body ends before the request does")
+	case errors.As(err, &syntax):
+		return fmt.Errorf("invalid json at byte %d: %s", syntax.Offset, strings.TrimPrefix(syntax.Error(), "json: "))
+	case errors.As(err, &typ) && typ.Field == "":
+		return fmt.Errorf("invalid request: expected a json %s, got %s", Kind(typ.Type), typ.Value)
+	case errors.As(err, &typ):
+		return fmt.Errorf("invalid %s: expected %s, got %s", typ.Field, Kind(typ.Type), typ.Value)
+	case errors.As(err, &size):
+		return fmt.Errorf("request body is larger than %d bytes", size.Limit)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return err
+}
+
+// Kind names the json value that decodes into a go type
+func Kind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Pointer:
+		return Kind(t.Elem())
+	}
+	return t.String()
+}
+
+// Decode decodes a json request body replying with a 400 on failure
+func Decode(response http.ResponseWriter, request *http.Request, value any) bool {
+	err := Strict(Limit(response, request), value)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Reply writes a json reply
+func Reply(response http.ResponseWriter, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Write(data)
+}
+
+// Parse parses a generation request into the prompt and options
+func (h Handler) Parse(response http.ResponseWriter, request *http.Request) ([]byte, Options, bool) {
+	var req Request
+	if !Decode(response, request, &req) {
+		return nil, Options{}, false
+	}
+	options, err := req.Options()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return nil, options, false
+	}
+	query, err := req.Prompt()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return nil, options, false
+	}
+	// a dry run is charged for the steps it generates to measure them
+	admitted := options
+	if req.DryRun {
+		admitted.Count = min(admitted.Count, EstimateSteps)
+	}
+	if !h.Admit(response, request, admitted) {
+		return nil, options, false
+	}
+	if !req.DryRun {
+		options.Account = AccountOf(request)
+	}
+	return query, options, true
+}
+
+// Generate generates text
+func (h Handler) Generate(response http.ResponseWriter, request *http.Request) {
+	query, options, ok := h.Parse(response, request)
+	if !ok {
+		return
+	}
+	if options.Request.DryRun {
+		Reply(response, h.Model.Estimate(query, options))
+		return
+	}
+	searches := h.Soda(query, options)
+	Reply(response, client.Response{
+		Text:            Text(searches[0].Result),
+		Output:          Outputs(searches[0].Result),
+		Truncated:       searches[0].Truncated,
+		PromptTruncated: searches[0].PromptTruncated,
+		Degraded:        searches[0].Degraded,
+		ID:              searches[0].ID,
+		Steps:           searches[0].Steps,
+		FinishReason:    searches[0].FinishReason,
+	})
+}
+
+// GenerateStream generates text streaming each rune as a server sent event
+func (h Handler) GenerateStream(response http.ResponseWriter, request *http.Request) {
+	query, options, ok := h.Parse(response, request)
+	if !ok {
+		return
+	}
+	if options.Request.DryRun {
+		http.Error(response, "dry runs are estimated by /v1/generate", http.StatusBadRequest)
+		return
+	}
+	if _, ok := response.(http.Flusher); !ok {
+		http.Error(response, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	// the events are written as the client reads them, generation pauses
+	// while it falls behind and stops once it goes away
+	flow := NewFlowWriter(response, request, *FlagStreamHighWater)
+	defer flow.Close()
+	options.Control = &Control{
+		Sampler: options.Sampler,
+		Stop:    options.Stop,
+	}
+	if h.Streams != nil {
+		id := h.Streams.Add(options.Control)
+		defer h.Streams.Remove(id)
+		data, err := json.Marshal(client.Start{ID: id})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(flow, "event: start\ndata: %s\n\n", data)
+	}
+	// the outputs are post-processed as they become stable, so the stream
+	// post-processes the raw results itself
+	postprocess, seen := options.Postprocess, 0
+	options.Postprocess = nil
+	send := func(result []Output) {
+		if seen > len(result) {
+			seen = len(result)
+		}
+		rewritten := postprocess.Rewrite(query, result)
+		for _, output := range Outputs(Kept(rewritten[seen:])) {
+			data, err := json.Marshal(output)
+			if err != nil {
+				panic(err)
+			}
+			_, err = fmt.Fprintf(flow, "data: %s\n\n", data)
+			if err != nil {
+				options.Control.Cancel()
+				break
+			}
+		}
+		seen = len(result)
+	}
+	options.Progress = func(symbols int, result []Output) {
+		send(result[:postprocess.Stable(result)])
+	}
+	searches := h.Soda(query, options)
+	send(searches[0].Result)
+	data, err := json.Marshal(client.Done{Truncated: searches[0].Truncated, Canceled: searches[0].Canceled, Degraded: searches[0].Degraded, ID: searches[0].ID, FinishReason: searches[0].FinishReason})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(flow, "event: done\ndata: %s\n\n", data)
+}
+
+// FlagEmbedBatch is the maximum number of texts in a batch embedding request
+var FlagEmbedBatch = flag.Int("embed-batch", 256, "maximum number of texts in a batch embedding request")
+
+const (
+	// PoolingLast embeds a text as the mixer vector after the text
+	PoolingLast = "last"
+	// PoolingMean embeds a text as the mean of the mixer vectors at each position
+	PoolingMean = "mean"
+	// PoolingMax embeds a text as the element wise max of the mixer vectors at
+	// each position
+	PoolingMax = "max"
+)
+
+// Pool embeds text by pooling the database vectors of the model after each
+// symbol of the text
+func (m *Model) Pool(text []byte, pooling string) []float32 {
+	if pooling == PoolingLast {
+		return m.Embed(text)
+	}
+	text = m.Coding().Encode(m.Smoothing.Apply(m.Preprocess.Apply(text)))
+	if len(text) == 0 {
+		return m.Embed(text)
+	}
+	mixer, mixed := m.NewMixer(), [256]float32{}
+	output, embedding := make([]float32, m.Width()), make([]float32, m.Width())
+	for i, v := range text {
+		mixer.Add(v)
+		mixer.Mix(&mixed)
+		m.Project(embedding, mixed[:])
+		for j, value := range embedding {
+			switch {
+			case pooling == PoolingMax && (i == 0 || value > output[j]):
+				output[j] = value
+			case pooling == PoolingMean:
+				output[j] += value / float32(len(text))
+			}
+		}
+	}
+	return output
+}
+
+// Embed embeds text as the database vector after the text
+func (h Handler) Embed(response http.ResponseWriter, request *http.Request) {
+	var req client.EmbedRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	Reply(response, client.EmbedResponse{
+		Vector: h.Pool([]byte(req.Text), PoolingLast),
+	})
+}
+
+// Entropy reports the entropy of the context after the text of the request
+func (h Handler) Entropy(response http.ResponseWriter, request *http.Request) {
+	var req client.EntropyRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	vector, entropy := h.Model.Entropy([]byte(req.Text))
+	Reply(response, client.EntropyResponse{
+		Vector:  vector,
+		Entropy: entropy,
+	})
+}
+
+// EmbedBatch embeds several texts with the pooling of the request
+func (h Handler) EmbedBatch(response http.ResponseWriter, request *http.Request) {
+	var req client.EmbedBatchRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	if req.Pooling == "" {
+		req.Pooling = PoolingLast
+	}
+	switch req.Pooling {
+	case PoolingLast, PoolingMean, PoolingMax:
+	default:
+		http.Error(response, fmt.Sprintf("unknown pooling %s", req.Pooling), http.StatusBadRequest)
+		return
+	}
+	if len(req.Texts) > *FlagEmbedBatch {
+		http.Error(response, fmt.Sprintf("at most %d texts can be embedded at once", *FlagEmbedBatch), http.StatusBadRequest)
+		return
+	}
+	vectors, work := make([][]float32, len(req.Texts)), make(chan int, len(req.Texts))
+	for i := range req.Texts {
+		work <- i
+	}
+	close(work)
+	var wait sync.WaitGroup
+	errs := make([]error, runtime.NumCPU())
+	for i := range errs {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			errs[i] = Recover(func() {
+				for i := range work {
+					vectors[i] = h.Pool([]byte(req.Texts[i]), req.Pooling)
+				}
+			})
+		}()
+	}
+	wait.Wait()
+	for _, err := range errs {
+		if err != nil {
+			panic(err)
+		}
+	}
+	Reply(response, client.EmbedBatchResponse{
+		Vectors: vectors,
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// Appender is a store documents can be appended to after the database is
+// built
+type Appender interface {
+	Store
+	// Append appends a document, its preprocessed text, and its entries by
+	// bucket in one transaction
+	Append(document Document, text []byte, entries map[int][]binaryvec.Entry) error
+	// Appended is the preprocessed text of the appended documents, it follows
+	// the corpus
+	Appended() []byte
+}
+
+// MixDocument mixes the document with id into the entries of the buckets
+// nearest to them, the rune indexes of the entries start at runes. Every
+// position is indexed whatever the stride of the database. The preprocessed
+// text of the document is returned with the entries
+func (m *Model) MixDocument(document Document, id, runes uint64) ([]byte, map[int][]binaryvec.Entry, error) {
+	settings, width := m.Settings, m.Width()
+	mixer, mixed, vector := settings.NewMixer(), [256]float32{}, make([]float32, width)
+	mixer.Add(0)
+	var text []byte
+	entries := make(map[int][]binaryvec.Entry)
+	err := StreamCorpus([]Document{document}, DocumentOrder(1), settings.Redact, settings.Preprocess, CorpusChunk, func(chunk Chunk) error {
+		coding := settings.Coding()
+		data := coding.Encode(chunk.Input)
+		offsets, indexes := coding.Offsets(chunk.Input, data), chunk.RuneIndexes()
+		for i, symbol := range data {
+			offset := i
+			if offsets != nil {
+				offset = int(offsets[i])
+			}
+			mixer.Mix(&mixed)
+			settings.Project(vector, mixed[:])
+			bucket := m.Header.Nearest(vector)
+			entry := binaryvec.Entry{
+				Vector:   append([]float32(nil), vector...),
+				Symbol:   symbol,
+				Index:    runes + indexes[offset],
+				Document: id,
+				Entropy:  Entropy(mixed[:]),
+			}
+			copy(entry.Signature[:], NewSignature(vector, m.Header[bucket].Vector[:width]).Bytes())
+			entries[bucket] = append(entries[bucket], entry)
+			mixer.Add(symbol)
+		}
+		text = append(text, chunk.Input...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return text, entries, nil
+}
+
+// DBAppend appends a document to the database given by -db without
+// rebuilding it, the document and its entries are appended to the store in
+// one transaction. Only the bolt backend supports appends
+func DBAppend(args []string) {
+	if len(args) != 2 {
+		fmt.Println("usage: db append <path> <title>")
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	appender, ok := model.Store.(Appender)
+	switch {
+	case !ok:
+		fmt.Printf("the %s backend can't append documents, import the database with db bolt and use -backend bolt\n", *FlagBackend)
+		return
+	case model.Metadata == nil:
+		fmt.Println(*FlagDB, "has no metadata to record the document in")
+		return
+	case model.EmbedCorpus:
+		fmt.Println("documents can't be appended to a database with an embedded corpus")
+		return
+	case model.Counts != nil:
+		fmt.Println("documents can't be appended to a distilled database")
+		return
+	case model.Subclusters > 0:
+		fmt.Println("documents can't be appended to a database with sub-clusters")
+		return
+	}
+	corpus, err := model.Corpus()
+	if err != nil {
+		fmt.Println("the corpus of the database is needed for the rune indexes:", err)
+		return
+	}
+	// the document is a new version of the documents with its title
+	documents := model.Documents()
+	numbered := NumberVersions(append(documents[:len(documents):len(documents)], Document{Path: args[0], Title: args[1]}))
+	document, id := numbered[len(numbered)-1], uint64(len(documents))
+	text, entries, err := model.MixDocument(document, id, uint64(len(corpus)))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = appender.Append(document, text, entries)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	count := 0
+	for _, bucket := range entries {
+		count += len(bucket)
+	}
+	fmt.Printf("appended version %d of %s as document %d with %d entries\n", document.Version, document.Title, id, count)
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// FlagAssets is the directory of assets that override the embedded assets
+	FlagAssets = flag.String("assets", "", "directory of web assets served instead of the embedded assets, files it doesn't have fall back to the embedded assets")
+	// FlagBooks is the directory of books that override the embedded books
+	FlagBooks = flag.String("books", "", "directory of bzip2 compressed books read instead of the embedded books, books it doesn't have fall back to the embedded books, a books.json list of documents in it replaces the -moar documents")
+)
+
+// BooksManifest is the file of a books directory listing its documents
+const BooksManifest = "books.json"
+
+// Overlay is a file system where the files of a directory override the files
+// of an embedded file system
+type Overlay struct {
+	// Dir is the flag of the directory, the embedded files are used if it is
+	// empty
+	Dir *string
+	// Prefix is the directory of the files in Embedded the files of Dir stand
+	// for
+	Prefix   string
+	Embedded fs.FS
+}
+
+// Open opens the file name of Dir if it has it, otherwise of Embedded
+func (o Overlay) Open(name string) (fs.File, error) {
+	if *o.Dir != "" {
+		if rest, ok := strings.CutPrefix(name, o.Prefix+"/"); ok {
+			file, err := os.DirFS(*o.Dir).Open(rest)
+			if !errors.Is(err, fs.ErrNotExist) {
+				return file, err
+			}
+		}
+	}
+	return o.Embedded.Open(name)
+}
+
+// Books are the books of the corpus
+var Books = Overlay{Dir: FlagBooks, Prefix: "books", Embedded: Data}
+
+// Assets are the web assets
+var Assets = Overlay{Dir: FlagAssets, Prefix: "assets", Embedded: Index}
+
+// LoadBooks replaces the -moar documents with the documents of the manifest
+// of the books directory if it has one, the paths of the manifest are
+// relative to the directory
+func LoadBooks(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path.Join(dir, BooksManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var documents []Document
+	err = json.Unmarshal(data, &documents)
+	if err != nil {
+		return fmt.Errorf("%s: %w", BooksManifest, err)
+	}
+	for i := range documents {
+		if !fs.ValidPath(documents[i].Path) {
+			return fmt.Errorf("%s: invalid path %s", BooksManifest, documents[i].Path)
+		}
+		documents[i].Path = "books/" + documents[i].Path
+	}
+	Moar = documents
+	return nil
+}
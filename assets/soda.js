@@ -0,0 +1,22 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Soda runs the soda model in the browser. It requires wasm_exec.js:
+//
+//  const model = await Soda.load("soda.wasm", "db.bin");
+//  const output = await model.generate("What is the meaning of life?", {count: 64});
+//  console.log(output.map((o) => o.symbol).join(""));
+const Soda = {
+ async load(wasm, db) {
+  const go = new Go();
+  const result = await WebAssembly.instantiateStreaming(fetch(wasm), go.importObject);
+  go.run(result.instance);
+  const response = await fetch(db);
+  soda.load(new Uint8Array(await response.arrayBuffer()));
+  return Soda;
+ },
+ async generate(query, options) {
+  return JSON.parse(await soda.generate(query, options || {}));
+ }
+};
@@ -0,0 +1,74 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TempSuffix is the suffix of a database that is being written
+const TempSuffix = ".tmp"
+
+// AtomicFile is a file that is written to a temporary file and renamed into
+// place on commit, so a crash never leaves a partial file at the path
+type AtomicFile struct {
+	*os.File
+	Path      string
+	committed bool
+}
+
+// CreateAtomic creates path.tmp to be renamed to path on commit
+func CreateAtomic(path string) (*AtomicFile, error) {
+	file, err := os.Create(path + TempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{
+		File: file,
+		Path: path,
+	}, nil
+}
+
+// Commit syncs the temporary file and renames it to the path
+func (a *AtomicFile) Commit() error {
+	err := a.File.Sync()
+	if err != nil {
+		return err
+	}
+	err = a.File.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(a.File.Name(), a.Path)
+	if err != nil {
+		return err
+	}
+	a.committed = true
+	return nil
+}
+
+// Close removes the temporary file if it wasn't committed
+func (a *AtomicFile) Close() error {
+	if a.committed {
+		return nil
+	}
+	a.File.Close()
+	return os.Remove(a.File.Name())
+}
+
+// CheckTemp refuses databases that are temporary files or that have a
+// leftover temporary file from an unfinished write
+func CheckTemp(path string) error {
+	if strings.HasSuffix(path, TempSuffix) {
+		return fmt.Errorf("%s is an unfinished database write", path)
+	}
+	if _, err := os.Stat(path + TempSuffix); err == nil {
+		return fmt.Errorf("%s%s exists, a write of %s is in progress or was interrupted, remove it to load %s",
+			path, TempSuffix, path, path)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+)
+
+// FlagAttention is the weight of the attention over the prompt
+var FlagAttention = flag.Float64("attention", 0, "weight between 0 and 1 of the attention over the prompt positions in the vector the buckets are probed and the candidates are scored with, 0 uses the latest mixer vector alone")
+
+const (
+	// AttentionPositions is the maximum number of prompt positions attended
+	// to, longer prompts are attended to at evenly spaced positions
+	AttentionPositions = 256
+	// AttentionSharpness scales the similarity of a prompt position to the
+	// current vector in the softmax of the attention
+	AttentionSharpness = 8
+	// AttentionRecency is how much less weight the start of the prompt has
+	// than the end of the prompt in the softmax of the attention
+	AttentionRecency = 2
+)
+
+// Attention is the mixer vectors of the prompt positions, the current vector
+// attends to them
+type Attention struct {
+	// Stride is the spacing of the positions
+	Stride int
+	// Vectors are the vectors of the positions and Ages how far back in the
+	// prompt they are between 0 at the end and 1 at the start
+	Vectors [][]float32
+	Ages    []float32
+}
+
+// NewAttention creates the attention of a prompt of length bytes
+func NewAttention(length int) *Attention {
+	return &Attention{
+		Stride: max((length+AttentionPositions-1)/AttentionPositions, 1),
+	}
+}
+
+// Record records the vector of the mixer after the prompt byte at position
+// i of a prompt of length bytes, the positions are counted back from the end
+// of the prompt so the last byte is always recorded
+func (a *Attention) Record(m Mixer, settings Settings, i, length int) {
+	back := length - 1 - i
+	if back%a.Stride != 0 {
+		return
+	}
+	var data [256]float32
+	m.Mix(&data)
+	vector := make([]float32, settings.Width())
+	settings.Project(vector, data[:])
+	a.Vectors = append(a.Vectors, vector)
+	a.Ages = append(a.Ages, float32(back)/float32(length))
+}
+
+// Attend writes to output the unit vector of current blended with the
+// softmax weighted sum of the prompt vectors, the weight of a prompt vector
+// grows with its similarity to current and its closeness to the end of the
+// prompt
+func (a *Attention) Attend(output, current []float32, weight float32) {
+	if a == nil || len(a.Vectors) == 0 || weight <= 0 {
+		copy(output, current)
+		return
+	}
+	logits, max := make([]float32, len(a.Vectors)), float32(0)
+	for i, vector := range a.Vectors {
+		logits[i] = AttentionSharpness*CS(vector, current) - AttentionRecency*a.Ages[i]
+		if i == 0 || logits[i] > max {
+			max = logits[i]
+		}
+	}
+	sum := float32(0)
+	for i := range logits {
+		logits[i] = exp(logits[i] - max)
+		sum += logits[i]
+	}
+	attended := make([]float32, len(current))
+	for i, vector := range a.Vectors {
+		w := logits[i] / sum
+		for j, value := range vector {
+			attended[j] += w * value
+		}
+	}
+	unit(attended, attended)
+	for j := range output {
+		output[j] = (1-weight)*current[j] + weight*attended[j]
+	}
+	unit(output, output)
+}
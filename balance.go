@@ -0,0 +1,50 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+)
+
+// HeaderPositions is the number of positions the header statistics of a
+// corpus of several documents are computed over
+const HeaderPositions = 1 << 20
+
+// DocumentOrder is the order a build processes n documents in, documents of
+// a mixed corpus are shuffled with a fixed seed so the corpus isn't ordered
+// by source, nil processes them in order
+func DocumentOrder(n int) []int {
+	if n <= 1 {
+		return nil
+	}
+	return rand.New(rand.NewSource(1)).Perm(n)
+}
+
+// HeaderSamples are the positions of a corpus the header statistics are
+// computed over, each document contributes an equal share of HeaderPositions
+// so large or early documents don't dominate them. lengths are the number of
+// symbols of each document and order is the order the documents are
+// processed in, nil if every position is used
+func HeaderSamples(lengths []int, order []int) []int {
+	if order == nil {
+		return nil
+	}
+	share, samples, start := HeaderPositions/len(order), []int{}, 0
+	for _, document := range order {
+		length := lengths[document]
+		stride := (length + share - 1) / share
+		positions := StridePositions(length, stride)
+		if positions == nil {
+			for position := 0; position < length; position++ {
+				samples = append(samples, start+position)
+			}
+		}
+		for _, position := range positions {
+			samples = append(samples, start+position)
+		}
+		start += length
+	}
+	return samples
+}
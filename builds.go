@@ -0,0 +1,293 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FlagBuildDir is the directory the build api writes databases to
+var FlagBuildDir = flag.String("build-dir", "", "directory the admin build api writes databases to with the build flags of the server, empty disables the build api, it is open to every client unless -keys is given")
+
+// BuildEvents is the number of progress events buffered for each client of a
+// build event stream, events are dropped for clients that fall behind
+const BuildEvents = 64
+
+// BuildRequest starts a build
+type BuildRequest struct {
+	// Name is the file name of the database in the build directory
+	Name string `json:"name"`
+	// Corpora are uploaded corpora the database is built from instead of the
+	// documents of the server
+	Corpora []string `json:"corpora,omitempty"`
+}
+
+// BuildJob is a build started through the api
+type BuildJob struct {
+	sync.Mutex `json:"-"`
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	// Progress is the latest progress event of the build
+	Progress *ProgressEvent `json:"progress,omitempty"`
+
+	listeners map[chan ProgressEvent]bool
+	done      chan struct{}
+}
+
+// Snapshot returns the json encoding of the build
+func (b *BuildJob) Snapshot() []byte {
+	b.Lock()
+	defer b.Unlock()
+	data, err := json.Marshal(b)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Report records a progress event and sends it to the listeners
+func (b *BuildJob) Report(event ProgressEvent) {
+	b.Lock()
+	defer b.Unlock()
+	b.Progress = &event
+	for listener := range b.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
+
+// Listen returns a channel of the progress events of the build, nil if the
+// build has finished
+func (b *BuildJob) Listen() chan ProgressEvent {
+	b.Lock()
+	defer b.Unlock()
+	if b.Finished != nil {
+		return nil
+	}
+	listener := make(chan ProgressEvent, BuildEvents)
+	b.listeners[listener] = true
+	return listener
+}
+
+// Unlisten stops sending events to a listener
+func (b *BuildJob) Unlisten(listener chan ProgressEvent) {
+	b.Lock()
+	delete(b.listeners, listener)
+	b.Unlock()
+}
+
+// Builds is the admin build api, one build runs at a time
+type Builds struct {
+	sync.Mutex
+	Dir     string
+	Jobs    map[string]*BuildJob
+	Running *BuildJob
+	// Uploads are the corpora uploaded to the build directory
+	Uploads *Uploads
+}
+
+// NewBuilds creates the build api of the directory
+func NewBuilds(dir string) (*Builds, error) {
+	uploads, err := NewUploads(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Builds{
+		Dir:     dir,
+		Jobs:    make(map[string]*BuildJob),
+		Uploads: uploads,
+	}, nil
+}
+
+// Admin is true if the request may use the admin api, every request may if
+// there are no keys, otherwise it replies with a 403
+func Admin(response http.ResponseWriter, request *http.Request) bool {
+	if account := AccountOf(request); account != nil && !account.Key.Admin {
+		http.Error(response, "an admin key is required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Create starts a build of the documents with the build flags
+func (b *Builds) Create(response http.ResponseWriter, request *http.Request) {
+	if !Admin(response, request) {
+		return
+	}
+	var req BuildRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	err := ValidFileName(req.Name)
+	if err != nil {
+		http.Error(response, fmt.Sprintf("database: %s", err), http.StatusBadRequest)
+		return
+	}
+	settings, err := BuildSettings()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options, err := BuildFlags()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	documents := Documents()
+	if len(req.Corpora) > 0 {
+		documents, err = b.Uploads.Documents(req.Corpora)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	job := &BuildJob{
+		ID:        hex.EncodeToString(id),
+		Name:      req.Name,
+		Status:    JobRunning,
+		Started:   time.Now(),
+		listeners: make(map[chan ProgressEvent]bool),
+		done:      make(chan struct{}),
+	}
+	b.Lock()
+	if b.Running != nil {
+		b.Unlock()
+		http.Error(response, fmt.Sprintf("build %s is running", b.Running.ID), http.StatusConflict)
+		return
+	}
+	b.Running, b.Jobs[job.ID] = job, job
+	b.Unlock()
+	go b.Run(job, filepath.Join(b.Dir, req.Name), documents, settings, options)
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.WriteHeader(http.StatusAccepted)
+	response.Write(job.Snapshot())
+}
+
+// Run builds the database of a job from the documents with the options, the
+// progress of the process is reported to the job while it runs
+func (b *Builds) Run(job *BuildJob, path string, documents []Document, settings Settings, options BuildOptions) {
+	stop := ListenProgress(job.Report)
+	err := Recover(func() {
+		err := Build(path, documents, settings, options)
+		if err != nil {
+			panic(err)
+		}
+	})
+	stop()
+	now := time.Now()
+	job.Lock()
+	job.Status, job.Finished = JobDone, &now
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+		if p, ok := err.(*Panic); ok {
+			job.Error = fmt.Sprint(p.Value)
+		}
+	}
+	for listener := range job.listeners {
+		close(listener)
+	}
+	job.listeners = nil
+	job.Unlock()
+	close(job.done)
+	b.Lock()
+	b.Running = nil
+	b.Unlock()
+}
+
+// job returns the job of the request replying with a 404 if it doesn't exist
+func (b *Builds) job(response http.ResponseWriter, request *http.Request) *BuildJob {
+	if !Admin(response, request) {
+		return nil
+	}
+	id := request.PathValue("id")
+	b.Lock()
+	job := b.Jobs[id]
+	b.Unlock()
+	if job == nil {
+		http.Error(response, fmt.Sprintf("build %s does not exist", id), http.StatusNotFound)
+	}
+	return job
+}
+
+// Status reports a build
+func (b *Builds) Status(response http.ResponseWriter, request *http.Request) {
+	job := b.job(response, request)
+	if job == nil {
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Write(job.Snapshot())
+}
+
+// Events streams the progress of a build as server sent progress events, the
+// latest event is sent first and a done event with the build ends the stream
+func (b *Builds) Events(response http.ResponseWriter, request *http.Request) {
+	job := b.job(response, request)
+	if job == nil {
+		return
+	}
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		http.Error(response, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	send := func(event ProgressEvent) {
+		ExtendWriteDeadline(response)
+		data, err := json.Marshal(event)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(response, "event: progress\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	listener := job.Listen()
+	if listener != nil {
+		defer job.Unlisten(listener)
+	}
+	job.Lock()
+	last := job.Progress
+	job.Unlock()
+	if last != nil {
+		send(*last)
+	}
+	for listener != nil {
+		select {
+		case event, ok := <-listener:
+			if !ok {
+				listener = nil
+				break
+			}
+			send(event)
+		case <-request.Context().Done():
+			return
+		}
+	}
+	<-job.done
+	ExtendWriteDeadline(response)
+	fmt.Fprintf(response, "event: done\ndata: %s\n\n", job.Snapshot())
+	flusher.Flush()
+}
@@ -0,0 +1,217 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// FlagCalibrate is the number of holdout positions the calibration is fit at
+var FlagCalibrate = flag.Int("calibrate", 0, "number of positions of the corpus a build fits the calibration of the candidate scores to probabilities at, 256 is a good number, 0 doesn't calibrate")
+
+// PlattIterations is the maximum number of newton steps of a platt fit
+const PlattIterations = 100
+
+// Calibration maps the score of a candidate to the probability that it is the
+// next symbol, it is a logistic function of the score fit by platt scaling
+type Calibration struct {
+	A float32 `json:"a"`
+	B float32 `json:"b"`
+	// Positions and Samples are the number of holdout positions and of
+	// candidate scores the calibration was fit with
+	Positions int `json:"positions"`
+	Samples   int `json:"samples"`
+}
+
+// Probability is the calibrated probability of a candidate with the score
+func (c *Calibration) Probability(score float32) float32 {
+	return float32(math.Exp(c.LogProbability(score)))
+}
+
+// LogProbability is the log of the calibrated probability of a candidate with
+// the score, it is computed without overflow for large scores
+func (c *Calibration) LogProbability(score float32) float64 {
+	z := float64(c.A)*float64(score) + float64(c.B)
+	if z >= 0 {
+		return -math.Log1p(math.Exp(-z))
+	}
+	return z - math.Log1p(math.Exp(z))
+}
+
+// FitPlatt fits p = 1/(1+exp(-(a*score+b))) to the labels of the scores by
+// newton's method on the log loss, the targets are smoothed as in platt's
+// paper so the fit is finite if the scores are separable. It isn't ok
+// without both positive and negative labels
+func FitPlatt(scores []float32, labels []bool) (a, b float64, ok bool) {
+	positives := 0
+	for _, label := range labels {
+		if label {
+			positives++
+		}
+	}
+	negatives := len(labels) - positives
+	if positives == 0 || negatives == 0 {
+		return 0, 0, false
+	}
+	high := (float64(positives) + 1) / (float64(positives) + 2)
+	low := 1 / (float64(negatives) + 2)
+	targets := make([]float64, len(labels))
+	for i, label := range labels {
+		targets[i] = low
+		if label {
+			targets[i] = high
+		}
+	}
+	loss := func(a, b float64) float64 {
+		sum := 0.0
+		for i, score := range scores {
+			z := a*float64(score) + b
+			// t*log(1+exp(-z)) + (1-t)*log(1+exp(z))
+			if z >= 0 {
+				sum += targets[i]*math.Log1p(math.Exp(-z)) + (1-targets[i])*(z+math.Log1p(math.Exp(-z)))
+			} else {
+				sum += targets[i]*(-z+math.Log1p(math.Exp(z))) + (1-targets[i])*math.Log1p(math.Exp(z))
+			}
+		}
+		return sum
+	}
+	b = math.Log((float64(positives) + 1) / (float64(negatives) + 1))
+	current := loss(a, b)
+	for i := 0; i < PlattIterations; i++ {
+		// the gradient and the hessian, which is kept positive definite
+		var ga, gb, haa, hab, hbb float64
+		for j, score := range scores {
+			s := float64(score)
+			p := 1 / (1 + math.Exp(-(a*s + b)))
+			d, w := p-targets[j], p*(1-p)
+			ga, gb = ga+d*s, gb+d
+			haa, hab, hbb = haa+w*s*s, hab+w*s, hbb+w
+		}
+		if math.Abs(ga) < 1e-6 && math.Abs(gb) < 1e-6 {
+			break
+		}
+		haa, hbb = haa+1e-12, hbb+1e-12
+		det := haa*hbb - hab*hab
+		da, db := -(hbb*ga-hab*gb)/det, -(haa*gb-hab*ga)/det
+		// the step is halved until the loss decreases
+		step, improved := 1.0, false
+		for step > 1e-10 {
+			next := loss(a+step*da, b+step*db)
+			if next < current {
+				a, b, current, improved = a+step*da, b+step*db, next, true
+				break
+			}
+			step /= 2
+		}
+		if !improved {
+			break
+		}
+	}
+	return a, b, true
+}
+
+// Holdout is a position of the corpus the calibration is fit at
+type Holdout struct {
+	// Context are the symbols before the position and Symbol is the symbol
+	// at it
+	Context []byte
+	Symbol  byte
+	// Start and Index are the corpus indexes of the first rune of the
+	// context and of the rune of the symbol
+	Start, Index uint64
+}
+
+// SampleHoldouts samples n positions of a corpus of length symbols with a
+// fixed seed, pass calls fn with each chunk of the corpus as in Build. The
+// context of each position is the EvalLength symbols before it
+func SampleHoldouts(n, length int, pass func(fn func(chunk Chunk, data []byte, offsets []uint64))) []Holdout {
+	if n <= 0 || length <= EvalLength {
+		return nil
+	}
+	rng, positions := rand.New(rand.NewSource(1)), make([]int, n)
+	for i := range positions {
+		positions[i] = EvalLength + rng.Intn(length-EvalLength)
+	}
+	sort.Ints(positions)
+	holdouts, next, index := []Holdout{}, 0, 0
+	context, starts := []byte{}, []uint64{}
+	pass(func(chunk Chunk, data []byte, offsets []uint64) {
+		indexes := chunk.RuneIndexes()
+		for i, symbol := range data {
+			offset := i
+			if offsets != nil {
+				offset = int(offsets[i])
+			}
+			for ; next < len(positions) && positions[next] == index; next++ {
+				holdouts = append(holdouts, Holdout{
+					Context: append([]byte(nil), context[len(context)-EvalLength:]...),
+					Symbol:  symbol,
+					Start:   starts[len(starts)-EvalLength],
+					Index:   indexes[offset],
+				})
+			}
+			context, starts = append(context, symbol), append(starts, indexes[offset])
+			if len(context) == 2*EvalLength {
+				context = append(context[:0], context[EvalLength:]...)
+				starts = append(starts[:0], starts[EvalLength:]...)
+			}
+			index++
+		}
+	})
+	return holdouts
+}
+
+// Calibrate fits the calibration of the candidate scores of the database
+// at the holdouts, a candidate is positive if it is the symbol at the
+// holdout. The entries whose context overlaps the context of a holdout are
+// left out as the holdout itself is one of them. It is nil if the fit fails
+func (h Header) Calibrate(store Store, sizes []uint64, holdouts []Holdout, settings Settings) *Calibration {
+	options, err := Request{}.Options()
+	if err != nil {
+		panic(err)
+	}
+	options.Settings = settings
+	scan, vector := h.Scanner(store, sizes, options), make([]float32, settings.Width())
+	progress, scores, labels := NewProgress("calibrate", len(holdouts)), []float32{}, []bool{}
+	for i, holdout := range holdouts {
+		progress.Update(i, "")
+		m := settings.NewMixer()
+		for _, symbol := range holdout.Context {
+			m.Add(symbol)
+		}
+		var data [256]float32
+		m.Mix(&data)
+		settings.Project(vector, data[:])
+		probes := h.Probe(sizes, vector, options.NProbe, options.ProbeThreshold)
+		results := scan(probes, Query{
+			Vector:  vector,
+			Entropy: Entropy(data[:]),
+		})
+		radius := holdout.Index - holdout.Start
+		for _, result := range results {
+			if result.Index+radius > holdout.Index && result.Index < holdout.Index+radius {
+				continue
+			}
+			scores = append(scores, result.Score)
+			labels = append(labels, result.Symbol == holdout.Symbol)
+		}
+	}
+	progress.Done()
+	a, b, ok := FitPlatt(scores, labels)
+	if !ok {
+		progress.Warn(len(holdouts), fmt.Sprintf("the %d candidates of the holdouts can't be calibrated", len(scores)))
+		return nil
+	}
+	return &Calibration{
+		A:         float32(a),
+		B:         float32(b),
+		Positions: len(holdouts),
+		Samples:   len(scores),
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+var (
+	// FlagCheckpoint is the spacing of the mixer checkpoints of a build
+	FlagCheckpoint = flag.Int("checkpoint", 0, "bytes of corpus between the mixer checkpoints a build records alongside the database for differential builds, 1048576 is a good spacing, 0 records none unless the build is differential, which keeps the spacing of the previous build")
+	// FlagDifferential rebuilds a database reusing the vectors of its previous build
+	FlagDifferential = flag.Bool("differential", false, "rebuild the database at -db reusing the vectors of its previous build for the corpus before the first changed byte, the mixer resumes from the last checkpoint before it and the header is sampled with the transform of the previous build")
+)
+
+// CheckpointsPath is the path of the checkpoints kept alongside the database
+// at path
+func CheckpointsPath(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, ".bin"), HeadSuffix) + ".checkpoints"
+}
+
+// MixingSettings identifies the settings the vectors of a build depend on,
+// the vectors of builds with the same mixing settings are the same for the
+// same corpus
+func MixingSettings(settings Settings) string {
+	data, err := json.Marshal(struct {
+		Preprocess Pipeline
+		Redact     Redaction
+		Code       bool
+		Order2     int
+		Dimensions int
+		Alphabet   Alphabet
+		Stride     int
+		Mixer      string
+		Windows    []int    `json:",omitempty"`
+		Folding    *Folding `json:",omitempty"`
+	}{settings.Preprocess, settings.Redact, settings.Code, settings.Order2,
+		settings.Dimensions, settings.Alphabet, settings.Stride, settings.Mixer, settings.Windows,
+		settings.Folding})
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// Checkpoint is the state of the mixer of a build before a byte of the corpus
+type Checkpoint struct {
+	// Offset is the byte of the corpus and Hash is the fnv hash of the
+	// corpus before it
+	Offset uint64
+	Hash   uint64
+	// Symbol is the index of the symbol that starts at the byte and Item is
+	// the next item
+	Symbol uint64
+	Item   uint64
+	// Mixer is the encoded mixer
+	Mixer []byte
+}
+
+// Append appends the encoding of the checkpoint to data
+func (c *Checkpoint) Append(data []byte) []byte {
+	data = binaryvec.Order.AppendUint64(data, c.Offset)
+	data = binaryvec.Order.AppendUint64(data, c.Hash)
+	data = binaryvec.Order.AppendUint64(data, c.Symbol)
+	data = binaryvec.Order.AppendUint64(data, c.Item)
+	data = binaryvec.Order.AppendUint64(data, uint64(len(c.Mixer)))
+	return append(data, c.Mixer...)
+}
+
+// Uvarints are numbers encoded as uvarints, the entries of the items are
+// small so they take less space than fixed width numbers
+type Uvarints []uint64
+
+// Append appends the encoding of the numbers to data
+func (u Uvarints) Append(data []byte) []byte {
+	for _, value := range u {
+		data = binary.AppendUvarint(data, value)
+	}
+	return data
+}
+
+// CheckpointsMagic starts a checkpoints file
+var CheckpointsMagic = []byte("sodackpt")
+
+// CheckpointsVersion is the version of the layout of a checkpoints file,
+// version 1 added the magic, the version, and the spacing of the checkpoints
+const CheckpointsVersion = 1
+
+// Checkpoints are the checkpoints of a build, a rebuild resumes mixing from
+// the last checkpoint before the first changed byte of the corpus
+type Checkpoints struct {
+	// Settings are the mixing settings of the build
+	Settings string
+	// Every is the number of bytes between the checkpoints
+	Every  uint64
+	Points []Checkpoint
+	// Entries is the entry of each item in the database, the entries are
+	// numbered in bucket order
+	Entries []uint64
+}
+
+// Write writes the checkpoints to path, the magic and the version are
+// followed by the settings, the spacing, the checkpoints, and the entries
+func (c *Checkpoints) Write(path string) error {
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+	writer := binaryvec.NewWriter(buffered)
+	_, err = buffered.Write(CheckpointsMagic)
+	if err != nil {
+		return err
+	}
+	for _, value := range []uint64{CheckpointsVersion, uint64(len(c.Settings))} {
+		err = writer.WriteUint64(value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = buffered.WriteString(c.Settings)
+	if err != nil {
+		return err
+	}
+	for _, value := range []uint64{c.Every, uint64(len(c.Points))} {
+		err = writer.WriteUint64(value)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Points {
+		err = writer.WriteRecord(&c.Points[i])
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.WriteUint64(uint64(len(c.Entries)))
+	if err != nil {
+		return err
+	}
+	err = writer.WriteRecord(Uvarints(c.Entries))
+	if err != nil {
+		return err
+	}
+	err = buffered.Flush()
+	if err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// ReadCheckpoints reads the checkpoints at path
+func ReadCheckpoints(path string) (*Checkpoints, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, CheckpointsMagic) {
+		return nil, fmt.Errorf("%s isn't a checkpoints file of this version of soda, rebuild the database without -differential", path)
+	}
+	data = data[len(CheckpointsMagic):]
+	invalid := fmt.Errorf("%s is truncated", path)
+	uint64s := func() uint64 {
+		if err != nil || len(data) < 8 {
+			err = invalid
+			return 0
+		}
+		value := binaryvec.Order.Uint64(data)
+		data = data[8:]
+		return value
+	}
+	uvarint := func() uint64 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = invalid
+			return 0
+		}
+		data = data[n:]
+		return value
+	}
+	take := func(n uint64) []byte {
+		if err != nil || n > uint64(len(data)) {
+			err = invalid
+			return nil
+		}
+		value := data[:n]
+		data = data[n:]
+		return value
+	}
+	if version := uint64s(); err == nil && version > CheckpointsVersion {
+		return nil, fmt.Errorf("%s has version %d but only %d is supported", path, version, CheckpointsVersion)
+	}
+	c := &Checkpoints{}
+	c.Settings = string(take(uint64s()))
+	c.Every = uint64s()
+	points := uint64s()
+	for i := uint64(0); i < points && err == nil; i++ {
+		var point Checkpoint
+		point.Offset, point.Hash = uint64s(), uint64s()
+		point.Symbol, point.Item = uint64s(), uint64s()
+		point.Mixer = take(uint64s())
+		c.Points = append(c.Points, point)
+	}
+	entries := uint64s()
+	if err == nil && entries > uint64(len(data)) {
+		err = invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Entries = make([]uint64, entries)
+	for i := range c.Entries {
+		c.Entries[i] = uvarint()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Recorder records the checkpoints of a build as the corpus is mixed
+type Recorder struct {
+	Checkpoints
+	next   uint64
+	hash   hash.Hash64
+	hashed int
+}
+
+// NewRecorder records a checkpoint every bytes of a build of items items
+// with settings, it is nil if every is 0
+func NewRecorder(every int, items int, settings Settings) *Recorder {
+	if every <= 0 {
+		return nil
+	}
+	return &Recorder{
+		Checkpoints: Checkpoints{
+			Settings: MixingSettings(settings),
+			Every:    uint64(every),
+			Entries:  make([]uint64, items),
+		},
+		next: uint64(every),
+		hash: fnv.New64a(),
+	}
+}
+
+// Mark records the mixer before byte at of the chunk if the byte is at least
+// Every bytes after the last checkpoint, symbol is the index of the symbol
+// that starts at the byte and item is the next item
+func (r *Recorder) Mark(chunk Chunk, at int, symbol, item int, m Mixer) {
+	if r == nil || chunk.Offset+uint64(at) < r.next {
+		return
+	}
+	r.hash.Write(chunk.Input[r.hashed:at])
+	r.hashed = at
+	state, err := m.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	offset := chunk.Offset + uint64(at)
+	r.Points = append(r.Points, Checkpoint{
+		Offset: offset,
+		Hash:   r.hash.Sum64(),
+		Symbol: uint64(symbol),
+		Item:   uint64(item),
+		Mixer:  state,
+	})
+	r.next = offset + r.Every
+}
+
+// Keep keeps the checkpoints of the previous build before the checkpoint the
+// build resumes from, the next checkpoint is recorded at it
+func (r *Recorder) Keep(points []Checkpoint, resume *Checkpoint) {
+	if r == nil {
+		return
+	}
+	for _, point := range points {
+		if point.Offset >= resume.Offset {
+			break
+		}
+		r.Points = append(r.Points, point)
+	}
+	r.next = resume.Offset
+}
+
+// Next hashes the rest of a chunk that has been mixed
+func (r *Recorder) Next(chunk Chunk) {
+	if r == nil {
+		return
+	}
+	r.hash.Write(chunk.Input[r.hashed:])
+	r.hashed = 0
+}
+
+// Commit writes the checkpoints of the database at path, without a recorder
+// the checkpoints of a previous build are removed as they no longer match
+// the database
+func (r *Recorder) Commit(path string) error {
+	if r == nil {
+		err := os.Remove(CheckpointsPath(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return r.Write(CheckpointsPath(path))
+}
+
+// Differential is the previous build of a database that is rebuilt, the
+// vectors of the corpus before the first changed byte are read from it
+type Differential struct {
+	*Model
+	Checkpoints *Checkpoints
+	// Matched is the number of checkpoints the corpus before which is unchanged
+	Matched int
+	offset  uint64
+	changed bool
+	hash    hash.Hash64
+}
+
+// OpenDifferential opens the previous build of the database at path and its
+// checkpoints
+func OpenDifferential(path string) (*Differential, error) {
+	checkpoints, err := ReadCheckpoints(CheckpointsPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s has no checkpoints for a differential build, build it with -checkpoint first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	model, err := LoadModel(path)
+	if err != nil {
+		return nil, err
+	}
+	if model.Counts != nil {
+		model.Close()
+		return nil, fmt.Errorf("%s is distilled, its entries aren't the vectors of its build", path)
+	}
+	return &Differential{
+		Model:       model,
+		Checkpoints: checkpoints,
+		hash:        fnv.New64a(),
+	}, nil
+}
+
+// Match returns the build settings with the alphabet or folding of the
+// previous build if the same number of merges are learned or runes folded,
+// the settings have to mix the same vectors
+func (d *Differential) Match(settings Settings) (Settings, error) {
+	if settings.Merges > 0 && settings.Merges == d.Merges && settings.Alphabet == nil {
+		settings.Alphabet = d.Alphabet
+	}
+	if settings.Fold > 0 && settings.Fold == d.Fold && settings.Folding == nil {
+		settings.Folding = d.Folding
+	}
+	if MixingSettings(settings) != d.Checkpoints.Settings {
+		return settings, fmt.Errorf("%s was built with another preprocessing, redaction, mixer, alphabet, folding, stride, or dimensionality, rebuild it without -differential", d.Path)
+	}
+	return settings, nil
+}
+
+// Compare hashes the next bytes of the corpus and counts the checkpoints the
+// corpus before is unchanged
+func (d *Differential) Compare(input []byte) {
+	points := d.Checkpoints.Points
+	for len(input) > 0 && !d.changed && d.Matched < len(points) {
+		point := points[d.Matched]
+		n := min(uint64(len(input)), point.Offset-d.offset)
+		d.hash.Write(input[:n])
+		d.offset, input = d.offset+n, input[n:]
+		if d.offset < point.Offset {
+			return
+		}
+		if d.hash.Sum64() != point.Hash {
+			d.changed = true
+			return
+		}
+		d.Matched++
+	}
+}
+
+// Resume is the checkpoint the mixer resumes from after the corpus is
+// compared, nil if the corpus changed before the first checkpoint. The
+// symbols of an alphabet or a folding can span the byte of a checkpoint, so
+// with either the checkpoint before the last unchanged one is resumed from
+func (d *Differential) Resume() *Checkpoint {
+	matched := d.Matched
+	if len(d.Alphabet) > 0 || d.Folding != nil {
+		matched--
+	}
+	if matched <= 0 {
+		return nil
+	}
+	return &d.Checkpoints.Points[matched-1]
+}
+
+// Same is true if the header has the buckets of the previous build, the
+// reused items are then in the buckets they were in
+func (d *Differential) Same(header Header) bool {
+	for i := range header {
+		if header[i].Vector != d.Header[i].Vector {
+			return false
+		}
+	}
+	return true
+}
+
+// Reuse reads the vector and fields of an item of the previous build and
+// returns its bucket
+func (d *Differential) Reuse(item int, vector []float32) (Item, int) {
+	entry := d.Checkpoints.Entries[item]
+	bucket := sort.Search(len(d.Sums), func(i int) bool {
+		return d.Sums[i] > entry
+	}) - 1
+	position := entry - d.Sums[bucket]
+	block, err := d.Store.Entries(bucket, position, position+1)
+	if err != nil {
+		panic(err)
+	}
+	block.Vector(0, vector)
+	return Item{
+		Entropy:  block.Entropy(0),
+		Symbol:   block.Symbol(0),
+		Index:    block.Index(0),
+		Document: uint32(block.Document(0)),
+	}, bucket
+}
@@ -0,0 +1,643 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client is a client for the soda http api
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Request is a generation request
+type Request struct {
+	// Query is the prompt
+	Query string `json:"query"`
+	// Model names the database of a server serving several that generates,
+	// the database is chosen by the prompt if it is empty
+	Model string `json:"model,omitempty"`
+	// Count is the number of symbols to generate
+	Count int `json:"count,omitempty"`
+	// Documents restricts candidates to document ids, titles, or corpus ranges
+	Documents []string `json:"documents,omitempty"`
+	// Weights multiply the sampling mass of candidates from documents given
+	// by id, title, or path, other documents have weight 1 and weight 0
+	// excludes a document
+	Weights map[string]float32 `json:"weights,omitempty"`
+	// Quota is the maximum number of the candidates of each symbol from one
+	// document, 0 uses the default of the server
+	Quota int `json:"quota,omitempty"`
+	// Seed seeds the sampler
+	Seed *int64 `json:"seed,omitempty"`
+	// Continue generates from the corpus before doc:offset instead of the query
+	Continue string `json:"continue,omitempty"`
+	// Symbols is a character class of the symbols that can start a rune
+	Symbols string `json:"symbols,omitempty"`
+	// NProbe is the maximum number of buckets to probe per symbol
+	NProbe int `json:"nprobe,omitempty"`
+	// SubProbe is the number of sub-clusters scanned in each probed bucket
+	// of a sub-clustered database, 0 scans every entry of the buckets
+	SubProbe *int `json:"subprobe,omitempty"`
+	// Fanout is fixed or auto, auto probes fewer than NProbe buckets when
+	// one bucket usually wins and up to 4 times NProbe when none does
+	Fanout string `json:"fanout,omitempty"`
+	// Threshold is the bucket similarity below which buckets aren't probed
+	Threshold *float32 `json:"probe_threshold,omitempty"`
+	// ProbeCache is the cosine distance the mixer vector moves before the
+	// similarities of all the buckets are recomputed, the buckets most
+	// similar to the last recomputed vector are rescored until then
+	ProbeCache *float32 `json:"probe_cache,omitempty"`
+	// Timeout is a duration such as 5s after which generation stops and the
+	// partial result is returned
+	Timeout string `json:"timeout,omitempty"`
+	// Context is the number of runes of corpus text on each side of the
+	// source of each rune to return with it
+	Context int `json:"context,omitempty"`
+	// Raw skips the smoothing of typographic variants in the query
+	Raw bool `json:"raw,omitempty"`
+	// PromptBudget is the maximum number of prompt bytes mixed
+	PromptBudget int `json:"prompt_budget,omitempty"`
+	// Truncation is tail, headtail, or summary, how a prompt over the
+	// budget is truncated
+	Truncation string `json:"truncation,omitempty"`
+	// Stop ends generation when the generated text ends with one of the
+	// sequences, the sequence isn't returned
+	Stop []string `json:"stop,omitempty"`
+	// Repetition is the number of times the last repetition window bytes of
+	// the output occur in its recent output when generation is cycling, 0
+	// uses the default of the server
+	Repetition int `json:"repetition,omitempty"`
+	// RepetitionWindow is the number of bytes of the window
+	RepetitionWindow int `json:"repetition_window,omitempty"`
+	// RepetitionAction is stop, which ends a cycling generation with the
+	// finish reason repetition, or resample, which samples its next steps
+	// at a raised temperature
+	RepetitionAction string `json:"repetition_action,omitempty"`
+	// Vocabulary is the number of steps before each step whose top
+	// candidates have the symbols that can start the rune of the step, 0
+	// uses the default of the server
+	Vocabulary int `json:"vocabulary,omitempty"`
+	// VocabularyK is the number of top candidates of each step whose
+	// symbols are observed
+	VocabularyK int `json:"vocabulary_k,omitempty"`
+	// Hamming is the signature distance above which entries are skipped
+	Hamming int `json:"hamming,omitempty"`
+	// EntropyWeight is the weight of the entropy match in candidate scoring
+	EntropyWeight *float32 `json:"entropy_weight,omitempty"`
+	// Locality is the weight of the closeness in the corpus of a candidate
+	// to the recently generated passage, it keeps generation from jumping
+	// between books
+	Locality *float32 `json:"locality,omitempty"`
+	// Attention is the weight between 0 and 1 of the attention over the
+	// whole prompt in the vector candidates are scored with, it keeps
+	// generation closer to long prompts
+	Attention *float32 `json:"attention,omitempty"`
+	// Lambda is the maximal marginal relevance weight of the candidate
+	// score against diversity, 1 selects candidates by score alone
+	Lambda *float32 `json:"mmr_lambda,omitempty"`
+	// Decoder is greedy, topk, or topp
+	Decoder string `json:"decoder,omitempty"`
+	// Temperature is applied to the candidate scores
+	Temperature float32 `json:"temperature,omitempty"`
+	// TopK is the number of candidates for top-k sampling
+	TopK int `json:"top_k,omitempty"`
+	// TopP is the nucleus mass for top-p sampling
+	TopP float32 `json:"top_p,omitempty"`
+	// TempSchedule is the temperature across the generation as comma
+	// separated step:temperature points, it replaces Temperature
+	TempSchedule string `json:"temp_schedule,omitempty"`
+	// Calibrated samples from the calibrated probabilities of the
+	// candidates instead of the softmax of their scores
+	Calibrated bool `json:"calibrated,omitempty"`
+	// Alternatives is the number of the highest scoring symbols returned
+	// for each step with the chosen one, 0 returns none
+	Alternatives int `json:"alternatives,omitempty"`
+	// Postprocess are the post-processing stages applied to the generated
+	// text in order: capitalize, space, or mask, nil applies the stages of
+	// the server
+	Postprocess []string `json:"postprocess,omitempty"`
+	// Latest only draws candidates from the latest version of each document
+	Latest bool `json:"latest,omitempty"`
+	// DryRun estimates the cost of the generation instead of generating,
+	// the reply of /v1/generate is an Estimate
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Estimate is the predicted cost of a generation, it is measured by
+// generating a few steps of it
+type Estimate struct {
+	// Count is the number of symbols of the generation and Sampled the
+	// number of steps that were measured
+	Count   int `json:"count"`
+	Sampled int `json:"sampled"`
+	// Buckets and Entries are the number of buckets and entries of the
+	// database and EntrySize the size of an entry in bytes
+	Buckets   int    `json:"buckets"`
+	Entries   uint64 `json:"entries"`
+	EntrySize uint64 `json:"entry_size"`
+	// Probes, Scanned, and Candidates are the mean number of buckets probed,
+	// entries scanned, and candidates retrieved per step
+	Probes     float64 `json:"probes"`
+	Scanned    float64 `json:"scanned"`
+	Candidates float64 `json:"candidates"`
+	// BytesPerStep and Bytes are the bytes of entries read per step and for
+	// the whole generation
+	BytesPerStep float64 `json:"bytes_per_step"`
+	Bytes        float64 `json:"bytes"`
+	// PromptSeconds is the time to mix the prompt, StepSeconds the time of a
+	// step, and Seconds the wall time of the whole generation
+	PromptSeconds float64 `json:"prompt_seconds"`
+	StepSeconds   float64 `json:"step_seconds"`
+	Seconds       float64 `json:"seconds"`
+}
+
+// Output is a generated rune and where it came from in the corpus
+type Output struct {
+	Index    uint64 `json:"index"`
+	Document uint64 `json:"document"`
+	Symbol   string `json:"symbol"`
+	// Context is the corpus text around the source of the rune
+	Context string `json:"context,omitempty"`
+	// Entropy is the entropy of the distribution of the context the rune
+	// was generated in scaled to [0, 1], it is high when the model is
+	// uncertain
+	Entropy float32 `json:"entropy"`
+	// Probability is the calibrated probability of the candidate the rune
+	// is from, it is omitted if the database isn't calibrated
+	Probability float32 `json:"probability,omitempty"`
+}
+
+// Alternative is a symbol that could have been generated at a step
+type Alternative struct {
+	// Symbol is a byte or a merged symbol of the alphabet of the database
+	// and Text is the bytes it stands for
+	Symbol uint8  `json:"symbol"`
+	Text   string `json:"text"`
+	// Score is the score of the best candidate with the symbol, Index and
+	// Document are where it is in the corpus
+	Score    float32 `json:"score"`
+	Index    uint64  `json:"index"`
+	Document uint64  `json:"document"`
+	// Probability is the softmax mass of the candidates with the symbol
+	Probability float32 `json:"probability"`
+}
+
+// Step is a generated symbol and its alternatives
+type Step struct {
+	// Offset is the number of outputs generated before the step
+	Offset       int           `json:"offset"`
+	Symbol       uint8         `json:"symbol"`
+	Alternatives []Alternative `json:"alternatives"`
+}
+
+// Response is a generation response
+type Response struct {
+	Text   string   `json:"text"`
+	Output []Output `json:"output"`
+	// Truncated is true if generation ran out of time
+	Truncated bool `json:"truncated"`
+	// PromptTruncated is true if the prompt was over the prompt budget and
+	// was truncated
+	PromptTruncated bool `json:"prompt_truncated,omitempty"`
+	// Degraded is true if shards of the server failed and the candidates
+	// they hold were missing from some steps
+	Degraded bool `json:"degraded,omitempty"`
+	// ID identifies the generation in the generation log of the server for
+	// /debug/trace/{id}, empty if the server doesn't log generations
+	ID string `json:"id,omitempty"`
+	// Steps are the alternatives of each step if they were requested
+	Steps []Step `json:"steps,omitempty"`
+	// FinishReason is why generation ended: length, stop, repetition,
+	// timeout, canceled, or exhausted if there were no candidates
+	FinishReason string `json:"finish_reason,omitempty"`
+	// State is a hash of the random state of a session after the
+	// generation, empty outside of sessions
+	State string `json:"state,omitempty"`
+}
+
+// Start is the first event of a generation stream
+type Start struct {
+	// ID identifies the stream for control frames
+	ID string `json:"id"`
+}
+
+// Control is a control frame that adjusts a generation stream in progress,
+// zero fields are unchanged
+type Control struct {
+	Decoder     string  `json:"decoder,omitempty"`
+	Temperature float32 `json:"temperature,omitempty"`
+	TopK        int     `json:"top_k,omitempty"`
+	TopP        float32 `json:"top_p,omitempty"`
+	// Stop replaces the stop sequences if it isn't nil
+	Stop []string `json:"stop,omitempty"`
+	// Cancel stops the generation at the next symbol, the other fields are
+	// ignored
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+// Done is the final event of a generation stream
+type Done struct {
+	Truncated bool `json:"truncated"`
+	// Canceled is true if the generation was canceled by a control frame
+	Canceled bool `json:"canceled,omitempty"`
+	// Degraded is true if shards of the server failed and the candidates
+	// they hold were missing from some steps
+	Degraded bool `json:"degraded,omitempty"`
+	// ID identifies the generation in the generation log of the server
+	ID string `json:"id,omitempty"`
+	// FinishReason is why generation ended
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// ErrTruncated is returned by GenerateStream when generation ran out of time
+var ErrTruncated = errors.New("generation was truncated")
+
+// ScoreRequest is a request to score text, the query is context before the
+// text that isn't scored and the generation parameters select the candidates
+type ScoreRequest struct {
+	Request
+	Text string `json:"text"`
+}
+
+// SymbolScore is the score of a symbol of the text
+type SymbolScore struct {
+	// Offset is the byte offset of the symbol in the text, Symbol is a byte,
+	// a merged symbol of the alphabet, or a folded rune of the database
+	Offset int   `json:"offset"`
+	Symbol uint8 `json:"symbol"`
+	// Rank is the rank of the first candidate with the symbol, 0 if none
+	// was retrieved
+	Rank int `json:"rank"`
+	// Probability is the softmax mass of the candidates with the symbol
+	Probability float32 `json:"probability"`
+	Candidates  int     `json:"candidates"`
+}
+
+// ScoreResponse is the pseudo-likelihood of the text of a score request
+type ScoreResponse struct {
+	Symbols []SymbolScore `json:"symbols"`
+	// LogLikelihood is the sum of the log probabilities of the symbols, a
+	// symbol that wasn't retrieved has a small fixed probability
+	LogLikelihood float64 `json:"log_likelihood"`
+	Perplexity    float64 `json:"perplexity"`
+	// MeanReciprocalRank is the mean of 1/rank, 0 for symbols not retrieved
+	MeanReciprocalRank float64 `json:"mean_reciprocal_rank"`
+	// Hits is the number of symbols that were retrieved
+	Hits int `json:"hits"`
+	// Degraded is true if shards of the server failed and the candidates
+	// they hold were missing from some symbols
+	Degraded bool `json:"degraded,omitempty"`
+}
+
+// EmbedRequest is an embedding request
+type EmbedRequest struct {
+	Text string `json:"text"`
+}
+
+// EmbedResponse is an embedding response
+type EmbedResponse struct {
+	Vector []float32 `json:"vector"`
+}
+
+// EmbedBatchRequest is a batch embedding request
+type EmbedBatchRequest struct {
+	Texts []string `json:"texts"`
+	// Pooling is last, mean, or max over the positions of a text
+	Pooling string `json:"pooling,omitempty"`
+}
+
+// EmbedBatchResponse is a batch embedding response, the vectors are in the
+// order of the texts
+type EmbedBatchResponse struct {
+	Vectors [][]float32 `json:"vectors"`
+}
+
+// EntropyRequest is a request for the entropy of the context after text
+type EntropyRequest struct {
+	Text string `json:"text"`
+}
+
+// EntropyResponse is the entropy of the context after the text of a request
+type EntropyResponse struct {
+	// Vector is the entropy of each distribution mixed by the mixer of the
+	// database
+	Vector []float32 `json:"vector"`
+	// Entropy is the entropy of the mixed distribution scaled to [0, 1] as
+	// with Output.Entropy
+	Entropy float32 `json:"entropy"`
+}
+
+// SessionRequest creates a session from a prompt
+type SessionRequest struct {
+	Query string `json:"query"`
+	// Model names the database of a server serving several that holds the
+	// session, the database is chosen by the query if it is empty
+	Model string `json:"model,omitempty"`
+	// Seed seeds the random state of the session, the seed of the server by
+	// default, and Draws is the number of draws the state starts after so a
+	// session can be recreated at the state of another, at most 1<<24 as
+	// the draws are replayed
+	Seed  *int64 `json:"seed,omitempty"`
+	Draws uint64 `json:"draws,omitempty"`
+}
+
+// Session is a snapshot of a generation session
+type Session struct {
+	// ID starts with the name of the database that holds the session on a
+	// server serving several, the requests with it are routed there
+	ID string `json:"id"`
+	// Text is the text of the symbols of the session, it includes the stop
+	// sequence a generation ended with
+	Text string `json:"text"`
+	// Symbols is the number of symbols of the session
+	Symbols int `json:"symbols"`
+	// Seed and Draws are the random state of the sampler of the session
+	// and State is a hash of it
+	Seed  int64  `json:"seed"`
+	Draws uint64 `json:"draws"`
+	State string `json:"state"`
+}
+
+// RollbackRequest removes the last symbols of a session
+type RollbackRequest struct {
+	Symbols int `json:"symbols"`
+}
+
+// Client is a soda http api client
+type Client struct {
+	URL  string
+	HTTP *http.Client
+	// Key is the api key sent with every request, if any
+	Key string
+}
+
+// New creates a new client for the server at url
+func New(url string) *Client {
+	return &Client{
+		URL:  strings.TrimSuffix(url, "/"),
+		HTTP: http.DefaultClient,
+	}
+}
+
+func (c *Client) post(ctx context.Context, path string, request any) (*http.Response, error) {
+	return c.send(ctx, http.MethodPost, path, request)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, request any) (*http.Response, error) {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+	response, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(response.Body)
+		return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+func (c *Client) call(ctx context.Context, path string, request, reply any) error {
+	return c.do(ctx, http.MethodPost, path, request, reply)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, request, reply any) error {
+	response, err := c.send(ctx, method, path, request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(reply)
+}
+
+// Generate generates text
+func (c *Client) Generate(ctx context.Context, request Request) (*Response, error) {
+	var response Response
+	err := c.call(ctx, "/v1/generate", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Estimate predicts the wall time and bytes read of a generation without
+// generating it
+func (c *Client) Estimate(ctx context.Context, request Request) (*Estimate, error) {
+	request.DryRun = true
+	var estimate Estimate
+	err := c.call(ctx, "/v1/generate", request, &estimate)
+	if err != nil {
+		return nil, err
+	}
+	return &estimate, nil
+}
+
+// GenerateStream generates text calling fn for each rune as it is generated,
+// ErrTruncated is returned if generation ran out of time
+func (c *Client) GenerateStream(ctx context.Context, request Request, fn func(Output) error) error {
+	return c.Stream(ctx, request, nil, fn)
+}
+
+// Stream is GenerateStream that also calls start with the id of the stream,
+// which can be passed to Control while the stream is in progress. The id
+// names the database of a server serving several, so Control reaches it
+// without the model
+func (c *Client) Stream(ctx context.Context, request Request, start func(id string), fn func(Output) error) error {
+	response, err := c.post(ctx, "/v1/generate/stream", request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	scanner := bufio.NewScanner(response.Body)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			switch event {
+			case "start":
+				var started Start
+				err := json.Unmarshal([]byte(data), &started)
+				if err != nil {
+					return err
+				}
+				if start != nil {
+					start(started.ID)
+				}
+				continue
+			case "error":
+				return fmt.Errorf("%s", data)
+			case "done":
+				var done Done
+				err := json.Unmarshal([]byte(data), &done)
+				if err != nil {
+					return err
+				}
+				if done.Truncated {
+					return ErrTruncated
+				}
+				return nil
+			}
+			var output Output
+			err := json.Unmarshal([]byte(data), &output)
+			if err != nil {
+				return err
+			}
+			err = fn(output)
+			if err != nil {
+				return err
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Control adjusts the sampling of the stream id in progress
+func (c *Client) Control(ctx context.Context, id string, control Control) error {
+	response, err := c.post(ctx, "/v1/generate/stream/"+id+"/control", control)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Cancel stops the stream id in progress at the next symbol, the stream ends
+// with a canceled done event
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.Control(ctx, id, Control{Cancel: true})
+}
+
+// Embed embeds text as a vector
+func (c *Client) Embed(ctx context.Context, request EmbedRequest) (*EmbedResponse, error) {
+	var response EmbedResponse
+	err := c.call(ctx, "/v1/embed", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Score scores text by how highly each symbol ranks among the candidates
+// retrieved for it
+func (c *Client) Score(ctx context.Context, request ScoreRequest) (*ScoreResponse, error) {
+	var response ScoreResponse
+	err := c.call(ctx, "/v1/score", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Entropy returns the entropy of the context after text
+func (c *Client) Entropy(ctx context.Context, request EntropyRequest) (*EntropyResponse, error) {
+	var response EntropyResponse
+	err := c.call(ctx, "/v1/entropy", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// EmbedBatch embeds several texts as pooled vectors
+func (c *Client) EmbedBatch(ctx context.Context, request EmbedBatchRequest) (*EmbedBatchResponse, error) {
+	var response EmbedBatchResponse
+	err := c.call(ctx, "/v1/embed/batch", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// CreateSession creates a generation session from a prompt, generations in
+// the session continue from the text of the session
+func (c *Client) CreateSession(ctx context.Context, request SessionRequest) (*Session, error) {
+	var session Session
+	err := c.call(ctx, "/v1/sessions", request, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Session returns a snapshot of the session id
+func (c *Client) Session(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	err := c.do(ctx, http.MethodGet, "/v1/sessions/"+id, nil, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SessionGenerate mixes the query into the session id and generates from it,
+// the generated symbols are added to the session
+func (c *Client) SessionGenerate(ctx context.Context, id string, request Request) (*Response, error) {
+	var response Response
+	err := c.call(ctx, "/v1/sessions/"+id+"/generate", request, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Branch copies the session id to a new session
+func (c *Client) Branch(ctx context.Context, id string) (*Session, error) {
+	var session Session
+	err := c.call(ctx, "/v1/sessions/"+id+"/branch", nil, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Rollback removes the last symbols of the session id
+func (c *Client) Rollback(ctx context.Context, id string, request RollbackRequest) (*Session, error) {
+	var session Session
+	err := c.call(ctx, "/v1/sessions/"+id+"/rollback", request, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// DeleteSession deletes the session id
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	response, err := c.send(ctx, http.MethodDelete, "/v1/sessions/"+id, nil)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
@@ -0,0 +1,145 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sync"
+)
+
+// FlagCollapse runs identical concurrent generation requests once
+var FlagCollapse = flag.Bool("collapse", false, "run identical concurrent generation requests once and fan the result out to every waiting client, identical means the same prompt, parameters, and seed, streams are steerable so they aren't collapsed")
+
+// Flight is a generation shared by identical requests
+type Flight struct {
+	sync.Mutex
+	cond *sync.Cond
+	// Symbols is the number of symbols generated and Result is the partial
+	// result so far
+	Symbols int
+	Result  []Output
+	// Searches is the final result
+	Searches []Search
+	Done     bool
+	// Err is the panic of the generation, it fails every caller
+	Err error
+}
+
+// Flights are the generations in progress by the key of their requests
+type Flights struct {
+	sync.Mutex
+	Flights map[string]*Flight
+	// Collapsed is the number of requests that joined another generation
+	Collapsed int
+}
+
+// NewFlights creates the generations in progress
+func NewFlights() *Flights {
+	return &Flights{
+		Flights: make(map[string]*Flight),
+	}
+}
+
+// FlightKey is the key of a generation of query with options, requests that
+// don't come from a client aren't collapsed and neither are generations with
+// a cancel channel or a control, canceling or steering them would cancel or
+// steer every request that joined
+func FlightKey(model string, query []byte, options Options) (string, bool) {
+	if options.Request == nil || options.Cancel != nil || options.Control != nil {
+		return "", false
+	}
+	// each caller post-processes its own copy of the results
+	request := options.Effective()
+	request.Postprocess = nil
+	data, err := json.Marshal(struct {
+		Model   string
+		Query   []byte
+		Request any
+	}{model, query, request})
+	if err != nil {
+		panic(err)
+	}
+	return string(data), true
+}
+
+// Do runs generate once for the concurrent calls with the same key, the
+// progress of every caller is reported
+func (f *Flights) Do(key string, options Options, generate func(options Options) []Search) []Search {
+	f.Lock()
+	flight, ok := f.Flights[key]
+	if ok {
+		f.Collapsed++
+		f.Unlock()
+		return flight.Wait(options.Progress)
+	}
+	flight = &Flight{}
+	flight.cond = sync.NewCond(&flight.Mutex)
+	f.Flights[key] = flight
+	f.Unlock()
+
+	forget := func() {
+		f.Lock()
+		if f.Flights[key] == flight {
+			delete(f.Flights, key)
+		}
+		f.Unlock()
+	}
+	progress := options.Progress
+	options.Progress = func(symbols int, result []Output) {
+		flight.Lock()
+		flight.Symbols, flight.Result = symbols, append(flight.Result[:0], result...)
+		flight.Unlock()
+		flight.cond.Broadcast()
+		if progress != nil {
+			progress(symbols, result)
+		}
+	}
+	defer func() {
+		forget()
+		flight.Lock()
+		flight.Done = true
+		flight.Unlock()
+		flight.cond.Broadcast()
+	}()
+	flight.Err = Recover(func() {
+		flight.Searches = generate(options)
+	})
+	if flight.Err != nil {
+		panic(flight.Err)
+	}
+	return flight.Searches
+}
+
+// Wait reports the progress of the flight until it is done and returns its
+// result
+func (f *Flight) Wait(progress func(symbols int, result []Output)) []Search {
+	f.Lock()
+	defer f.Unlock()
+	reported := 0
+	for {
+		if progress != nil && f.Symbols != reported {
+			symbols, result := f.Symbols, append([]Output{}, f.Result...)
+			reported = symbols
+			f.Unlock()
+			progress(symbols, result)
+			f.Lock()
+			continue
+		}
+		if f.Done {
+			break
+		}
+		f.cond.Wait()
+	}
+	if f.Err != nil {
+		panic(f.Err)
+	}
+	searches := make([]Search, len(f.Searches))
+	for i, search := range f.Searches {
+		searches[i] = search
+		searches[i].Result = append([]Output{}, search.Result...)
+	}
+	return searches
+}
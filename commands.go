@@ -0,0 +1,432 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CheckFlags checks the global flags that aren't checked when they are parsed
+func CheckFlags() error {
+	if err := CheckTieBreak(*FlagTieBreak); err != nil {
+		return err
+	}
+	if _, err := ParseSchedule(*FlagTempSchedule); err != nil {
+		return err
+	}
+	return LoadBooks(*FlagBooks)
+}
+
+// ParseCommand parses the arguments of a subcommand with the flags of set and
+// the global flags set doesn't shadow, so the global flags can follow the
+// subcommand
+func ParseCommand(set *flag.FlagSet, args []string) error {
+	flag.VisitAll(func(f *flag.Flag) {
+		if set.Lookup(f.Name) == nil {
+			set.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	err := set.Parse(args)
+	if err != nil {
+		return err
+	}
+	// a config after the subcommand is applied to the flags set on neither
+	// side of it
+	if SetFlags(set)["config"] {
+		err = LoadConfig(flag.CommandLine, set)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+	err = CheckFlags()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// Modes are the subcommands of the deprecated mode flags, in the order the
+// flags were checked
+var Modes = []struct {
+	Flags   []*bool
+	Names   string
+	Command string
+}{
+	{[]*bool{FlagRank, FlagBuild}, "-rank -build", "rank build"},
+	{[]*bool{FlagRank}, "-rank", "rank"},
+	{[]*bool{FlagBuild}, "-build", "build"},
+	{[]*bool{FlagServer}, "-server", "serve"},
+	{[]*bool{FlagBrute}, "-brute", "brute"},
+}
+
+// Mode returns the subcommand of the deprecated mode flags that are set
+func Mode() (string, string) {
+	for _, mode := range Modes {
+		set := true
+		for _, f := range mode.Flags {
+			set = set && *f
+		}
+		if set {
+			return mode.Names, mode.Command
+		}
+	}
+	return "", ""
+}
+
+// BuildSettings returns the build settings of the flags
+func BuildSettings() (Settings, error) {
+	pipeline, err := NewPipeline(*FlagPreprocess)
+	if err != nil {
+		return Settings{}, err
+	}
+	if *FlagOrder2 < 0 {
+		return Settings{}, fmt.Errorf("order2 must not be negative")
+	}
+	weights, err := NewWeights(strings.Split(*FlagWeights, ","))
+	if err != nil {
+		return Settings{}, err
+	}
+	err = CheckDimensions(*FlagDimensions)
+	if err != nil {
+		return Settings{}, err
+	}
+	dimensions := *FlagDimensions
+	if dimensions == 256 {
+		dimensions = 0
+	}
+	var smooth []string
+	for _, class := range strings.Split(*FlagSmooth, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			smooth = append(smooth, class)
+		}
+	}
+	_, err = NewSmoothing(smooth, nil)
+	if err != nil {
+		return Settings{}, err
+	}
+	err = CheckMerges(*FlagMerges)
+	if err != nil {
+		return Settings{}, err
+	}
+	err = CheckFold(*FlagFold, *FlagMerges)
+	if err != nil {
+		return Settings{}, err
+	}
+	err = CheckStride(*FlagStride)
+	if err != nil {
+		return Settings{}, err
+	}
+	if *FlagQuota < 0 {
+		return Settings{}, fmt.Errorf("quota must not be negative")
+	}
+	err = CheckSubclusters(*FlagSubclusters, *FlagSubclusterMin)
+	if err != nil {
+		return Settings{}, err
+	}
+	windows, err := ParseWindows(*FlagWindows)
+	if err != nil {
+		return Settings{}, err
+	}
+	redaction, err := NewRedaction(strings.Split(*FlagRedact, ","), *FlagRedactPatterns)
+	if err != nil {
+		return Settings{}, err
+	}
+	stride := *FlagStride
+	if stride == 1 {
+		stride = 0
+	}
+	mixer := *FlagMixer
+	if mixer == "histogram" {
+		mixer = ""
+	}
+	header := *FlagHeader
+	if header == HeaderGaussian {
+		header = ""
+	}
+	// the minimum is only recorded for a sub-clustered database
+	subclusterMin := 0
+	if *FlagSubclusters > 0 {
+		subclusterMin = *FlagSubclusterMin
+	}
+	settings := Settings{
+		Preprocess:    pipeline,
+		Code:          *FlagCode,
+		Order2:        *FlagOrder2,
+		Windows:       windows,
+		Weights:       weights,
+		Quota:         *FlagQuota,
+		Smooth:        smooth,
+		Dimensions:    dimensions,
+		Merges:        *FlagMerges,
+		Fold:          *FlagFold,
+		Stride:        stride,
+		Mixer:         mixer,
+		EmbedCorpus:   *FlagEmbedCorpus,
+		Redact:        redaction,
+		Header:        header,
+		Subclusters:   *FlagSubclusters,
+		SubclusterMin: subclusterMin,
+	}
+	err = CheckMixer(settings)
+	if err != nil {
+		return Settings{}, err
+	}
+	err = CheckHeader(settings)
+	if err != nil {
+		return Settings{}, err
+	}
+	return settings, nil
+}
+
+// BuildFlags are the build options of the flags
+func BuildFlags() (BuildOptions, error) {
+	options := BuildOptions{
+		MaxMemory:    int64(*FlagMaxMemory) << 20,
+		Differential: *FlagDifferential,
+		Checkpoint:   *FlagCheckpoint,
+		Calibrate:    *FlagCalibrate,
+	}
+	if *FlagTransform != "" {
+		transform, err := ReadTransformFile(*FlagTransform)
+		if err != nil {
+			return BuildOptions{}, err
+		}
+		options.Transform = transform
+	}
+	return options, nil
+}
+
+// BuildCommand builds the database
+func BuildCommand(args []string) {
+	set := flag.NewFlagSet("build", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	if set.NArg() != 0 {
+		fmt.Println("usage: soda build [-db <db>] [flags]")
+		return
+	}
+	settings, err := BuildSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	options, err := BuildFlags()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = Build(*FlagDB, Documents(), settings, options)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ServeCommand serves the api of the database
+func ServeCommand(args []string) {
+	set := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	if set.NArg() != 0 {
+		fmt.Println("usage: soda serve [-db <db>] [-models <db>,...] [-addr <addr>] [flags]")
+		return
+	}
+	gate := &Gate{}
+	load := func(path string, keys *Keys) (*Model, http.Handler, error) {
+		model, err := LoadModel(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		handler, err := Routes(model, keys)
+		if err != nil {
+			model.Close()
+			return nil, nil, err
+		}
+		if *FlagMlock {
+			err = model.Mlock()
+			if err != nil {
+				model.Close()
+				return nil, nil, err
+			}
+		}
+		if *FlagLazy {
+			err = model.Warm()
+			if err != nil {
+				model.Close()
+				return nil, nil, err
+			}
+		}
+		return model, handler, nil
+	}
+	start := func() error {
+		var keys *Keys
+		if *FlagKeys != "" {
+			var err error
+			keys, err = LoadKeys(*FlagKeys, ModelName(*FlagDB))
+			if err != nil {
+				return err
+			}
+		}
+		model, handler, err := load(*FlagDB, keys)
+		if err != nil {
+			return err
+		}
+		if *FlagModels == "" {
+			gate.Open(handler)
+			return nil
+		}
+		// the other databases are routed to by the prompts of the requests
+		router := &Router{}
+		err = router.Add(model, handler)
+		if err != nil {
+			return err
+		}
+		for _, path := range strings.Split(*FlagModels, ",") {
+			model, handler, err := load(strings.TrimSpace(path), keys)
+			if err != nil {
+				return err
+			}
+			err = router.Add(model, handler)
+			if err != nil {
+				return err
+			}
+		}
+		gate.Open(router)
+		return nil
+	}
+	if *FlagLazy {
+		go func() {
+			err := start()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}()
+	} else if err := start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	err := NewServer(gate).ListenAndServe()
+	if err != nil {
+		fmt.Println("Failed to start server", err)
+		return
+	}
+}
+
+// RankCommand generates from the query with the page rank database
+func RankCommand(args []string) {
+	set := flag.NewFlagSet("rank", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	Rank(false)
+}
+
+// RankBuildCommand builds the page rank database
+func RankBuildCommand(args []string) {
+	set := flag.NewFlagSet("rank build", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	Rank(true)
+}
+
+// BruteCommand searches the corpus by brute force
+func BruteCommand(args []string) {
+	set := flag.NewFlagSet("brute", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	Brute()
+}
+
+// GenerateQuery generates from the query text with the database, the query is replaced
+// by the corpus before -continue if it is set
+func GenerateQuery(text string) {
+	err := CheckOutput(*FlagOutput)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	options, err := Request{
+		Documents: strings.Split(*FlagOnlyDoc, ","),
+		Symbols:   *FlagSymbols,
+	}.Options()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	query, expected := []byte(text), []byte(nil)
+	if *FlagContinue != "" {
+		query, expected, err = Continuation(*FlagContinue)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		panic(err)
+	}
+	defer model.Close()
+	err = CheckPipeline(model.Preprocess)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = model.Check(options)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	query, expected = model.Preprocess.Apply(query), model.Preprocess.Apply(expected)
+	searches := model.Soda(query, options)
+	if *FlagOutput == OutputHTML {
+		err = model.WriteAnnotated(os.Stdout, query, searches)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	if *FlagContinue != "" {
+		if len(query) > 256 {
+			query = query[len(query)-256:]
+		}
+		if len(expected) > options.Count {
+			expected = expected[:options.Count]
+		}
+		fmt.Println(string(query))
+		fmt.Println("expected ---------------------------------------")
+		fmt.Println(string(expected))
+		fmt.Println("generated ---------------------------------------")
+		query = nil
+	}
+	for _, search := range searches {
+		output := search.Result
+		str := append([]byte{}, query...)
+		for i := range output {
+			str = append(str, output[i].S...)
+		}
+		fmt.Println(string(str))
+		if search.Truncated {
+			fmt.Println("truncated after", *FlagDeadline)
+		}
+		if search.PromptTruncated {
+			fmt.Println("prompt truncated to", options.PromptBudget, "bytes with", options.Truncation)
+		}
+		if options.Context > 0 {
+			for _, output := range output {
+				fmt.Printf("%q %d %q\n", output.S, output.Index, output.Context)
+			}
+		}
+		fmt.Println(search.Rank, " ---------------------------------------")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	// DriftCosine is the mean cosine between the embeddings of two models
+	// below which stored embeddings should be regenerated
+	DriftCosine = .99
+	// DriftOverlap is the mean neighborhood overlap between two models below
+	// which stored embeddings should be regenerated
+	DriftOverlap = .9
+)
+
+// Embed embeds text as the database vector of the model after the text
+func (m *Model) Embed(text []byte) []float32 {
+	text = m.Coding().Encode(m.Smoothing.Apply(m.Preprocess.Apply(text)))
+	mixer, mixed := m.NewMixer(), [256]float32{}
+	for _, v := range text {
+		mixer.Add(v)
+	}
+	mixer.Mix(&mixed)
+	embedding := make([]float32, m.Width())
+	m.Project(embedding, mixed[:])
+	return embedding
+}
+
+// Entropy returns the entropy of each distribution mixed for the context
+// after the text and the entropy of the mixed distribution
+func (m *Model) Entropy(text []byte) ([]float32, float32) {
+	text = m.Coding().Encode(m.Smoothing.Apply(m.Preprocess.Apply(text)))
+	mixer, mixed := m.NewMixer(), [256]float32{}
+	for _, v := range text {
+		mixer.Add(v)
+	}
+	mixer.Mix(&mixed)
+	return mixer.Entropy(), Entropy(mixed[:])
+}
+
+// Neighbors returns the k nearest embeddings to each embedding
+func Neighbors(embeddings [][]float32, k int) [][]int {
+	neighbors := make([][]int, len(embeddings))
+	for i, a := range embeddings {
+		type Neighbor struct {
+			Index int
+			CS    float32
+		}
+		candidates := make([]Neighbor, 0, len(embeddings)-1)
+		for j, b := range embeddings {
+			if i != j {
+				candidates = append(candidates, Neighbor{Index: j, CS: CS(a, b)})
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].CS > candidates[j].CS
+		})
+		for j := 0; j < k && j < len(candidates); j++ {
+			neighbors[i] = append(neighbors[i], candidates[j].Index)
+		}
+	}
+	return neighbors
+}
+
+// ReadSamples reads the non blank lines of a file
+func ReadSamples(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var samples [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			samples = append(samples, []byte(line))
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// CompareEmbeddings reports the drift between the embeddings of sample texts
+// under two databases
+func CompareEmbeddings(args []string) {
+	set := flag.NewFlagSet("db compare-embeddings", flag.ContinueOnError)
+	samplesPath := set.String("samples", "", "file of sample texts, one per line")
+	k := set.Int("k", 10, "number of nearest neighbors compared")
+	var paths []string
+	for {
+		if err := set.Parse(args); err != nil {
+			return
+		}
+		args = set.Args()
+		if len(args) == 0 {
+			break
+		}
+		paths, args = append(paths, args[0]), args[1:]
+	}
+	if len(paths) != 2 || *samplesPath == "" || *k < 1 {
+		fmt.Println("usage: db compare-embeddings <old> <new> -samples <file> [-k neighbors]")
+		return
+	}
+	samples, err := ReadSamples(*samplesPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(samples) < 2 {
+		fmt.Println("at least two samples are needed")
+		return
+	}
+
+	var embeddings [2][][]float32
+	for i, path := range paths {
+		model, err := LoadModel(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, sample := range samples {
+			embeddings[i] = append(embeddings[i], model.Embed(sample))
+		}
+		fmt.Printf("%s: %d dimensions, preprocess %v\n", path, model.Width(), model.Preprocess)
+		model.Close()
+	}
+
+	fmt.Println("samples", len(samples))
+	old, new := embeddings[0], embeddings[1]
+	drift := false
+	if len(old[0]) == len(new[0]) {
+		sum, min := 0.0, 1.0
+		for i := range samples {
+			cs := float64(CS(old[i], new[i]))
+			sum += cs
+			if cs < min {
+				min = cs
+			}
+		}
+		mean := sum / float64(len(samples))
+		fmt.Printf("mean cosine %.4f min %.4f\n", mean, min)
+		drift = drift || mean < DriftCosine
+	} else {
+		fmt.Println("the dimensions differ so the embeddings can't be compared directly")
+		drift = true
+	}
+
+	a, b := Neighbors(old, *k), Neighbors(new, *k)
+	overlap := 0.0
+	for i := range samples {
+		in := make(map[int]bool, len(a[i]))
+		for _, j := range a[i] {
+			in[j] = true
+		}
+		shared := 0
+		for _, j := range b[i] {
+			if in[j] {
+				shared++
+			}
+		}
+		overlap += float64(shared) / float64(len(a[i]))
+	}
+	overlap /= float64(len(samples))
+	fmt.Printf("neighborhood overlap@%d %.4f\n", *k, overlap)
+	drift = drift || overlap < DriftOverlap
+
+	if drift {
+		fmt.Println("the embeddings drifted, stored embeddings should be regenerated")
+	} else {
+		fmt.Println("the embeddings are compatible, stored embeddings can be kept")
+	}
+}
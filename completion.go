@@ -0,0 +1,182 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PrintUsage prints the usage of soda with its subcommands and global flags
+func PrintUsage() {
+	output := flag.CommandLine.Output()
+	fmt.Fprintln(output, "usage: soda [flags] [command] [args] [flags]")
+	fmt.Fprintln(output, "generates from -query without a command, the commands are:")
+	for _, name := range CommandNames() {
+		fmt.Fprintln(output, "  "+name)
+	}
+	fmt.Fprintln(output, "the flags are:")
+	flag.PrintDefaults()
+}
+
+// CommandNames returns the sorted names of the subcommands
+func CommandNames() []string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CommandTree returns the words that can follow each sequence of subcommand
+// words, the words that start a command follow the empty sequence
+func CommandTree() map[string][]string {
+	tree := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, name := range CommandNames() {
+		words := strings.Fields(name)
+		for i := range words {
+			prefix := strings.Join(words[:i], " ")
+			if key := prefix + "/" + words[i]; !seen[key] {
+				seen[key] = true
+				tree[prefix] = append(tree[prefix], words[i])
+			}
+		}
+	}
+	return tree
+}
+
+// Prefixes returns the sorted sequences of subcommand words of the tree
+func Prefixes(tree map[string][]string) []string {
+	prefixes := make([]string, 0, len(tree))
+	for prefix := range tree {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// ValueFlags returns the names of the global flags that take a value and of
+// the boolean flags
+func ValueFlags() (values, bools []string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			bools = append(bools, f.Name)
+			return
+		}
+		values = append(values, f.Name)
+	})
+	return values, bools
+}
+
+// Bash writes the bash completion script of soda
+func Bash(w io.Writer) {
+	values, bools := ValueFlags()
+	flags := []string{}
+	for _, name := range append(append([]string{}, values...), bools...) {
+		flags = append(flags, "-"+name)
+	}
+	sort.Strings(flags)
+	fmt.Fprintln(w, "# bash completion of soda, source it or install it with")
+	fmt.Fprintln(w, "#   soda completion bash > /etc/bash_completion.d/soda")
+	fmt.Fprintln(w, "_soda() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" path="" skip="" word i`)
+	fmt.Fprintf(w, "\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(flags, " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tfor ((i = 1; i < COMP_CWORD; i++)); do")
+	fmt.Fprintln(w, `		word="${COMP_WORDS[i]}"`)
+	fmt.Fprintln(w, `		if [[ -n "$skip" ]]; then skip=""; continue; fi`)
+	fmt.Fprintln(w, `		case "$word" in`)
+	fmt.Fprintln(w, `		-*=*) ;;`)
+	for _, name := range values {
+		fmt.Fprintf(w, "\t\t-%s|--%s) skip=1 ;;\n", name, name)
+	}
+	fmt.Fprintln(w, `		-*) ;;`)
+	fmt.Fprintln(w, `		*) path="${path:+$path }$word" ;;`)
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintln(w, "\tdone")
+	fmt.Fprintln(w, `	if [[ -n "$skip" ]]; then`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, `	case "$path" in`)
+	tree := CommandTree()
+	for _, prefix := range Prefixes(tree) {
+		fmt.Fprintf(w, "\t%q) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", prefix, strings.Join(tree[prefix], " "))
+	}
+	fmt.Fprintln(w, `	*) COMPREPLY=($(compgen -f -- "$cur")) ;;`)
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _soda soda")
+}
+
+// Zsh writes the zsh completion script of soda, it runs the bash completion
+// with bashcompinit
+func Zsh(w io.Writer) {
+	fmt.Fprintln(w, "# zsh completion of soda, source it from .zshrc")
+	fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	Bash(w)
+}
+
+// Fish writes the fish completion script of soda
+func Fish(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion of soda, install it with")
+	fmt.Fprintln(w, "#   soda completion fish > ~/.config/fish/completions/soda.fish")
+	fmt.Fprintln(w, "complete -c soda -f")
+	tree := CommandTree()
+	for _, word := range tree[""] {
+		fmt.Fprintf(w, "complete -c soda -n __fish_use_subcommand -a %s\n", word)
+	}
+	for _, prefix := range Prefixes(tree) {
+		if prefix == "" {
+			continue
+		}
+		words := tree[prefix]
+		last := strings.Fields(prefix)
+		for _, word := range words {
+			fmt.Fprintf(w, "complete -c soda -n '__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s' -a %s\n",
+				last[len(last)-1], strings.Join(words, " "), word)
+		}
+	}
+	values, bools := ValueFlags()
+	usage := func(name string) string {
+		return strings.ReplaceAll(flag.Lookup(name).Usage, "'", `\'`)
+	}
+	for _, name := range values {
+		fmt.Fprintf(w, "complete -c soda -o %s -r -F -d '%s'\n", name, usage(name))
+	}
+	for _, name := range bools {
+		fmt.Fprintf(w, "complete -c soda -o %s -d '%s'\n", name, usage(name))
+	}
+}
+
+// Shells are the completion script writers by shell
+var Shells = map[string]func(w io.Writer){
+	"bash": Bash,
+	"zsh":  Zsh,
+	"fish": Fish,
+}
+
+func init() {
+	// the completion is generated from the commands so it can't be in their
+	// initializer
+	Commands["completion"] = CompletionCommand
+}
+
+// CompletionCommand writes the completion script of a shell
+func CompletionCommand(args []string) {
+	if len(args) != 1 || Shells[args[0]] == nil {
+		fmt.Println("usage: soda completion bash|zsh|fish")
+		return
+	}
+	Shells[args[0]](os.Stdout)
+}
@@ -0,0 +1,185 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// FlagCompress enables compression of the static and data responses
+	FlagCompress = flag.Bool("compress", true, "compress static assets, the corpus, and the model card for clients that accept it")
+	// FlagCacheMaxAge is how long clients can cache the static and data responses
+	FlagCacheMaxAge = flag.Duration("cache-max-age", 0, "how long clients can use static assets, the corpus, and the model card without revalidating them, 0 revalidates every time with the etag")
+)
+
+// CompressMin is the size below which responses aren't compressed
+const CompressMin = 1024
+
+// Encodings are the content encodings responses can be compressed with by
+// preference
+var Encodings = []struct {
+	Name   string
+	Writer func(w io.Writer) io.WriteCloser
+}{
+	{"zstd", func(w io.Writer) io.WriteCloser {
+		writer, err := zstd.NewWriter(w)
+		if err != nil {
+			panic(err)
+		}
+		return writer
+	}},
+	{"gzip", func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	}},
+}
+
+// Negotiate returns the encoding of Encodings the Accept-Encoding header
+// prefers, the empty string is the identity encoding
+func Negotiate(accept string) string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					weight = q
+				}
+			}
+		}
+		weights[name] = weight
+	}
+	best, weight := "", 0.0
+	for _, encoding := range Encodings {
+		q, ok := weights[encoding.Name]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > weight {
+			best, weight = encoding.Name, q
+		}
+	}
+	return best
+}
+
+// Content is a response body with its etag and its compressed forms, which
+// are compressed the first time they are requested
+type Content struct {
+	Data        []byte
+	ContentType string
+	ETag        string
+	sync.Mutex
+	encoded map[string][]byte
+}
+
+// NewContent creates the content of data
+func NewContent(data []byte, contentType string) *Content {
+	hash := sha256.Sum256(data)
+	return &Content{
+		Data:        data,
+		ContentType: contentType,
+		ETag:        hex.EncodeToString(hash[:16]),
+	}
+}
+
+// Encode returns the data compressed with the encoding
+func (c *Content) Encode(encoding string) []byte {
+	c.Lock()
+	defer c.Unlock()
+	if data, ok := c.encoded[encoding]; ok {
+		return data
+	}
+	for _, e := range Encodings {
+		if e.Name != encoding {
+			continue
+		}
+		var buffer bytes.Buffer
+		writer := e.Writer(&buffer)
+		_, err := writer.Write(c.Data)
+		if err != nil {
+			panic(err)
+		}
+		err = writer.Close()
+		if err != nil {
+			panic(err)
+		}
+		if c.encoded == nil {
+			c.encoded = make(map[string][]byte)
+		}
+		c.encoded[encoding] = buffer.Bytes()
+		return c.encoded[encoding]
+	}
+	panic(fmt.Errorf("unknown encoding %s", encoding))
+}
+
+// Matches is true if the If-None-Match header lists the etag of the content
+// in any encoding
+func (c *Content) Matches(match string) bool {
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" {
+			return true
+		}
+		tag = strings.Trim(tag, `"`)
+		if tag == c.ETag || strings.HasPrefix(tag, c.ETag+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP serves the content compressed if the client accepts it, with a 304
+// if the client has it already
+func (c *Content) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	header := response.Header()
+	header.Set("Content-Type", c.ContentType)
+	header.Add("Vary", "Accept-Encoding")
+	if *FlagCacheMaxAge > 0 {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", *FlagCacheMaxAge/time.Second))
+	} else {
+		header.Set("Cache-Control", "no-cache")
+	}
+	data, encoding := c.Data, ""
+	if *FlagCompress && len(c.Data) >= CompressMin {
+		encoding = Negotiate(request.Header.Get("Accept-Encoding"))
+	}
+	etag := c.ETag
+	if encoding != "" {
+		data = c.Encode(encoding)
+		etag += "-" + encoding
+		header.Set("Content-Encoding", encoding)
+	}
+	header.Set("ETag", `"`+etag+`"`)
+	if match := request.Header.Get("If-None-Match"); match != "" && c.Matches(match) {
+		header.Del("Content-Type")
+		header.Del("Content-Encoding")
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	if request.Method == http.MethodHead {
+		return
+	}
+	response.Write(data)
+}
@@ -0,0 +1,422 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FlagConfig is the config file of the flags
+var FlagConfig = flag.String("config", "", "yaml file of flag values by flag name, optionally grouped under the sections model, server, sampling, corpus, and build, a list is a comma separated value, flags set on the command line take precedence")
+
+// ConfigSections are the sections the flags of a config can be grouped under,
+// they are only for readability
+var ConfigSections = []string{"model", "server", "sampling", "corpus", "build"}
+
+// ConfigEntry is the value of a flag in a config
+type ConfigEntry struct {
+	Line    int
+	Section string
+	Flag    string
+	Value   string
+}
+
+// Config are the flag values of a config file in the order they appear
+type Config struct {
+	Path    string
+	Entries []ConfigEntry
+}
+
+// ReadConfig reads a config file
+func ReadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+	return &Config{Path: path, Entries: entries}, nil
+}
+
+// WriteConfig sets a flag to value in the config file at path, the line of
+// the flag and the items of its list are replaced if the config sets it and
+// the flag is appended otherwise. The rest of the file is kept as it is
+func WriteConfig(path, name, value string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	entries, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+	lines := strings.Split(string(data), "\n")
+	found := false
+	for _, entry := range entries {
+		if entry.Flag != name {
+			continue
+		}
+		line := lines[entry.Line-1]
+		lines[entry.Line-1], found = line[:len(line)-len(strings.TrimLeft(line, " "))]+name+": "+value, true
+		last := entry.Line - 1
+		for i := entry.Line; i < len(lines); i++ {
+			text := strings.TrimSpace(StripComment(lines[i]))
+			if text == "-" || strings.HasPrefix(text, "- ") {
+				last = i
+			} else if text != "" {
+				break
+			}
+		}
+		lines = append(lines[:entry.Line], lines[last+1:]...)
+		break
+	}
+	text := strings.Join(lines, "\n")
+	if !found {
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		text += name + ": " + value + "\n"
+	}
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(text)
+	if err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// ParseConfig parses the subset of yaml of a config, a mapping of flag names
+// to scalars or lists that can be nested one level under a section. Lists are
+// block sequences or flow sequences of scalars
+func ParseConfig(data []byte) ([]ConfigEntry, error) {
+	var entries []ConfigEntry
+	// section is the section the lines are in and indent the indentation of
+	// its keys, open is the key without a value on the line before that is a
+	// section, a list, or empty
+	section, indent, open := "", -1, (*ConfigEntry)(nil)
+	list, seen := []string(nil), make(map[string]int)
+	add := func(entry ConfigEntry) error {
+		if entry.Flag == "config" {
+			return fmt.Errorf("%d: a config can't set config", entry.Line)
+		}
+		if line, ok := seen[entry.Flag]; ok {
+			return fmt.Errorf("%d: %s is already set on line %d", entry.Line, entry.Flag, line)
+		}
+		seen[entry.Flag] = entry.Line
+		entries = append(entries, entry)
+		return nil
+	}
+	// finish ends the key without a value once the lines that follow it are
+	// read
+	finish := func() error {
+		if open == nil {
+			return nil
+		}
+		entry := *open
+		entry.Value, open, list = strings.Join(list, ","), nil, nil
+		if entry.Section == "" && entry.Value == "" && slices.Contains(ConfigSections, entry.Flag) {
+			// an empty section
+			return nil
+		}
+		return add(entry)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		n := i + 1
+		line = strings.TrimRight(StripComment(line), " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("%d: tabs can't indent", n)
+		}
+		depth := len(line) - len(text)
+		if open != nil && (text == "-" || strings.HasPrefix(text, "- ")) {
+			item, err := ConfigScalar(strings.TrimSpace(strings.TrimPrefix(text, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%d: %w", n, err)
+			}
+			list = append(list, item)
+			continue
+		}
+		if open != nil && open.Section == "" && list == nil && depth > 0 {
+			if !slices.Contains(ConfigSections, open.Flag) {
+				return nil, fmt.Errorf("%d: unknown section %s, it should be one of %s", open.Line, open.Flag, strings.Join(ConfigSections, ", "))
+			}
+			section, indent, open = open.Flag, depth, nil
+		}
+		if err := finish(); err != nil {
+			return nil, err
+		}
+		switch {
+		case depth == 0:
+			section, indent = "", -1
+		case depth != indent:
+			return nil, fmt.Errorf("%d: unexpected indentation", n)
+		}
+		key, value, ok := strings.Cut(text, ":")
+		if !ok || key == "" || strings.ContainsAny(key, " \"'") || value != "" && value[0] != ' ' {
+			return nil, fmt.Errorf("%d: expected flag: value", n)
+		}
+		entry := ConfigEntry{Line: n, Section: section, Flag: key}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			open = &entry
+			continue
+		}
+		var err error
+		if strings.HasPrefix(value, "[") {
+			entry.Value, err = ConfigFlow(value)
+		} else {
+			entry.Value, err = ConfigScalar(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", n, err)
+		}
+		if err := add(entry); err != nil {
+			return nil, err
+		}
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// StripComment removes the comment of a line, a comment starts with a # at
+// the start of the line or after a space that isn't quoted
+func StripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// ConfigScalar is the value of a plain, single quoted, or double quoted scalar
+func ConfigScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted value %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid single quoted value %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	case strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{"):
+		return "", fmt.Errorf("nested collections aren't supported")
+	}
+	return value, nil
+}
+
+// ConfigFlow is the comma separated items of a flow sequence
+func ConfigFlow(value string) (string, error) {
+	if !strings.HasSuffix(value, "]") {
+		return "", fmt.Errorf("unterminated list %s", value)
+	}
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	if inner == "" {
+		return "", nil
+	}
+	var items []string
+	quote, start := byte(0), 0
+	for i := 0; i <= len(inner); i++ {
+		if i < len(inner) {
+			switch c := inner[i]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				} else if c == '\\' && quote == '"' {
+					i++
+				}
+				continue
+			case c == '"' || c == '\'':
+				quote = c
+				continue
+			case c != ',':
+				continue
+			}
+		}
+		item, err := ConfigScalar(strings.TrimSpace(inner[start:i]))
+		if err != nil {
+			return "", err
+		}
+		items, start = append(items, item), i+1
+	}
+	return strings.Join(items, ","), nil
+}
+
+// Set sets the flag of the entry
+func (e ConfigEntry) Set() error {
+	if flag.Lookup(e.Flag) == nil {
+		return fmt.Errorf("%d: unknown flag %s", e.Line, e.Flag)
+	}
+	err := flag.Set(e.Flag, e.Value)
+	if err != nil {
+		return fmt.Errorf("%d: invalid value %q for %s: %v", e.Line, e.Value, e.Flag, err)
+	}
+	return nil
+}
+
+// Apply sets the flags of the config that aren't in set, the flags set on the
+// command line. It returns the errors of every entry
+func (c *Config) Apply(set map[string]bool) error {
+	var errs []error
+	for _, entry := range c.Entries {
+		if set[entry.Flag] {
+			continue
+		}
+		if err := entry.Set(); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%w", c.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetFlags are the names of the flags of the sets that have been set
+func SetFlags(sets ...*flag.FlagSet) map[string]bool {
+	names := make(map[string]bool)
+	for _, set := range sets {
+		set.Visit(func(f *flag.Flag) {
+			names[f.Name] = true
+		})
+	}
+	return names
+}
+
+// LoadConfig applies the config file of -config to the flags that aren't set
+// on the command line by the sets
+func LoadConfig(sets ...*flag.FlagSet) error {
+	if *FlagConfig == "" {
+		return nil
+	}
+	config, err := ReadConfig(*FlagConfig)
+	if err != nil {
+		return err
+	}
+	return config.Apply(SetFlags(sets...))
+}
+
+// ConfigChecks are the build flags a config is checked against the database
+// with, Setting is the setting of the flag
+var ConfigChecks = []struct {
+	Flag    string
+	Setting func(settings Settings) any
+}{
+	{"preprocess", func(s Settings) any { return s.Preprocess }},
+	{"redact", func(s Settings) any { return s.Redact }},
+	{"code", func(s Settings) any { return s.Code }},
+	{"order2", func(s Settings) any { return s.Order2 }},
+	{"windows", func(s Settings) any { return s.Windows }},
+	{"smooth", func(s Settings) any { return s.Smooth }},
+	{"dims", func(s Settings) any { return s.Dimensions }},
+	{"merges", func(s Settings) any { return s.Merges }},
+	{"fold", func(s Settings) any { return s.Fold }},
+	{"stride", func(s Settings) any { return s.Stride }},
+	{"mixer", func(s Settings) any { return s.Mixer }},
+	{"embed-corpus", func(s Settings) any { return s.EmbedCorpus }},
+	{"header", func(s Settings) any { return s.Header }},
+	{"subclusters", func(s Settings) any { return s.Subclusters }},
+}
+
+// ValidateConfig checks the applied config and the flags set on the command
+// line against the database of -db, the build flags of configured have to be
+// the settings the database was built with and the generation flags have to
+// be usable with it. It returns every problem found
+func ValidateConfig(configured map[string]bool) []error {
+	var problems []error
+	if err := CheckFlags(); err != nil {
+		problems = append(problems, err)
+	}
+	options, err := Request{
+		Documents: strings.Split(*FlagOnlyDoc, ","),
+		Symbols:   *FlagSymbols,
+	}.Options()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	settings, err := BuildSettings()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 || *FlagDB == "" {
+		return problems
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		return append(problems, err)
+	}
+	defer model.Close()
+	for _, check := range ConfigChecks {
+		if !configured[check.Flag] {
+			continue
+		}
+		want, err := json.Marshal(check.Setting(settings))
+		if err != nil {
+			panic(err)
+		}
+		got, err := json.Marshal(check.Setting(model.Settings))
+		if err != nil {
+			panic(err)
+		}
+		if string(want) != string(got) {
+			problems = append(problems, fmt.Errorf("%s is %s but %s was built with %s", check.Flag, want, *FlagDB, got))
+		}
+	}
+	if err := model.Check(options); err != nil {
+		problems = append(problems, err)
+	}
+	return problems
+}
+
+// ConfigValidate checks the config of -config against the database of -db,
+// the config is applied before the command runs
+func ConfigValidate(args []string) {
+	set := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	if *FlagConfig == "" {
+		fmt.Println("usage: -config <soda.yaml> [-db <db>] config validate")
+		return
+	}
+	problems := ValidateConfig(SetFlags(flag.CommandLine, set))
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println(*FlagConfig, "is valid for", *FlagDB)
+}
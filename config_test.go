@@ -0,0 +1,182 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		config  string
+		entries []ConfigEntry
+	}{
+		{"count: 64\n", []ConfigEntry{{Line: 1, Flag: "count", Value: "64"}}},
+		{"# a comment\n\ncount: 64 # trailing\nquery: a#b\n", []ConfigEntry{
+			{Line: 3, Flag: "count", Value: "64"},
+			{Line: 4, Flag: "query", Value: "a#b"},
+		}},
+		{"addr: :9090\r\n", []ConfigEntry{{Line: 1, Flag: "addr", Value: ":9090"}}},
+		{`query: "and god said # not a comment\n"`, []ConfigEntry{{Line: 1, Flag: "query", Value: "and god said # not a comment\n"}}},
+		{`query: 'it''s # kept'`, []ConfigEntry{{Line: 1, Flag: "query", Value: "it's # kept"}}},
+		{"query:\n", []ConfigEntry{{Line: 1, Flag: "query", Value: ""}}},
+		{"server:\n  addr: :9090\n  quiet: true\ncount: 8\n", []ConfigEntry{
+			{Line: 2, Section: "server", Flag: "addr", Value: ":9090"},
+			{Line: 3, Section: "server", Flag: "quiet", Value: "true"},
+			{Line: 4, Flag: "count", Value: "8"},
+		}},
+		{"build:\nsampling:\n    temperature: .5\n", []ConfigEntry{
+			{Line: 3, Section: "sampling", Flag: "temperature", Value: ".5"},
+		}},
+		{"windows:\n  - 1\n  - 2 # two\n  - '4'\n", []ConfigEntry{{Line: 1, Flag: "windows", Value: "1,2,4"}}},
+		{"build:\n  windows:\n  - 1\n  - 8\n  dims: 64\n", []ConfigEntry{
+			{Line: 2, Section: "build", Flag: "windows", Value: "1,8"},
+			{Line: 5, Section: "build", Flag: "dims", Value: "64"},
+		}},
+		{`only-doc: [1, "2,3", 'x']`, []ConfigEntry{{Line: 1, Flag: "only-doc", Value: "1,2,3,x"}}},
+		{"windows: [ ]\n", []ConfigEntry{{Line: 1, Flag: "windows", Value: ""}}},
+	}
+	for _, test := range tests {
+		entries, err := ParseConfig([]byte(test.config))
+		if err != nil {
+			t.Fatalf("%q: %v", test.config, err)
+		}
+		if len(entries) != len(test.entries) {
+			t.Fatalf("%q should have %d entries not %+v", test.config, len(test.entries), entries)
+		}
+		for i := range entries {
+			if entries[i] != test.entries[i] {
+				t.Fatalf("%q entry %d should be %+v not %+v", test.config, i, test.entries[i], entries[i])
+			}
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"count: 1\ncount: 2\n", "2: count is already set on line 1"},
+		{"server:\n  addr: :1\nbuild:\n  addr: :2\n", "4: addr is already set on line 2"},
+		{"server:\n\taddr: :9090\n", "2: tabs can't indent"},
+		{"server:\n  addr: :9090\n    quiet: true\n", "3: unexpected indentation"},
+		{"count: 1\n  quiet: true\n", "2: unexpected indentation"},
+		{"network:\n  addr: :9090\n", "1: unknown section network"},
+		{"count 1\n", "1: expected flag: value"},
+		{"count:1\n", "1: expected flag: value"},
+		{"my count: 1\n", "1: expected flag: value"},
+		{"config: other.yaml\n", "1: a config can't set config"},
+		{`query: "unterminated`, "1: invalid double quoted value"},
+		{"query: 'unterminated\n", "1: invalid single quoted value"},
+		{"windows: [1, 2\n", "1: unterminated list"},
+		{"windows: [[1], 2]\n", "1: nested collections aren't supported"},
+		{"weights: {a: 1}\n", "1: nested collections aren't supported"},
+		{"windows:\n  - [1]\n", "2: nested collections aren't supported"},
+	}
+	for _, test := range tests {
+		_, err := ParseConfig([]byte(test.config))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Fatalf("%q should fail with %q not %v", test.config, test.err, err)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	tests := []struct {
+		config, expected string
+	}{
+		{"", "windows: [1, 2]\n"},
+		{"build:\n  stride: 1", "build:\n  stride: 1\nwindows: [1, 2]\n"},
+		{"build:\n  windows: 4,8 # old\n  stride: 1\n", "build:\n  windows: [1, 2]\n  stride: 1\n"},
+		{"windows:\n  - 4\n\n  - 8\nstride: 1\n", "windows: [1, 2]\nstride: 1\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if test.config != "" {
+			err := os.WriteFile(path, []byte(test.config), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := WriteConfig(path, "windows", "[1, 2]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Fatalf("%q should be written as %q not %q", test.config, test.expected, data)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	vocabulary, k := *FlagVocabulary, *FlagVocabularyK
+	defer func() {
+		*FlagVocabulary, *FlagVocabularyK = vocabulary, k
+	}()
+	*FlagVocabulary, *FlagVocabularyK = 3, 8
+	entries, err := ParseConfig([]byte("sampling:\n  vocabulary: 5\n  vocabulary-k: 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Path: "soda.yaml", Entries: entries}
+	// the flags set on the command line take precedence
+	err = config.Apply(map[string]bool{"vocabulary": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *FlagVocabulary != 3 || *FlagVocabularyK != 2 {
+		t.Fatalf("vocabulary should stay 3 and vocabulary k should be 2 not %d and %d", *FlagVocabulary, *FlagVocabularyK)
+	}
+	err = config.Apply(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *FlagVocabulary != 5 {
+		t.Fatalf("vocabulary should be 5 not %d", *FlagVocabulary)
+	}
+
+	// every entry is applied and the errors of all of them are returned
+	*FlagVocabularyK = 8
+	config.Entries = []ConfigEntry{
+		{Line: 1, Flag: "no-such-flag", Value: "1"},
+		{Line: 2, Flag: "vocabulary", Value: "many"},
+		{Line: 3, Flag: "vocabulary-k", Value: "4"},
+	}
+	err = config.Apply(nil)
+	if err == nil {
+		t.Fatal("applying unknown flags and invalid values should fail")
+	}
+	for _, problem := range []string{"soda.yaml:1: unknown flag no-such-flag", "soda.yaml:2: invalid value \"many\" for vocabulary"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q should report %q", err, problem)
+		}
+	}
+	if *FlagVocabularyK != 4 {
+		t.Fatalf("the valid entry should be applied, vocabulary k is %d", *FlagVocabularyK)
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Int("count", 0, "")
+	set.Int("other", 0, "")
+	err := set.Parse([]string{"-count", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := SetFlags(set)
+	if !names["count"] || names["other"] {
+		t.Fatalf("only count should be set not %v", names)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/pointlander/soda/client"
+)
+
+// Control adjusts the sampler and the stop sequences of a generation in
+// progress, changes are applied at the next symbol
+type Control struct {
+	sync.Mutex
+	Sampler  Sampler
+	Stop     []string
+	Changed  bool
+	canceled bool
+}
+
+// Cancel stops the generation at the next symbol
+func (c *Control) Cancel() {
+	c.Lock()
+	defer c.Unlock()
+	c.canceled = true
+}
+
+// Canceled is true if the generation has been canceled
+func (c *Control) Canceled() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.canceled
+}
+
+// Update merges a sampler update into the control, zero fields are unchanged,
+// the stop sequences are replaced if stop isn't nil. A temperature replaces
+// the temperature schedule
+func (c *Control) Update(sampler Sampler, stop []string) {
+	c.Lock()
+	defer c.Unlock()
+	if sampler.Temperature != 0 && sampler.Schedule == nil {
+		c.Sampler.Schedule = nil
+	}
+	c.Sampler = sampler.Merge(c.Sampler)
+	if stop != nil {
+		c.Stop = stop
+	}
+	c.Changed = true
+}
+
+// Apply returns the sampler and stop sequences if they have changed
+func (c *Control) Apply(sampler Sampler, stop []string) (Sampler, []string) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.Changed {
+		return sampler, stop
+	}
+	c.Changed = false
+	return c.Sampler, c.Stop
+}
+
+// NewID returns a random id starting with prefix
+func NewID(prefix string) string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return prefix + hex.EncodeToString(id)
+}
+
+// Streams are the generation streams in progress that can be controlled
+type Streams struct {
+	sync.Mutex
+	Controls map[string]*Control
+	// Prefix starts the ids of the streams
+	Prefix string
+}
+
+// NewStreams creates a new stream registry
+func NewStreams() *Streams {
+	return &Streams{
+		Controls: make(map[string]*Control),
+	}
+}
+
+// Add registers a stream and returns its id
+func (s *Streams) Add(control *Control) string {
+	key := NewID(s.Prefix)
+	s.Lock()
+	s.Controls[key] = control
+	s.Unlock()
+	return key
+}
+
+// Remove unregisters a stream
+func (s *Streams) Remove(id string) {
+	s.Lock()
+	delete(s.Controls, id)
+	s.Unlock()
+}
+
+// Control applies a control frame to the stream in progress
+func (s *Streams) Control(response http.ResponseWriter, request *http.Request) {
+	s.Lock()
+	control, ok := s.Controls[request.PathValue("id")]
+	s.Unlock()
+	if !ok {
+		http.NotFound(response, request)
+		return
+	}
+	var req client.Control
+	if !Decode(response, request, &req) {
+		return
+	}
+	if req.Cancel {
+		control.Cancel()
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sampler := Sampler{
+		Decoder:     req.Decoder,
+		Temperature: req.Temperature,
+		TopK:        req.TopK,
+		TopP:        req.TopP,
+	}
+	control.Lock()
+	current := control.Sampler
+	control.Unlock()
+	err := sampler.Merge(current).Validate()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	control.Update(sampler, req.Stop)
+	response.WriteHeader(http.StatusNoContent)
+}
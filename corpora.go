@@ -0,0 +1,333 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/bzip2"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FlagCorpusMax is the maximum size of an uploaded corpus
+var FlagCorpusMax = flag.Int64("corpus-max", 1<<30, "maximum number of bytes of a corpus uploaded to the build api")
+
+// CorporaDir is the directory of the build directory the uploaded corpora are
+// stored in, the documents of the uploaded corpora have paths in it
+const CorporaDir = "corpora"
+
+// PartSuffix is the suffix of a corpus whose upload isn't complete
+const PartSuffix = ".part"
+
+// OpenDocument opens the text of a document, the books are bzip2 compressed
+// and the uploaded corpora are plain text in the build directory
+func OpenDocument(document Document) (io.ReadCloser, error) {
+	if name, ok := strings.CutPrefix(document.Path, CorporaDir+"/"); ok {
+		if *FlagBuildDir == "" {
+			return nil, fmt.Errorf("%s is an uploaded corpus and there is no -build-dir", document.Path)
+		}
+		return os.Open(filepath.Join(*FlagBuildDir, CorporaDir, name))
+	}
+	file, err := Books.Open(document.Path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{bzip2.NewReader(file), file}, nil
+}
+
+// ValidFileName checks that name is the name of a file of a directory
+func ValidFileName(name string) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q, it must be a file name", name)
+	}
+	return nil
+}
+
+// Upload is a corpus uploaded to the build api
+type Upload struct {
+	Name string `json:"name"`
+	// Size is the number of bytes uploaded, the next chunk is uploaded at
+	// it
+	Size int64 `json:"size"`
+	// Complete is true once the last chunk has been uploaded, databases can
+	// only be built from complete corpora
+	Complete bool `json:"complete"`
+}
+
+// Uploads are the corpora uploaded to the build api, a corpus is uploaded in
+// chunks at the offset of the bytes uploaded so far so an interrupted upload
+// resumes where it stopped
+type Uploads struct {
+	sync.Mutex
+	Dir string
+	// locks are the locks of the corpora being uploaded, the chunks of
+	// different corpora are appended at the same time
+	locks map[string]*corpusLock
+}
+
+// corpusLock is the lock of a corpus and the number of requests holding or
+// waiting for it
+type corpusLock struct {
+	sync.Mutex
+	users int
+}
+
+// Corpus locks the corpus with name until the returned function is called
+func (u *Uploads) Corpus(name string) func() {
+	u.Lock()
+	if u.locks == nil {
+		u.locks = make(map[string]*corpusLock)
+	}
+	lock, ok := u.locks[name]
+	if !ok {
+		lock = &corpusLock{}
+		u.locks[name] = lock
+	}
+	lock.users++
+	u.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		u.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(u.locks, name)
+		}
+		u.Unlock()
+	}
+}
+
+// NewUploads creates the corpora directory of the build directory
+func NewUploads(dir string) (*Uploads, error) {
+	dir = filepath.Join(dir, CorporaDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Uploads{Dir: dir}, nil
+}
+
+// Stat returns the upload of a corpus, it doesn't exist if nothing has been
+// uploaded
+func (u *Uploads) Stat(name string) (Upload, error) {
+	upload := Upload{Name: name}
+	info, err := os.Stat(filepath.Join(u.Dir, name))
+	if err == nil {
+		upload.Size, upload.Complete = info.Size(), true
+		return upload, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return upload, err
+	}
+	info, err = os.Stat(filepath.Join(u.Dir, name+PartSuffix))
+	if err != nil {
+		return upload, err
+	}
+	upload.Size = info.Size()
+	return upload, nil
+}
+
+// Documents returns the documents of complete corpora
+func (u *Uploads) Documents(names []string) ([]Document, error) {
+	documents := make([]Document, len(names))
+	for i, name := range names {
+		err := ValidFileName(name)
+		if err != nil {
+			return nil, err
+		}
+		upload, err := u.Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("corpus %s does not exist", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if !upload.Complete {
+			return nil, fmt.Errorf("the upload of corpus %s isn't complete", name)
+		}
+		documents[i] = Document{Path: CorporaDir + "/" + name, Title: name}
+	}
+	return documents, nil
+}
+
+// reply writes an upload as json
+func (u *Uploads) reply(response http.ResponseWriter, upload Upload) {
+	response.Header().Set("Upload-Offset", strconv.FormatInt(upload.Size, 10))
+	Reply(response, upload)
+}
+
+// List lists the uploaded corpora
+func (u *Uploads) List(response http.ResponseWriter, request *http.Request) {
+	if !Admin(response, request) {
+		return
+	}
+	entries, err := os.ReadDir(u.Dir)
+	if err != nil {
+		panic(err)
+	}
+	uploads, listed := []Upload{}, make(map[string]bool)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), PartSuffix)
+		upload, err := u.Stat(name)
+		if err != nil || listed[name] {
+			continue
+		}
+		uploads, listed[name] = append(uploads, upload), true
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Name < uploads[j].Name
+	})
+	Reply(response, uploads)
+}
+
+// name returns the valid corpus name of the request replying with a 400 if
+// it isn't valid
+func (u *Uploads) name(response http.ResponseWriter, request *http.Request) (string, bool) {
+	if !Admin(response, request) {
+		return "", false
+	}
+	name := request.PathValue("name")
+	err := ValidFileName(name)
+	if err != nil || strings.HasSuffix(name, PartSuffix) {
+		http.Error(response, fmt.Sprintf("invalid corpus name %q", name), http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+// Status reports the upload of a corpus, an interrupted upload resumes at its
+// size
+func (u *Uploads) Status(response http.ResponseWriter, request *http.Request) {
+	name, ok := u.name(response, request)
+	if !ok {
+		return
+	}
+	unlock := u.Corpus(name)
+	upload, err := u.Stat(name)
+	unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(response, fmt.Sprintf("corpus %s does not exist", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	u.reply(response, upload)
+}
+
+// Append appends the chunk in the body of the request to a corpus, the chunk
+// is at the offset query parameter which has to be the size uploaded so far
+// and complete=true ends the upload. The body is the chunk or a multipart
+// form with the chunk in its file field
+func (u *Uploads) Append(response http.ResponseWriter, request *http.Request) {
+	name, ok := u.name(response, request)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(request.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(response, "offset must be the number of bytes uploaded so far", http.StatusBadRequest)
+		return
+	}
+	complete := request.URL.Query().Get("complete") == "true"
+	request.Body = io.NopCloser(Limit(response, request))
+	chunk := io.Reader(request.Body)
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		reader, err := request.MultipartReader()
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for chunk = nil; chunk == nil; {
+			part, err := reader.NextPart()
+			if err != nil {
+				http.Error(response, "the multipart form has no file field", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "file" {
+				chunk = part
+			}
+		}
+	}
+
+	// one chunk of a corpus is appended at a time so the offsets of the
+	// chunks of an upload are checked against the size they are appended at
+	defer u.Corpus(name)()
+	upload, err := u.Stat(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		panic(err)
+	}
+	if upload.Complete {
+		http.Error(response, fmt.Sprintf("corpus %s is complete, delete it to upload it again", name), http.StatusConflict)
+		return
+	}
+	if offset != upload.Size {
+		response.Header().Set("Upload-Offset", strconv.FormatInt(upload.Size, 10))
+		http.Error(response, fmt.Sprintf("the upload of corpus %s is at byte %d, not %d", name, upload.Size, offset), http.StatusConflict)
+		return
+	}
+	part := filepath.Join(u.Dir, name+PartSuffix)
+	file, err := os.OpenFile(part, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		panic(err)
+	}
+	// the bytes of an interrupted chunk that were written are kept, the
+	// upload resumes after them
+	n, err := io.Copy(file, io.LimitReader(chunk, *FlagCorpusMax-upload.Size+1))
+	upload.Size += n
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		http.Error(response, BodyError(err).Error(), http.StatusBadRequest)
+		return
+	}
+	if upload.Size > *FlagCorpusMax {
+		os.Remove(part)
+		http.Error(response, fmt.Sprintf("a corpus can be at most %d bytes", *FlagCorpusMax), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if complete {
+		err = os.Rename(part, filepath.Join(u.Dir, name))
+		if err != nil {
+			panic(err)
+		}
+		upload.Complete = true
+	}
+	u.reply(response, upload)
+}
+
+// Delete deletes a corpus or its incomplete upload
+func (u *Uploads) Delete(response http.ResponseWriter, request *http.Request) {
+	name, ok := u.name(response, request)
+	if !ok {
+		return
+	}
+	defer u.Corpus(name)()
+	found := false
+	for _, path := range []string{name, name + PartSuffix} {
+		err := os.Remove(filepath.Join(u.Dir, path))
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			panic(err)
+		}
+	}
+	if !found {
+		http.Error(response, fmt.Sprintf("corpus %s does not exist", name), http.StatusNotFound)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,246 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is a document in the corpus
+type Document struct {
+	Path  string `json:"path"`
+	Title string `json:"title"`
+	// Version orders the documents with the same title, the highest is the
+	// latest and supersedes the others
+	Version int `json:"version,omitempty"`
+}
+
+// Genesis is the first document of the corpus
+var Genesis = Document{Path: "books/10.txt.utf-8.bz2", Title: "The King James Version of the Bible"}
+
+// Corpus returns every document that can be part of the corpus, the index of
+// a document is its document id
+func Corpus() []Document {
+	return append([]Document{Genesis}, Moar...)
+}
+
+// Documents returns the documents in the corpus being used
+func Documents() []Document {
+	if *FlagMoar {
+		return Corpus()
+	}
+	return []Document{Genesis}
+}
+
+// LoadCorpus loads documents returning the concatenated redacted and
+// preprocessed data and the byte offset where each document starts
+func LoadCorpus(documents []Document, redaction Redaction, pipeline Pipeline) ([]byte, []uint64) {
+	var input []byte
+	var starts []uint64
+	for _, document := range documents {
+		starts = append(starts, uint64(len(input)))
+		input = append(input, pipeline.Apply(redaction.Apply(LoadDocument(document)))...)
+	}
+	return input, starts
+}
+
+// LoadDocument loads a document
+func LoadDocument(document Document) []byte {
+	file, err := OpenDocument(document)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// FindDocuments finds the ids of the documents with a title or path
+// containing name, or the document with the id name
+func FindDocuments(name string) ([]uint64, error) {
+	corpus := Corpus()
+	if id, err := strconv.ParseUint(name, 10, 64); err == nil {
+		if id >= uint64(len(corpus)) {
+			return nil, fmt.Errorf("document %d does not exist", id)
+		}
+		return []uint64{id}, nil
+	}
+	var ids []uint64
+	lower := strings.ToLower(name)
+	for id, document := range corpus {
+		if strings.Contains(strings.ToLower(document.Title), lower) ||
+			strings.Contains(strings.ToLower(document.Path), lower) {
+			ids = append(ids, uint64(id))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no document matches %s", name)
+	}
+	return ids, nil
+}
+
+// Continuation parses doc:offset and returns the document content before the
+// byte offset and the content that follows it
+func Continuation(spec string) ([]byte, []byte, error) {
+	colon := strings.LastIndex(spec, ":")
+	if colon < 0 {
+		return nil, nil, fmt.Errorf("continuation %s should be doc:offset", spec)
+	}
+	name, position := spec[:colon], spec[colon+1:]
+	offset, err := strconv.ParseUint(position, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid continuation offset %s", position)
+	}
+	ids, err := FindDocuments(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ids) > 1 {
+		return nil, nil, fmt.Errorf("%s matches %d documents", name, len(ids))
+	}
+	data := LoadDocument(Corpus()[ids[0]])
+	if offset > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("offset %d is past the end of %s which has %d bytes", offset, name, len(data))
+	}
+	return data[:offset], data[offset:], nil
+}
+
+// DocumentOf returns the document id of a byte offset given the document starts
+func DocumentOf(starts []uint64, offset uint64) uint64 {
+	return uint64(sort.Search(len(starts), func(i int) bool {
+		return starts[i] > offset
+	}) - 1)
+}
+
+// Filter restricts candidates to documents and ranges of the corpus
+type Filter struct {
+	Documents map[uint64]bool
+	Ranges    [][2]uint64
+	// Excluded are documents that are rejected even if they are allowed
+	Excluded map[uint64]bool `json:",omitempty"`
+}
+
+// NewFilter parses a filter from document ids, document titles or paths, and
+// corpus index ranges of the form start-end
+func NewFilter(specs []string) (*Filter, error) {
+	filter := Filter{Documents: make(map[uint64]bool)}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if start, end, found := strings.Cut(spec, "-"); found {
+			a, errA := strconv.ParseUint(start, 10, 64)
+			b, errB := strconv.ParseUint(end, 10, 64)
+			if errA == nil && errB == nil {
+				if b <= a {
+					return nil, fmt.Errorf("empty corpus range %s", spec)
+				}
+				filter.Ranges = append(filter.Ranges, [2]uint64{a, b})
+				continue
+			}
+		}
+		ids, err := FindDocuments(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			filter.Documents[id] = true
+		}
+	}
+	if len(filter.Documents) == 0 && len(filter.Ranges) == 0 {
+		return nil, nil
+	}
+	return &filter, nil
+}
+
+// Weights are multipliers of the softmax mass of the candidates from each
+// document, the log of the weight is added to the scores so a weight above 1
+// favors the candidates of a document whatever the sign of their scores, and
+// the candidates of documents with weight 0 are skipped
+type Weights map[uint64]float32
+
+// NewWeights parses weights of the form name=weight where name is a document
+// id, title, or path
+func NewWeights(specs []string) (Weights, error) {
+	weights := make(Weights)
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		equals := strings.LastIndex(spec, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("weight %s should be name=weight", spec)
+		}
+		name, value := spec[:equals], spec[equals+1:]
+		weight, err := strconv.ParseFloat(value, 32)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %s", value)
+		}
+		ids, err := FindDocuments(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			weights[id] = float32(weight)
+		}
+	}
+	if len(weights) == 0 {
+		return nil, nil
+	}
+	return weights, nil
+}
+
+// Weight returns the weight of a document, documents without a weight have
+// weight 1
+func (w Weights) Weight(document uint64) float32 {
+	if weight, ok := w[document]; ok {
+		return weight
+	}
+	return 1
+}
+
+// Quota keeps at most quota of the sorted candidates from each document, so
+// the candidates of big documents don't crowd out the others
+func Quota(candidates []Candidate, quota int) []Candidate {
+	counts, kept := make(map[uint64]int), candidates[:0]
+	for _, candidate := range candidates {
+		if counts[candidate.Document] < quota {
+			counts[candidate.Document]++
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+// Allow returns true if an entry from document at corpus index passes the filter
+func (f *Filter) Allow(document, index uint64) bool {
+	if f == nil {
+		return true
+	}
+	if f.Excluded[document] {
+		return false
+	}
+	if len(f.Documents) == 0 && len(f.Ranges) == 0 {
+		return true
+	}
+	if f.Documents[document] {
+		return true
+	}
+	for _, r := range f.Ranges {
+		if index >= r[0] && index < r[1] {
+			return true
+		}
+	}
+	return false
+}
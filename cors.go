@@ -0,0 +1,168 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// FlagCORSOrigins are the origins of the browser clients allowed to call the api
+	FlagCORSOrigins = flag.String("cors-origins", "", "comma separated origins such as https://example.com allowed to call the api from a browser, * allows any origin, empty disables cors")
+	// FlagCORSMethods are the methods browser clients are allowed to use
+	FlagCORSMethods = flag.String("cors-methods", "GET,POST", "comma separated methods browser clients are allowed to use")
+	// FlagCORSMaxAge is how long browsers cache a preflight response
+	FlagCORSMaxAge = flag.Duration("cors-max-age", 10*time.Minute, "how long browsers cache a preflight response")
+)
+
+// CORSHeaders are the request headers browser clients are allowed to send
+const CORSHeaders = "Content-Type, Authorization, X-API-Key"
+
+// CORS allows browser clients from other origins to call the api
+type CORS struct {
+	// Any allows every origin
+	Any     bool
+	Origins map[string]bool
+	Methods []string
+	MaxAge  time.Duration
+}
+
+// NewCORS parses the comma separated origins and methods
+func NewCORS(origins, methods string, maxAge time.Duration) (*CORS, error) {
+	c := CORS{
+		Origins: make(map[string]bool),
+		MaxAge:  maxAge,
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			c.Any = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("the cors origin %q should be * or a scheme and host such as https://example.com", origin)
+		}
+		c.Origins[u.Scheme+"://"+u.Host] = true
+	}
+	for _, method := range strings.Split(methods, ",") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			return nil, fmt.Errorf("the cors methods %q have an empty method", methods)
+		}
+		c.Methods = append(c.Methods, method)
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("the cors max age %s is negative", maxAge)
+	}
+	return &c, nil
+}
+
+// Allowed is true if requests from origin are allowed
+func (c *CORS) Allowed(origin string) bool {
+	return c.Any || c.Origins[origin]
+}
+
+// Allows is true if browser clients can use method
+func (c *CORS) Allows(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap adds the cors headers to the responses of next and answers preflight
+// and OPTIONS requests
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		header := response.Header()
+		header.Add("Vary", "Origin")
+		origin := request.Header.Get("Origin")
+		allowed := origin != "" && c.Allowed(origin)
+		if allowed {
+			if c.Any {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+			header.Set("Access-Control-Expose-Headers", "Retry-After")
+		}
+		if request.Method != http.MethodOptions {
+			next.ServeHTTP(response, request)
+			return
+		}
+		method := request.Header.Get("Access-Control-Request-Method")
+		if method == "" {
+			header.Set("Allow", strings.Join(append(c.Methods, http.MethodOptions), ", "))
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !allowed {
+			http.Error(response, fmt.Sprintf("the origin %q is not allowed", origin), http.StatusForbidden)
+			return
+		}
+		if !c.Allows(method) {
+			http.Error(response, fmt.Sprintf("the method %s is not allowed", method), http.StatusForbidden)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+		header.Set("Access-Control-Allow-Headers", CORSHeaders)
+		header.Set("Access-Control-Max-Age", fmt.Sprint(int(c.MaxAge.Seconds())))
+		response.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ContentTypes are the media types accepted in request bodies by path, the
+// types of a path ending in / are accepted by the paths under it and the
+// other paths accept json. /infer takes any other body as a plain text query
+// like curl -d sends
+var ContentTypes = map[string][]string{
+	"/infer":             {"application/json", "text/plain", "application/x-www-form-urlencoded"},
+	"/v1/admin/corpora/": {"application/octet-stream", "text/plain", "multipart/form-data"},
+}
+
+// CheckContentType rejects request bodies that aren't of an accepted media
+// type, a body of /infer without a content type is a plain text query
+func CheckContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost && request.Method != http.MethodPut && request.Method != http.MethodPatch ||
+			request.ContentLength == 0 {
+			next.ServeHTTP(response, request)
+			return
+		}
+		accepted, ok := ContentTypes[request.URL.Path]
+		for path, types := range ContentTypes {
+			if !ok && strings.HasSuffix(path, "/") && strings.HasPrefix(request.URL.Path, path) {
+				accepted, ok = types, true
+			}
+		}
+		if !ok {
+			accepted = []string{"application/json"}
+		}
+		contentType := request.Header.Get("Content-Type")
+		if contentType == "" && request.URL.Path == "/infer" {
+			next.ServeHTTP(response, request)
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			for _, a := range accepted {
+				if mediaType == a {
+					next.ServeHTTP(response, request)
+					return
+				}
+			}
+		}
+		http.Error(response, fmt.Sprintf("the content type should be %s", strings.Join(accepted, " or ")), http.StatusUnsupportedMediaType)
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// MixerTemplate renders a mixer snapshot
+var MixerTemplate = template.Must(template.New("mixer").Parse(`<!DOCTYPE html>
+<html>
+ <head>
+  <meta charset="UTF-8">
+  <title>Soda Mixer</title>
+ </head>
+ <body>
+  <form method="GET">
+   <textarea name="query" rows="4" cols="80">{{.Query}}</textarea><br/>
+   <input type="submit"/>
+  </form>
+  <h3>markov</h3>
+  <pre>{{printf "%q" .Snapshot.Markov}}</pre>
+  {{range .Snapshot.Histograms}}
+  <h3>window {{.Size}}</h3>
+  <pre>{{printf "%q" .Window}}</pre>
+  <table>
+   {{range .Counts}}
+   <tr>
+    <td>{{printf "%q" .S}}</td>
+    <td>{{.Count}}</td>
+    <td><div style="background: steelblue; height: 1em; width: {{.Count}}em;"></div></td>
+   </tr>
+   {{end}}
+  </table>
+  {{end}}
+ </body>
+</html>
+`))
+
+// DebugMixer visualizes the mixer state after feeding it the query
+func DebugMixer(response http.ResponseWriter, request *http.Request) {
+	query := request.FormValue("query")
+	m := NewHistogramMixer()
+	for _, v := range []byte(query) {
+		m.Add(v)
+	}
+	snapshot := m.Snapshot()
+	if request.FormValue("format") == "json" {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			panic(err)
+		}
+		response.Header().Set("Content-Type", "application/json; charset=utf-8")
+		response.Write(data)
+		return
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := MixerTemplate.Execute(response, struct {
+		Query    string
+		Snapshot MixerSnapshot
+	}{
+		Query:    query,
+		Snapshot: snapshot,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
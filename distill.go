@@ -0,0 +1,424 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// Distillation records the database a distilled database was made from
+type Distillation struct {
+	// Entries is the number of entries of the original database
+	Entries uint64 `json:"entries"`
+	// Target is the size in bytes the database was distilled to
+	Target int64 `json:"target"`
+}
+
+// DistillIterations is the number of iterations of each 2-means split
+const DistillIterations = 4
+
+// ParseSize parses a size in bytes with an optional KB, MB, GB, or TB suffix
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		Suffix string
+		Scale  float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	number, scale := strings.ToUpper(strings.TrimSpace(s)), 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.Suffix) {
+			number, scale = strings.TrimSpace(strings.TrimSuffix(number, unit.Suffix)), unit.Scale
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || !(value > 0) {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return int64(value * scale), nil
+}
+
+// Allocate divides budget entries among groups of sizes entries in proportion
+// to their sizes, every non empty group keeps at least one entry and no group
+// keeps more than it has, false is returned if the budget is too small for
+// that
+func Allocate(sizes []uint64, budget uint64) ([]uint64, bool) {
+	kept := make([]uint64, len(sizes))
+	keep := func(ratio float64) uint64 {
+		total := uint64(0)
+		for i, size := range sizes {
+			k := uint64(float64(size)*ratio + .5)
+			if k < 1 {
+				k = 1
+			}
+			if k > size {
+				k = size
+			}
+			kept[i] = k
+			total += k
+		}
+		return total
+	}
+	if keep(0) > budget {
+		return nil, false
+	}
+	low, high := 0.0, 1.0
+	for i := 0; i < 64; i++ {
+		if ratio := (low + high) / 2; keep(ratio) <= budget {
+			low = ratio
+		} else {
+			high = ratio
+		}
+	}
+	keep(low)
+	return kept, true
+}
+
+// Centroid is the unit mean of the vectors of the members
+func Centroid(vectors [][]float32, members []int) []float32 {
+	centroid := make([]float32, len(vectors[members[0]]))
+	for _, member := range members {
+		for i, v := range vectors[member] {
+			centroid[i] += v
+		}
+	}
+	unit(centroid, centroid)
+	return centroid
+}
+
+// Bisect clusters the unit vectors into k clusters by splitting the largest
+// cluster in two with spherical 2-means until there are k, it returns the
+// members of each cluster
+func Bisect(vectors [][]float32, k int, rng *rand.Rand) [][]int {
+	all := make([]int, len(vectors))
+	for i := range all {
+		all[i] = i
+	}
+	clusters := [][]int{all}
+	if k > len(vectors) {
+		k = len(vectors)
+	}
+	for len(clusters) < k {
+		largest := 0
+		for i := range clusters {
+			if len(clusters[i]) > len(clusters[largest]) {
+				largest = i
+			}
+		}
+		members := clusters[largest]
+		// the seeds are a random member and the member least similar to it
+		a := vectors[members[rng.Intn(len(members))]]
+		b, min := a, float32(2)
+		for _, member := range members {
+			if cs := CS(a, vectors[member]); cs < min {
+				b, min = vectors[member], cs
+			}
+		}
+		var left, right []int
+		for i := 0; i < DistillIterations; i++ {
+			left, right = left[:0], right[:0]
+			for _, member := range members {
+				if CS(a, vectors[member]) >= CS(b, vectors[member]) {
+					left = append(left, member)
+				} else {
+					right = append(right, member)
+				}
+			}
+			if len(left) == 0 || len(right) == 0 {
+				break
+			}
+			a, b = Centroid(vectors, left), Centroid(vectors, right)
+		}
+		if len(left) == 0 || len(right) == 0 {
+			// the members are identical so they are split arbitrarily
+			left, right = members[:len(members)/2], members[len(members)/2:]
+		}
+		clusters[largest] = append([]int(nil), left...)
+		clusters = append(clusters, append([]int(nil), right...))
+	}
+	return clusters
+}
+
+// ReadCounts reads the number of original entries each entry of a distilled
+// database represents, they follow the metadata, nil is returned for
+// databases that aren't distilled
+func ReadCounts(db io.ReaderAt, sizes, sums []uint64, settings Settings, metadata *Metadata) ([]uint32, error) {
+	if metadata == nil || metadata.Distilled == nil {
+		return nil, nil
+	}
+	offset, err := MetadataEnd(db, sizes, sums, settings)
+	if err != nil {
+		return nil, err
+	}
+	entries := uint64(0)
+	for _, size := range sizes {
+		entries += size
+	}
+	buffer := make([]byte, 4*entries)
+	n, err := db.ReadAt(buffer, offset)
+	if n != len(buffer) {
+		return nil, fmt.Errorf("the counts of the distilled entries should be %d bytes: %v", len(buffer), err)
+	}
+	counts := make([]uint32, entries)
+	for i := range counts {
+		counts[i] = binaryvec.Order.Uint32(buffer[4*i:])
+	}
+	return counts, nil
+}
+
+// WriteCounts writes the counts of the entries of a distilled database
+func WriteCounts(out io.Writer, counts []uint32) error {
+	buffer := make([]byte, 0, 4*len(counts))
+	for _, count := range counts {
+		buffer = binaryvec.Order.AppendUint32(buffer, count)
+	}
+	_, err := out.Write(buffer)
+	return err
+}
+
+// Distill writes a database at path of at most target bytes whose entries
+// are the centroids of clusters of the entries of each symbol of each bucket,
+// it returns the mean cosine of the original entries to their centroids
+func (m *Model) Distill(path string, target int64) (float64, error) {
+	if m.Shards != nil {
+		return 0, fmt.Errorf("a coordinator can't be distilled")
+	}
+	entries := m.Entries()
+	metadata := Metadata{}
+	if m.Metadata != nil {
+		metadata = *m.Metadata
+	}
+	metadata.Encoding, metadata.Created = binaryvec.Version, time.Now().UTC()
+	// the distilled entries are sorted by symbol without sub-clusters
+	metadata.Settings.Subclusters, metadata.Settings.SubclusterMin = 0, 0
+	metadata.Distilled = &Distillation{
+		Entries: entries,
+		Target:  target,
+	}
+	if m.Metadata != nil && m.Metadata.Distilled != nil {
+		metadata.Distilled.Entries = m.Metadata.Distilled.Entries
+	}
+	// the metadata is assumed to keep its size, the entry count can only add
+	// a few digits
+	var encoded strings.Builder
+	metadata.Write(&encoded)
+	fixed := int64(Offset) + int64(len(m.Header))*256*8 + m.ProjectionSize() + int64(encoded.Len()) + 32
+	if m.Transform {
+		fixed += TransformSize
+	}
+	entrySize := int64(m.EntrySize()) + 4
+	if target <= fixed {
+		return 0, fmt.Errorf("the target should be larger than the %d bytes of the header and metadata", fixed)
+	}
+	budget := uint64((target - fixed) / entrySize)
+	if budget >= entries {
+		return 0, fmt.Errorf("the database has %d entries which already fit in %d bytes", entries, target)
+	}
+
+	// the entries of a bucket are sorted by symbol, each symbol of each
+	// bucket is a group that is clustered on its own
+	groups := make([]uint64, 0, len(m.Header))
+	for i := range m.Header {
+		symbols := m.Header[i].Symbols
+		total := uint64(0)
+		for _, count := range symbols {
+			total += count
+		}
+		if total != m.Sizes[i] {
+			return 0, fmt.Errorf("%s has no symbol index", m.Path)
+		}
+		groups = append(groups, symbols[:]...)
+	}
+	kept, ok := Allocate(groups, budget)
+	if !ok {
+		return 0, fmt.Errorf("the target is too small to keep an entry for each symbol of each bucket")
+	}
+
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	db := bufio.NewWriter(file)
+	writer := binaryvec.NewWriter(db)
+	metadata.Entries = 0
+	for i := range m.Header {
+		size := uint64(0)
+		for _, k := range kept[256*i : 256*(i+1)] {
+			size += k
+		}
+		metadata.Entries += size
+		err := writer.WriteRecord(&binaryvec.Bucket{
+			Vector: m.Header[i].Vector,
+			Count:  size,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	width, rng := m.Width(), rand.New(rand.NewSource(1))
+	counts, similarity := make([]uint32, 0, metadata.Entries), 0.0
+	progress := NewProgress("distill", len(m.Header))
+	for i := range m.Header {
+		progress.Update(i, "")
+		if m.Sizes[i] == 0 {
+			continue
+		}
+		block, err := m.Store.Entries(i, 0, m.Sizes[i])
+		if err != nil {
+			return 0, err
+		}
+		// the entries of a sub-clustered bucket aren't sorted by symbol, so
+		// the entries of each symbol are gathered first
+		var bySymbol [256][]int
+		for j := 0; j < block.Len; j++ {
+			bySymbol[block.Symbol(j)] = append(bySymbol[block.Symbol(j)], j)
+		}
+		var distilled []binaryvec.Entry
+		for symbol, indexes := range bySymbol {
+			if len(indexes) == 0 {
+				continue
+			}
+			vectors := make([][]float32, len(indexes))
+			for j := range vectors {
+				vectors[j] = make([]float32, width)
+				block.Vector(indexes[j], vectors[j])
+			}
+			for _, members := range Bisect(vectors, int(kept[256*i+symbol]), rng) {
+				centroid, best, max := Centroid(vectors, members), members[0], float32(-2)
+				for _, member := range members {
+					cs := CS(centroid, vectors[member])
+					similarity += float64(cs)
+					if cs > max {
+						best, max = member, cs
+					}
+				}
+				// the member nearest the centroid represents the cluster
+				entry := block.Entry(indexes[best])
+				entry.Vector = centroid
+				copy(entry.Signature[:], NewSignature(centroid, m.Header[i].Vector[:width]).Bytes())
+				distilled = append(distilled, entry)
+				count := uint32(len(members))
+				if m.Counts != nil {
+					count = 0
+					for _, member := range members {
+						count += m.Counts[m.Sums[i]+uint64(indexes[member])]
+					}
+				}
+				counts = append(counts, count)
+			}
+		}
+		_, err = db.Write(binaryvec.AppendBlock(nil, distilled))
+		if err != nil {
+			return 0, err
+		}
+	}
+	progress.Done()
+
+	for i := range m.Header {
+		for symbol := range m.Header[i].Symbols {
+			err := writer.WriteUint64(kept[256*i+symbol])
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	m.Projection.Write(db)
+	metadata.Write(db)
+	err = WriteCounts(db, counts)
+	if err != nil {
+		return 0, err
+	}
+	err = m.WriteEmbedded(db)
+	if err != nil {
+		return 0, err
+	}
+	err = m.WriteTransform(db)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Flush()
+	if err != nil {
+		return 0, err
+	}
+	err = file.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return similarity / float64(entries), nil
+}
+
+// DistillCommand distills the database given by -db to a target size and
+// compares the recall of the two databases
+func DistillCommand(args []string) {
+	set := flag.NewFlagSet("distill", flag.ContinueOnError)
+	targetSize := set.String("target", "", "size of the distilled database, such as 512MB")
+	out := set.String("o", "", "path of the distilled database, the database path with .distilled by default")
+	if err := set.Parse(args); err != nil {
+		return
+	}
+	if *targetSize == "" || set.NArg() != 0 {
+		fmt.Println("usage: -db <db> distill -target <size> [-o <distilled db>]")
+		return
+	}
+	target, err := ParseSize(*targetSize)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	path := *out
+	if path == "" {
+		path = strings.TrimSuffix(*FlagDB, ".bin") + ".distilled.bin"
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	similarity, err := model.Distill(path, target)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", path)
+	fmt.Printf("mean cosine of the entries to their centroids %.4f\n", similarity)
+	if corpus, err := os.Open(CorpusPath(*FlagDB)); err == nil {
+		info, err := corpus.Stat()
+		if err == nil {
+			err = CopyRanges(CorpusPath(path), corpus, [][2]int64{{0, info.Size()}})
+		}
+		corpus.Close()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	samples, err := model.SampleQueries()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	distilled, err := LoadModel(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer distilled.Close()
+	for _, m := range []*Model{model, distilled} {
+		fmt.Println(m.Path, m.Eval(samples))
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagEmbedCorpus embeds the compressed corpus in a built database
+var FlagEmbedCorpus = flag.Bool("embed-corpus", false, "embed the zstd compressed corpus in the database with an index of its members, so the database serves context and attribution without the corpus file")
+
+// ZstdMagic starts a zstd frame, the members of the corpus sections of older
+// databases are gzip members
+var ZstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// CorpusDecoder decodes the zstd frames of embedded corpora, it is made on
+// first use
+var CorpusDecoder = sync.OnceValue(func() *zstd.Decoder {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return decoder
+})
+
+// Embed writes the zstd frames of the compressed corpus as the corpus section
+// of a database, the number of members, the rune and offset of each member,
+// the number of runes, the compressed size, and the frames
+func (c *CorpusWriter) Embed(out io.Writer) error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	if c.frames == nil {
+		return fmt.Errorf("the corpus wasn't created to be embedded")
+	}
+	writer := binaryvec.NewWriter(out)
+	values := []uint64{uint64(len(c.Index))}
+	for i, member := range c.Index {
+		values = append(values, member.Rune, c.Frames[i])
+	}
+	values = append(values, c.Runes, c.FramesSize)
+	for _, value := range values {
+		err := writer.WriteUint64(value)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(out, io.NewSectionReader(c.frames, 0, int64(c.FramesSize)))
+	return err
+}
+
+// EmbeddedCorpus is the corpus section of a database
+type EmbeddedCorpus struct {
+	Index []CorpusMember
+	Runes uint64
+	// Data are the compressed members
+	Data *io.SectionReader
+	// Offset and Length are the offset and size of the section
+	Offset, Length int64
+}
+
+// ReadEmbeddedCorpus reads the index of the corpus section at offset
+func ReadEmbeddedCorpus(db io.ReaderAt, offset int64) (*EmbeddedCorpus, error) {
+	read := func(values []uint64, at int64) error {
+		buffer := make([]byte, 8*len(values))
+		n, err := db.ReadAt(buffer, at)
+		if n != len(buffer) {
+			return fmt.Errorf("the corpus section is truncated: %v", err)
+		}
+		for i := range values {
+			values[i] = binaryvec.Order.Uint64(buffer[8*i:])
+		}
+		return nil
+	}
+	count := make([]uint64, 1)
+	err := read(count, offset)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]uint64, 2*count[0]+2)
+	err = read(values, offset+8)
+	if err != nil {
+		return nil, err
+	}
+	e := EmbeddedCorpus{
+		Index:  make([]CorpusMember, count[0]),
+		Runes:  values[2*count[0]],
+		Offset: offset,
+	}
+	for i := range e.Index {
+		e.Index[i] = CorpusMember{
+			Rune:   values[2*i],
+			Offset: values[2*i+1],
+		}
+	}
+	size, start := int64(values[2*count[0]+1]), offset+8+8*int64(len(values))
+	e.Data, e.Length = io.NewSectionReader(db, start, size), start+size-offset
+	return &e, nil
+}
+
+// Slice decompresses the runes [start, end) of the corpus, only the members
+// that hold them are decompressed
+func (e *EmbeddedCorpus) Slice(start, end uint64) ([]rune, error) {
+	if end > e.Runes {
+		end = e.Runes
+	}
+	if start >= end {
+		return nil, nil
+	}
+	i := sort.Search(len(e.Index), func(i int) bool {
+		return e.Index[i].Rune > start
+	}) - 1
+	first, data := e.Index[i].Rune, []byte{}
+	for ; i < len(e.Index) && e.Index[i].Rune < end; i++ {
+		next := uint64(e.Data.Size())
+		if i+1 < len(e.Index) {
+			next = e.Index[i+1].Offset
+		}
+		compressed := make([]byte, next-e.Index[i].Offset)
+		n, err := e.Data.ReadAt(compressed, int64(e.Index[i].Offset))
+		if n != len(compressed) {
+			return nil, fmt.Errorf("the corpus section is truncated: %v", err)
+		}
+		member, err := Decompress(compressed)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, member...)
+	}
+	runes := []rune(string(data))
+	return runes[start-first : end-first], nil
+}
+
+// Decompress decompresses a member of an embedded corpus, a zstd frame or
+// the gzip member of an older database
+func Decompress(compressed []byte) ([]byte, error) {
+	if bytes.HasPrefix(compressed, ZstdMagic) {
+		return CorpusDecoder().DecodeAll(compressed, nil)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	reader.Multistream(false)
+	return io.ReadAll(reader)
+}
+
+// Embedded returns the corpus section of a database built with an embedded
+// corpus, its index is read on first use
+func (m *Model) Embedded() (*EmbeddedCorpus, error) {
+	m.embedded.Do(func() {
+		if !m.EmbedCorpus {
+			m.embedded.Err = fmt.Errorf("%s has no embedded corpus", m.Path)
+			return
+		}
+		offset, err := MetadataEnd(m.DB, m.FileSizes, m.FileSums, m.Settings)
+		if err != nil {
+			m.embedded.Err = err
+			return
+		}
+		m.embedded.Corpus, m.embedded.Err = ReadEmbeddedCorpus(m.DB, offset+4*int64(len(m.Counts)))
+	})
+	return m.embedded.Corpus, m.embedded.Err
+}
+
+// WriteEmbedded copies the corpus section of a database built with an
+// embedded corpus to out, it does nothing for other databases
+func (m *Model) WriteEmbedded(out io.Writer) error {
+	if !m.EmbedCorpus {
+		return nil
+	}
+	embedded, err := m.Embedded()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(m.DB, embedded.Offset, embedded.Length))
+	return err
+}
+
+// Snippet returns the runes of the corpus within n runes of index, only the
+// members of an embedded corpus around index are decompressed
+func (m *Model) Snippet(index uint64, n int) (string, error) {
+	if !m.EmbedCorpus {
+		corpus, err := m.Corpus()
+		return Snippet(corpus, index, n), err
+	}
+	embedded, err := m.Embedded()
+	if err != nil {
+		return "", err
+	}
+	start := uint64(0)
+	if index > uint64(n) {
+		start = index - uint64(n)
+	}
+	runes, err := embedded.Slice(start, index+uint64(n)+1)
+	return string(runes), err
+}
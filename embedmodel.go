@@ -0,0 +1,26 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build embedmodel
+// +build embedmodel
+
+// Build a server with a prebuilt database compiled in with:
+//
+//	mkdir -p embedded
+//	go run . build -embed-corpus -db embedded/db.bin
+//	go build -tags embedmodel -o soda
+//
+// and run it with soda serve, the database is the default -db
+
+package main
+
+import _ "embed"
+
+//go:embed embedded/db.bin
+var embeddedModel []byte
+
+func init() {
+	EmbeddedModel = embeddedModel
+	*FlagDB = EmbeddedDB
+}
@@ -0,0 +1,350 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package binaryvec encodes the vectors and records of the soda files with an
+// explicit byte order, so files are portable between machines
+package binaryvec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Version is the version of the record layouts, it changes whenever a layout
+// changes, version 2 added entries narrower than Width and version 3 stores
+// the entries of a bucket as a Block
+const Version = 3
+
+// Interleaved is the last version that stores the entries of a bucket as
+// consecutive Entry records
+const Interleaved = 2
+
+// Order is the byte order of every soda file
+var Order = binary.LittleEndian
+
+const (
+	// Width is the width of the vectors of the database
+	Width = 256
+	// RankWidth is the width of the vectors of the rank database
+	RankWidth = 8
+	// SignatureSize is the size of an entry signature in bytes
+	SignatureSize = 32
+	// BucketSize is the size of a bucket record
+	BucketSize = 4*Width + 8
+	// EntryTail is the size of the fields of an entry record after its vector
+	EntryTail = 1 + 8 + 8 + 4 + SignatureSize
+	// EntrySize is the size of an entry record with a Width vector
+	EntrySize = 4*Width + EntryTail
+	// RankEntrySize is the size of a rank entry record
+	RankEntrySize = 4*RankWidth + 1 + 8
+)
+
+// AppendFloat32s appends the encoding of values to data
+func AppendFloat32s(data []byte, values []float32) []byte {
+	for _, v := range values {
+		data = Order.AppendUint32(data, math.Float32bits(v))
+	}
+	return data
+}
+
+// Float32s decodes len(values) floats from data into values
+func Float32s(values []float32, data []byte) {
+	for i := range values {
+		values[i] = math.Float32frombits(Order.Uint32(data[4*i:]))
+	}
+}
+
+// Bucket is the record of a bucket of the database header
+type Bucket struct {
+	Vector [Width]float32
+	Count  uint64
+}
+
+// Append appends the encoding of the bucket to data
+func (b *Bucket) Append(data []byte) []byte {
+	data = AppendFloat32s(data, b.Vector[:])
+	return Order.AppendUint64(data, b.Count)
+}
+
+// Decode decodes a bucket from data
+func (b *Bucket) Decode(data []byte) {
+	Float32s(b.Vector[:], data)
+	b.Count = Order.Uint64(data[4*Width:])
+}
+
+// EntrySizeOf is the size of an entry record with a width vector
+func EntrySizeOf(width int) int {
+	return 4*width + EntryTail
+}
+
+// Entry is the record of an entry of the database, the width of the vector is
+// that of the database
+type Entry struct {
+	Vector    []float32
+	Symbol    byte
+	Index     uint64
+	Document  uint64
+	Entropy   float32
+	Signature [SignatureSize]byte
+}
+
+// the offsets of the fields of an entry record from the end of its vector
+const (
+	entrySymbol    = 0
+	entryIndex     = entrySymbol + 1
+	entryDocument  = entryIndex + 8
+	entryEntropy   = entryDocument + 8
+	entrySignature = entryEntropy + 4
+)
+
+// tail returns the fields of an encoded entry after its vector
+func tail(data []byte) []byte {
+	return data[len(data)-EntryTail:]
+}
+
+// Append appends the encoding of the entry to data
+func (e *Entry) Append(data []byte) []byte {
+	data = AppendFloat32s(data, e.Vector[:])
+	data = append(data, e.Symbol)
+	data = Order.AppendUint64(data, e.Index)
+	data = Order.AppendUint64(data, e.Document)
+	data = Order.AppendUint32(data, math.Float32bits(e.Entropy))
+	return append(data, e.Signature[:]...)
+}
+
+// Decode decodes an entry from data, which must be exactly one record
+func (e *Entry) Decode(data []byte) {
+	e.Vector = make([]float32, (len(data)-EntryTail)/4)
+	Float32s(e.Vector, data)
+	e.Symbol = EntrySymbol(data)
+	e.Index, e.Document = EntryIndex(data), EntryDocument(data)
+	e.Entropy = EntryEntropy(data)
+	copy(e.Signature[:], EntrySignature(data))
+}
+
+// EntrySymbol decodes only the symbol of an encoded entry, the accessors
+// take exactly one record
+func EntrySymbol(data []byte) byte {
+	return tail(data)[entrySymbol]
+}
+
+// EntryIndex decodes only the rune index of an encoded entry
+func EntryIndex(data []byte) uint64 {
+	return Order.Uint64(tail(data)[entryIndex:])
+}
+
+// EntryDocument decodes only the document of an encoded entry
+func EntryDocument(data []byte) uint64 {
+	return Order.Uint64(tail(data)[entryDocument:])
+}
+
+// EntryEntropy decodes only the context entropy of an encoded entry
+func EntryEntropy(data []byte) float32 {
+	return math.Float32frombits(Order.Uint32(tail(data)[entryEntropy:]))
+}
+
+// EntrySignature returns the signature bytes of an encoded entry
+func EntrySignature(data []byte) []byte {
+	return tail(data)[entrySignature : entrySignature+SignatureSize]
+}
+
+// Vector is a record of a vector alone
+type Vector []float32
+
+// Append appends the encoding of the vector to data
+func (v Vector) Append(data []byte) []byte {
+	return AppendFloat32s(data, v)
+}
+
+// Fields are the fields after the vectors of a block of entries, the vectors
+// of the entries are ignored
+type Fields []Entry
+
+// Append appends the symbols, indexes, documents, entropies, and signatures
+// of the entries to data in that order
+func (f Fields) Append(data []byte) []byte {
+	for i := range f {
+		data = append(data, f[i].Symbol)
+	}
+	for i := range f {
+		data = Order.AppendUint64(data, f[i].Index)
+	}
+	for i := range f {
+		data = Order.AppendUint64(data, f[i].Document)
+	}
+	for i := range f {
+		data = Order.AppendUint32(data, math.Float32bits(f[i].Entropy))
+	}
+	for i := range f {
+		data = append(data, f[i].Signature[:]...)
+	}
+	return data
+}
+
+// Columns are the sizes of the fields of an entry with a width vector in the
+// order the columns of a block are stored
+func Columns(width int) [6]int {
+	return [6]int{4 * width, 1, 8, 8, 4, SignatureSize}
+}
+
+// Block is the entries of a bucket stored as a structure of arrays, the
+// vectors of every entry are followed by every symbol, index, document,
+// entropy, and signature, so a scan reads each field sequentially. A block
+// is the same size as the entries stored as records and the entries [start,
+// end) of a block are a block themselves
+type Block struct {
+	Width int
+	Len   int
+	Data  []byte
+	// columns are the offsets of the columns in data
+	columns [6]int
+}
+
+// NewBlock makes a block of the encoded entries in data with width vectors
+func NewBlock(width int, data []byte) Block {
+	b := Block{
+		Width: width,
+		Len:   len(data) / EntrySizeOf(width),
+		Data:  data,
+	}
+	offset := 0
+	for i, size := range Columns(width) {
+		b.columns[i] = offset
+		offset += b.Len * size
+	}
+	return b
+}
+
+// AppendBlock appends the encoding of entries as a block to data, the
+// vectors of the entries are all the same width
+func AppendBlock(data []byte, entries []Entry) []byte {
+	for i := range entries {
+		data = AppendFloat32s(data, entries[i].Vector)
+	}
+	return Fields(entries).Append(data)
+}
+
+// Transpose converts the entry records in data to a block
+func Transpose(width int, data []byte) Block {
+	size := EntrySizeOf(width)
+	entries := make([]Entry, len(data)/size)
+	for i := range entries {
+		entries[i].Decode(data[i*size : (i+1)*size])
+	}
+	return NewBlock(width, AppendBlock(make([]byte, 0, len(data)), entries))
+}
+
+// Vectors are the encoded vectors of the entries, they are contiguous
+func (b Block) Vectors() []byte {
+	return b.Data[:b.columns[1]]
+}
+
+// Vector decodes the vector of entry i into vector
+func (b Block) Vector(i int, vector []float32) {
+	Float32s(vector, b.Data[4*b.Width*i:])
+}
+
+// Symbol decodes the symbol of entry i
+func (b Block) Symbol(i int) byte {
+	return b.Data[b.columns[1]+i]
+}
+
+// Index decodes the rune index of entry i
+func (b Block) Index(i int) uint64 {
+	return Order.Uint64(b.Data[b.columns[2]+8*i:])
+}
+
+// Document decodes the document of entry i
+func (b Block) Document(i int) uint64 {
+	return Order.Uint64(b.Data[b.columns[3]+8*i:])
+}
+
+// Entropy decodes the context entropy of entry i
+func (b Block) Entropy(i int) float32 {
+	return math.Float32frombits(Order.Uint32(b.Data[b.columns[4]+4*i:]))
+}
+
+// Signature returns the signature bytes of entry i
+func (b Block) Signature(i int) []byte {
+	offset := b.columns[5] + SignatureSize*i
+	return b.Data[offset : offset+SignatureSize]
+}
+
+// Entry decodes entry i
+func (b Block) Entry(i int) Entry {
+	e := Entry{
+		Vector:   make([]float32, b.Width),
+		Symbol:   b.Symbol(i),
+		Index:    b.Index(i),
+		Document: b.Document(i),
+		Entropy:  b.Entropy(i),
+	}
+	b.Vector(i, e.Vector)
+	copy(e.Signature[:], b.Signature(i))
+	return e
+}
+
+// RankEntry is the record of an entry of the rank database
+type RankEntry struct {
+	Vector [RankWidth]float32
+	Symbol byte
+	Index  uint64
+}
+
+// Append appends the encoding of the rank entry to data
+func (r *RankEntry) Append(data []byte) []byte {
+	data = AppendFloat32s(data, r.Vector[:])
+	data = append(data, r.Symbol)
+	return Order.AppendUint64(data, r.Index)
+}
+
+// Decode decodes a rank entry from data
+func (r *RankEntry) Decode(data []byte) {
+	Float32s(r.Vector[:], data)
+	r.Symbol = data[4*RankWidth]
+	r.Index = Order.Uint64(data[4*RankWidth+1:])
+}
+
+// Record is a record that can be appended to a buffer
+type Record interface {
+	Append(data []byte) []byte
+}
+
+// Writer writes records reusing a buffer
+type Writer struct {
+	io.Writer
+	buffer []byte
+}
+
+// NewWriter makes a new record writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		Writer: w,
+	}
+}
+
+// WriteRecord writes a record
+func (w *Writer) WriteRecord(record Record) error {
+	w.buffer = record.Append(w.buffer[:0])
+	return w.write()
+}
+
+// WriteUint64 writes a uint64
+func (w *Writer) WriteUint64(value uint64) error {
+	w.buffer = Order.AppendUint64(w.buffer[:0], value)
+	return w.write()
+}
+
+func (w *Writer) write() error {
+	n, err := w.Writer.Write(w.buffer)
+	if err != nil {
+		return err
+	}
+	if n != len(w.buffer) {
+		return fmt.Errorf("%d bytes should have been written, not %d", len(w.buffer), n)
+	}
+	return nil
+}
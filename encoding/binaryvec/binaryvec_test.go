@@ -0,0 +1,147 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package binaryvec
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEntry(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	entry := Entry{
+		Vector:   make([]float32, Width),
+		Symbol:   'a',
+		Index:    1 << 40,
+		Document: 3,
+		Entropy:  .5,
+	}
+	for i := range entry.Vector {
+		entry.Vector[i] = float32(rng.NormFloat64())
+	}
+	for i := range entry.Signature {
+		entry.Signature[i] = byte(rng.Intn(256))
+	}
+	data := entry.Append(nil)
+	if len(data) != EntrySize {
+		t.Fatalf("entry size is %d not %d", len(data), EntrySize)
+	}
+	if data[4*Width+1] != 0 || data[4*Width+1+5] != 1 {
+		t.Fatal("index should be little endian")
+	}
+	var decoded Entry
+	decoded.Decode(data)
+	for i, v := range entry.Vector {
+		if decoded.Vector[i] != v {
+			t.Fatalf("decoded vector is %f at %d not %f", decoded.Vector[i], i, v)
+		}
+	}
+	decoded.Vector, entry.Vector = nil, nil
+	if !reflect.DeepEqual(decoded, entry) {
+		t.Fatal("decoded entry should equal the entry")
+	}
+}
+
+func TestNarrowEntry(t *testing.T) {
+	entry := Entry{
+		Vector:   []float32{1, 2, 3, 4},
+		Symbol:   'b',
+		Index:    5,
+		Document: 6,
+		Entropy:  .25,
+	}
+	data := entry.Append(nil)
+	if len(data) != EntrySizeOf(4) {
+		t.Fatalf("entry size is %d not %d", len(data), EntrySizeOf(4))
+	}
+	if EntrySymbol(data) != 'b' || EntryIndex(data) != 5 || EntryDocument(data) != 6 || EntryEntropy(data) != .25 {
+		t.Fatal("the fields should be decoded from the end of the vector")
+	}
+	var decoded Entry
+	decoded.Decode(data)
+	if len(decoded.Vector) != 4 || decoded.Vector[3] != 4 {
+		t.Fatalf("decoded vector is %v", decoded.Vector)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	entries, records := make([]Entry, 5), []byte{}
+	for i := range entries {
+		entries[i] = Entry{
+			Vector:   []float32{float32(rng.NormFloat64()), float32(rng.NormFloat64()), float32(rng.NormFloat64())},
+			Symbol:   byte('a' + i),
+			Index:    uint64(1<<40 + i),
+			Document: uint64(i),
+			Entropy:  float32(i) / 4,
+		}
+		for j := range entries[i].Signature {
+			entries[i].Signature[j] = byte(rng.Intn(256))
+		}
+		records = entries[i].Append(records)
+	}
+	data := AppendBlock(nil, entries)
+	if len(data) != len(records) {
+		t.Fatalf("block size is %d not %d", len(data), len(records))
+	}
+	block := NewBlock(3, data)
+	if block.Len != len(entries) {
+		t.Fatalf("block length is %d not %d", block.Len, len(entries))
+	}
+	if len(block.Vectors()) != 4*3*len(entries) {
+		t.Fatalf("vectors are %d bytes", len(block.Vectors()))
+	}
+	for i := range entries {
+		if !reflect.DeepEqual(block.Entry(i), entries[i]) {
+			t.Fatalf("entry %d of the block should equal the entry", i)
+		}
+	}
+	if !reflect.DeepEqual(Transpose(3, records), block) {
+		t.Fatal("the transposed records should equal the block")
+	}
+
+	// the entries [1, 4) of the block read column by column are a block
+	part := []byte{}
+	offset := 0
+	for _, size := range Columns(3) {
+		part = append(part, data[offset+1*size:offset+4*size]...)
+		offset += len(entries) * size
+	}
+	sub := NewBlock(3, part)
+	for i := 0; i < sub.Len; i++ {
+		if !reflect.DeepEqual(sub.Entry(i), entries[i+1]) {
+			t.Fatalf("entry %d of the part should equal entry %d", i, i+1)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	bucket := Bucket{Count: 7}
+	bucket.Vector[255] = 1
+	data := bucket.Append(nil)
+	if len(data) != BucketSize {
+		t.Fatalf("bucket size is %d not %d", len(data), BucketSize)
+	}
+	var decoded Bucket
+	decoded.Decode(data)
+	if decoded != bucket {
+		t.Fatal("decoded bucket should equal the bucket")
+	}
+}
+
+func TestRankEntry(t *testing.T) {
+	entry := RankEntry{Symbol: 'z', Index: 9}
+	entry.Vector[0] = -2
+	data := entry.Append(nil)
+	if len(data) != RankEntrySize {
+		t.Fatalf("rank entry size is %d not %d", len(data), RankEntrySize)
+	}
+	var decoded RankEntry
+	decoded.Decode(data)
+	if decoded != entry {
+		t.Fatal("decoded rank entry should equal the rank entry")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pointlander/soda/client"
+)
+
+// EstimateSteps is the number of steps generated to measure the cost of a
+// step of a generation
+const EstimateSteps = 16
+
+// Estimate predicts the wall time and bytes read of generating from the query
+// with the options, the first steps of the generation are generated and
+// timed and the rest are assumed to cost the same
+func (m *Model) Estimate(query []byte, options Options) client.Estimate {
+	sizes := m.Sizes
+	if m.Shards != nil {
+		sizes = m.Shards.Sizes
+	}
+	estimate := client.Estimate{
+		Count:     options.Count,
+		Buckets:   len(sizes),
+		EntrySize: m.EntrySize(),
+	}
+	for _, size := range sizes {
+		estimate.Entries += size
+	}
+	options.Context, options.Alternatives, options.Timeout = 0, 0, 0
+	options.Progress, options.Trace, options.Stop = nil, nil, nil
+	// the measured steps don't count towards the probe statistics of the
+	// model
+	options.Stats = NewBucketStats(len(m.Header))
+
+	start := time.Now()
+	prompt := options
+	prompt.Count = 0
+	m.generate(query, prompt)
+	estimate.PromptSeconds = time.Since(start).Seconds()
+
+	var scanned, candidates uint64
+	probes := 0
+	options.Count = min(options.Count, EstimateSteps)
+	options.Probed = func(buckets []int, retrieved int) {
+		estimate.Sampled++
+		probes += len(buckets)
+		for _, bucket := range buckets {
+			scanned += sizes[bucket]
+		}
+		candidates += uint64(retrieved)
+	}
+	start = time.Now()
+	m.generate(query, options)
+	elapsed := time.Since(start).Seconds() - estimate.PromptSeconds
+	if estimate.Sampled > 0 {
+		n := float64(estimate.Sampled)
+		estimate.Probes = float64(probes) / n
+		estimate.Scanned = float64(scanned) / n
+		estimate.Candidates = float64(candidates) / n
+		estimate.StepSeconds = max(elapsed, 0) / n
+	}
+	estimate.BytesPerStep = estimate.Scanned * float64(estimate.EntrySize)
+	estimate.Bytes = estimate.BytesPerStep * float64(estimate.Count)
+	estimate.Seconds = estimate.PromptSeconds + estimate.StepSeconds*float64(estimate.Count)
+	return estimate
+}
+
+// EstimateCommand prints the estimated cost of generating from the query of
+// the arguments or -query with the generation flags
+func EstimateCommand(args []string) {
+	set := flag.NewFlagSet("estimate", flag.ContinueOnError)
+	if err := ParseCommand(set, args); err != nil {
+		return
+	}
+	if set.NArg() > 0 {
+		*FlagQuery = strings.Join(set.Args(), " ")
+	}
+	options, err := Request{
+		Documents: strings.Split(*FlagOnlyDoc, ","),
+		Symbols:   *FlagSymbols,
+	}.Options()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	query := []byte(*FlagQuery)
+	if *FlagContinue != "" {
+		query, _, err = Continuation(*FlagContinue)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	err = CheckPipeline(model.Preprocess)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	estimate := model.Estimate(query, options)
+	duration := func(seconds float64) time.Duration {
+		return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+	}
+	fmt.Printf("database     %d buckets, %d entries of %d bytes\n", estimate.Buckets, estimate.Entries, estimate.EntrySize)
+	fmt.Printf("measured     %d of %d steps\n", estimate.Sampled, estimate.Count)
+	fmt.Printf("per step     %.1f buckets, %.0f entries, %.0f candidates, %s, %s\n",
+		estimate.Probes, estimate.Scanned, estimate.Candidates, FormatSize(estimate.BytesPerStep), duration(estimate.StepSeconds))
+	fmt.Printf("prompt       %s\n", duration(estimate.PromptSeconds))
+	fmt.Printf("generation   %s read, %s\n", FormatSize(estimate.Bytes), duration(estimate.Seconds))
+}
+
+// FormatSize formats a size in bytes with the suffixes of ParseSize
+func FormatSize(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n, i = n/1024, i+1
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
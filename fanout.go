@@ -0,0 +1,165 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	// FanoutFixed probes the -nprobe most similar buckets
+	FanoutFixed = "fixed"
+	// FanoutAuto probes fewer buckets when the most similar bucket usually
+	// wins and more when the wins are spread out
+	FanoutAuto = "auto"
+)
+
+// FlagFanout is the probing policy
+var FlagFanout = flag.String("fanout", FanoutFixed, "probing policy: fixed probes up to -nprobe buckets, auto probes between 1 and 4 times -nprobe buckets depending on how often the buckets win")
+
+const (
+	// FanoutWindow is the number of probes the bucket statistics are kept for
+	FanoutWindow = 1 << 16
+	// FanoutMiss is the estimated probability that none of the probed buckets
+	// holds the winner below which auto stops probing more buckets
+	FanoutMiss = .1
+	// FanoutExpand is the multiple of -nprobe buckets auto can probe when the
+	// win rates are low
+	FanoutExpand = 4
+	// FanoutExplore is the period in steps at which auto probes every bucket
+	// it considers, the statistics are recorded for these steps only so the
+	// buckets it usually skips are measured against the ones it keeps
+	FanoutExplore = 8
+	// HotBuckets is the number of buckets reported by the statistics
+	HotBuckets = 32
+)
+
+// CheckFanout checks that a probing policy is known
+func CheckFanout(fanout string) error {
+	switch fanout {
+	case FanoutFixed, FanoutAuto:
+		return nil
+	}
+	return fmt.Errorf("unknown fanout %s", fanout)
+}
+
+// probe is a bucket probed for one symbol and whether it had the winner
+type probe struct {
+	Bucket int
+	Won    bool
+}
+
+// BucketStats counts how often each bucket is probed and how often it has the
+// winning candidate over a sliding window of probes
+type BucketStats struct {
+	sync.Mutex
+	Probes []uint32
+	Wins   []uint32
+	Window []probe
+	Index  int
+	Count  int
+	// Steps is the number of steps auto fanout has chosen the probes of
+	Steps uint64
+}
+
+// NewBucketStats makes statistics for buckets buckets
+func NewBucketStats(buckets int) *BucketStats {
+	return &BucketStats{
+		Probes: make([]uint32, buckets),
+		Wins:   make([]uint32, buckets),
+		Window: make([]probe, FanoutWindow),
+	}
+}
+
+// Record records the buckets probed for a symbol and the bucket of the winner
+func (b *BucketStats) Record(probes []int, winner int) {
+	b.Lock()
+	defer b.Unlock()
+	for _, bucket := range probes {
+		if b.Count == len(b.Window) {
+			old := b.Window[b.Index]
+			b.Probes[old.Bucket]--
+			if old.Won {
+				b.Wins[old.Bucket]--
+			}
+		} else {
+			b.Count++
+		}
+		won := bucket == winner
+		b.Window[b.Index] = probe{Bucket: bucket, Won: won}
+		b.Index = (b.Index + 1) % len(b.Window)
+		b.Probes[bucket]++
+		if won {
+			b.Wins[bucket]++
+		}
+	}
+}
+
+// rate is the smoothed win rate of a bucket
+func (b *BucketStats) rate(bucket int) float64 {
+	return (float64(b.Wins[bucket]) + 1) / (float64(b.Probes[bucket]) + 2)
+}
+
+// Fanout returns the prefix of the ranked probes that likely holds the winner,
+// at least one bucket is probed, complete is true if every probe is returned
+// because the win rates are low or the step explores
+func (b *BucketStats) Fanout(probes []int) (prefix []int, complete bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.Steps++
+	if b.Steps%FanoutExplore == 0 {
+		return probes, true
+	}
+	miss := 1.0
+	for i, bucket := range probes {
+		miss *= 1 - b.rate(bucket)
+		if miss < FanoutMiss {
+			return probes[:i+1], i+1 == len(probes)
+		}
+	}
+	return probes, true
+}
+
+// HotBucket is the statistics of a bucket
+type HotBucket struct {
+	Bucket  int     `json:"bucket"`
+	Probes  uint32  `json:"probes"`
+	Wins    uint32  `json:"wins"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// Hot returns the most probed buckets
+func (b *BucketStats) Hot(n int) []HotBucket {
+	b.Lock()
+	defer b.Unlock()
+	var hot []HotBucket
+	for i, probes := range b.Probes {
+		if probes == 0 {
+			continue
+		}
+		hot = append(hot, HotBucket{
+			Bucket:  i,
+			Probes:  probes,
+			Wins:    b.Wins[i],
+			WinRate: float64(b.Wins[i]) / float64(probes),
+		})
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].Probes > hot[j].Probes
+	})
+	if len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+// ServeHTTP reports the most probed buckets
+func (b *BucketStats) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	Reply(response, b.Hot(HotBuckets))
+}
@@ -0,0 +1,141 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"sync"
+)
+
+// FlagStreamHighWater is the number of bytes of events buffered for a stream
+// before its generation pauses
+var FlagStreamHighWater = flag.Int("stream-high-water", 64<<10, "number of bytes of server sent events buffered for a client that isn't reading before the generation of its stream pauses, it resumes when they are drained to half of it")
+
+// ErrStreamClosed is the error of a write to a closed flow writer
+var ErrStreamClosed = errors.New("the stream is closed")
+
+// FlowWriter writes the events of a stream to the client from a goroutine, so
+// generation runs ahead of a slow client by at most the high-water mark of
+// buffered bytes and then waits for them to drain
+type FlowWriter struct {
+	sync.Mutex
+	cond     *sync.Cond
+	response http.ResponseWriter
+	// High is the high-water mark, writes wait while more bytes than it are
+	// buffered or being written until they are drained to half of it
+	High int
+	// buffer is the bytes that haven't been handed to the client and
+	// pending is them and the bytes being written
+	buffer  []byte
+	pending int
+	err     error
+	closed  bool
+	done    chan struct{}
+	stop    func() bool
+}
+
+// NewFlowWriter starts writing the events of a stream to response, the writes
+// fail once the client of the request goes away
+func NewFlowWriter(response http.ResponseWriter, request *http.Request, high int) *FlowWriter {
+	f := &FlowWriter{
+		response: response,
+		High:     high,
+		done:     make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.Mutex)
+	f.stop = context.AfterFunc(request.Context(), func() {
+		f.fail(request.Context().Err())
+	})
+	go f.run()
+	return f
+}
+
+// fail records the first error of the stream and wakes the waiting writes
+func (f *FlowWriter) fail(err error) {
+	f.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.Unlock()
+	f.cond.Broadcast()
+}
+
+// run writes and flushes the buffered bytes until the writer is closed and
+// drained or the client fails
+func (f *FlowWriter) run() {
+	defer close(f.done)
+	controller := http.NewResponseController(f.response)
+	f.Lock()
+	defer f.Unlock()
+	for {
+		for len(f.buffer) == 0 && !f.closed && f.err == nil {
+			f.cond.Wait()
+		}
+		if f.err != nil || len(f.buffer) == 0 {
+			return
+		}
+		data := f.buffer
+		f.buffer = nil
+		f.Unlock()
+		ExtendWriteDeadline(f.response)
+		_, err := f.response.Write(data)
+		if err == nil {
+			err = controller.Flush()
+		}
+		f.Lock()
+		f.pending -= len(data)
+		if err != nil && f.err == nil {
+			f.err = err
+		}
+		f.cond.Broadcast()
+	}
+}
+
+// Write buffers data for the client, it waits while the buffered bytes are
+// over the high-water mark until they are drained to half of it. It returns
+// the error of the client once it fails
+func (f *FlowWriter) Write(data []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.pending > f.High {
+		for f.pending > f.High/2 && f.err == nil {
+			f.cond.Wait()
+		}
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.closed {
+		return 0, ErrStreamClosed
+	}
+	f.buffer = append(f.buffer, data...)
+	f.pending += len(data)
+	f.cond.Broadcast()
+	return len(data), nil
+}
+
+// Err is the error of the client, nil while it is reading
+func (f *FlowWriter) Err() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.err
+}
+
+// Close waits until the buffered bytes are written or the client fails, the
+// response can't be used by the writer after it returns
+func (f *FlowWriter) Close() error {
+	f.Lock()
+	f.closed = true
+	f.Unlock()
+	f.cond.Broadcast()
+	<-f.done
+	f.stop()
+	f.Lock()
+	defer f.Unlock()
+	return f.err
+}
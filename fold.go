@@ -0,0 +1,178 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// FlagFold is the number of runes of the corpus with their own symbols
+var FlagFold = flag.Int("fold", 0, "fold each rune into a single symbol when building, the most frequent fold runes of the corpus have their own symbols and the rest are hashed into the remaining symbols, for corpora whose multi-byte characters the byte alphabet splits, 0 keeps the byte alphabet")
+
+// CheckFold checks the folding of a build, it can't be combined with merges
+func CheckFold(fold, merges int) error {
+	if fold < 0 || fold > 255 {
+		return fmt.Errorf("fold must be between 0 and 255")
+	}
+	if fold > 0 && merges > 0 {
+		return fmt.Errorf("fold and merges can't be combined")
+	}
+	return nil
+}
+
+// Coding encodes text as the symbols the mixer is fed and decodes them, it is
+// the alphabet or the folding of a database
+type Coding interface {
+	// Encode encodes bytes as symbols
+	Encode(data []byte) []byte
+	// Offsets are the byte offsets in data of the symbols it was encoded
+	// to, nil if the symbols are the bytes
+	Offsets(data, encoded []byte) []uint64
+	// Expansions are the bytes each symbol decodes to
+	Expansions() *[256][]byte
+	// Symbols extends a set of bytes to the symbols whose expansions start
+	// with one of them
+	Symbols(set *SymbolSet) *SymbolSet
+}
+
+// Coding is the folding of the settings if runes are folded and the alphabet
+// otherwise
+func (s Settings) Coding() Coding {
+	if s.Folding != nil {
+		return s.Folding
+	}
+	return s.Alphabet
+}
+
+// Folding maps each rune to a symbol, the Dedicated most frequent runes of the
+// corpus are symbols 0 to Dedicated-1 and the other runes are hashed into the
+// remaining symbols
+type Folding struct {
+	Dedicated int `json:"dedicated"`
+	// Runes are the runes the symbols decode to, a hashed symbol decodes to
+	// the most frequent rune of the corpus hashed into it
+	Runes [256]rune `json:"runes"`
+}
+
+// Hash is the symbol a rune without its own symbol is hashed into
+func (f *Folding) Hash(r rune) uint8 {
+	return uint8(f.Dedicated + int(uint32(r)*0x9e3779b1%uint32(256-f.Dedicated)))
+}
+
+// LearnFolding gives the fold most frequent runes of data their own symbols,
+// every rune has its own symbol if there are fewer than 256 of them
+func LearnFolding(data []byte, fold int) *Folding {
+	counts := make(map[rune]int)
+	for _, r := range string(data) {
+		counts[r]++
+	}
+	runes := make([]rune, 0, len(counts))
+	for r := range counts {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool {
+		if counts[runes[i]] != counts[runes[j]] {
+			return counts[runes[i]] > counts[runes[j]]
+		}
+		return runes[i] < runes[j]
+	})
+	folding := &Folding{Dedicated: fold}
+	if len(runes) < 256 {
+		folding.Dedicated = len(runes)
+	}
+	for i := range folding.Runes {
+		folding.Runes[i] = utf8.RuneError
+	}
+	copy(folding.Runes[:], runes[:folding.Dedicated])
+	// the runes are in order of frequency so the first rune hashed into a
+	// symbol is its most frequent
+	var hashed [256]bool
+	for _, r := range runes[folding.Dedicated:] {
+		if symbol := folding.Hash(r); !hashed[symbol] {
+			folding.Runes[symbol], hashed[symbol] = r, true
+		}
+	}
+	return folding
+}
+
+// table maps the runes with their own symbols to them
+func (f *Folding) table() map[rune]uint8 {
+	table := make(map[rune]uint8, f.Dedicated)
+	for i, r := range f.Runes[:f.Dedicated] {
+		table[r] = uint8(i)
+	}
+	return table
+}
+
+// Encode encodes each rune of data as a symbol
+func (f *Folding) Encode(data []byte) []byte {
+	table, encoded := f.table(), make([]byte, 0, len(data))
+	for _, r := range string(data) {
+		symbol, ok := table[r]
+		if !ok {
+			symbol = f.Hash(r)
+		}
+		encoded = append(encoded, symbol)
+	}
+	return encoded
+}
+
+// Offsets are the byte offsets of the runes of data
+func (f *Folding) Offsets(data, encoded []byte) []uint64 {
+	offsets := make([]uint64, 0, len(encoded))
+	for offset := range string(data) {
+		offsets = append(offsets, uint64(offset))
+	}
+	return offsets
+}
+
+// Expansions are the utf-8 encodings of the runes the symbols decode to
+func (f *Folding) Expansions() *[256][]byte {
+	var expansions [256][]byte
+	for i, r := range f.Runes {
+		expansions[i] = utf8.AppendRune(nil, r)
+	}
+	return &expansions
+}
+
+// Symbols extends a set of bytes to the symbols whose runes start with one of
+// them
+func (f *Folding) Symbols(set *SymbolSet) *SymbolSet {
+	if set == nil {
+		return set
+	}
+	expansions, symbols := f.Expansions(), SymbolSet{}
+	for i, expansion := range expansions {
+		symbols[i] = set[expansion[0]]
+	}
+	return &symbols
+}
+
+// Unfold replaces the runes of the outputs of hashed symbols with the runes of
+// the corpus they are from, it does nothing if the corpus isn't available
+func (m *Model) Unfold(outputs []Output) error {
+	if m.Folding == nil {
+		return nil
+	}
+	if _, err := m.Snippet(0, 0); err != nil {
+		return nil
+	}
+	for i := range outputs {
+		if int(outputs[i].Symbol) < m.Folding.Dedicated || outputs[i].S == "" {
+			continue
+		}
+		snippet, err := m.Snippet(outputs[i].Index, 0)
+		if err != nil {
+			return err
+		}
+		if snippet != "" {
+			outputs[i].S = snippet
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pointlander/soda/client"
+)
+
+// BatchResult is the result of a line of a batch generation
+type BatchResult struct {
+	// Line is the line of the input the request was on
+	Line int `json:"line"`
+	client.Response
+	// Error is why the request failed, empty if it didn't
+	Error string `json:"error,omitempty"`
+}
+
+// Batch generates the response of a line of a batch generation
+func (m *Model) Batch(line int, data []byte) BatchResult {
+	result := BatchResult{Line: line}
+	var req Request
+	err := Strict(bytes.NewReader(data), &req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	options, err := req.Options()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	err = m.Check(options)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	query, err := req.Prompt()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	searches := m.Soda(query, options)
+	result.Response = client.Response{
+		Text:            Text(searches[0].Result),
+		Output:          Outputs(searches[0].Result),
+		Truncated:       searches[0].Truncated,
+		PromptTruncated: searches[0].PromptTruncated,
+		Steps:           searches[0].Steps,
+		FinishReason:    searches[0].FinishReason,
+	}
+	return result
+}
+
+// GenerateBatch generates a response for each request of the jsonl input with
+// workers in parallel and writes the results to output in the order of the
+// input, blank lines are skipped. It returns the number of requests and the
+// number that failed
+func (m *Model) GenerateBatch(input io.Reader, output io.Writer, workers int) (int, int, error) {
+	type Line struct {
+		Index, Line int
+		Data        []byte
+	}
+	type Result struct {
+		Index  int
+		Result BatchResult
+	}
+	lines, results := make(chan Line, workers), make(chan Result, workers)
+	var readErr error
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 1<<16), 1<<28)
+		index, line := 0, 0
+		for scanner.Scan() {
+			line++
+			data := scanner.Bytes()
+			if strings.TrimSpace(string(data)) == "" {
+				continue
+			}
+			lines <- Line{Index: index, Line: line, Data: append([]byte(nil), data...)}
+			index++
+		}
+		readErr = scanner.Err()
+	}()
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for line := range lines {
+				var result BatchResult
+				err := Recover(func() {
+					result = m.Batch(line.Line, line.Data)
+				})
+				if err != nil {
+					result = BatchResult{Line: line.Line, Error: err.Error()}
+				}
+				results <- Result{Index: line.Index, Result: result}
+			}
+		}()
+	}
+	go func() {
+		wait.Wait()
+		close(results)
+	}()
+
+	writer := bufio.NewWriter(output)
+	pending, next, failed := make(map[int]BatchResult), 0, 0
+	var writeErr error
+	for result := range results {
+		pending[result.Index] = result.Result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if result.Error != "" {
+				failed++
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				panic(err)
+			}
+			if writeErr == nil {
+				_, writeErr = writer.Write(append(data, '\n'))
+			}
+		}
+	}
+	if writeErr == nil {
+		writeErr = writer.Flush()
+	}
+	if readErr != nil {
+		return next, failed, readErr
+	}
+	return next, failed, writeErr
+}
+
+// GenerateCommand generates from the query of the arguments or -query, or
+// the requests of a jsonl file in parallel against one model
+func GenerateCommand(args []string) {
+	set := flag.NewFlagSet("generate", flag.ContinueOnError)
+	input := set.String("input", "", "jsonl file of generation requests, one per line")
+	out := set.String("output", "", "jsonl file the results are written to in the order of the requests, stdout by default")
+	workers := set.Int("workers", runtime.NumCPU(), "number of requests generated in parallel")
+	if err := ParseCommand(set, args); err != nil {
+		return
+	}
+	if *input == "" {
+		if set.NArg() > 0 {
+			*FlagQuery = strings.Join(set.Args(), " ")
+		}
+		GenerateQuery(*FlagQuery)
+		return
+	}
+	if *workers < 1 || set.NArg() != 0 {
+		fmt.Println("usage: soda generate [-db <db>] [query] | -input <requests.jsonl> [-output <results.jsonl>] [-workers n]")
+		return
+	}
+	in, err := os.Open(*input)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer in.Close()
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	err = CheckPipeline(model.Preprocess)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *FlagLexical != 0 {
+		model.Lexical, err = model.LexicalIndex(float32(*FlagLexical))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	output, file := io.Writer(os.Stdout), (*AtomicFile)(nil)
+	if *out != "" {
+		file, err = CreateAtomic(*out)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer file.Close()
+		output = file
+	}
+	requests, failed, err := model.GenerateBatch(in, output, *workers)
+	if err == nil && file != nil {
+		err = file.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "generated %d requests, %d failed\n", requests, failed)
+}
@@ -0,0 +1,292 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pointlander/soda/client"
+)
+
+// FlagGenerationLog is the path of the generation log of the server
+var FlagGenerationLog = flag.String("generation-log", "", "append every generation request of the server with its outputs to the jsonl file for soda replay, empty disables the log")
+
+// LogStep is a candidate chosen during generation
+type LogStep struct {
+	Index    uint64 `json:"index"`
+	Document uint64 `json:"document"`
+}
+
+// LogEntry is a generation request recorded in the generation log
+type LogEntry struct {
+	// ID identifies the entry for /debug/trace
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+	// DB is the name of the database and Created is when it was built
+	DB      string    `json:"db"`
+	Created time.Time `json:"created,omitempty"`
+	// Query is the prompt, QueryBytes holds it instead if it isn't utf-8
+	Query      string `json:"query,omitempty"`
+	QueryBytes []byte `json:"query_bytes,omitempty"`
+	// Request are the effective parameters of the generation
+	Request   client.Request `json:"request"`
+	Steps     []LogStep      `json:"steps"`
+	Text      string         `json:"text"`
+	Truncated bool           `json:"truncated,omitempty"`
+	// FinishReason is why generation ended
+	FinishReason string `json:"finish_reason,omitempty"`
+}
+
+// Prompt is the prompt of the entry
+func (l LogEntry) Prompt() []byte {
+	if l.QueryBytes != nil {
+		return l.QueryBytes
+	}
+	return []byte(l.Query)
+}
+
+// GenerationLog is an append only jsonl log of generation requests
+type GenerationLog struct {
+	sync.Mutex
+	File *os.File
+	// Size is the size of the log and Offsets are the offsets of the entries
+	// by id
+	Size    int64
+	Offsets map[string]int64
+}
+
+// OpenGenerationLog opens the generation log at path for appending, the ids
+// of the entries already in it are indexed
+func OpenGenerationLog(path string) (*GenerationLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	g := &GenerationLog{
+		File:    file,
+		Offsets: make(map[string]int64),
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var entry struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(line, &entry) == nil && entry.ID != "" {
+				g.Offsets[entry.ID] = g.Size
+			}
+			g.Size += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Record appends an entry to the log
+func (g *GenerationLog) Record(entry LogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		panic(err)
+	}
+	g.Lock()
+	defer g.Unlock()
+	n, err := g.File.Write(append(data, '\n'))
+	if n == len(data)+1 {
+		g.Offsets[entry.ID] = g.Size
+	}
+	g.Size += int64(n)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "generation log:", err)
+	}
+}
+
+// Close closes the log
+func (g *GenerationLog) Close() error {
+	return g.File.Close()
+}
+
+// Effective returns the request that reproduces the options, the parameters
+// that default to flags are filled in so the request doesn't depend on them
+func (o Options) Effective() client.Request {
+	var r client.Request
+	if o.Request != nil {
+		r = *o.Request
+	}
+	threshold, entropyWeight, lambda, seed := o.ProbeThreshold, o.EntropyWeight, o.Lambda, o.Seed
+	cache, locality, attention, subprobe := o.ProbeCache, o.Locality, o.Attention, o.SubProbe
+	r.Query, r.Continue = "", ""
+	r.Count, r.NProbe, r.Fanout, r.Hamming = o.Count, o.NProbe, o.Fanout, o.Hamming
+	r.Threshold, r.EntropyWeight, r.Lambda, r.Seed = &threshold, &entropyWeight, &lambda, &seed
+	r.ProbeCache, r.Locality, r.Attention, r.SubProbe = &cache, &locality, &attention, &subprobe
+	r.Context, r.Raw, r.PromptBudget, r.Truncation = o.Context, o.Raw, o.PromptBudget, o.Truncation
+	r.Latest = o.Latest
+	r.Decoder, r.Temperature, r.TopK, r.TopP = o.Sampler.Decoder, o.Sampler.Temperature, o.Sampler.TopK, o.Sampler.TopP
+	r.TempSchedule, r.Calibrated = o.Sampler.Schedule.String(), o.Sampler.Calibrated
+	r.Stop, r.Timeout, r.Postprocess = o.Stop, "", o.Postprocess
+	r.Repetition, r.RepetitionWindow, r.RepetitionAction = o.Repetition.Count, o.Repetition.Window, o.Repetition.Action
+	r.Vocabulary, r.VocabularyK = o.Vocabulary.Steps, o.Vocabulary.K
+	if o.Timeout > 0 {
+		r.Timeout = o.Timeout.String()
+	}
+	return r
+}
+
+// Record records a generation of the model in its generation log and returns
+// the id of the entry
+func (m *Model) Record(query []byte, options Options, search Search) string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	entry := LogEntry{
+		ID:           hex.EncodeToString(id),
+		Time:         time.Now().UTC(),
+		DB:           filepath.Base(m.Path),
+		Request:      options.Effective(),
+		Steps:        make([]LogStep, len(search.Result)),
+		Text:         Text(search.Result),
+		Truncated:    search.Truncated,
+		FinishReason: search.FinishReason,
+	}
+	if m.Metadata != nil {
+		entry.Created = m.Metadata.Created
+	}
+	if utf8.Valid(query) {
+		entry.Query = string(query)
+	} else {
+		entry.QueryBytes = query
+	}
+	for i, output := range search.Result {
+		entry.Steps[i] = LogStep{
+			Index:    output.Index,
+			Document: output.Document,
+		}
+	}
+	m.Log.Record(entry)
+	return entry.ID
+}
+
+// Find finds the entry with the id in the log, nil if there is none
+func (g *GenerationLog) Find(id string) (*LogEntry, error) {
+	g.Lock()
+	offset, ok := g.Offsets[id]
+	size := g.Size
+	g.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(g.File, offset, size-offset)).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var entry LogEntry
+	err = json.Unmarshal(line, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Options are the options that replay the entry
+func (l LogEntry) Options() (Options, error) {
+	req := Request(l.Request)
+	req.Timeout = ""
+	return req.Options()
+}
+
+// Diverged returns the first step where a replayed result differs from the
+// entry, or -1 if it doesn't, a truncated generation is compared up to where
+// it stopped
+func (l LogEntry) Diverged(result []Output) int {
+	for i, logged := range l.Steps {
+		if i >= len(result) || result[i].Index != logged.Index || result[i].Document != logged.Document {
+			return i
+		}
+	}
+	if !l.Truncated && len(result) != len(l.Steps) {
+		return len(l.Steps)
+	}
+	return -1
+}
+
+// Replay replays the generation log given as an argument against the database
+// given by -db and reports the requests whose outputs differ, a truncated
+// generation is compared up to where it stopped
+func Replay(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: replay <log.jsonl>")
+		return
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<16), 1<<28)
+	line, replayed, diverged := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		var entry LogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			fmt.Printf("line %d: %v\n", line, err)
+			diverged++
+			continue
+		}
+		if model.Metadata != nil && !entry.Created.IsZero() && !entry.Created.Equal(model.Metadata.Created) {
+			fmt.Printf("line %d: logged against %s built %s but the database was built %s\n",
+				line, entry.DB, entry.Created, model.Metadata.Created)
+		}
+		options, err := entry.Options()
+		if err != nil {
+			fmt.Printf("line %d: %v\n", line, err)
+			diverged++
+			continue
+		}
+		replayed++
+		// the log records the results before post-processing
+		options.Postprocess = nil
+		result := model.Soda(entry.Prompt(), options)[0].Result
+		if step := entry.Diverged(result); step >= 0 {
+			diverged++
+			fmt.Printf("line %d: diverged at step %d, logged %q replayed %q\n", line, step, entry.Text, Text(result))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("replayed %d of %d requests, %d diverged\n", replayed, line, diverged)
+	if diverged > 0 {
+		os.Exit(1)
+	}
+}
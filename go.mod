@@ -2,10 +2,18 @@ module github.com/pointlander/soda
 
 go 1.23.3
 
+require (
+	github.com/alixaxel/pagerank v0.0.0-20200105181019-900657b89dcb
+	github.com/klauspost/compress v1.18.0
+	github.com/pointlander/gradient v0.0.0-20240226214843-e3d2a19564fd
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/text v0.19.0
+	gonum.org/v1/plot v0.15.0
+)
+
 require (
 	git.sr.ht/~sbinet/gg v0.6.0 // indirect
 	github.com/ajstarks/svgo v0.0.0-20211024235047-1546f124cd8b // indirect
-	github.com/alixaxel/pagerank v0.0.0-20200105181019-900657b89dcb // indirect
 	github.com/campoy/embedmd v1.0.0 // indirect
 	github.com/go-fonts/liberation v0.3.3 // indirect
 	github.com/go-latex/latex v0.0.0-20240709081214-31cef3c7570e // indirect
@@ -13,10 +21,8 @@ require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/pointlander/gradient v0.0.0-20240226214843-e3d2a19564fd // indirect
 	github.com/ziutek/blas v0.0.0-20190227122918-da4ca23e90bb // indirect
 	golang.org/x/image v0.21.0 // indirect
-	golang.org/x/text v0.19.0 // indirect
-	gonum.org/v1/plot v0.15.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
 	google.golang.org/protobuf v1.24.0 // indirect
 )
@@ -0,0 +1,265 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/pointlander/gradient/tf32"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+const (
+	// B1 exponential decay of the rate for the first moment estimates
+	B1 = 0.8
+	// B2 exponential decay rate for the second-moment estimates
+	B2 = 0.89
+)
+
+const (
+	// StateM is the state for the mean
+	StateM = iota
+	// StateV is the state for the variance
+	StateV
+	// StateTotal is the total number of states
+	StateTotal
+)
+
+// NewHeader generates a new header with the mixer of the settings, the
+// bucket vectors are sampled with transform or with a transform trained from
+// the length symbols of two passes over the corpus, the statistics are
+// computed at the sorted positions of samples, or every position if it is
+// nil. The transform the header was sampled with is returned, it is nil for
+// a k-means header
+func NewHeader(pass func(fn func(data []byte)), length int, samples []int, settings Settings, transform *Transform) (Header, *Transform) {
+	if settings.Header == HeaderKMeans {
+		return KMeansHeader(pass, length, samples, settings), nil
+	}
+	model := make(Header, ModelSize*1024)
+	rng := rand.New(rand.NewSource(1))
+	if transform == nil {
+		transform = TrainTransform(pass, length, samples, settings, rng)
+	} else {
+		// the initial weights are drawn anyway so the buckets sampled with
+		// an exported transform are the buckets of the database it is from
+		for i := 0; i < 256*256; i++ {
+			rng.NormFloat64()
+		}
+	}
+	for i := range model {
+		var x [256]float32
+		transform.Sample(rng, x[:])
+		settings.Project(model[i].Vector[:], x[:])
+	}
+	return model, transform
+}
+
+// TrainTransform trains the transform of the mixer vectors of the length
+// symbols of two passes over the corpus at the sorted positions of samples,
+// or every position if it is nil, the initial weights are drawn from rng
+func TrainTransform(pass func(fn func(data []byte)), length int, samples []int, settings Settings, rng *rand.Rand) *Transform {
+	n := length
+	if samples != nil {
+		n = len(samples)
+	}
+	sampled := func(j int, s *int) bool {
+		if samples == nil {
+			return true
+		}
+		if *s < len(samples) && samples[*s] == j {
+			*s++
+			return true
+		}
+		return false
+	}
+
+	avg := make([]float32, 256)
+	m := settings.NewMixer()
+	m.Add(0)
+	progress, j, s := NewProgress("header mean", length), 0, 0
+	pass(func(data []byte) {
+		for _, v := range data {
+			progress.Update(j, "")
+			if !sampled(j, &s) {
+				m.Add(v)
+				j++
+				continue
+			}
+			var vector [256]float32
+			m.Mix(&vector)
+			for i, v := range vector {
+				avg[i] += v
+			}
+			m.Add(v)
+			j++
+		}
+	})
+	progress.Done()
+	for i := range avg {
+		avg[i] /= float32(n)
+	}
+	cov := [256][256]float32{}
+	m.Reset()
+	m.Add(0)
+	progress, j, s = NewProgress("header covariance", length), 0, 0
+	pass(func(data []byte) {
+		for _, v := range data {
+			progress.Update(j, "")
+			if !sampled(j, &s) {
+				m.Add(v)
+				j++
+				continue
+			}
+			var vector [256]float32
+			m.Mix(&vector)
+			for i, v := range vector {
+				for ii, vv := range vector {
+					diff1 := avg[i] - v
+					diff2 := avg[ii] - vv
+					cov[i][ii] += diff1 * diff2
+				}
+			}
+			m.Add(v)
+			j++
+		}
+	})
+	progress.Done()
+	for i := range cov {
+		for j := range cov[i] {
+			cov[i][j] = cov[i][j] / float32(n)
+		}
+	}
+
+	set := tf32.NewSet()
+	set.Add("A", 256, 256)
+
+	for i := range set.Weights {
+		w := set.Weights[i]
+		if strings.HasPrefix(w.N, "b") {
+			w.X = w.X[:cap(w.X)]
+			w.States = make([][]float32, StateTotal)
+			for i := range w.States {
+				w.States[i] = make([]float32, len(w.X))
+			}
+			continue
+		}
+		factor := math.Sqrt(2.0 / float64(w.S[0]))
+		for i := 0; i < cap(w.X); i++ {
+			w.X = append(w.X, float32(rng.NormFloat64()*factor))
+		}
+		w.States = make([][]float32, StateTotal)
+		for i := range w.States {
+			w.States[i] = make([]float32, len(w.X))
+		}
+	}
+
+	others := tf32.NewSet()
+	others.Add("E", 256, 256)
+	E := others.ByName["E"]
+	for i := range cov {
+		for j := range cov[i] {
+			E.X = append(E.X, cov[i][j])
+		}
+	}
+
+	loss := tf32.Sum(tf32.Quadratic(others.Get("E"), tf32.Mul(set.Get("A"), set.Get("A"))))
+
+	// the training stops when the best cost hasn't improved by the relative
+	// tolerance for patience iterations
+	eta, tolerance := float32(*FlagHeaderRate), float32(*FlagHeaderTolerance)
+	best, stale := float32(0), 0
+	points := make(plotter.XYs, 0, 8)
+	progress = NewProgress("header training", *FlagHeaderIterations)
+	for i := 0; i < *FlagHeaderIterations; i++ {
+		pow := func(x float32) float32 {
+			y := pow(x, float32(i+1))
+			if isNaN(y) || isInf(y) {
+				return 0
+			}
+			return y
+		}
+
+		set.Zero()
+		others.Zero()
+		cost := tf32.Gradient(loss).X[0]
+		if isNaN(cost) || isInf(cost) {
+			progress.Warn(i, fmt.Sprintf("cost=%f", cost))
+			break
+		}
+
+		norm := float32(0.0)
+		for _, p := range set.Weights {
+			for _, d := range p.D {
+				norm += d * d
+			}
+		}
+		norm = sqrt(norm)
+		b1, b2 := pow(B1), pow(B2)
+		scaling := float32(1.0)
+		if norm > 1 {
+			scaling = 1 / norm
+		}
+		for _, w := range set.Weights {
+			for l, d := range w.D {
+				g := d * scaling
+				m := B1*w.States[StateM][l] + (1-B1)*g
+				v := B2*w.States[StateV][l] + (1-B2)*g*g
+				w.States[StateM][l] = m
+				w.States[StateV][l] = v
+				mhat := m / (1 - b1)
+				vhat := v / (1 - b2)
+				if vhat < 0 {
+					vhat = 0
+				}
+				w.X[l] -= eta * mhat / (sqrt(vhat) + 1e-8)
+			}
+		}
+		points = append(points, plotter.XY{X: float64(i), Y: float64(cost)})
+		progress.Update(i+1, fmt.Sprintf("cost=%f", cost))
+		if tolerance > 0 {
+			if i == 0 || cost < best*(1-tolerance) {
+				best, stale = cost, 0
+			} else if stale++; stale >= *FlagHeaderPatience {
+				progress.Update(i+1, fmt.Sprintf("converged cost=%f", cost))
+				break
+			}
+		}
+	}
+	progress.Done()
+
+	p := plot.New()
+
+	p.Title.Text = "epochs vs cost"
+	p.X.Label.Text = "epochs"
+	p.Y.Label.Text = "cost"
+
+	scatter, err := plotter.NewScatter(points)
+	if err != nil {
+		panic(err)
+	}
+	scatter.GlyphStyle.Radius = vg.Length(1)
+	scatter.GlyphStyle.Shape = draw.CircleGlyph{}
+	p.Add(scatter)
+
+	err = p.Save(8*vg.Inch, 8*vg.Inch, "epochs.png")
+	if err != nil {
+		panic(err)
+	}
+
+	return &Transform{
+		Mean: avg,
+		A:    append([]float32{}, set.ByName["A"].X...),
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// FlagJobs is the number of generation jobs that run at once
+	FlagJobs = flag.Int("jobs", 4, "number of generation jobs that run at once, the other jobs wait in the job queue")
+	// FlagJobQueue is the number of generation jobs that wait to run
+	FlagJobQueue = flag.Int("job-queue", 64, "number of generation jobs that wait for a running job to finish, new jobs are rejected with 503 while it is full")
+	// FlagCallbackTimeout is the timeout of a job callback
+	FlagCallbackTimeout = flag.Duration("callback-timeout", 10*time.Second, "time allowed to post a finished job to its callback")
+	// FlagCallbackHosts are the hosts job callbacks can be posted to
+	FlagCallbackHosts = flag.String("callback-hosts", "", "comma separated hosts job callbacks can be posted to, empty allows any host whose addresses aren't loopback, private, or link-local")
+)
+
+// JobRetention is how long a finished job is kept around for polling
+const JobRetention = time.Hour
+
+const (
+	// JobQueued is the status of a job that is waiting in the job queue
+	JobQueued = "queued"
+	// JobRunning is the status of a job that is generating
+	JobRunning = "running"
+	// JobDone is the status of a job that has finished
+	JobDone = "done"
+	// JobFailed is the status of a job that has failed
+	JobFailed = "failed"
+	// JobCanceled is the status of a job that was canceled, its result is
+	// the partial result
+	JobCanceled = "canceled"
+)
+
+// JobRequest is a request to start a generation job
+type JobRequest struct {
+	Request
+	// Callback is an optional url that receives the finished job as a POST
+	Callback string `json:"callback"`
+}
+
+// Job is a long running generation job
+type Job struct {
+	sync.Mutex `json:"-"`
+	ID         string   `json:"id"`
+	Status     string   `json:"status"`
+	Symbols    int      `json:"symbols"`
+	Count      int      `json:"count"`
+	Progress   float64  `json:"progress"`
+	Text       string   `json:"text"`
+	Result     []Output `json:"result,omitempty"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	Error      string   `json:"error,omitempty"`
+
+	cancel chan struct{}
+	once   sync.Once
+	done   chan struct{}
+}
+
+// Cancel stops the job at the next symbol
+func (j *Job) Cancel() {
+	j.once.Do(func() {
+		close(j.cancel)
+	})
+}
+
+// Snapshot returns the json encoding of the job
+func (j *Job) Snapshot() []byte {
+	j.Lock()
+	defer j.Unlock()
+	data, err := json.Marshal(j)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// ErrCallbackAddress is the error of a callback to an internal address
+var ErrCallbackAddress = errors.New("callbacks can't be posted to loopback, private, or link-local addresses")
+
+// Internal is true if an address is loopback, private, link-local, or
+// unspecified
+func Internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// NewCallbackClient makes the client job callbacks are posted with, it times
+// out and doesn't follow redirects. Without allowed hosts it refuses to
+// connect to internal addresses, they are checked after the host is
+// resolved so a name can't resolve to one
+func NewCallbackClient(timeout time.Duration, hosts []string) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if len(hosts) == 0 {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || Internal(ip) {
+				return ErrCallbackAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Jobs is the asynchronous job api, the jobs are run by a fixed number of
+// workers from a bounded queue
+type Jobs struct {
+	sync.Mutex
+	Handler Handler
+	Jobs    map[string]*Job
+	// Prefix starts the ids of the jobs
+	Prefix string
+	// Hosts are the hosts callbacks can be posted to, any host that isn't
+	// internal if it is empty
+	Hosts  []string
+	Client *http.Client
+	queue  chan func()
+}
+
+// NewJobs creates a new job api with workers running the jobs of a queue of
+// queued jobs
+func NewJobs(handler Handler, workers, queued int) *Jobs {
+	var hosts []string
+	for _, host := range strings.Split(*FlagCallbackHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+	}
+	j := &Jobs{
+		Handler: handler,
+		Jobs:    make(map[string]*Job),
+		Hosts:   hosts,
+		Client:  NewCallbackClient(*FlagCallbackTimeout, hosts),
+		queue:   make(chan func(), max(queued, 0)),
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		go func() {
+			for run := range j.queue {
+				run()
+			}
+		}()
+	}
+	return j
+}
+
+// CheckCallback checks the url a finished job is posted to, its host has to
+// be allowed and it can't be an internal address
+func (j *Jobs) CheckCallback(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid callback url %s", callback)
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(j.Hosts) > 0 {
+		if !slices.Contains(j.Hosts, host) {
+			return fmt.Errorf("callbacks can't be posted to %s", host)
+		}
+		return nil
+	}
+	if ip := net.ParseIP(host); (ip != nil && Internal(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrCallbackAddress
+	}
+	return nil
+}
+
+// Create starts a new generation job and returns its id immediately
+func (j *Jobs) Create(response http.ResponseWriter, request *http.Request) {
+	var req JobRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	options, err := req.Options()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DryRun {
+		http.Error(response, "dry runs are estimated by /v1/generate", http.StatusBadRequest)
+		return
+	}
+	query, err := req.Prompt()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Callback != "" {
+		err := j.CheckCallback(req.Callback)
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !j.Handler.Admit(response, request, options) {
+		return
+	}
+	options.Account = AccountOf(request)
+
+	job := &Job{
+		ID:     NewID(j.Prefix),
+		Status: JobQueued,
+		Count:  options.Count,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	options.Cancel = job.cancel
+	j.Lock()
+	j.Jobs[job.ID] = job
+	j.Unlock()
+
+	postprocess := options.Postprocess
+	options.Progress = func(symbols int, result []Output) {
+		job.Lock()
+		defer job.Unlock()
+		job.Symbols = symbols
+		job.Progress = float64(symbols) / float64(job.Count)
+		job.Text = Text(postprocess.Apply(query, result[:postprocess.Stable(result)]))
+	}
+	select {
+	case j.queue <- func() { j.Run(job, query, options, req.Callback) }:
+	default:
+		j.Lock()
+		delete(j.Jobs, job.ID)
+		j.Unlock()
+		options.Account.Refund(time.Now(), uint64(options.Count))
+		http.Error(response, "the job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.WriteHeader(http.StatusAccepted)
+	response.Write(job.Snapshot())
+}
+
+// Run runs a job to completion and notifies the callback, a job canceled
+// while it was queued isn't run
+func (j *Jobs) Run(job *Job, query []byte, options Options, callback string) {
+	defer func() {
+		if r := recover(); r != nil {
+			job.Lock()
+			job.Status, job.Error = JobFailed, fmt.Sprint(r)
+			job.Unlock()
+		}
+		if callback != "" {
+			response, err := j.Client.Post(callback, "application/json; charset=utf-8", bytes.NewReader(job.Snapshot()))
+			if err != nil {
+				fmt.Println("job", job.ID, "callback failed", err)
+			} else {
+				response.Body.Close()
+			}
+		}
+		close(job.done)
+		time.AfterFunc(JobRetention, func() {
+			j.Lock()
+			delete(j.Jobs, job.ID)
+			j.Unlock()
+		})
+	}()
+
+	job.Lock()
+	if job.Status == JobCanceled {
+		job.Unlock()
+		options.Account.Refund(time.Now(), uint64(options.Count))
+		return
+	}
+	job.Status = JobRunning
+	job.Unlock()
+	h := j.Handler
+	searches := h.Soda(query, options)
+	job.Lock()
+	job.Status, job.Progress, job.Result = JobDone, 1, searches[0].Result
+	job.Truncated, job.Text = searches[0].Truncated, Text(searches[0].Result)
+	if searches[0].Canceled {
+		job.Status, job.Progress = JobCanceled, float64(job.Symbols)/float64(job.Count)
+	}
+	job.Unlock()
+}
+
+// job returns the job of the request replying with a 404 if it doesn't exist
+func (j *Jobs) job(response http.ResponseWriter, request *http.Request) *Job {
+	j.Lock()
+	job, ok := j.Jobs[request.PathValue("id")]
+	j.Unlock()
+	if !ok {
+		http.NotFound(response, request)
+		return nil
+	}
+	return job
+}
+
+// Status reports the progress and partial text of a job
+func (j *Jobs) Status(response http.ResponseWriter, request *http.Request) {
+	job := j.job(response, request)
+	if job == nil {
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Write(job.Snapshot())
+}
+
+// Cancel stops a running job at the next symbol and replies with the job and
+// its partial result once it has stopped, a queued job is canceled without
+// running and a finished job is returned as it is
+func (j *Jobs) Cancel(response http.ResponseWriter, request *http.Request) {
+	job := j.job(response, request)
+	if job == nil {
+		return
+	}
+	job.Cancel()
+	job.Lock()
+	queued := job.Status == JobQueued
+	if queued {
+		job.Status = JobCanceled
+	}
+	job.Unlock()
+	if queued {
+		// the job is finished when a worker takes it from the queue
+		response.Header().Set("Content-Type", "application/json; charset=utf-8")
+		response.Write(job.Snapshot())
+		return
+	}
+	select {
+	case <-job.done:
+	case <-request.Context().Done():
+		return
+	}
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.Write(job.Snapshot())
+}
@@ -0,0 +1,255 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlagKeys is the api keys file
+var FlagKeys = flag.String("keys", "", "json file of api keys with their models, daily symbol quotas, and rate limits, when given every request but those of the web page and the shards needs a key")
+
+// Key is an api key
+type Key struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// Models are the names of the databases the key can use, all if empty
+	Models []string `json:"models,omitempty"`
+	// Symbols is the number of symbols that can be requested per day, 0 is
+	// unlimited
+	Symbols uint64 `json:"symbols_per_day,omitempty"`
+	// Rate is the number of requests per second, 0 is unlimited
+	Rate float64 `json:"rate,omitempty"`
+	// Burst is the number of requests that can be made at once, at least 1
+	Burst int `json:"burst,omitempty"`
+	// Admin can query the usage of all keys
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Usage is the usage of a key
+type Usage struct {
+	Name     string `json:"name"`
+	Requests uint64 `json:"requests"`
+	Symbols  uint64 `json:"symbols"`
+	// Day is the utc day Today is counted for
+	Day   string `json:"day"`
+	Today uint64 `json:"today"`
+	// Limited is the number of requests rejected by the rate limit or quota
+	Limited uint64 `json:"limited"`
+}
+
+// Account is the state of a key
+type Account struct {
+	sync.Mutex
+	Key   Key
+	Usage Usage
+	// Tokens are the requests that can be made now
+	Tokens float64
+	Last   time.Time
+}
+
+// Allow takes a token from the rate limit, returning the time until one is
+// available if there are none
+func (a *Account) Allow(now time.Time) (bool, time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	a.Usage.Requests++
+	if a.Key.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(a.Key.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	a.Tokens = math.Min(burst, a.Tokens+now.Sub(a.Last).Seconds()*a.Key.Rate)
+	a.Last = now
+	if a.Tokens < 1 {
+		a.Usage.Limited++
+		return false, time.Duration((1 - a.Tokens) / a.Key.Rate * float64(time.Second))
+	}
+	a.Tokens--
+	return true, 0
+}
+
+// Charge charges symbols against the daily quota, failing without charging if
+// the quota would be exceeded
+func (a *Account) Charge(now time.Time, symbols uint64) error {
+	a.Lock()
+	defer a.Unlock()
+	day := now.UTC().Format(time.DateOnly)
+	if a.Usage.Day != day {
+		a.Usage.Day, a.Usage.Today = day, 0
+	}
+	if a.Key.Symbols > 0 && a.Usage.Today+symbols > a.Key.Symbols {
+		a.Usage.Limited++
+		return fmt.Errorf("daily quota of %d symbols exceeded, %d remaining", a.Key.Symbols, a.Key.Symbols-a.Usage.Today)
+	}
+	a.Usage.Today += symbols
+	a.Usage.Symbols += symbols
+	return nil
+}
+
+// Refund returns symbols that were charged but not generated to the quota, a
+// nil account is ignored
+func (a *Account) Refund(now time.Time, symbols uint64) {
+	if a == nil || symbols == 0 {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.Usage.Day == now.UTC().Format(time.DateOnly) {
+		a.Usage.Today -= min(symbols, a.Usage.Today)
+	}
+	a.Usage.Symbols -= min(symbols, a.Usage.Symbols)
+}
+
+// Snapshot returns a copy of the usage
+func (a *Account) Snapshot() Usage {
+	a.Lock()
+	defer a.Unlock()
+	return a.Usage
+}
+
+// Keys are the api keys of a server hosting the model Model
+type Keys struct {
+	Model    string
+	Accounts map[string]*Account
+}
+
+// LoadKeys loads the api keys file for the model named model
+func LoadKeys(path, model string) (*Keys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k := &Keys{
+		Model:    model,
+		Accounts: make(map[string]*Account, len(keys)),
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("%s: key %s has no key", path, key.Name)
+		}
+		if _, ok := k.Accounts[key.Key]; ok {
+			return nil, fmt.Errorf("%s: duplicate key for %s", path, key.Name)
+		}
+		if key.Burst < 1 {
+			key.Burst = 1
+		}
+		k.Accounts[key.Key] = &Account{
+			Key:    key,
+			Usage:  Usage{Name: key.Name},
+			Tokens: float64(key.Burst),
+			Last:   now,
+		}
+	}
+	return k, nil
+}
+
+// For returns the keys of the server hosting the model named model, the
+// accounts are shared so the quotas and rate limits span the models
+func (k *Keys) For(model string) *Keys {
+	return &Keys{
+		Model:    model,
+		Accounts: k.Accounts,
+	}
+}
+
+// accountKey is the context key of the account of a request
+type accountKey struct{}
+
+// AccountOf returns the account of a request, nil if the server has no keys
+func AccountOf(request *http.Request) *Account {
+	account, _ := request.Context().Value(accountKey{}).(*Account)
+	return account
+}
+
+// Wrap requires a key for the requests to next that aren't public, enforcing
+// the models and rate limit of the key
+func (k *Keys) Wrap(next http.Handler, public func(request *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if public(request) {
+			next.ServeHTTP(response, request)
+			return
+		}
+		key := request.Header.Get("X-API-Key")
+		if auth := request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+		account, ok := k.Accounts[key]
+		if !ok {
+			http.Error(response, "a valid api key is required", http.StatusUnauthorized)
+			return
+		}
+		if len(account.Key.Models) > 0 {
+			allowed := false
+			for _, model := range account.Key.Models {
+				allowed = allowed || model == k.Model
+			}
+			if !allowed {
+				http.Error(response, fmt.Sprintf("the key can't use the model %s", k.Model), http.StatusForbidden)
+				return
+			}
+		}
+		if ok, wait := account.Allow(time.Now()); !ok {
+			response.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			http.Error(response, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(response, request.WithContext(context.WithValue(request.Context(), accountKey{}, account)))
+	})
+}
+
+// Admit checks the options of a request and reserves the symbols requested in
+// the quota of its key, replying with an error if the request can't be served.
+// The symbols that aren't generated are refunded to the Account of the options
+func (h Handler) Admit(response http.ResponseWriter, request *http.Request, options Options) bool {
+	err := h.Check(options)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if account := AccountOf(request); account != nil {
+		err = account.Charge(time.Now(), uint64(options.Count))
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusTooManyRequests)
+			return false
+		}
+	}
+	return true
+}
+
+// Usage reports the usage of every key to admin keys
+func (k *Keys) Usage(response http.ResponseWriter, request *http.Request) {
+	account := AccountOf(request)
+	if account == nil || !account.Key.Admin {
+		http.Error(response, "an admin key is required", http.StatusForbidden)
+		return
+	}
+	usage := make([]Usage, 0, len(k.Accounts))
+	for _, account := range k.Accounts {
+		usage = append(usage, account.Snapshot())
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Name < usage[j].Name
+	})
+	Reply(response, usage)
+}
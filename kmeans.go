@@ -0,0 +1,168 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+const (
+	// HeaderGaussian samples the buckets from a gaussian fitted to the mixer
+	// vectors of the corpus
+	HeaderGaussian = "gaussian"
+	// HeaderKMeans clusters a sample of the mixer vectors of the corpus into
+	// the buckets
+	HeaderKMeans = "kmeans"
+)
+
+var (
+	// FlagHeader is the header initialization method of a build
+	FlagHeader = flag.String("header", HeaderGaussian, "header initialization: gaussian samples the buckets from a gaussian fitted to the mixer vectors, kmeans clusters a sample of the mixer vectors with mini-batch k-means, recorded in the database")
+	// FlagHeaderIterations is the maximum number of iterations of the
+	// gaussian header training
+	FlagHeaderIterations = flag.Int("header-iterations", 1024, "maximum number of iterations of the gaussian header training")
+	// FlagHeaderRate is the learning rate of the gaussian header training
+	FlagHeaderRate = flag.Float64("header-rate", 1.0e-3, "learning rate of the gaussian header training")
+	// FlagHeaderTolerance is the relative cost improvement below which the
+	// gaussian header training stops
+	FlagHeaderTolerance = flag.Float64("header-tolerance", 0, "relative improvement of the best cost of the gaussian header training below which it stops after -header-patience iterations, 0 runs every iteration")
+	// FlagHeaderPatience is the number of iterations without improvement
+	// after which the gaussian header training stops
+	FlagHeaderPatience = flag.Int("header-patience", 32, "number of iterations the cost of the gaussian header training can go without improving by -header-tolerance before it stops")
+)
+
+const (
+	// KMeansSamples is the maximum number of mixer vectors clustered
+	KMeansSamples = 1 << 16
+	// KMeansBatch is the number of vectors of each mini-batch
+	KMeansBatch = 4096
+	// KMeansIterations is the number of mini-batches
+	KMeansIterations = 32
+)
+
+// CheckHeader checks the header initialization of build settings
+func CheckHeader(settings Settings) error {
+	switch settings.Header {
+	case "", HeaderKMeans:
+	default:
+		return fmt.Errorf("unknown header initialization %s", settings.Header)
+	}
+	if settings.Header == HeaderKMeans && *FlagTransform != "" {
+		return fmt.Errorf("-transform requires the gaussian header initialization")
+	}
+	if *FlagHeaderIterations < 1 {
+		return fmt.Errorf("header iterations must be positive")
+	}
+	if !(*FlagHeaderRate > 0) {
+		return fmt.Errorf("header rate must be positive")
+	}
+	if !(*FlagHeaderTolerance >= 0) || *FlagHeaderPatience < 1 {
+		return fmt.Errorf("header tolerance must not be negative and header patience must be positive")
+	}
+	return nil
+}
+
+// KMeansHeader clusters the mixer vectors of the length symbols of a pass over
+// the corpus at the sorted positions of samples, or every position if it is
+// nil, into the buckets of a header with spherical mini-batch k-means. At most
+// KMeansSamples vectors evenly spaced over the positions are clustered
+func KMeansHeader(pass func(fn func(data []byte)), length int, samples []int, settings Settings) Header {
+	model := make(Header, ModelSize*1024)
+	rng := rand.New(rand.NewSource(1))
+	n := length
+	if samples != nil {
+		n = len(samples)
+	}
+	stride := (n + KMeansSamples - 1) / KMeansSamples
+	if stride < 1 {
+		stride = 1
+	}
+	vectors := make([][256]float32, 0, (n+stride-1)/stride)
+	m := settings.NewMixer()
+	m.Add(0)
+	progress, j, s, k := NewProgress("header vectors", length), 0, 0, 0
+	pass(func(data []byte) {
+		for _, v := range data {
+			progress.Update(j, "")
+			sampled := samples == nil
+			if !sampled && s < len(samples) && samples[s] == j {
+				s++
+				sampled = true
+			}
+			if sampled {
+				if k%stride == 0 {
+					var vector [256]float32
+					m.Mix(&vector)
+					vectors = append(vectors, vector)
+				}
+				k++
+			}
+			m.Add(v)
+			j++
+		}
+	})
+	progress.Done()
+	if len(vectors) == 0 {
+		panic("the corpus has no vectors to cluster")
+	}
+
+	// the centers start at distinct vectors while there are enough of them
+	centers, counts := make([][256]float32, len(model)), make([]int, len(model))
+	perm := rng.Perm(len(vectors))
+	for i := range centers {
+		if i < len(perm) {
+			centers[i] = vectors[perm[i]]
+		} else {
+			centers[i] = vectors[rng.Intn(len(vectors))]
+		}
+	}
+	batch, assignments := make([]int, KMeansBatch), make([]int, KMeansBatch)
+	cpus := runtime.NumCPU()
+	progress = NewProgress("header k-means", KMeansIterations)
+	for i := 0; i < KMeansIterations; i++ {
+		for b := range batch {
+			batch[b] = rng.Intn(len(vectors))
+		}
+		var wait sync.WaitGroup
+		for c := 0; c < cpus; c++ {
+			wait.Add(1)
+			go func(c int) {
+				defer wait.Done()
+				for b := c; b < len(batch); b += cpus {
+					vector, best, max := vectors[batch[b]][:], 0, float32(-2)
+					for center := range centers {
+						if cs := CS(vector, centers[center][:]); cs > max {
+							best, max = center, cs
+						}
+					}
+					assignments[b] = best
+				}
+			}(c)
+		}
+		wait.Wait()
+		// each center moves toward its vectors with a rate of one over the
+		// number of vectors it has been assigned
+		for b, center := range assignments {
+			counts[center]++
+			rate := 1 / float32(counts[center])
+			for d, value := range vectors[batch[b]] {
+				centers[center][d] += rate * (value - centers[center][d])
+			}
+		}
+		for center := range centers {
+			unit(centers[center][:], centers[center][:])
+		}
+		progress.Update(i+1, "")
+	}
+	progress.Done()
+	for i := range model {
+		settings.Project(model[i].Vector[:], centers[i][:])
+	}
+	return model
+}
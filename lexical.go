@@ -0,0 +1,169 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// FlagLexical is the weight of the lexical score of candidates
+var FlagLexical = flag.Float64("lexical", 0, "weight of the bm25 score of the character n-grams of the recent text in the corpus before a candidate, blended with its cosine score, 0 disables the lexical index")
+
+const (
+	// LexicalGram is the number of runes of the n-grams of the lexical index
+	LexicalGram = 4
+	// LexicalSuffix is the number of runes of recent text whose n-grams are
+	// looked up
+	LexicalSuffix = 32
+	// LexicalWindow is the number of runes of corpus before a candidate the
+	// n-grams are counted in
+	LexicalWindow = 64
+	// LexicalK1 is the term frequency saturation of the bm25 score
+	LexicalK1 = 1.2
+)
+
+// LexicalIndex is an inverted index of the character n-grams of a corpus,
+// each n-gram has the sorted rune indexes it starts at
+type LexicalIndex struct {
+	Postings map[uint64][]uint32
+	// Runes is the number of runes of the corpus
+	Runes int
+	// Weight is the weight of the lexical score
+	Weight float32
+}
+
+// gram hashes an n-gram of runes
+func gram(runes []rune) uint64 {
+	hash := uint64(0xCBF29CE484222325)
+	for _, r := range runes {
+		hash = (hash ^ uint64(r)) * 0x100000001B3
+	}
+	return hash
+}
+
+// NewLexicalIndex indexes the n-grams of the corpus
+func NewLexicalIndex(corpus []rune, weight float32) (*LexicalIndex, error) {
+	if !(weight > 0) {
+		return nil, fmt.Errorf("the lexical weight must be positive")
+	}
+	if uint64(len(corpus)) > math.MaxUint32 {
+		return nil, fmt.Errorf("the corpus is too large for the lexical index")
+	}
+	index := LexicalIndex{
+		Postings: make(map[uint64][]uint32),
+		Runes:    len(corpus),
+		Weight:   weight,
+	}
+	for i := 0; i+LexicalGram <= len(corpus); i++ {
+		key := gram(corpus[i : i+LexicalGram])
+		index.Postings[key] = append(index.Postings[key], uint32(i))
+	}
+	return &index, nil
+}
+
+// Term is an n-gram of the recent text and its inverse document frequency
+type Term struct {
+	Postings []uint32
+	IDF      float64
+}
+
+// Terms returns the distinct n-grams of the end of text that occur in the
+// corpus, and the sum of their inverse document frequencies
+func (l *LexicalIndex) Terms(text []byte) ([]Term, float64) {
+	runes := []rune{}
+	for len(text) > 0 && len(runes) < LexicalSuffix {
+		r, size := utf8.DecodeLastRune(text)
+		runes = append(runes, r)
+		text = text[:len(text)-size]
+	}
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	seen, terms, total := make(map[uint64]bool), []Term{}, 0.0
+	for i := 0; i+LexicalGram <= len(runes); i++ {
+		key := gram(runes[i : i+LexicalGram])
+		postings, ok := l.Postings[key]
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		n := float64(len(postings))
+		idf := math.Log(1 + (float64(l.Runes)-n+.5)/(n+.5))
+		terms = append(terms, Term{Postings: postings, IDF: idf})
+		total += idf
+	}
+	return terms, total
+}
+
+// Score is the bm25 score of the terms in the window of corpus before the rune
+// index, divided by total so a window with each term once scores 1
+func (l *LexicalIndex) Score(terms []Term, total float64, index uint64) float32 {
+	if total == 0 || index < LexicalGram {
+		return 0
+	}
+	start, end := uint64(0), index-LexicalGram
+	if index > LexicalWindow {
+		start = index - LexicalWindow
+	}
+	score := 0.0
+	for _, term := range terms {
+		first := sort.Search(len(term.Postings), func(i int) bool {
+			return uint64(term.Postings[i]) >= start
+		})
+		last := sort.Search(len(term.Postings), func(i int) bool {
+			return uint64(term.Postings[i]) > end
+		})
+		if tf := float64(last - first); tf > 0 {
+			score += term.IDF * tf * (LexicalK1 + 1) / (tf + LexicalK1)
+		}
+	}
+	return float32(score / total)
+}
+
+// Reranker returns a reranker that adds the weighted lexical score of the
+// recent text to the score of each candidate after next reranks them, the
+// symbols of the query and text are expanded with expansions, decoded text
+// is unchanged as merged symbols don't occur in it
+func (l *LexicalIndex) Reranker(next Reranker, expansions *[256][]byte) Reranker {
+	return func(ctx Context, candidates []Candidate) []Candidate {
+		if next != nil {
+			candidates = next(ctx, candidates)
+		}
+		// a symbol stands for at least one byte so the end of the query
+		// covers the suffix
+		query := ctx.Query
+		if len(query) > utf8.UTFMax*LexicalSuffix {
+			query = query[len(query)-utf8.UTFMax*LexicalSuffix:]
+		}
+		text := []byte{}
+		for _, symbol := range query {
+			text = append(text, expansions[symbol]...)
+		}
+		for _, symbol := range ctx.Text {
+			text = append(text, expansions[symbol]...)
+		}
+		terms, total := l.Terms(text)
+		if total == 0 {
+			return candidates
+		}
+		for i := range candidates {
+			candidates[i].Score += l.Weight * l.Score(terms, total, candidates[i].Index)
+		}
+		return candidates
+	}
+}
+
+// LexicalIndex indexes the corpus of the model
+func (m *Model) LexicalIndex(weight float32) (*LexicalIndex, error) {
+	corpus, err := m.Corpus()
+	if err != nil {
+		return nil, fmt.Errorf("the corpus isn't available for the lexical index: %w", err)
+	}
+	return NewLexicalIndex(corpus, weight)
+}
@@ -0,0 +1,57 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"math"
+)
+
+// FlagLocality is the weight of the corpus locality of candidates
+var FlagLocality = flag.Float64("locality", 0, "weight of the closeness in the corpus of a candidate to where the recently chosen outputs continue, added to its score so generation follows passages, 0 disables it")
+
+const (
+	// LocalityRecent is the number of recent outputs candidates are compared
+	// to
+	LocalityRecent = 8
+	// LocalityScale is the corpus distance in runes ahead of a continuation at
+	// which the locality of a candidate falls to 1/e
+	LocalityScale = 64
+)
+
+// Locality adds the weighted locality of each candidate to its score, the
+// locality is 1 for a candidate that continues a recent output in the corpus
+// and falls off exponentially with the distance ahead of where it continues,
+// candidates behind it would repeat the passage and candidates from other
+// documents have no locality
+func Locality(candidates []Candidate, result []Output, weight float32) {
+	recent := result
+	if len(recent) > LocalityRecent {
+		recent = recent[len(recent)-LocalityRecent:]
+	}
+	if len(recent) == 0 || weight == 0 {
+		return
+	}
+	for i := range candidates {
+		closest := math.Inf(1)
+		for j, output := range recent {
+			if output.Document != candidates[i].Document {
+				continue
+			}
+			// the output continues at the index after it plus the outputs
+			// that followed it
+			next := output.Index + uint64(len(recent)-j)
+			if candidates[i].Index < next {
+				continue
+			}
+			if distance := float64(candidates[i].Index - next); distance < closest {
+				closest = distance
+			}
+		}
+		if !math.IsInf(closest, 1) {
+			candidates[i].Score += weight * float32(math.Exp(-closest/LocalityScale))
+		}
+	}
+}
@@ -8,18 +8,30 @@ import (
 	"compress/bzip2"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"math"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/pointlander/soda/client"
+	"github.com/pointlander/soda/encoding/binaryvec"
 )
 
+// Data are the embedded books, see Books
+//
 //go:embed books/*
 var Data embed.FS
 
+// Index are the embedded assets, see Assets
+//
 //go:embed assets/index.html
 var Index embed.FS
 
@@ -28,118 +40,584 @@ var (
 	FlagQuery = flag.String("query", "What is the meaning of life?", "query flag")
 	// FlagCount count is the number of symbols to generate
 	FlagCount = flag.Int("count", 128, "number of symbols to generate")
-	// FlagBuild build the database
-	FlagBuild = flag.Bool("build", false, "build the database")
+	// FlagBuild build the database, deprecated by soda build
+	FlagBuild = flag.Bool("build", false, "build the database, deprecated: use soda build")
 	// FlagMoar use more training data
 	FlagMoar = flag.Bool("moar", false, "use more training data")
-	// FlagServer is server mode
-	FlagServer = flag.Bool("server", false, "server mode")
-	// FlagBrute is the brute force mode
-	FlagBrute = flag.Bool("brute", false, "brute force mode")
-	// FlagRank is page rank mode
-	FlagRank = flag.Bool("rank", false, "page rank mode")
+	// FlagServer is server mode, deprecated by soda serve
+	FlagServer = flag.Bool("server", false, "server mode, deprecated: use soda serve")
+	// FlagBrute is the brute force mode, deprecated by soda brute
+	FlagBrute = flag.Bool("brute", false, "brute force mode, deprecated: use soda brute")
+	// FlagRank is page rank mode, deprecated by soda rank
+	FlagRank = flag.Bool("rank", false, "page rank mode, deprecated: use soda rank, and soda rank build to build the page rank database")
+	// FlagContinue continues the corpus from a document byte offset
+	FlagContinue = flag.String("continue", "", "generate from the corpus content before doc:offset")
+	// FlagNProbe is the number of buckets to probe per symbol
+	FlagNProbe = flag.Int("nprobe", 8, "maximum number of buckets to probe per symbol")
+	// FlagProbeThreshold is the bucket similarity below which buckets aren't probed
+	FlagProbeThreshold = flag.Float64("probe-threshold", 0, "bucket similarity below which buckets aren't probed")
+	// FlagSymbols restricts the symbols that can be generated
+	FlagSymbols = flag.String("symbols", "", "regular expression character class of the symbols that can start a generated rune")
+	// FlagOnlyDoc restricts generation to documents or corpus ranges
+	FlagOnlyDoc = flag.String("only-doc", "", "comma separated document ids, titles, or corpus ranges start-end to draw candidates from")
+	// FlagWeights are the document weights
+	FlagWeights = flag.String("weights", "", "comma separated document weights name=weight multiplying the sampling mass of candidates from the documents, 0 excludes a document, recorded as the default when building")
+	// FlagQuota is the maximum number of candidates of a step from one document
+	FlagQuota = flag.Int("quota", 0, "maximum number of the candidates of each symbol from one document, 0 is no limit, recorded as the default when building")
+	// FlagRaw skips the smoothing of the query
+	FlagRaw = flag.Bool("raw", false, "don't smooth typographic variants in the query")
+	// FlagContext is the number of runes of corpus context shown around each output
+	FlagContext = flag.Int("context", 0, "number of runes of the corpus on each side of the source of each output to return with it")
+	// FlagDeadline is the time budget of generation
+	FlagDeadline = flag.Duration("deadline", 0, "stop generating after the duration and return the partial result, 0 is no limit")
+	// FlagEntropyWeight is the weight of the entropy match in candidate scoring
+	FlagEntropyWeight = flag.Float64("entropy-weight", 0, "weight of the match between the context entropy and the entry entropy in candidate scoring")
 )
 
-var Moar = []string{
-	"books/84.txt.utf-8.bz2",    // 2 Frankenstein; Or, The Modern Prometheus
-	"books/2701.txt.utf-8.bz2",  // 3 Moby Dick; Or, The Whale
-	"books/1513.txt.utf-8.bz2",  // 4 Romeo and Juliet
-	"books/1342.txt.utf-8.bz2",  // 5 Pride and Prejudice
-	"books/11.txt.utf-8.bz2",    // 6 Alice's Adventures in Wonderland
-	"books/145.txt.utf-8.bz2",   // 7 Middlemarch
-	"books/2641.txt.utf-8.bz2",  // 8 A Room with a View
-	"books/37106.txt.utf-8.bz2", // 9 Little Women; Or, Meg, Jo, Beth, and Amy
-	"books/64317.txt.utf-8.bz2", // 10 The Great Gatsby
-	"books/100.txt.utf-8.bz2",   // 11 The Complete Works of William Shakespeare
-	"books/75256.txt.utf-8.bz2", // 12 Pirate tales from the law
-	"books/16389.txt.utf-8.bz2", // 13 The Enchanted April
-	"books/67979.txt.utf-8.bz2", // 14 The Blue Castle: a novel
-	"books/394.txt.utf-8.bz2",   // 15 Cranford
-	"books/6761.txt.utf-8.bz2",  // 16 The Adventures of Ferdinand Count Fathom — Complete
-	"books/2542.txt.utf-8.bz2",  // 17 A Doll's House : a play
-	"books/2160.txt.utf-8.bz2",  // 18 The Expedition of Humphry Clinker
-	"books/4085.txt.utf-8.bz2",  // 19 The Adventures of Roderick Random
-	"books/6593.txt.utf-8.bz2",  // 20 History of Tom Jones, a Foundling
+// Moar is the additional training data
+var Moar = []Document{
+	{Path: "books/84.txt.utf-8.bz2", Title: "Frankenstein; Or, The Modern Prometheus"},
+	{Path: "books/2701.txt.utf-8.bz2", Title: "Moby Dick; Or, The Whale"},
+	{Path: "books/1513.txt.utf-8.bz2", Title: "Romeo and Juliet"},
+	{Path: "books/1342.txt.utf-8.bz2", Title: "Pride and Prejudice"},
+	{Path: "books/11.txt.utf-8.bz2", Title: "Alice's Adventures in Wonderland"},
+	{Path: "books/145.txt.utf-8.bz2", Title: "Middlemarch"},
+	{Path: "books/2641.txt.utf-8.bz2", Title: "A Room with a View"},
+	{Path: "books/37106.txt.utf-8.bz2", Title: "Little Women; Or, Meg, Jo, Beth, and Amy"},
+	{Path: "books/64317.txt.utf-8.bz2", Title: "The Great Gatsby"},
+	{Path: "books/100.txt.utf-8.bz2", Title: "The Complete Works of William Shakespeare"},
+	{Path: "books/75256.txt.utf-8.bz2", Title: "Pirate tales from the law"},
+	{Path: "books/16389.txt.utf-8.bz2", Title: "The Enchanted April"},
+	{Path: "books/67979.txt.utf-8.bz2", Title: "The Blue Castle: a novel"},
+	{Path: "books/394.txt.utf-8.bz2", Title: "Cranford"},
+	{Path: "books/6761.txt.utf-8.bz2", Title: "The Adventures of Ferdinand Count Fathom — Complete"},
+	{Path: "books/2542.txt.utf-8.bz2", Title: "A Doll's House : a play"},
+	{Path: "books/2160.txt.utf-8.bz2", Title: "The Expedition of Humphry Clinker"},
+	{Path: "books/4085.txt.utf-8.bz2", Title: "The Adventures of Roderick Random"},
+	{Path: "books/6593.txt.utf-8.bz2", Title: "History of Tom Jones, a Foundling"},
 }
 
 // Root is the root file
-type Root struct{}
+type Root struct {
+	// Contents are the contents of the assets by name, each is made by the
+	// first request for it so it is compressed once
+	Contents sync.Map
+}
 
-// ServeHTTP implements model inference access
-func (r Root) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	file, err := Index.Open("assets/index.html")
+// ServeHTTP serves the asset of the path, paths that aren't assets are
+// served the index
+func (r *Root) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	name := strings.TrimPrefix(request.URL.Path, "/")
+	file, err := fs.File(nil), fs.ErrNotExist
+	if name != "" && fs.ValidPath(name) {
+		file, err = Assets.Open("assets/" + name)
+		if err == nil {
+			info, stat := file.Stat()
+			if stat != nil || info.IsDir() {
+				file.Close()
+				file, err = nil, fs.ErrNotExist
+			}
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		name = "index.html"
+		file, err = Assets.Open("assets/index.html")
+	}
 	if err != nil {
 		panic(err)
 	}
 	defer file.Close()
+	if content, ok := r.Contents.Load(name); ok {
+		content.(*Content).ServeHTTP(response, request)
+		return
+	}
 	input, err := io.ReadAll(file)
 	if err != nil {
 		panic(err)
 	}
-	response.Header().Set("Content-Type", "text/html; charset=utf-8")
-	response.Write(input)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	content, _ := r.Contents.LoadOrStore(name, NewContent(input, contentType))
+	content.(*Content).ServeHTTP(response, request)
 }
 
 // Bibiel is the bible file
-type Bible struct{}
+type Bible struct {
+	Redaction Redaction
+	Pipeline  Pipeline
+	// Content is the corpus, it is loaded by the first request
+	Content *Content
+	once    sync.Once
+}
 
 // ServeHTTP implements model inference access
-func (b Bible) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	file, err := Data.Open("books/10.txt.utf-8.bz2")
+func (b *Bible) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	b.once.Do(func() {
+		input, _ := LoadCorpus(Documents(), b.Redaction, b.Pipeline)
+		b.Content = NewContent(input, "text/plain; charset=utf-8")
+	})
+	b.Content.ServeHTTP(response, request)
+}
+
+// Request is a json inference request
+type Request client.Request
+
+// Options converts the request into generation options
+func (r Request) Options() (Options, error) {
+	options := Options{
+		Count:          *FlagCount,
+		NProbe:         *FlagNProbe,
+		SubProbe:       *FlagSubProbe,
+		Fanout:         *FlagFanout,
+		PromptBudget:   *FlagPromptBudget,
+		Truncation:     *FlagTruncation,
+		ProbeThreshold: float32(*FlagProbeThreshold),
+		ProbeCache:     float32(*FlagProbeCache),
+		EntropyWeight:  float32(*FlagEntropyWeight),
+		Locality:       float32(*FlagLocality),
+		Attention:      float32(*FlagAttention),
+		Lambda:         float32(*FlagLambda),
+		Quota:          *FlagQuota,
+		Hamming:        *FlagHamming,
+		Timeout:        *FlagDeadline,
+		Context:        *FlagContext,
+		Sampler:        r.Sampler().Merge(DefaultSampler()),
+		Seed:           *FlagSeed,
+		Request:        (*client.Request)(&r),
+	}
+	if r.Count < 0 {
+		return options, fmt.Errorf("count must not be negative, 0 uses the default of %d", *FlagCount)
+	}
+	if *FlagMaxCount > 0 && r.Count > *FlagMaxCount {
+		return options, fmt.Errorf("count is %d, at most %d symbols can be generated", r.Count, *FlagMaxCount)
+	}
+	if r.Count > 0 {
+		options.Count = r.Count
+	}
+	if r.NProbe > 0 {
+		options.NProbe = r.NProbe
+	}
+	if r.SubProbe != nil {
+		options.SubProbe = *r.SubProbe
+	}
+	if r.Fanout != "" {
+		options.Fanout = r.Fanout
+	}
+	if r.Threshold != nil {
+		options.ProbeThreshold = *r.Threshold
+	}
+	if r.ProbeCache != nil {
+		options.ProbeCache = *r.ProbeCache
+	}
+	if r.EntropyWeight != nil {
+		options.EntropyWeight = *r.EntropyWeight
+	}
+	options.Stop = r.Stop
+	options.Repetition = Repetition{
+		Count:  *FlagRepetition,
+		Window: *FlagRepetitionWindow,
+		Action: *FlagRepetitionAction,
+	}
+	if r.Repetition > 0 {
+		options.Repetition.Count = r.Repetition
+	}
+	if r.RepetitionWindow > 0 {
+		options.Repetition.Window = r.RepetitionWindow
+	}
+	if r.RepetitionAction != "" {
+		options.Repetition.Action = r.RepetitionAction
+	}
+	if err := options.Repetition.Validate(); err != nil {
+		return options, err
+	}
+	options.Vocabulary = Vocabulary{
+		Steps: *FlagVocabulary,
+		K:     *FlagVocabularyK,
+	}
+	if r.Vocabulary > 0 {
+		options.Vocabulary.Steps = r.Vocabulary
+	}
+	if r.VocabularyK > 0 {
+		options.Vocabulary.K = r.VocabularyK
+	}
+	if err := options.Vocabulary.Validate(); err != nil {
+		return options, err
+	}
+	options.Raw = r.Raw || *FlagRaw
+	options.Latest = r.Latest || *FlagLatest
+	if r.Context > 0 {
+		options.Context = r.Context
+	}
+	if options.Context < 0 || options.Context > MaxContext {
+		return options, fmt.Errorf("context must be between 0 and %d", MaxContext)
+	}
+	if r.Timeout != "" {
+		timeout, err := time.ParseDuration(r.Timeout)
+		if err != nil {
+			return options, fmt.Errorf("invalid timeout %s", r.Timeout)
+		}
+		options.Timeout = timeout
+	}
+	if options.Timeout < 0 {
+		return options, fmt.Errorf("timeout must not be negative")
+	}
+	if r.Hamming > 0 {
+		options.Hamming = r.Hamming
+	}
+	if options.Hamming <= 0 || options.Hamming > SignatureBits {
+		return options, fmt.Errorf("hamming must be between 1 and %d", SignatureBits)
+	}
+	if options.EntropyWeight < 0 {
+		return options, fmt.Errorf("entropy weight must not be negative")
+	}
+	if r.Locality != nil {
+		options.Locality = *r.Locality
+	}
+	if !(options.Locality >= 0) {
+		return options, fmt.Errorf("locality must not be negative")
+	}
+	if r.Attention != nil {
+		options.Attention = *r.Attention
+	}
+	if !(options.Attention >= 0 && options.Attention <= 1) {
+		return options, fmt.Errorf("attention must be between 0 and 1")
+	}
+	if r.Lambda != nil {
+		options.Lambda = *r.Lambda
+	}
+	if !(options.Lambda >= 0 && options.Lambda <= 1) {
+		return options, fmt.Errorf("mmr lambda must be between 0 and 1")
+	}
+	if options.NProbe <= 0 {
+		return options, fmt.Errorf("nprobe must be positive")
+	}
+	if r.Quota > 0 {
+		options.Quota = r.Quota
+	}
+	if options.Quota < 0 {
+		return options, fmt.Errorf("quota must not be negative")
+	}
+	if options.SubProbe < 0 {
+		return options, fmt.Errorf("subprobe must not be negative")
+	}
+	if err := CheckFanout(options.Fanout); err != nil {
+		return options, err
+	}
+	if !(options.ProbeCache >= 0 && options.ProbeCache <= 2) {
+		return options, fmt.Errorf("probe cache must be between 0 and 2")
+	}
+	if r.PromptBudget > 0 {
+		options.PromptBudget = r.PromptBudget
+	}
+	if r.Truncation != "" {
+		options.Truncation = r.Truncation
+	}
+	if options.PromptBudget < 0 {
+		return options, fmt.Errorf("prompt budget must not be negative")
+	}
+	if err := CheckTruncation(options.Truncation); err != nil {
+		return options, err
+	}
+	if r.Seed != nil {
+		options.Seed = *r.Seed
+	}
+	options.Alternatives = r.Alternatives
+	if options.Alternatives < 0 || options.Alternatives > MaxAlternatives {
+		return options, fmt.Errorf("alternatives must be between 0 and %d", MaxAlternatives)
+	}
+	schedule := *FlagTempSchedule
+	if r.TempSchedule != "" {
+		schedule = r.TempSchedule
+	}
+	var err error
+	options.Sampler.Schedule, err = ParseSchedule(schedule)
 	if err != nil {
-		panic(err)
+		return options, err
 	}
-	defer file.Close()
-	reader := bzip2.NewReader(file)
-	input, err := io.ReadAll(reader)
+	err = options.Sampler.Validate()
 	if err != nil {
-		panic(err)
+		return options, err
 	}
-	if *FlagMoar {
-		for _, f := range Moar {
-			file, err := Data.Open(f)
-			if err != nil {
-				panic(err)
-			}
-			defer file.Close()
-			reader := bzip2.NewReader(file)
-			data, err := io.ReadAll(reader)
-			if err != nil {
-				panic(err)
-			}
-			input = append(input, data...)
+	options.Symbols, err = NewSymbolSet(r.Symbols)
+	if err != nil {
+		return options, err
+	}
+	options.Filter, err = NewFilter(r.Documents)
+	if err != nil {
+		return options, err
+	}
+	specs := strings.Split(*FlagWeights, ",")
+	if r.Weights != nil {
+		specs = specs[:0]
+		for name, weight := range r.Weights {
+			specs = append(specs, fmt.Sprintf("%s=%g", name, weight))
 		}
 	}
-	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	response.Write(input)
+	options.Weights, err = NewWeights(specs)
+	if err != nil {
+		return options, err
+	}
+	stages := strings.Split(*FlagPostprocess, ",")
+	if r.Postprocess != nil {
+		stages = r.Postprocess
+	}
+	options.Postprocess, err = NewPostprocess(stages)
+	return options, err
+}
+
+// Sampler returns the sampler parameters of the request
+func (r Request) Sampler() Sampler {
+	return Sampler{
+		Decoder:     r.Decoder,
+		Temperature: r.Temperature,
+		TopK:        r.TopK,
+		TopP:        r.TopP,
+		Calibrated:  r.Calibrated,
+	}
+}
+
+// Prefix returns the text before the generation, which is the corpus before
+// the continuation point if one is given, it can be empty
+func (r Request) Prefix() ([]byte, error) {
+	if r.Continue != "" {
+		prompt, _, err := Continuation(r.Continue)
+		return prompt, err
+	}
+	if *FlagMaxPrompt > 0 && len(r.Query) > *FlagMaxPrompt {
+		return nil, fmt.Errorf("query is %d bytes, at most %d bytes are accepted", len(r.Query), *FlagMaxPrompt)
+	}
+	return []byte(r.Query), nil
+}
+
+// Prompt returns the prompt of the request, which is the prefix of the
+// request and can't be empty
+func (r Request) Prompt() ([]byte, error) {
+	prompt, err := r.Prefix()
+	if err != nil {
+		return nil, err
+	}
+	if len(prompt) == 0 {
+		return nil, fmt.Errorf("prompt is empty, give a query or a continuation point")
+	}
+	return prompt, nil
 }
 
 // Handler is a http handler
 type Handler struct {
-	Header Header
-	Sizes  []uint64
-	Sums   []uint64
+	*Model
+	// Streams are the generation streams in progress
+	Streams *Streams
+	// Sessions are the generation sessions, nil if the session api is
+	// disabled
+	Sessions *Sessions
 }
 
 // ServeHTTP implements model inference access
 func (h Handler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	query, err := io.ReadAll(request.Body)
+	var req Request
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+		if !Decode(response, request, &req) {
+			return
+		}
+	} else {
+		body, err := io.ReadAll(Limit(response, request))
+		if err != nil {
+			http.Error(response, BodyError(err).Error(), http.StatusBadRequest)
+			return
+		}
+		req.Query = string(body)
+	}
+	options, err := req.Options()
 	if err != nil {
-		panic(err)
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := req.Prompt()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
 	}
-	request.Body.Close()
-	searches := h.Header.Soda(h.Sizes, h.Sums, query)
+	if !h.Admit(response, request, options) {
+		return
+	}
+	options.Account = AccountOf(request)
+	searches := h.Soda(query, options)
 	data, err := json.Marshal(searches[0].Result)
 	if err != nil {
 		panic(err)
 	}
+	if searches[0].ID != "" {
+		response.Header().Set("X-Request-Id", searches[0].ID)
+	}
 	response.Header().Set("Content-Type", "application/json; charset=utf-8")
 	response.Write(data)
 }
 
+// Routes returns the handler of the api of a model, keys are the api keys of
+// the server, nil if it has none
+func Routes(model *Model, keys *Keys) (http.Handler, error) {
+	err := CheckPipeline(model.Preprocess)
+	if err != nil {
+		return nil, err
+	}
+	// the shards are shards of the -db database
+	if *FlagShards != "" && model.Path == *FlagDB {
+		model.Shards, err = NewShards(strings.Split(*FlagShards, ","), len(model.Header))
+		if err != nil {
+			return nil, err
+		}
+	}
+	infer := Handler{
+		Model:   model,
+		Streams: NewStreams(),
+	}
+	// the ids of a server serving several databases name the database that
+	// holds them so the router routes the requests that use them
+	prefix := ""
+	if *FlagModels != "" {
+		prefix = ModelName(model.Path) + IDSeparator
+	}
+	infer.Streams.Prefix = prefix
+	if *FlagSessions > 0 {
+		infer.Sessions = NewSessions(*FlagSessions)
+		infer.Sessions.Prefix = prefix
+	}
+	mux := http.NewServeMux()
+	api := &API{Mux: mux}
+	mux.Handle("/infer", infer)
+	jobs := NewJobs(infer, *FlagJobs, *FlagJobQueue)
+	jobs.Prefix = prefix
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/jobs", Summary: "start a generation job",
+		Request: JobRequest{}, Responses: []any{Job{}}, Status: http.StatusAccepted}, jobs.Create)
+	api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/jobs/{id}", Summary: "report a generation job",
+		Responses: []any{Job{}}}, jobs.Status)
+	api.HandleFunc(Endpoint{Method: "DELETE", Path: "/v1/jobs/{id}", Summary: "cancel a generation job",
+		Responses: []any{Job{}}}, jobs.Cancel)
+	mux.Handle("/bible", &Bible{Redaction: model.Redact, Pipeline: model.Preprocess})
+	mux.HandleFunc("/debug/mixer", DebugMixer)
+	mux.Handle("GET /debug/buckets", model.Stats)
+	mux.Handle("GET /debug/buckets/map", NewBucketMaps(model))
+	mux.HandleFunc("GET /debug/trace/{id}", infer.Trace)
+	if model.Shards != nil {
+		mux.Handle("GET /debug/shards", model.Shards)
+	}
+	api.Handle(Endpoint{Method: "GET", Path: "/v1/model", Summary: "describe the database",
+		Responses: []any{Metadata{}}}, model.Metadata)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/generate", Summary: "generate text, or estimate the cost of generating it with dry_run",
+		Request: client.Request{}, Responses: []any{client.Response{}, client.Estimate{}}}, infer.Generate)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/generate/stream", Summary: "generate text streaming start, output, and done server sent events",
+		Request: client.Request{}, ContentType: "text/event-stream"}, infer.GenerateStream)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/generate/html", Summary: "generate text as html with each span colored by its confidence and linked to its source passage",
+		Request: client.Request{}, ContentType: "text/html"}, infer.GenerateHTML)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/generate/stream/{id}/control", Summary: "adjust a stream in progress",
+		Request: client.Control{}, Status: http.StatusNoContent}, infer.Streams.Control)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/score", Summary: "rank each symbol of a text among the candidates retrieved for it",
+		Request: client.ScoreRequest{}, Responses: []any{client.ScoreResponse{}}}, infer.Score)
+	mux.HandleFunc("POST /score", infer.Score)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/embed", Summary: "embed a text as the database vector after it",
+		Request: client.EmbedRequest{}, Responses: []any{client.EmbedResponse{}}}, infer.Embed)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/embed/batch", Summary: "embed several texts",
+		Request: client.EmbedBatchRequest{}, Responses: []any{client.EmbedBatchResponse{}}}, infer.EmbedBatch)
+	mux.HandleFunc("POST /embed/batch", infer.EmbedBatch)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/entropy", Summary: "report the entropy of the context after a text",
+		Request: client.EntropyRequest{}, Responses: []any{client.EntropyResponse{}}}, infer.Entropy)
+	mux.HandleFunc("POST /entropy", infer.Entropy)
+	if infer.Sessions != nil {
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/sessions", Summary: "create a session from a prompt",
+			Request: client.SessionRequest{}, Responses: []any{client.Session{}}}, infer.CreateSession)
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/sessions/{id}", Summary: "describe a session",
+			Responses: []any{client.Session{}}}, infer.SessionSnapshot)
+		api.HandleFunc(Endpoint{Method: "DELETE", Path: "/v1/sessions/{id}", Summary: "delete a session",
+			Status: http.StatusNoContent}, infer.DeleteSession)
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/sessions/{id}/generate", Summary: "continue a session",
+			Request: client.Request{}, Responses: []any{client.Response{}}}, infer.SessionGenerate)
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/sessions/{id}/branch", Summary: "copy a session",
+			Responses: []any{client.Session{}}}, infer.Branch)
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/sessions/{id}/rollback", Summary: "remove the last symbols of a session",
+			Request: client.RollbackRequest{}, Responses: []any{client.Session{}}}, infer.Rollback)
+	}
+	if *FlagBuildDir != "" {
+		builds, err := NewBuilds(*FlagBuildDir)
+		if err != nil {
+			return nil, err
+		}
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/admin/builds", Summary: "start a build of a database in the build directory with the build flags",
+			Request: BuildRequest{}, Responses: []any{BuildJob{}}, Status: http.StatusAccepted}, builds.Create)
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/admin/builds/{id}", Summary: "report a build",
+			Responses: []any{BuildJob{}}}, builds.Status)
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/admin/builds/{id}/events", Summary: "stream the progress of a build as progress server sent events ending with a done event",
+			ContentType: "text/event-stream"}, builds.Events)
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/admin/corpora", Summary: "list the corpora uploaded for builds",
+			Responses: []any{[]Upload{}}}, builds.Uploads.List)
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/admin/corpora/{name}", Summary: "report the upload of a corpus, an interrupted upload resumes at its size",
+			Responses: []any{Upload{}}}, builds.Uploads.Status)
+		api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/admin/corpora/{name}", Summary: "append the chunk in the body, or in the file field of a multipart form, at the offset query parameter to a corpus, complete=true ends the upload",
+			Responses: []any{Upload{}}}, builds.Uploads.Append)
+		api.HandleFunc(Endpoint{Method: "DELETE", Path: "/v1/admin/corpora/{name}", Summary: "delete a corpus",
+			Status: http.StatusNoContent}, builds.Uploads.Delete)
+	}
+	api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/shard", Summary: "report the bucket sizes of a shard",
+		Responses: []any{ShardInfo{}}}, infer.ShardInfo)
+	api.HandleFunc(Endpoint{Method: "POST", Path: "/v1/shard/scan", Summary: "scan buckets of a shard for a coordinator",
+		Request: ShardRequest{}, Responses: []any{[]ShardCandidate{}}}, infer.ShardScan)
+	mux.Handle("GET /openapi.json", api)
+	root := &Root{}
+	mux.Handle("/index.html", root)
+	mux.Handle("/", root)
+	if *FlagCollapse {
+		model.Flights = NewFlights()
+	}
+	if *FlagLexical != 0 {
+		model.Lexical, err = model.LexicalIndex(float32(*FlagLexical))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *FlagGenerationLog != "" {
+		model.Log, err = OpenGenerationLog(*FlagGenerationLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handler := CheckContentType(mux)
+	if keys != nil {
+		keys = keys.For(ModelName(model.Path))
+		api.HandleFunc(Endpoint{Method: "GET", Path: "/v1/admin/usage", Summary: "report the usage of every key to admin keys",
+			Responses: []any{[]Usage{}}}, keys.Usage)
+		api.Security = map[string]any{
+			"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+		}
+		// the web page and the shards, which have their own -shard-key, don't
+		// need an api key
+		public := map[string]bool{
+			"/":                   true,
+			"/index.html":         true,
+			"/bible":              true,
+			"GET /openapi.json":   true,
+			"GET /v1/shard":       true,
+			"POST /v1/shard/scan": true,
+		}
+		handler = keys.Wrap(handler, func(request *http.Request) bool {
+			_, pattern := mux.Handler(request)
+			return public[pattern]
+		})
+	}
+	if *FlagCORSOrigins != "" {
+		cors, err := NewCORS(*FlagCORSOrigins, *FlagCORSMethods, *FlagCORSMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		handler = cors.Wrap(handler)
+	}
+	return Isolate(handler), nil
+}
+
 // Brute is brute force mode
 func Brute() {
-	file, err := Data.Open("books/10.txt.utf-8.bz2")
+	file, err := Books.Open(Genesis.Path)
 	if err != nil {
 		panic(err)
 	}
@@ -155,23 +633,21 @@ func Brute() {
 		Symbol byte
 	}
 	vectors := make([]Vector, len(input))
-	m := NewMixer()
+	m := NewHistogramMixer()
 	m.Add(0)
-	vector := make([]float32, Size)
 	for i, v := range input {
-		m.MixEntropy(vector)
-		copy(vectors[i].Vector[:], vector)
+		copy(vectors[i].Vector[:], m.Entropy())
 		vectors[i].Symbol = v
 		m.Add(v)
 	}
 
 	query := []byte("Go")
-	m = NewMixer()
+	m = NewHistogramMixer()
 	for _, v := range query {
 		m.Add(v)
 	}
 
-	m.MixEntropy(vector)
+	vector := m.Entropy()
 	index, max := 0, float32(0.0)
 	for i := range vectors {
 		cs := CS(vector, vectors[i].Vector[:])
@@ -182,129 +658,101 @@ func Brute() {
 	}
 }
 
-// Rank is page rank mode
-func Rank() {
-	file, err := Data.Open("books/10.txt.utf-8.bz2")
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-	reader := bzip2.NewReader(file)
-	input, err := io.ReadAll(reader)
-	if err != nil {
-		panic(err)
-	}
+// RankBlock is the number of entries of the page rank database read at a time
+// when it is scanned
+const RankBlock = 4096
 
-	type Entry struct {
-		Vector [Size]float32
-		Symbol byte
-		Index  uint64
-	}
+// Rank is page rank mode, the page rank database is built if build is true
+func Rank(build bool) {
+	type Entry = binaryvec.RankEntry
+
+	if build {
+		file, err := Books.Open(Genesis.Path)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		reader := bzip2.NewReader(file)
+		input, err := io.ReadAll(reader)
+		if err != nil {
+			panic(err)
+		}
 
-	if *FlagBuild {
 		model := make([]Entry, len(input))
-		m := NewMixer()
+		m := NewHistogramMixer()
 		m.Add(0)
+		progress := NewProgress("rank", len(input))
 		for i, v := range input {
 			m.MixRank(&model[i].Vector)
 			model[i].Symbol = v
 			model[i].Index = uint64(i)
 			m.Add(v)
-			fmt.Println(i, "/", len(input))
+			progress.Update(i+1, "")
 		}
+		progress.Done()
 
-		db, err := os.Create("rdb.bin")
+		db, err := CreateAtomic("rdb.bin")
 		if err != nil {
 			panic(err)
 		}
 		defer db.Close()
 
-		buffer32 := make([]byte, 4)
-		buffer64 := make([]byte, 8)
-		symbol := make([]byte, 1)
+		writer := binaryvec.NewWriter(db)
 		for i := range model {
-			vector := model[i].Vector
-			for _, v := range vector {
-				bits := math.Float32bits(v)
-				for i := range buffer32 {
-					buffer32[i] = byte((bits >> (8 * i)) & 0xFF)
-				}
-				n, err := db.Write(buffer32)
-				if err != nil {
-					panic(err)
-				}
-				if n != len(buffer32) {
-					panic("4 bytes should be been written")
-				}
-			}
-			symbol[0] = model[i].Symbol
-			n, err := db.Write(symbol)
+			err := writer.WriteRecord(&model[i])
 			if err != nil {
 				panic(err)
 			}
-			if n != len(symbol) {
-				panic("1 bytes should be been written")
-			}
-
-			for i := range buffer64 {
-				buffer64[i] = byte((model[i].Index >> (8 * i)) & 0xFF)
-			}
-			n, err = db.Write(buffer64)
-			if err != nil {
-				panic(err)
-			}
-			if n != len(buffer64) {
-				panic("8 bytes should be been written")
-			}
 		}
-
+		err = db.Commit()
+		if err != nil {
+			panic(err)
+		}
 		return
 	}
 
-	m := NewMixer()
+	m := NewHistogramMixer()
 	for _, v := range []byte(*FlagQuery) {
 		m.Add(v)
 	}
 
+	err := CheckTemp("rdb.bin")
+	if err != nil {
+		panic(err)
+	}
 	db, err := os.Open("rdb.bin")
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
-
-	buffer, err := io.ReadAll(db)
+	info, err := db.Stat()
 	if err != nil {
 		panic(err)
 	}
-
-	const EntryLineSize = 8*4 + 1 + 8
-	model := make([]Entry, len(input))
-	for j := range model {
-		vector := [Size]float32{}
-		for k := range vector {
-			var bits uint32
-			for l := 0; l < 4; l++ {
-				bits |= uint32(buffer[j*EntryLineSize+4*k+l]) << (8 * l)
-			}
-			vector[k] = math.Float32frombits(bits)
-		}
-		symbolIndex, symbol := uint64(0), buffer[(j+1)*EntryLineSize-1-8]
-		for k := 0; k < 8; k++ {
-			symbolIndex |= uint64(buffer[(j+1)*EntryLineSize-8+k]) << (8 * k)
-		}
-		model[j].Vector = vector
-		model[j].Symbol = symbol
-		model[j].Index = symbolIndex
+	if info.Size()%binaryvec.RankEntrySize != 0 {
+		panic("rdb.bin is truncated")
 	}
 
-	symbols := []byte{}
+	// the entries are streamed from the file in blocks at each step instead
+	// of being held in memory
+	entries, size := int(info.Size()/binaryvec.RankEntrySize), binaryvec.RankEntrySize
+	symbols, block, entry := []byte{}, make([]byte, RankBlock*size), Entry{}
 	for i := 0; i < 128; i++ {
-		max, vector, symbol := float32(0.0), [Size]float32{}, byte(0)
+		max, vector, symbol, best := float32(0.0), [Size]float32{}, byte(0), -1
 		m.MixRank(&vector)
-		for j := range model {
-			cs := CS(vector[:], model[j].Vector[:])
-			if cs > max {
-				max, symbol = cs, model[j].Symbol
+		for start := 0; start < entries; start += RankBlock {
+			n := min(RankBlock, entries-start)
+			_, err := db.ReadAt(block[:n*size], int64(start*size))
+			if err != nil {
+				panic(err)
+			}
+			for k := 0; k < n; k++ {
+				entry.Decode(block[k*size:])
+				j := start + k
+				cs := CS(vector[:], entry.Vector[:])
+				if cs > 0 && (best < 0 || Ahead(cs, uint64(j), max, uint64(best))) {
+					max, symbol, best = cs, entry.Symbol, j
+				}
 			}
 		}
 		symbols = append(symbols, symbol)
@@ -313,54 +761,66 @@ func Rank() {
 	fmt.Println(string(symbols))
 }
 
-func main() {
-	flag.Parse()
+// Commands are the subcommands
+var Commands = map[string]func(args []string){
+	"build":                 BuildCommand,
+	"serve":                 ServeCommand,
+	"rank":                  RankCommand,
+	"rank build":            RankBuildCommand,
+	"brute":                 BruteCommand,
+	"db info":               DBInfo,
+	"db shard":              DBShard,
+	"db split":              DBSplit,
+	"db append":             DBAppend,
+	"db purge":              DBPurge,
+	"db viz":                DBViz,
+	"db transform":          DBTransform,
+	"db compare-embeddings": CompareEmbeddings,
+	"bench prefilter":       Prefilter,
+	"bench stride":          BenchStride,
+	"bench windows":         BenchWindows,
+	"eval":                  EvalCommand,
+	"corpus stats":          CorpusStats,
+	"replay":                Replay,
+	"generate":              GenerateCommand,
+	"estimate":              EstimateCommand,
+	"distill":               DistillCommand,
+	"config validate":       ConfigValidate,
+}
 
-	if *FlagRank {
-		Rank()
-		return
-	} else if *FlagBuild {
-		Build()
+// Entry is an alternative entry point for platforms without a command line
+var Entry func()
+
+func main() {
+	if Entry != nil {
+		Entry()
 		return
-	} else if *FlagServer {
-		header, sizes, sums := LoadHeader()
-		infer := Handler{
-			Header: header,
-			Sizes:  sizes,
-			Sums:   sums,
-		}
-		mux := http.NewServeMux()
-		mux.Handle("/infer", infer)
-		mux.Handle("/bible", Bible{})
-		mux.Handle("/index.html", Root{})
-		mux.Handle("/", Root{})
-		s := &http.Server{
-			Addr:           ":8080",
-			Handler:        mux,
-			ReadTimeout:    10 * 60 * time.Second,
-			WriteTimeout:   10 * 60 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		}
-		err := s.ListenAndServe()
-		if err != nil {
-			fmt.Println("Failed to start server", err)
-			return
-		}
+	}
+	flag.Usage = PrintUsage
+	flag.Parse()
+	if err := LoadConfig(flag.CommandLine); err != nil {
+		fmt.Println(err)
 		return
-	} else if *FlagBrute {
-		Brute()
+	}
+	if err := CheckFlags(); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	header, sizes, sums := LoadHeader()
-	searches := header.Soda(sizes, sums, []byte(*FlagQuery))
-	for _, search := range searches {
-		output := search.Result
-		str := []byte(*FlagQuery)
-		for i := range output {
-			str = append(str, output[i].Symbol)
+	args := flag.Args()
+	if names, mode := Mode(); mode != "" {
+		fmt.Fprintf(os.Stderr, "%s is deprecated, use soda %s\n", names, mode)
+		args = append(strings.Fields(mode), args...)
+	}
+	if len(args) > 0 {
+		for i := len(args); i > 0; i-- {
+			if command, ok := Commands[strings.Join(args[:i], " ")]; ok {
+				command(args[i:])
+				return
+			}
 		}
-		fmt.Println(string(str))
-		fmt.Println(search.Rank, " ---------------------------------------")
+		fmt.Println("unknown command", strings.Join(args, " "))
+		return
 	}
+	GenerateQuery(*FlagQuery)
 }
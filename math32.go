@@ -6,6 +6,8 @@ package main
 
 import (
 	"math"
+
+	"github.com/pointlander/soda/vector"
 )
 
 func sqrt(a float32) float32 {
@@ -19,3 +21,44 @@ func exp(a float32) float32 {
 func log(a float32) float32 {
 	return float32(math.Log(float64(a)))
 }
+
+func pow(a, b float32) float32 {
+	return float32(math.Pow(float64(a), float64(b)))
+}
+
+func isNaN(a float32) bool {
+	return a != a
+}
+
+func isInf(a float32) bool {
+	return a > math.MaxFloat32 || a < -math.MaxFloat32
+}
+
+// Epsilon is the norm below which a vector is treated as zero
+const Epsilon = 1e-12
+
+// unit writes values scaled to unit length to output, a vector with a norm
+// below Epsilon is written as zeros
+func unit(output, values []float32) {
+	norm := sqrt(vector.Dot(values, values))
+	if !(norm > Epsilon) || isInf(norm) {
+		for i := range output {
+			output[i] = 0
+		}
+		return
+	}
+	for i, v := range values {
+		output[i] = v / norm
+	}
+}
+
+// NonFinite returns the index of the first NaN or infinite value, -1 if all
+// the values are finite
+func NonFinite(values []float32) int {
+	for i, v := range values {
+		if isNaN(v) || isInf(v) {
+			return i
+		}
+	}
+	return -1
+}
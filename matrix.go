@@ -16,7 +16,7 @@ const (
 	S = 1.0 - 1e38*math.SmallestNonzeroFloat32
 )
 
-// Matrix is a float64 matrix
+// Matrix is a float32 matrix
 type Matrix struct {
 	Cols int
 	Rows int
@@ -156,16 +156,44 @@ func softmax(values []float32) {
 		values[j] = exp(value - s)
 		sum += values[j]
 	}
+	if !(sum > 0) || isInf(sum) {
+		for j := range values {
+			values[j] = 1 / float32(len(values))
+		}
+		return
+	}
 	for j, value := range values {
 		values[j] = value / sum
 	}
 }
 
-// SelfAttention computes the self attention of Q, K, V
-func SelfAttention(input Matrix, output *[256]float32) {
-	values := make([]float32, input.Rows)
-	V := input.T()
-	sums := make([]float32, V.Rows)
+// Workspace is reusable memory for self attention
+type Workspace struct {
+	Input   Matrix
+	Values  []float32
+	Weights []float32
+	Sums    []float32
+}
+
+// NewWorkspace creates a workspace for an input with cols columns and rows rows
+func NewWorkspace(cols, rows int) *Workspace {
+	return &Workspace{
+		Input:   NewMatrix(cols, rows, make([]float32, cols*rows)...),
+		Values:  make([]float32, rows),
+		Weights: make([]float32, rows),
+		Sums:    make([]float32, cols),
+	}
+}
+
+// SelfAttention computes the self attention of Q, K, V where Q = K = V is the
+// workspace input. The attention of every row is a weighted sum of the same
+// rows, so the softmax weights are accumulated first and the rows are summed
+// once instead of once per row.
+func (w *Workspace) SelfAttention(output []float32) {
+	input, values, weights, sums := w.Input, w.Values, w.Weights, w.Sums
+	for i := range weights {
+		weights[i] = 0
+	}
 	for i := 0; i < input.Rows; i++ {
 		K := input.Data[i*input.Cols : (i+1)*input.Cols]
 		for j := 0; j < input.Rows; j++ {
@@ -173,16 +201,20 @@ func SelfAttention(input Matrix, output *[256]float32) {
 			values[j] = vector.Dot(K, Q)
 		}
 		softmax(values)
-
-		for j := 0; j < V.Rows; j++ {
-			V := V.Data[j*V.Cols : (j+1)*V.Cols]
-			sums[j] += vector.Dot(values, V)
+		for j, value := range values {
+			weights[j] += value
 		}
 	}
-	aa := sqrt(vector.Dot(sums, sums))
-	for i, v := range sums {
-		output[i] = v / aa
+	for i := range sums {
+		sums[i] = 0
 	}
+	for i, weight := range weights {
+		V := input.Data[i*input.Cols : (i+1)*input.Cols]
+		for j, value := range V {
+			sums[j] += weight * value
+		}
+	}
+	unit(output, sums)
 }
 
 // SelfEntropy computes the self entropy of Q, K, V
@@ -205,7 +237,9 @@ func SelfEntropy(input Matrix, output []float32) {
 		softmax(sums)
 		entropy := float32(0.0)
 		for _, v := range sums {
-			entropy += v * log(v)
+			if v > 0 {
+				entropy += v * log(v)
+			}
 		}
 		output[i] = -float32(entropy)
 	}
@@ -215,3 +249,11 @@ func SelfEntropy(input Matrix, output []float32) {
 func CS(a []float32, b []float32) float32 {
 	return vector.Dot(a, b)
 }
+
+// CSBatch is the cosine similarity of the query with each of the contiguous
+// vectors, the similarities are stored in scores. The vectors are normalized
+// as they are read, so a vector that isn't unit length like the centroid of a
+// distilled database is scored by its direction
+func CSBatch(scores []float32, vectors []float32, query []float32) {
+	vector.CosineBatch(query, vectors, scores)
+}
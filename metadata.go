@@ -0,0 +1,195 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// Version is the version of soda
+const Version = "0.1.0"
+
+// FlagDescription is the description of the model
+var FlagDescription = flag.String("description", "", "description of the model recorded in the database")
+
+// Metadata is the model card of a database
+type Metadata struct {
+	Version string `json:"version"`
+	// Encoding is the version of the record layouts of the database
+	Encoding    int               `json:"encoding"`
+	Description string            `json:"description"`
+	Corpus      []Document        `json:"corpus"`
+	Flags       map[string]string `json:"flags"`
+	Created     time.Time         `json:"created"`
+	Duration    string            `json:"duration"`
+	Bytes       int               `json:"bytes"`
+	Entries     uint64            `json:"entries"`
+	Buckets     int               `json:"buckets"`
+	// Shard is the shard of a database split into Shards shards
+	Shard  int `json:"shard,omitempty"`
+	Shards int `json:"shards,omitempty"`
+	// Distilled records the original database of a distilled database
+	Distilled *Distillation `json:"distilled,omitempty"`
+	// Purged is the number of entries of superseded documents removed
+	Purged uint64 `json:"purged,omitempty"`
+	Settings
+}
+
+// NewMetadata creates the metadata for a database built from documents with
+// the current flags
+func NewMetadata(start time.Time, size int, h Header, documents []Document, settings Settings) *Metadata {
+	metadata := Metadata{
+		Version:     Version,
+		Encoding:    binaryvec.Version,
+		Description: *FlagDescription,
+		Corpus:      documents,
+		Flags:       make(map[string]string),
+		Settings:    settings,
+		Created:     start.UTC(),
+		Duration:    time.Since(start).Round(time.Second).String(),
+		Bytes:       size,
+		Buckets:     len(h),
+	}
+	flag.Visit(func(f *flag.Flag) {
+		metadata.Flags[f.Name] = f.Value.String()
+	})
+	for i := range h {
+		metadata.Entries += uint64(h[i].Count)
+	}
+	return &metadata
+}
+
+// MetadataOffset is the offset of the metadata section which follows the
+// entries and the symbol index
+func MetadataOffset(sizes, sums []uint64, settings Settings) int64 {
+	return ProjectionOffset(sizes, sums, settings) + settings.ProjectionSize()
+}
+
+// MetadataEnd is the offset of the end of the metadata section, the sections
+// of distilled databases and of databases with an embedded corpus follow it
+func MetadataEnd(db io.ReaderAt, sizes, sums []uint64, settings Settings) (int64, error) {
+	offset := MetadataOffset(sizes, sums, settings)
+	buffer := make([]byte, 8)
+	n, err := db.ReadAt(buffer, offset)
+	if n != len(buffer) {
+		return 0, fmt.Errorf("the metadata section is truncated: %v", err)
+	}
+	length := binaryvec.Order.Uint64(buffer)
+	if length > MaxMetadataSize {
+		return 0, fmt.Errorf("the metadata section is %d bytes, at most %d bytes are read", length, MaxMetadataSize)
+	}
+	return offset + 8 + int64(length), nil
+}
+
+// Write writes the metadata section, a length followed by json
+func (m *Metadata) Write(out io.Writer) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	err = binaryvec.NewWriter(out).WriteUint64(uint64(len(data)))
+	if err != nil {
+		panic(err)
+	}
+	n, err := out.Write(data)
+	if err != nil {
+		panic(err)
+	}
+	if n != len(data) {
+		panic(fmt.Sprintf("%d bytes should be been written", len(data)))
+	}
+}
+
+// MaxMetadataSize is the largest metadata section that is read
+const MaxMetadataSize = 64 << 20
+
+// ReadMetadata reads the metadata section, nil is returned for databases
+// without metadata
+func ReadMetadata(db io.ReaderAt, sizes, sums []uint64, settings Settings) *Metadata {
+	offset := MetadataOffset(sizes, sums, settings)
+	buffer64 := make([]byte, 8)
+	n, _ := db.ReadAt(buffer64, offset)
+	if n != len(buffer64) {
+		return nil
+	}
+	// the length of a corrupt section or of other bytes isn't allocated if
+	// it is too big or past the end of the database
+	length := binaryvec.Order.Uint64(buffer64)
+	if length == 0 || length > MaxMetadataSize {
+		return nil
+	}
+	n, _ = db.ReadAt(buffer64[:1], offset+8+int64(length)-1)
+	if n != 1 {
+		return nil
+	}
+	data := make([]byte, length)
+	n, _ = db.ReadAt(data, offset+8)
+	if n != len(data) {
+		return nil
+	}
+	var metadata Metadata
+	err := json.Unmarshal(data, &metadata)
+	if err != nil {
+		return nil
+	}
+	return &metadata
+}
+
+// ServeHTTP returns the model card
+func (m *Metadata) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if m == nil {
+		http.Error(response, "the database has no metadata", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	NewContent(data, "application/json; charset=utf-8").ServeHTTP(response, request)
+}
+
+// DBInfo prints the model card and bucket statistics of the database given as
+// an argument or by -db
+func DBInfo(args []string) {
+	path := *FlagDB
+	if len(args) > 0 {
+		path = args[0]
+	}
+	model, err := LoadModel(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	header, sizes, metadata := model.Header, model.Sizes, model.Metadata
+	if metadata == nil {
+		fmt.Println(path, "has no metadata")
+	} else {
+		data, err := json.MarshalIndent(metadata, "", " ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(data))
+	}
+	entries, empty := uint64(0), 0
+	for i := range header {
+		header[i].Count = int(sizes[i])
+		entries += sizes[i]
+		if sizes[i] == 0 {
+			empty++
+		}
+	}
+	fmt.Println("entries", entries)
+	fmt.Println("buckets", len(header), "empty", empty)
+	fmt.Printf("skew %.2f\n", header.Skew())
+	fmt.Println("symbol index", header.ReadSymbols(model.DB, model.FileSizes, model.FileSums, model.Settings))
+}
@@ -5,12 +5,15 @@
 package main
 
 import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+
 	"github.com/alixaxel/pagerank"
-	"github.com/pointlander/soda/vector"
 )
 
 const (
-	// Size is the number of histograms
+	// Size is the number of histograms of the default windows
 	Size = 8
 	// Order is the order of the markov model
 	Order = 7
@@ -19,6 +22,9 @@ const (
 // Markov is a markov model
 type Markov [Order + 1]byte
 
+// DefaultWindows are the windows of the histograms of the histogram mixer
+var DefaultWindows = []int{1, 2, 4, 8, 16, 32, 64, 128}
+
 // Histogram is a buffered histogram
 type Histogram struct {
 	Vector [256]byte
@@ -46,41 +52,355 @@ func (h *Histogram) Add(s byte) {
 	h.Index = index
 }
 
-// Mixer mixes several histograms together
-type Mixer struct {
+// Append appends the counts, window, and index of the histogram to data
+func (h *Histogram) Append(data []byte) []byte {
+	data = append(data, h.Vector[:]...)
+	data = append(data, h.Buffer[:h.Size]...)
+	return binary.AppendUvarint(data, uint64(h.Index))
+}
+
+// Decode decodes a histogram of the same size appended by Append and returns
+// the rest of data
+func (h *Histogram) Decode(data []byte) ([]byte, error) {
+	if len(data) < 256+h.Size {
+		return nil, fmt.Errorf("the state of a histogram of size %d is truncated", h.Size)
+	}
+	copy(h.Vector[:], data)
+	copy(h.Buffer[:h.Size], data[256:])
+	data = data[256+h.Size:]
+	index, n := binary.Uvarint(data)
+	if n <= 0 || index >= uint64(h.Size) {
+		return nil, fmt.Errorf("the state of a histogram of size %d has an invalid index", h.Size)
+	}
+	h.Index = int(index)
+	return data[n:], nil
+}
+
+// FlagCode builds a database for source code
+var FlagCode = flag.Bool("code", false, "build a database for source code that also mixes indentation depth and bracket nesting")
+
+// StructureSize is the window of the structure histograms
+const StructureSize = 32
+
+// Structure tracks the indentation depth and bracket nesting of code as two
+// extra histograms over depths
+type Structure struct {
+	// Indent is the indentation depth of the current line
+	Indent int
+	// Nesting is the bracket nesting depth
+	Nesting int
+	// Start is true until the first non blank symbol of a line
+	Start      bool
+	Histograms [2]Histogram
+}
+
+// Add updates the depths with a symbol and adds them to the histograms
+func (s *Structure) Add(symbol byte) {
+	switch symbol {
+	case '\n':
+		s.Indent, s.Start = 0, true
+	case ' ':
+		if s.Start {
+			s.Indent++
+		}
+	case '\t':
+		if s.Start {
+			s.Indent += 4
+		}
+	case '(', '[', '{':
+		s.Start = false
+		s.Nesting++
+	case ')', ']', '}':
+		s.Start = false
+		if s.Nesting > 0 {
+			s.Nesting--
+		}
+	default:
+		s.Start = false
+	}
+	indent, nesting := s.Indent, s.Nesting
+	if indent > 255 {
+		indent = 255
+	}
+	if nesting > 255 {
+		nesting = 255
+	}
+	s.Histograms[0].Add(byte(indent))
+	s.Histograms[1].Add(byte(nesting))
+}
+
+// FlagOrder2 is the size of the second order histogram bank
+var FlagOrder2 = flag.Int("order2", 0, "number of histograms in the bank selected by a hash of the previous two symbols, 0 disables the bank")
+
+// Order2Size is the window of the second order histograms
+const Order2Size = 64
+
+// Order2 is a bank of histograms of the symbols that followed each pair of
+// symbols, the pairs are hashed into the bank
+type Order2 struct {
+	// Context is the histogram of the current pair of symbols
+	Context    int
+	Histograms []Histogram
+}
+
+// Add adds the symbol that followed the current pair and selects the
+// histogram of the pair previous, symbol
+func (o *Order2) Add(previous, symbol byte) {
+	o.Histograms[o.Context].Add(symbol)
+	hash := (uint64(previous)<<8 | uint64(symbol)) * 0x9E3779B97F4A7C15
+	o.Context = int((hash >> 32) % uint64(len(o.Histograms)))
+}
+
+// Mixer mixes the symbols of a context into a vector, Build, Generate, and
+// Score only use a mixer through this interface so alternative mixers can be
+// added to Mixers without changing them
+type Mixer interface {
+	// Add adds a symbol to the context
+	Add(s byte)
+	// Mix writes the vector of the context to output
+	Mix(output *[256]float32)
+	// Entropy returns the entropy of each distribution mixed for the context
+	Entropy() []float32
+	// Copy copies the mixer, the copy doesn't share state with the mixer
+	Copy() Mixer
+	// Reset clears the context
+	Reset()
+	// MarshalBinary encodes the context, UnmarshalBinary restores it to a
+	// mixer made with the same settings
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(data []byte) error
+}
+
+// FlagMixer is the mixer of a build
+var FlagMixer = flag.String("mixer", "histogram", "mixer of the vectors of a build: histogram or ngram")
+
+// Mixers make the mixers of settings by name, the histogram mixer is also
+// the empty name which older databases record
+var Mixers = map[string]func(settings Settings) Mixer{
+	"":          NewSettingsHistogramMixer,
+	"histogram": NewSettingsHistogramMixer,
+	"ngram": func(settings Settings) Mixer {
+		return &NGramMixer{}
+	},
+}
+
+// CheckMixer checks the mixer of build settings, only the histogram mixer
+// tracks code structure and second order contexts and has windows
+func CheckMixer(settings Settings) error {
+	if _, ok := Mixers[settings.Mixer]; !ok {
+		return fmt.Errorf("unknown mixer %s", settings.Mixer)
+	}
+	if settings.Mixer == "" || settings.Mixer == "histogram" {
+		return nil
+	}
+	if settings.Code || settings.Order2 > 0 || len(settings.Windows) > 0 {
+		return fmt.Errorf("-code, -order2, and -windows require the histogram mixer")
+	}
+	return nil
+}
+
+// HistogramMixer mixes several histograms together with self attention, its
+// methods use the scratch buffers of its workspace so a mixer can't be used
+// concurrently and a mixer assigned from another shares its workspace, Copy
+// makes a mixer for another goroutine
+type HistogramMixer struct {
 	Markov     Markov
 	Histograms []Histogram
+	// Structure is the indentation and nesting of code, nil if not tracked
+	Structure *Structure
+	// Order2 is the second order histogram bank, nil if not used
+	Order2    *Order2
+	Workspace *Workspace
+}
+
+// NewHistogramMixer makes a new histogram mixer with the default windows
+func NewHistogramMixer() HistogramMixer {
+	return NewWindowsHistogramMixer(DefaultWindows)
 }
 
-// NewMixer makes a new mixer
-func NewMixer() Mixer {
-	histograms := make([]Histogram, Size)
-	histograms[0] = NewHistogram(1)
-	histograms[1] = NewHistogram(2)
-	histograms[2] = NewHistogram(4)
-	histograms[3] = NewHistogram(8)
-	histograms[4] = NewHistogram(16)
-	histograms[5] = NewHistogram(32)
-	histograms[6] = NewHistogram(64)
-	histograms[7] = NewHistogram(128)
-	return Mixer{
+// NewWindowsHistogramMixer makes a new histogram mixer with a histogram of
+// each window
+func NewWindowsHistogramMixer(windows []int) HistogramMixer {
+	histograms := make([]Histogram, len(windows))
+	for i, window := range windows {
+		histograms[i] = NewHistogram(window)
+	}
+	return HistogramMixer{
 		Histograms: histograms,
+		Workspace:  NewWorkspace(256, len(histograms)),
 	}
 }
 
-func (m Mixer) Copy() Mixer {
-	histograms := make([]Histogram, Size)
-	for i := range m.Histograms {
-		histograms[i] = m.Histograms[i]
+// NewSettingsHistogramMixer makes a histogram mixer with the windows of the
+// settings that also mixes their code structure and second order histograms
+func NewSettingsHistogramMixer(settings Settings) Mixer {
+	m := NewHistogramMixer()
+	if len(settings.Windows) > 0 {
+		m = NewWindowsHistogramMixer(settings.Windows)
+	}
+	if settings.Code {
+		m.Structure = NewStructure()
+	}
+	if settings.Order2 > 0 {
+		m.Order2 = NewOrder2(settings.Order2)
+	}
+	m.Workspace = NewWorkspace(256, m.Rows())
+	return &m
+}
+
+// NewStructure makes new indentation depth and bracket nesting histograms
+func NewStructure() *Structure {
+	return &Structure{
+		Start: true,
+		Histograms: [2]Histogram{
+			NewHistogram(StructureSize),
+			NewHistogram(StructureSize),
+		},
+	}
+}
+
+// NewOrder2 makes a bank of size histograms selected by the previous two symbols
+func NewOrder2(size int) *Order2 {
+	histograms := make([]Histogram, size)
+	for i := range histograms {
+		histograms[i] = NewHistogram(Order2Size)
+	}
+	return &Order2{
+		Histograms: histograms,
 	}
-	return Mixer{
+}
+
+// Rows is the number of histograms mixed
+func (m *HistogramMixer) Rows() int {
+	rows := len(m.Histograms)
+	if m.Structure != nil {
+		rows += len(m.Structure.Histograms)
+	}
+	if m.Order2 != nil {
+		rows++
+	}
+	return rows
+}
+
+// Copy copies the mixer, the copy has its own workspace
+func (m *HistogramMixer) Copy() Mixer {
+	histograms := make([]Histogram, len(m.Histograms))
+	copy(histograms, m.Histograms)
+	copied := HistogramMixer{
 		Markov:     m.Markov,
 		Histograms: histograms,
+		Workspace:  NewWorkspace(256, m.Workspace.Input.Rows),
+	}
+	if m.Structure != nil {
+		structure := *m.Structure
+		copied.Structure = &structure
+	}
+	if m.Order2 != nil {
+		copied.Order2 = &Order2{
+			Context:    m.Order2.Context,
+			Histograms: append([]Histogram(nil), m.Order2.Histograms...),
+		}
 	}
+	return &copied
+}
+
+// Reset empties the histograms
+func (m *HistogramMixer) Reset() {
+	m.Markov = Markov{}
+	for i := range m.Histograms {
+		m.Histograms[i] = NewHistogram(m.Histograms[i].Size)
+	}
+	if m.Structure != nil {
+		m.Structure = NewStructure()
+	}
+	if m.Order2 != nil {
+		m.Order2 = NewOrder2(len(m.Order2.Histograms))
+	}
+}
+
+// MarshalBinary encodes the markov context and the histograms
+func (m *HistogramMixer) MarshalBinary() ([]byte, error) {
+	data := append([]byte{}, m.Markov[:]...)
+	for i := range m.Histograms {
+		data = m.Histograms[i].Append(data)
+	}
+	if m.Structure != nil {
+		data = binary.AppendUvarint(data, uint64(m.Structure.Indent))
+		data = binary.AppendUvarint(data, uint64(m.Structure.Nesting))
+		start := byte(0)
+		if m.Structure.Start {
+			start = 1
+		}
+		data = append(data, start)
+		for i := range m.Structure.Histograms {
+			data = m.Structure.Histograms[i].Append(data)
+		}
+	}
+	if m.Order2 != nil {
+		data = binary.AppendUvarint(data, uint64(m.Order2.Context))
+		for i := range m.Order2.Histograms {
+			data = m.Order2.Histograms[i].Append(data)
+		}
+	}
+	return data, nil
+}
+
+// UnmarshalBinary restores a context encoded by a mixer with the same code
+// structure and second order histograms
+func (m *HistogramMixer) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < len(m.Markov) {
+		return fmt.Errorf("the state of the markov context is truncated")
+	}
+	copy(m.Markov[:], data)
+	data = data[len(m.Markov):]
+	for i := range m.Histograms {
+		data, err = m.Histograms[i].Decode(data)
+		if err != nil {
+			return err
+		}
+	}
+	uvarint := func() int {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			err = fmt.Errorf("the state of the mixer is truncated")
+			return 0
+		}
+		data = data[n:]
+		return int(value)
+	}
+	if m.Structure != nil {
+		m.Structure.Indent, m.Structure.Nesting = uvarint(), uvarint()
+		if err != nil || len(data) == 0 {
+			return fmt.Errorf("the state of the code structure is truncated")
+		}
+		m.Structure.Start, data = data[0] == 1, data[1:]
+		for i := range m.Structure.Histograms {
+			data, err = m.Structure.Histograms[i].Decode(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if m.Order2 != nil {
+		m.Order2.Context = uvarint()
+		if err != nil || m.Order2.Context >= len(m.Order2.Histograms) {
+			return fmt.Errorf("the state of the second order histograms is invalid")
+		}
+		for i := range m.Order2.Histograms {
+			data, err = m.Order2.Histograms[i].Decode(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("the state has %d bytes more than the mixer", len(data))
+	}
+	return nil
 }
 
 // Add adds a symbol to a mixer
-func (m *Mixer) Add(s byte) {
+func (m *HistogramMixer) Add(s byte) {
 	for i := range m.Histograms {
 		m.Histograms[i].Add(s)
 	}
@@ -88,58 +408,117 @@ func (m *Mixer) Add(s byte) {
 		m.Markov[k] = m.Markov[k-1]
 	}
 	m.Markov[0] = s
+	if m.Structure != nil {
+		m.Structure.Add(s)
+	}
+	if m.Order2 != nil {
+		m.Order2.Add(m.Markov[1], s)
+	}
 }
 
-// Mix mixes the histograms outputting a matrix
-func (m Mixer) Mix(output *[256]float32) {
-	x := NewMatrix(256, Size)
-	for i := range m.Histograms {
+// Normalize writes the normalized histograms into the rows of the workspace input
+func (m *HistogramMixer) Normalize() Matrix {
+	x := m.Workspace.Input
+	normalize := func(i int, h *Histogram) {
 		sum := float32(0.0)
-		for _, v := range m.Histograms[i].Vector {
+		for _, v := range h.Vector {
 			sum += float32(v)
 		}
-		for _, v := range m.Histograms[i].Vector {
-			x.Data = append(x.Data, float32(v)/sum)
+		row := x.Data[i*x.Cols : (i+1)*x.Cols]
+		if sum == 0 {
+			for j := range row {
+				row[j] = 0
+			}
+			return
+		}
+		for j, v := range h.Vector {
+			row[j] = float32(v) / sum
 		}
 	}
-	SelfAttention(x, output)
-}
-
-// MixEntropy mixes the histograms and outputs entropy
-func (m Mixer) MixEntropy(output []float32) {
-	x := NewMatrix(256, Size)
 	for i := range m.Histograms {
-		sum := float32(0.0)
-		for _, v := range m.Histograms[i].Vector {
-			sum += float32(v)
+		normalize(i, &m.Histograms[i])
+	}
+	row := len(m.Histograms)
+	if m.Structure != nil {
+		for i := range m.Structure.Histograms {
+			normalize(row, &m.Structure.Histograms[i])
+			row++
 		}
-		for _, v := range m.Histograms[i].Vector {
-			x.Data = append(x.Data, float32(v)/sum)
+	}
+	if m.Order2 != nil {
+		normalize(row, &m.Order2.Histograms[m.Order2.Context])
+	}
+	return x
+}
+
+// Mix mixes the histograms outputting a vector
+func (m *HistogramMixer) Mix(output *[256]float32) {
+	m.Normalize()
+	m.Workspace.SelfAttention(output[:])
+	if i := NonFinite(output[:]); i >= 0 {
+		panic(m.Diagnose(output[:], i))
+	}
+}
+
+// Diagnose describes a non finite value at index of a mixed vector
+func (m *HistogramMixer) Diagnose(output []float32, index int) string {
+	x, rows := m.Workspace.Input, []int{}
+	for i := 0; i < x.Rows; i++ {
+		if NonFinite(x.Data[i*x.Cols:(i+1)*x.Cols]) >= 0 {
+			rows = append(rows, i)
 		}
 	}
-	SelfEntropy(x, output)
-	aa := sqrt(vector.Dot(output, output))
-	for i, v := range output {
-		output[i] = v / aa
+	return fmt.Sprintf("mixer produced %f at %d after %q, non finite input rows %v",
+		output[index], index, m.Snapshot().Markov, rows)
+}
+
+// MixEntropy mixes the histograms and outputs entropy
+func (m *HistogramMixer) MixEntropy(output []float32) {
+	SelfEntropy(m.Normalize(), output)
+	unit(output, output)
+	if i := NonFinite(output); i >= 0 {
+		panic(m.Diagnose(output, i))
 	}
 }
 
-// MixRank mixes the histograms and outputs page rank
-func (m Mixer) MixRank(output *[Size]float32) {
-	x := NewMatrix(256, Size)
-	for i := range m.Histograms {
-		sum := float32(0.0)
-		for _, v := range m.Histograms[i].Vector {
-			sum += float32(v)
+// Entropy returns the self entropy of each histogram of the context
+func (m *HistogramMixer) Entropy() []float32 {
+	output := make([]float32, m.Rows())
+	m.MixEntropy(output)
+	return output
+}
+
+// Entropy is the entropy of the symbol distribution of a mixed vector scaled
+// to [0, 1], a low entropy context is highly predictable
+func Entropy(mixed []float32) float32 {
+	sum := float32(0.0)
+	for _, v := range mixed {
+		if v > 0 {
+			sum += v
 		}
-		for _, v := range m.Histograms[i].Vector {
-			x.Data = append(x.Data, float32(v)/sum)
+	}
+	if !(sum > Epsilon) {
+		return 0
+	}
+	entropy := float32(0.0)
+	for _, v := range mixed {
+		if v > 0 {
+			p := v / sum
+			entropy -= p * log(p)
 		}
 	}
+	return entropy / log(256)
+}
+
+// MixRank mixes the histograms and outputs page rank, the ranks of the
+// windows a mixer with fewer windows doesn't have are 0
+func (m *HistogramMixer) MixRank(output *[Size]float32) {
+	x, n := m.Normalize(), min(len(m.Histograms), Size)
+	*output = [Size]float32{}
 	graph := pagerank.NewGraph()
-	for i := 0; i < Size; i++ {
+	for i := 0; i < n; i++ {
 		a := x.Data[i*256 : i*256+256]
-		for j := 0; j < Size; j++ {
+		for j := 0; j < n; j++ {
 			b := x.Data[j*256 : j*256+256]
 			cs := CS(a, b)
 			graph.Link(uint32(i), uint32(j), float64(cs))
@@ -148,9 +527,66 @@ func (m Mixer) MixRank(output *[Size]float32) {
 	graph.Rank(1.0, 1e-3, func(node uint32, rank float64) {
 		output[node] = float32(rank)
 	})
-	a := output[:]
-	aa := sqrt(vector.Dot(a, a))
-	for i, v := range output {
-		output[i] = v / aa
+	unit(output[:], output[:])
+	if i := NonFinite(output[:]); i >= 0 {
+		panic(m.Diagnose(output[:], i))
+	}
+}
+
+// SymbolCount is the count of a symbol in a histogram
+type SymbolCount struct {
+	Symbol uint8  `json:"symbol"`
+	S      string `json:"s"`
+	Count  int    `json:"count"`
+}
+
+// HistogramSnapshot is a snapshot of a histogram
+type HistogramSnapshot struct {
+	Size   int           `json:"size"`
+	Window string        `json:"window"`
+	Counts []SymbolCount `json:"counts"`
+}
+
+// MixerSnapshot is a snapshot of the state of a mixer
+type MixerSnapshot struct {
+	Markov     string              `json:"markov"`
+	Histograms []HistogramSnapshot `json:"histograms"`
+}
+
+// Snapshot returns the symbols buffered by the histogram and its counts
+func (h Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Size: h.Size,
+	}
+	total := 0
+	for symbol, count := range h.Vector {
+		if count == 0 {
+			continue
+		}
+		total += int(count)
+		snapshot.Counts = append(snapshot.Counts, SymbolCount{
+			Symbol: uint8(symbol),
+			S:      string(rune(symbol)),
+			Count:  int(count),
+		})
+	}
+	window := make([]byte, 0, total)
+	for i := total - 1; i >= 0; i-- {
+		window = append(window, h.Buffer[(h.Index-i+h.Size)%h.Size])
+	}
+	snapshot.Window = string(window)
+	return snapshot
+}
+
+// Snapshot returns a structured snapshot of the context the mixer is conditioning on
+func (m *HistogramMixer) Snapshot() MixerSnapshot {
+	snapshot, markov := MixerSnapshot{}, make([]byte, 0, Order+1)
+	for i := Order; i >= 0; i-- {
+		markov = append(markov, m.Markov[i])
+	}
+	snapshot.Markov = string(markov)
+	for _, h := range m.Histograms {
+		snapshot.Histograms = append(snapshot.Histograms, h.Snapshot())
 	}
+	return snapshot
 }
@@ -0,0 +1,134 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func BenchmarkMix(b *testing.B) {
+	m := NewHistogramMixer()
+	m.Add(0)
+	for _, v := range []byte("In the beginning God created the heaven and the earth.") {
+		m.Add(v)
+	}
+	var output [256]float32
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Mix(&output)
+	}
+}
+
+func TestMixEmpty(t *testing.T) {
+	m := NewHistogramMixer()
+	var output [256]float32
+	m.Mix(&output)
+	for i, v := range output {
+		if v != 0 {
+			t.Fatalf("the mix of an empty mixer should be zero, %f at %d", v, i)
+		}
+	}
+	if entropy := Entropy(output[:]); entropy != 0 {
+		t.Fatalf("the entropy of a zero vector should be 0 not %f", entropy)
+	}
+	entropy := make([]float32, Size)
+	m.MixEntropy(entropy)
+	if i := NonFinite(entropy); i >= 0 {
+		t.Fatalf("the entropy mix of an empty mixer is %f at %d", entropy[i], i)
+	}
+	var rank [Size]float32
+	m.MixRank(&rank)
+	if i := NonFinite(rank[:]); i >= 0 {
+		t.Fatalf("the rank mix of an empty mixer is %f at %d", rank[i], i)
+	}
+}
+
+func TestMixShort(t *testing.T) {
+	for _, input := range []string{"", "a", "ab", "\x00", "\xff\xff"} {
+		for _, settings := range []Settings{{}, {Code: true}, {Order2: 16}, {Mixer: "ngram"}} {
+			m := settings.NewMixer()
+			var output [256]float32
+			for _, v := range []byte(input) {
+				m.Add(v)
+				m.Mix(&output)
+				if i := NonFinite(output[:]); i >= 0 {
+					t.Fatalf("mixing %q with %+v produced %f at %d", input, settings, output[i], i)
+				}
+			}
+			if len(input) == 0 {
+				continue
+			}
+			if norm := sqrt(CS(output[:], output[:])); norm < .99 || norm > 1.01 {
+				t.Fatalf("mixing %q with %+v should be unit length not %f", input, settings, norm)
+			}
+		}
+	}
+}
+
+func TestMixerReset(t *testing.T) {
+	for _, settings := range []Settings{{}, {Code: true, Order2: 16}, {Mixer: "ngram"}} {
+		fresh, m := settings.NewMixer(), settings.NewMixer()
+		for _, v := range []byte("{\n\tlet there be light") {
+			m.Add(v)
+		}
+		copied := m.Copy()
+		m.Reset()
+		var a, b, c [256]float32
+		for _, v := range []byte("and there was light") {
+			fresh.Add(v)
+			m.Add(v)
+			copied.Add(v)
+		}
+		fresh.Mix(&a)
+		m.Mix(&b)
+		copied.Mix(&c)
+		if a != b {
+			t.Fatalf("a reset mixer with %+v should mix like a new mixer", settings)
+		}
+		if a == c {
+			t.Fatalf("a copy of a mixer with %+v should keep its context", settings)
+		}
+	}
+}
+
+func TestMixerState(t *testing.T) {
+	for _, settings := range []Settings{{}, {Code: true, Order2: 16}, {Mixer: "ngram"}} {
+		m, restored := settings.NewMixer(), settings.NewMixer()
+		for _, v := range []byte("{\n\tlet there be light") {
+			m.Add(v)
+		}
+		state, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = restored.UnmarshalBinary(state)
+		if err != nil {
+			t.Fatalf("restoring the state of a mixer with %+v: %v", settings, err)
+		}
+		var a, b [256]float32
+		for _, v := range []byte("and there was light") {
+			m.Add(v)
+			restored.Add(v)
+		}
+		m.Mix(&a)
+		restored.Mix(&b)
+		if a != b {
+			t.Fatalf("a restored mixer with %+v should mix like the mixer", settings)
+		}
+		if restored.UnmarshalBinary(state[:len(state)-1]) == nil {
+			t.Fatalf("a truncated state of a mixer with %+v should be rejected", settings)
+		}
+	}
+}
+
+func TestSoftmax(t *testing.T) {
+	for _, values := range [][]float32{{}, {0, 0}, {1e30, 1e30}, {-1e30, 0}} {
+		softmax(values)
+		if i := NonFinite(values); i >= 0 {
+			t.Fatalf("softmax produced %f at %d", values[i], i)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+// +build !unix
+
+package main
+
+import "errors"
+
+func mlock(data []byte) error {
+	return errors.New("mlock isn't supported on this platform")
+}
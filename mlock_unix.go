@@ -0,0 +1,14 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+// +build unix
+
+package main
+
+import "syscall"
+
+func mlock(data []byte) error {
+	return syscall.Mlock(data)
+}
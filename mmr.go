@@ -0,0 +1,81 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+// FlagLambda is the weight of relevance against diversity in the selection of candidates
+var FlagLambda = flag.Float64("mmr-lambda", 1, "maximal marginal relevance weight of the candidate score against the dissimilarity to the candidates already selected from a bucket, 1 selects by score alone")
+
+// MMRPool is the number of best scoring candidates of a bucket that maximal
+// marginal relevance selects MaxCandidates from
+const MMRPool = 4 * MaxCandidates
+
+// MMR selects up to size candidates by maximal marginal relevance, each
+// selected candidate maximizes lambda times its score minus 1-lambda times
+// its greatest similarity to the candidates already selected, vectors are
+// the entry vectors of the candidates
+func MMR(candidates []Candidate, vectors [][]float32, size int, lambda float32) []Candidate {
+	if size > len(candidates) {
+		size = len(candidates)
+	}
+	similarity := make([]float32, len(candidates))
+	for i := range similarity {
+		similarity[i] = -1
+	}
+	used := make([]bool, len(candidates))
+	selected := make([]Candidate, 0, size)
+	for len(selected) < size {
+		best, max := -1, float32(0)
+		for i := range candidates {
+			if used[i] {
+				continue
+			}
+			relevance := lambda * candidates[i].Score
+			if len(selected) > 0 {
+				relevance -= (1 - lambda) * similarity[i]
+			}
+			if best < 0 || relevance > max {
+				best, max = i, relevance
+			}
+		}
+		used[best] = true
+		selected = append(selected, candidates[best])
+		for i := range candidates {
+			if !used[i] {
+				if cs := CS(vectors[i], vectors[best]); cs > similarity[i] {
+					similarity[i] = cs
+				}
+			}
+		}
+	}
+	return selected
+}
+
+// Diversify selects MaxCandidates of the candidates of a bucket by maximal
+// marginal relevance from the MMRPool best scoring ones, the vector of
+// candidate i is row i of the contiguous width vectors
+func Diversify(candidates []Candidate, vectors []float32, width int, lambda float32) []Candidate {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return candidates[order[i]].Before(candidates[order[j]])
+	})
+	if len(order) > MMRPool {
+		order = order[:MMRPool]
+	}
+	pool, rows := make([]Candidate, len(order)), make([][]float32, len(order))
+	for i, o := range order {
+		pool[i], rows[i] = candidates[o], vectors[o*width:(o+1)*width]
+	}
+	results := MMR(pool, rows, MaxCandidates, lambda)
+	SortCandidates(results)
+	return results
+}
@@ -0,0 +1,493 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagDB is the path of the database
+var FlagDB = flag.String("db", "db.bin", "path of the database to build or query")
+
+// Settings are the build settings that are recorded in a database and used
+// again at query time
+type Settings struct {
+	// Preprocess is the preprocessing pipeline of the corpus and queries
+	Preprocess Pipeline `json:"preprocess"`
+	// Code mixes the indentation depth and bracket nesting of source code
+	Code bool `json:"code"`
+	// Order2 is the size of the second order histogram bank, 0 if not used
+	Order2 int `json:"order2"`
+	// Windows are the windows of the histograms of the histogram mixer,
+	// empty for DefaultWindows
+	Windows []int `json:"windows,omitempty"`
+	// Weights are the default document weights of queries
+	Weights Weights `json:"weights,omitempty"`
+	// Quota is the default maximum number of candidates of a step from one
+	// document, 0 is no limit
+	Quota int `json:"quota,omitempty"`
+	// Smooth are the classes of variants smoothed in queries
+	Smooth []string `json:"smooth,omitempty"`
+	// Smoothing are the rules derived from the corpus for the classes
+	Smoothing Smoothing `json:"smoothing,omitempty"`
+	// Dimensions is the dimensionality of the vectors if they are projected
+	Dimensions int `json:"dimensions,omitempty"`
+	// Projection projects the mixer outputs to Dimensions dimensions, it is
+	// stored in its own section
+	Projection *Projection `json:"-"`
+	// Merges is the number of symbol pairs merged into the alphabet
+	Merges int `json:"merges,omitempty"`
+	// Alphabet are the merges learned from the corpus, the entries and
+	// queries are encoded with them
+	Alphabet Alphabet `json:"alphabet,omitempty"`
+	// Fold is the number of the most frequent runes of the corpus with
+	// their own symbols if runes are folded
+	Fold int `json:"fold,omitempty"`
+	// Folding maps the runes of the entries and queries to symbols, nil if
+	// runes aren't folded
+	Folding *Folding `json:"folding,omitempty"`
+	// Stride is the spacing of the indexed positions, 0 or 1 indexes every
+	// position
+	Stride int `json:"stride,omitempty"`
+	// Mixer is the name of the mixer in Mixers, empty for the histogram mixer
+	Mixer string `json:"mixer,omitempty"`
+	// EmbedCorpus is true if the compressed corpus is a section of the
+	// database instead of a file alongside it
+	EmbedCorpus bool `json:"embed_corpus,omitempty"`
+	// Redact are the rules masked in the corpus before it is preprocessed
+	Redact Redaction `json:"redact,omitempty"`
+	// Transform is true if the transform the header was sampled with is a
+	// section of the database, it follows the embedded corpus
+	Transform bool `json:"transform,omitempty"`
+	// Header is the header initialization, empty for the gaussian
+	Header string `json:"header,omitempty"`
+	// Calibration maps candidate scores to probabilities, nil if the
+	// database wasn't calibrated
+	Calibration *Calibration `json:"calibration,omitempty"`
+	// Subclusters is the number of sub-clusters of the big buckets, their
+	// section is the last of the database if it isn't 0
+	Subclusters int `json:"subclusters,omitempty"`
+	// SubclusterMin is the minimum number of entries of a sub-clustered
+	// bucket
+	SubclusterMin int `json:"subcluster_min,omitempty"`
+}
+
+// Width is the width of the database vectors
+func (s Settings) Width() int {
+	if s.Dimensions == 0 {
+		return 256
+	}
+	return s.Dimensions
+}
+
+// EntrySize is the size of an entry of the database
+func (s Settings) EntrySize() uint64 {
+	return uint64(binaryvec.EntrySizeOf(s.Width()))
+}
+
+// ProjectionSize is the size of the projection section of the database
+func (s Settings) ProjectionSize() int64 {
+	return int64(4 * 256 * s.Dimensions)
+}
+
+// Project writes a mixed vector as a database vector to output
+func (s Settings) Project(output, mixed []float32) {
+	if s.Projection == nil {
+		copy(output, mixed)
+		return
+	}
+	s.Projection.Project(output, mixed)
+}
+
+// NewMixer makes the mixer of the settings
+func (s Settings) NewMixer() Mixer {
+	mixer, ok := Mixers[s.Mixer]
+	if !ok {
+		panic(fmt.Sprintf("unknown mixer %q", s.Mixer))
+	}
+	return mixer(s)
+}
+
+// Model is a loaded database, multiple models can be used in one process
+type Model struct {
+	Path     string
+	DB       io.ReaderAt
+	Header   Header
+	Sizes    []uint64
+	Sums     []uint64
+	Metadata *Metadata
+	// Shards scan the buckets instead of DB when the model is a coordinator
+	Shards *Shards
+	// Reranker rescores the candidates of every generation
+	Reranker Reranker
+	// Lexical blends the lexical scores of the candidates with their cosine
+	// scores after the reranker, nil if it isn't used
+	Lexical *LexicalIndex
+	// Stats are the probe statistics of the buckets
+	Stats *BucketStats
+	// Store is the storage of the entries
+	Store Store
+	// FileSizes and FileSums are the Sizes and Sums of the entries in the
+	// database file, the sections after the entries are found with them.
+	// Sizes and Sums also count the entries appended to the store
+	FileSizes []uint64
+	FileSums  []uint64
+	// Counts are the number of original entries each entry of a distilled
+	// database represents, nil if it isn't distilled
+	Counts []uint32
+	// Log records the generations of the model, nil if they aren't recorded
+	Log *GenerationLog
+	// Flights are the generations in progress identical requests join, nil
+	// if requests aren't collapsed
+	Flights *Flights
+	Settings
+
+	corpus struct {
+		sync.Once
+		Runes []rune
+		Err   error
+	}
+	embedded struct {
+		sync.Once
+		Corpus *EmbeddedCorpus
+		Err    error
+	}
+}
+
+// MaxContext is the maximum number of runes of corpus context on each side of
+// an output
+const MaxContext = 4096
+
+// CorpusPath is the path of the compressed corpus kept alongside the database
+// at path
+func CorpusPath(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, ".bin"), HeadSuffix) + ".corpus.gz"
+}
+
+// Corpus returns the runes of the corpus the model was built from, they are
+// loaded from the compressed corpus on first use
+func (m *Model) Corpus() ([]rune, error) {
+	m.corpus.Do(func() {
+		if m.EmbedCorpus {
+			embedded, err := m.Embedded()
+			if err != nil {
+				m.corpus.Err = err
+				return
+			}
+			m.corpus.Runes, m.corpus.Err = embedded.Slice(0, embedded.Runes)
+			return
+		}
+		file, err := os.Open(CorpusPath(m.Path))
+		if err != nil {
+			m.corpus.Err = err
+			return
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			m.corpus.Err = err
+			return
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			m.corpus.Err = err
+			return
+		}
+		if appender, ok := m.Store.(Appender); ok {
+			data = append(data, appender.Appended()...)
+		}
+		m.corpus.Runes = []rune(string(data))
+	})
+	return m.corpus.Runes, m.corpus.Err
+}
+
+// Snippet returns the runes of the corpus within n runes of index
+func Snippet(corpus []rune, index uint64, n int) string {
+	start, end := int(index)-n, int(index)+n+1
+	if start < 0 {
+		start = 0
+	}
+	if end > len(corpus) {
+		end = len(corpus)
+	}
+	if start >= end {
+		return ""
+	}
+	return string(corpus[start:end])
+}
+
+// Check checks that the model can generate with the options
+func (m *Model) Check(options Options) error {
+	if options.Context > 0 {
+		_, err := m.Snippet(0, 0)
+		if err != nil {
+			return fmt.Errorf("the corpus context isn't available: %w", err)
+		}
+	}
+	if options.Sampler.Calibrated && m.Calibration == nil {
+		return fmt.Errorf("the database isn't calibrated, rebuild it with -calibrate to sample calibrated probabilities")
+	}
+	return nil
+}
+
+// EmbeddedDB is the -db path of the database compiled into the binary
+const EmbeddedDB = "embedded:db.bin"
+
+// EmbeddedModel is the database compiled into the binary with the embedmodel
+// build tag, nil without it. It is read in place without being copied
+var EmbeddedModel []byte
+
+// EmbeddedReader reads the database compiled into the binary
+type EmbeddedReader struct {
+	*bytes.Reader
+}
+
+// Close does nothing, the database is part of the binary
+func (EmbeddedReader) Close() error {
+	return nil
+}
+
+// LoadModel opens and loads the database at path, EmbeddedDB is the database
+// compiled into the binary
+func LoadModel(path string) (*Model, error) {
+	var db interface {
+		io.ReaderAt
+		io.Closer
+	}
+	if path == EmbeddedDB {
+		if EmbeddedModel == nil {
+			return nil, fmt.Errorf("%s requires a binary built with the embedmodel tag", path)
+		}
+		db = EmbeddedReader{bytes.NewReader(EmbeddedModel)}
+	} else if IsSplit(path) {
+		split, err := OpenSplit(path)
+		if err != nil {
+			return nil, err
+		}
+		db = split
+	} else {
+		err := CheckTemp(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		db = file
+	}
+	model := ReadModel(db)
+	model.Path = path
+	if *FlagBackend != "flat" {
+		var err error
+		model.Store, err = OpenStore(model, *FlagBackend)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if model.Metadata != nil && model.Metadata.Encoding > binaryvec.Version {
+		db.Close()
+		return nil, fmt.Errorf("%s has record encoding %d but only %d is supported", path, model.Metadata.Encoding, binaryvec.Version)
+	}
+	if _, ok := Mixers[model.Mixer]; !ok {
+		db.Close()
+		return nil, fmt.Errorf("%s was built with the unknown mixer %q", path, model.Mixer)
+	}
+	return model, nil
+}
+
+// ReadModel reads the header, symbol index, and metadata of a database
+func ReadModel(db io.ReaderAt) *Model {
+	header, sizes, sums := ReadHeader(bufio.NewReader(io.NewSectionReader(db, 0, math.MaxInt64)))
+	model := Model{
+		DB:        db,
+		Header:    header,
+		Sizes:     sizes,
+		Sums:      sums,
+		FileSizes: sizes,
+		FileSums:  sums,
+		Stats:     NewBucketStats(len(header)),
+	}
+	// the width of the entries is recorded in the metadata which follows them,
+	// so each width is tried until the metadata agrees with it
+	for _, width := range Dimensions {
+		settings := Settings{}
+		if width != 256 {
+			settings.Dimensions = width
+		}
+		metadata := ReadMetadata(db, sizes, sums, settings)
+		if metadata != nil && metadata.Width() == width {
+			model.Metadata, model.Settings = metadata, metadata.Settings
+			break
+		}
+	}
+	header.ReadSymbols(db, sizes, sums, model.Settings)
+	counts, err := ReadCounts(db, sizes, sums, model.Settings, model.Metadata)
+	if err != nil {
+		panic(err)
+	}
+	model.Counts = counts
+	store, err := OpenStore(&model, "flat")
+	if err != nil {
+		panic(err)
+	}
+	model.Store = store
+	if model.Dimensions > 0 {
+		projection, err := ReadProjection(db, ProjectionOffset(sizes, sums, model.Settings), model.Dimensions)
+		if err != nil {
+			panic(err)
+		}
+		model.Projection = projection
+	}
+	err = model.LoadSubclusters()
+	if err != nil {
+		panic(err)
+	}
+	return &model
+}
+
+// Close closes the database
+func (m *Model) Close() error {
+	if m.Log != nil {
+		m.Log.Close()
+	}
+	if closer, ok := m.Store.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := m.DB.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SetReranker sets the reranker that rescores the candidates of every
+// generation, it should be set before the model is used concurrently
+func (m *Model) SetReranker(reranker Reranker) {
+	m.Reranker = reranker
+}
+
+// Soda preprocesses the query with the pipeline of the model and generates
+// with the mixer of the model, identical concurrent requests are generated
+// once if the model collapses them. The results are logged before they are
+// post-processed
+func (m *Model) Soda(query []byte, options Options) []Search {
+	// the symbols reserved by Admit that aren't generated are refunded, all
+	// of them if generation fails
+	generated := 0
+	defer func() {
+		options.Account.Refund(time.Now(), uint64(options.Count-generated))
+	}()
+	key, collapse := "", false
+	if m.Flights != nil {
+		key, collapse = FlightKey(m.Path, query, options)
+	}
+	var searches []Search
+	if collapse {
+		searches = m.Flights.Do(key, options, func(options Options) []Search {
+			return m.generate(query, options)
+		})
+	} else {
+		searches = m.generate(query, options)
+	}
+	generated = len(searches[0].Symbols)
+	if m.Log != nil {
+		// the searches of a collapsed request are shared with the requests
+		// that joined it, each is logged with its own id
+		searches = append([]Search(nil), searches...)
+		searches[0].ID = m.Record(query, options, searches[0])
+	}
+	if len(options.Postprocess) > 0 {
+		processed := make([]Search, len(searches))
+		for i, search := range searches {
+			processed[i] = options.Postprocess.Search(query, search)
+		}
+		searches = processed
+	}
+	return searches
+}
+
+func (m *Model) generate(query []byte, options Options) []Search {
+	options.Settings = m.Settings
+	if m.Reranker != nil {
+		options.Reranker = m.Reranker
+	}
+	if m.Lexical != nil {
+		options.Reranker = m.Lexical.Reranker(options.Reranker, m.Coding().Expansions())
+	}
+	if options.Stats == nil {
+		options.Stats = m.Stats
+	}
+	if options.Weights == nil {
+		options.Weights = m.Weights
+	}
+	if options.Quota == 0 {
+		options.Quota = m.Quota
+	}
+	if options.Latest {
+		options.Filter = options.Filter.Exclude(m.Superseded())
+	}
+	query = m.Preprocess.Apply(query)
+	if !options.Raw {
+		query = m.Smoothing.Apply(query)
+	}
+	query, truncated := Truncate(query, options.PromptBudget, options.Truncation)
+	query = m.Coding().Encode(query)
+	options.Symbols = m.Coding().Symbols(options.Symbols)
+	if options.Context > 0 {
+		progress, annotated := options.Progress, 0
+		options.Progress = func(symbols int, result []Output) {
+			for ; annotated < len(result); annotated++ {
+				context, err := m.Snippet(result[annotated].Index, options.Context)
+				if err != nil {
+					panic(err)
+				}
+				result[annotated].Context = context
+			}
+			if progress != nil {
+				progress(symbols, result)
+			}
+		}
+	}
+	if m.Folding != nil {
+		// the runes of hashed symbols are read from the corpus before the
+		// outputs are annotated
+		progress, unfolded := options.Progress, 0
+		options.Progress = func(symbols int, result []Output) {
+			err := m.Unfold(result[min(unfolded, len(result)):])
+			if err != nil {
+				panic(err)
+			}
+			unfolded = len(result)
+			if progress != nil {
+				progress(symbols, result)
+			}
+		}
+	}
+	var searches []Search
+	degraded := false
+	if m.Shards != nil {
+		searches = m.Header.Generate(m.Shards.Sizes, query, options, m.Shards.Scanner(options, &degraded))
+	} else {
+		searches = m.Header.Soda(m.Store, m.Sizes, query, options)
+	}
+	for i := range searches {
+		searches[i].PromptTruncated = truncated
+		searches[i].Degraded = degraded
+	}
+	return searches
+}
@@ -0,0 +1,48 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/pointlander/soda/client"
+)
+
+// MaxAlternatives is the maximum number of alternative symbols of a step, one
+// for each symbol
+const MaxAlternatives = 256
+
+// Alternatives returns the k highest scoring symbols of the candidates sorted
+// by score, a symbol is scored by its best candidate and its probability is
+// the softmax mass of its candidates at the temperature of the sampler
+func Alternatives(candidates []Candidate, sampler Sampler, k int, expansions *[256][]byte) []client.Alternative {
+	if !(sampler.Temperature > 0) {
+		sampler.Temperature = 1
+	}
+	scores := make([]float32, len(candidates))
+	for i := range candidates {
+		scores[i] = candidates[i].Score
+	}
+	var alternatives []client.Alternative
+	var index [256]int
+	for i, p := range sampler.Probabilities(scores) {
+		symbol := candidates[i].Symbol
+		if j := index[symbol]; j > 0 {
+			alternatives[j-1].Probability += p
+			continue
+		}
+		alternatives = append(alternatives, client.Alternative{
+			Symbol:      symbol,
+			Text:        string(expansions[symbol]),
+			Score:       candidates[i].Score,
+			Probability: p,
+			Index:       candidates[i].Index,
+			Document:    candidates[i].Document,
+		})
+		index[symbol] = len(alternatives)
+	}
+	if len(alternatives) > k {
+		alternatives = alternatives[:k]
+	}
+	return alternatives
+}
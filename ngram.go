@@ -0,0 +1,112 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// NGramOrder is the length of the longest n-grams counted
+	NGramOrder = 4
+	// NGramWindow is the number of recent symbols the n-grams are counted in
+	NGramWindow = 64
+	// NGramDecay is the weight of an n-gram relative to the one after it
+	NGramDecay = .9
+)
+
+// NGramWeights are the weights of the n-grams by age
+var NGramWeights = func() (weights [NGramWindow]float32) {
+	weight := float32(1)
+	for i := range weights {
+		weights[i] = weight
+		weight *= NGramDecay
+	}
+	return weights
+}()
+
+// NGramMixer counts the n-grams of the recent symbols into a vector with
+// signed feature hashing, recent and longer n-grams count more
+type NGramMixer struct {
+	Buffer [NGramWindow]byte
+	// Index is where the next symbol goes in the buffer
+	Index int
+	// Length is the number of symbols in the buffer
+	Length int
+}
+
+// Add adds a symbol to the window
+func (m *NGramMixer) Add(s byte) {
+	m.Buffer[m.Index] = s
+	m.Index = (m.Index + 1) % NGramWindow
+	if m.Length < NGramWindow {
+		m.Length++
+	}
+}
+
+// Mix hashes the n-grams ending at each symbol of the window into output
+func (m *NGramMixer) Mix(output *[256]float32) {
+	*output = [256]float32{}
+	for age := 0; age < m.Length; age++ {
+		hash := uint64(0xCBF29CE484222325)
+		for n := 0; n < NGramOrder && age+n < m.Length; n++ {
+			symbol := m.Buffer[(m.Index+2*NGramWindow-1-age-n)%NGramWindow]
+			hash = (hash ^ uint64(symbol)) * 0x100000001B3
+			mixed := hash * 0x9E3779B97F4A7C15
+			weight := NGramWeights[age] * float32(n+1)
+			if mixed&(1<<55) != 0 {
+				weight = -weight
+			}
+			output[mixed>>56] += weight
+		}
+	}
+	unit(output[:], output[:])
+}
+
+// Entropy returns the entropy of the mixed vector, the n-grams are mixed into
+// one distribution
+func (m *NGramMixer) Entropy() []float32 {
+	var mixed [256]float32
+	m.Mix(&mixed)
+	return []float32{Entropy(mixed[:])}
+}
+
+// Copy copies the mixer
+func (m *NGramMixer) Copy() Mixer {
+	copied := *m
+	return &copied
+}
+
+// Reset empties the window
+func (m *NGramMixer) Reset() {
+	*m = NGramMixer{}
+}
+
+// MarshalBinary encodes the window
+func (m *NGramMixer) MarshalBinary() ([]byte, error) {
+	data := append([]byte{}, m.Buffer[:]...)
+	data = binary.AppendUvarint(data, uint64(m.Index))
+	return binary.AppendUvarint(data, uint64(m.Length)), nil
+}
+
+// UnmarshalBinary restores a window encoded by MarshalBinary
+func (m *NGramMixer) UnmarshalBinary(data []byte) error {
+	if len(data) < NGramWindow {
+		return fmt.Errorf("the state of the n-gram window is truncated")
+	}
+	copy(m.Buffer[:], data)
+	data = data[NGramWindow:]
+	index, n := binary.Uvarint(data)
+	if n <= 0 || index >= NGramWindow {
+		return fmt.Errorf("the state of the n-gram window has an invalid index")
+	}
+	length, k := binary.Uvarint(data[n:])
+	if k <= 0 || length > NGramWindow || n+k != len(data) {
+		return fmt.Errorf("the state of the n-gram window has an invalid length")
+	}
+	m.Index, m.Length = int(index), int(length)
+	return nil
+}
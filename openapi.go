@@ -0,0 +1,307 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoint is a route of the api described in the openapi document, the
+// schemas of its bodies are derived from the types of Request and Responses
+type Endpoint struct {
+	Method  string
+	Path    string
+	Summary string
+	// Request is a value of the type of the json request body, nil if the
+	// request has no body
+	Request any
+	// Responses are values of the types of the json reply, there is more
+	// than one if the reply depends on the request, none if the reply has no
+	// json body
+	Responses []any
+	// Status is the status of a successful reply, 200 if it is 0
+	Status int
+	// ContentType is the content type of a successful reply that isn't json
+	ContentType string
+}
+
+// API is the described routes of a mux
+type API struct {
+	Mux       *http.ServeMux
+	Endpoints []Endpoint
+	// Security are the schemes that authenticate requests, nil if requests
+	// aren't authenticated
+	Security map[string]any
+}
+
+// HandleFunc registers the handler of an endpoint
+func (a *API) HandleFunc(endpoint Endpoint, handler func(http.ResponseWriter, *http.Request)) {
+	a.Handle(endpoint, http.HandlerFunc(handler))
+}
+
+// Handle registers the handler of an endpoint
+func (a *API) Handle(endpoint Endpoint, handler http.Handler) {
+	a.Mux.Handle(endpoint.Method+" "+endpoint.Path, handler)
+	a.Endpoints = append(a.Endpoints, endpoint)
+}
+
+// Parameters are the path parameters of a route pattern
+var Parameters = regexp.MustCompile(`\{([a-zA-Z_]+)\}`)
+
+// OpenAPI returns the openapi 3 document of the endpoints
+func (a *API) OpenAPI() map[string]any {
+	schemas := &Schemas{
+		Components: make(map[string]any),
+		Names:      make(map[reflect.Type]string),
+	}
+	ref := func(value any) map[string]any {
+		return schemas.Schema(reflect.TypeOf(value))
+	}
+	paths := make(map[string]any)
+	for _, endpoint := range a.Endpoints {
+		operation := map[string]any{
+			"summary":     endpoint.Summary,
+			"operationId": OperationID(endpoint),
+		}
+		var parameters []any
+		for _, match := range Parameters.FindAllStringSubmatch(endpoint.Path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if endpoint.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": ref(endpoint.Request)},
+				},
+			}
+		}
+		status := endpoint.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		reply := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case endpoint.ContentType != "":
+			reply["content"] = map[string]any{
+				endpoint.ContentType: map[string]any{"schema": map[string]any{"type": "string"}},
+			}
+		case len(endpoint.Responses) == 1:
+			reply["content"] = map[string]any{
+				"application/json": map[string]any{"schema": ref(endpoint.Responses[0])},
+			}
+		case len(endpoint.Responses) > 1:
+			var oneOf []any
+			for _, response := range endpoint.Responses {
+				oneOf = append(oneOf, ref(response))
+			}
+			reply["content"] = map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"oneOf": oneOf}},
+			}
+		}
+		operation["responses"] = map[string]any{
+			strconv.Itoa(status): reply,
+			"400":                map[string]any{"description": "the request is invalid, the body is the reason"},
+		}
+		item, _ := paths[endpoint.Path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[endpoint.Path] = item
+		}
+		item[strings.ToLower(endpoint.Method)] = operation
+	}
+	components := map[string]any{"schemas": schemas.Components}
+	document := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "soda",
+			"version": Version,
+		},
+		"paths":      paths,
+		"components": components,
+	}
+	if a.Security != nil {
+		components["securitySchemes"] = a.Security
+		var security []any
+		for _, name := range SortedKeys(a.Security) {
+			security = append(security, map[string]any{name: []any{}})
+		}
+		document["security"] = security
+	}
+	return document
+}
+
+// ServeHTTP serves the openapi document
+func (a *API) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	data, err := json.Marshal(a.OpenAPI())
+	if err != nil {
+		panic(err)
+	}
+	NewContent(data, "application/json; charset=utf-8").ServeHTTP(response, request)
+}
+
+// OperationID names the operation of an endpoint after its method and path,
+// POST /v1/sessions/{id}/branch is postSessionsIdBranch
+func OperationID(endpoint Endpoint) string {
+	id := strings.ToLower(endpoint.Method)
+	for _, part := range strings.Split(strings.TrimPrefix(endpoint.Path, "/v1"), "/") {
+		part = strings.Trim(part, "{}")
+		for _, word := range strings.FieldsFunc(part, func(r rune) bool { return r == '_' || r == '-' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// SortedKeys returns the sorted keys of a map
+func SortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Schemas derives json schemas from go types, named structs are components
+// referenced by their name
+type Schemas struct {
+	Components map[string]any
+	Names      map[reflect.Type]string
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textType      = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Schema returns the schema of the json encoding of values of type t
+func (s *Schemas) Schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		return map[string]any{}
+	case t.Implements(textType) || reflect.PointerTo(t).Implements(textType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.Schema(t.Elem())
+		if _, ok := schema["$ref"]; !ok {
+			schema["nullable"] = true
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Float32:
+		return map[string]any{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		schema := map[string]any{"type": "array", "items": s.Schema(t.Elem())}
+		if t.Kind() == reflect.Array {
+			schema["minItems"], schema["maxItems"] = t.Len(), t.Len()
+		}
+		return schema
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.Schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.Object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + s.Component(t)}
+	}
+	return map[string]any{}
+}
+
+// Component adds the schema of the named struct t to the components and
+// returns its name, a name taken by a type of another package is qualified
+// with the package
+func (s *Schemas) Component(t reflect.Type) string {
+	if name, ok := s.Names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := s.Components[name]; taken {
+		pkg := path.Base(t.PkgPath())
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	s.Names[t] = name
+	// the placeholder stops the recursion of a type that refers to itself
+	s.Components[name] = map[string]any{}
+	s.Components[name] = s.Object(t)
+	return name
+}
+
+// Object returns the object schema of the exported fields of struct t, the
+// fields of embedded structs without a json name are its fields
+func (s *Schemas) Object(t reflect.Type) map[string]any {
+	properties, required := make(map[string]any), []string{}
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					fields(embedded)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = s.Schema(field.Type)
+			if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	fields(t)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
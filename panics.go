@@ -0,0 +1,96 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Panic is a panic recovered from a worker goroutine, it is passed to the
+// goroutine waiting for the worker as an error
+type Panic struct {
+	Value any
+	// Stack is the stack of the worker where it panicked
+	Stack []byte
+}
+
+// Error returns the value of the panic
+func (p *Panic) Error() string {
+	return fmt.Sprintf("panic: %v", p.Value)
+}
+
+// Unwrap returns the value of the panic if it is an error
+func (p *Panic) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+// Recover runs fn and returns its panic as a *Panic, a worker goroutine that
+// runs its work with Recover doesn't crash the process
+func Recover(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if p, ok := r.(*Panic); ok {
+				err = p
+				return
+			}
+			err = &Panic{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	fn()
+	return nil
+}
+
+// recorder is a response writer that records if the response was started
+type recorder struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.started = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.started = true
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *recorder) Flush() {
+	r.started = true
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap returns the response writer for http.ResponseController
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Isolate fails a request that panics with a 500 instead of crashing the
+// process, the panics of the workers of the request are passed to it, a
+// response that was started is cut off
+func Isolate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		writer := &recorder{ResponseWriter: response}
+		err := Recover(func() {
+			next.ServeHTTP(writer, request)
+		})
+		if err == nil {
+			return
+		}
+		p := err.(*Panic)
+		if p.Value == http.ErrAbortHandler {
+			panic(http.ErrAbortHandler)
+		}
+		fmt.Printf("%s %s: %v\n%s", request.Method, request.URL.Path, p.Value, p.Stack)
+		if writer.started {
+			panic(http.ErrAbortHandler)
+		}
+		http.Error(response, "internal error", http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,301 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pointlander/soda/client"
+)
+
+// FlagPostprocess is the default post-processing pipeline of generations
+var FlagPostprocess = flag.String("postprocess", "", "comma separated post-processing stages applied to generated text unless a request selects its own: capitalize, space, mask")
+
+// FlagMaskWords are the words masked by the mask stage
+var FlagMaskWords = flag.String("mask-words", "fuck,fucking,fucker,motherfucker,shit,bullshit,cunt,bitch,bastard,asshole,damn,piss,cock,dick,whore,slut", "comma separated words the mask post-processing stage masks")
+
+// Postprocessor rewrites the symbols of generated outputs in place, before is
+// the text the outputs follow. The rewrite of an output only depends on the
+// outputs before it and the rest of the word or run of white space it is in,
+// see Postprocess.Stable
+type Postprocessor func(before []byte, outputs []Output)
+
+// Postprocessors are the available post-processing stages
+var Postprocessors = map[string]Postprocessor{
+	"capitalize": Capitalize,
+	"space":      NormalizeSpace,
+	"mask":       Mask,
+}
+
+// outputRune returns the rune of an output, or -1 if it has been removed
+func outputRune(output Output) rune {
+	if output.S == "" {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(output.S)
+	return r
+}
+
+// word is true if the rune is part of a word
+func word(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// sentence tracks whether the next letter starts a sentence
+type sentence struct {
+	start, end bool
+	newlines   int
+}
+
+// next advances the state past r
+func (s *sentence) next(r rune) {
+	switch {
+	case word(r):
+		s.start, s.end, s.newlines = false, false, 0
+	case r == '.' || r == '!' || r == '?':
+		s.end, s.newlines = true, 0
+	case r == '\n':
+		s.newlines++
+		if s.end || s.newlines > 1 {
+			s.start = true
+		}
+	case unicode.IsSpace(r):
+		if s.end {
+			s.start = true
+		}
+	}
+}
+
+// Capitalize capitalizes the first letter of each sentence and the word i, a
+// sentence starts at the start of the text, after a blank line, and after
+// white space following a full stop, exclamation mark, or question mark
+func Capitalize(before []byte, outputs []Output) {
+	state, previous := sentence{start: true}, rune(-1)
+	for _, r := range string(before) {
+		state.next(r)
+		previous = r
+	}
+	for i := range outputs {
+		r := outputRune(outputs[i])
+		if r < 0 {
+			continue
+		}
+		if unicode.IsLetter(r) {
+			upper := state.start
+			if r == 'i' && !word(previous) {
+				j := i + 1
+				for j < len(outputs) && outputs[j].S == "" {
+					j++
+				}
+				upper = upper || j == len(outputs) || !word(outputRune(outputs[j]))
+			}
+			if upper {
+				outputs[i].S = string(unicode.ToUpper(r))
+			}
+		}
+		state.next(r)
+		previous = r
+	}
+}
+
+// NormalizeSpace replaces each run of white space with a single space, a run
+// with a newline becomes a newline and a run with a blank line becomes a blank
+// line as with CollapseSpace. The run is kept on the first output and the
+// other outputs of the run are removed, a run continuing the white space of
+// before is removed
+func NormalizeSpace(before []byte, outputs []Output) {
+	last, _ := utf8.DecodeLastRune(before)
+	continued := len(before) > 0 && unicode.IsSpace(last)
+	for i := 0; i < len(outputs); {
+		r := outputRune(outputs[i])
+		if r < 0 || !unicode.IsSpace(r) {
+			continued = false
+			i++
+			continue
+		}
+		first, newlines := i, 0
+		for ; i < len(outputs); i++ {
+			r := outputRune(outputs[i])
+			if r >= 0 && !unicode.IsSpace(r) {
+				break
+			}
+			if r == '\n' {
+				newlines++
+			}
+			outputs[i].S = ""
+		}
+		switch {
+		case continued:
+		case newlines > 1:
+			outputs[first].S = "\n\n"
+		case newlines == 1:
+			outputs[first].S = "\n"
+		default:
+			outputs[first].S = " "
+		}
+		continued = false
+	}
+}
+
+// MaskWords returns the words of -mask-words
+func MaskWords() map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.Split(*FlagMaskWords, ",") {
+		w = strings.TrimSpace(w)
+		if w != "" {
+			words[strings.ToLower(w)] = true
+		}
+	}
+	return words
+}
+
+// Mask replaces the letters after the first of each word of -mask-words with
+// asterisks, words are matched without regard to case
+func Mask(before []byte, outputs []Output) {
+	words := MaskWords()
+	last, _ := utf8.DecodeLastRune(before)
+	inside := len(before) > 0 && word(last)
+	for i := 0; i < len(outputs); {
+		r := outputRune(outputs[i])
+		if r < 0 || !word(r) {
+			inside = false
+			i++
+			continue
+		}
+		start, runes := i, []rune{}
+		for ; i < len(outputs); i++ {
+			r := outputRune(outputs[i])
+			if r < 0 {
+				continue
+			}
+			if !word(r) {
+				break
+			}
+			runes = append(runes, unicode.ToLower(r))
+		}
+		if inside || !words[string(runes)] {
+			inside = false
+			continue
+		}
+		first := true
+		for j := start; j < i; j++ {
+			if outputs[j].S == "" {
+				continue
+			}
+			if !first {
+				outputs[j].S = "*"
+			}
+			first = false
+		}
+	}
+}
+
+// Postprocess is a sequence of post-processing stages
+type Postprocess []string
+
+// NewPostprocess checks the names of post-processing stages
+func NewPostprocess(names []string) (Postprocess, error) {
+	var postprocess Postprocess
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := Postprocessors[name]; !ok {
+			return nil, fmt.Errorf("unknown post-processing stage %s", name)
+		}
+		postprocess = append(postprocess, name)
+	}
+	return postprocess, nil
+}
+
+// Stable is the number of outputs at the start of a partial generation whose
+// post-processing won't change as more outputs are generated, a trailing word
+// or run of white space is held back until it is complete. Every output is
+// stable without post-processing
+func (p Postprocess) Stable(outputs []Output) int {
+	if len(p) == 0 || len(outputs) == 0 {
+		return len(outputs)
+	}
+	class := func(output Output) int {
+		r := outputRune(output)
+		switch {
+		case word(r):
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		}
+		return 0
+	}
+	last := class(outputs[len(outputs)-1])
+	if last == 0 {
+		return len(outputs)
+	}
+	i := len(outputs) - 1
+	for i > 0 && class(outputs[i-1]) == last {
+		i--
+	}
+	return i
+}
+
+// Rewrite applies the stages in order to a copy of the outputs, removed
+// outputs are kept with an empty symbol so the copy lines up with outputs
+func (p Postprocess) Rewrite(before []byte, outputs []Output) []Output {
+	rewritten := append([]Output(nil), outputs...)
+	for _, name := range p {
+		Postprocessors[name](before, rewritten)
+	}
+	return rewritten
+}
+
+// Apply applies the stages in order to a copy of the outputs without the
+// removed outputs
+func (p Postprocess) Apply(before []byte, outputs []Output) []Output {
+	if len(p) == 0 {
+		return outputs
+	}
+	return Kept(p.Rewrite(before, outputs))
+}
+
+// Search applies the stages to the result of a search, the offsets of the
+// steps are moved to the outputs that are kept
+func (p Postprocess) Search(before []byte, search Search) Search {
+	if len(p) == 0 {
+		return search
+	}
+	rewritten := p.Rewrite(before, search.Result)
+	kept := make([]int, len(rewritten)+1)
+	for i, output := range rewritten {
+		kept[i+1] = kept[i]
+		if output.S != "" {
+			kept[i+1]++
+		}
+	}
+	search.Result = Kept(rewritten)
+	if search.Steps != nil {
+		steps := make([]client.Step, len(search.Steps))
+		for i, step := range search.Steps {
+			step.Offset = kept[min(step.Offset, len(rewritten))]
+			steps[i] = step
+		}
+		search.Steps = steps
+	}
+	return search
+}
+
+// Kept returns the outputs that haven't been removed
+func Kept(outputs []Output) []Output {
+	kept := make([]Output, 0, len(outputs))
+	for _, output := range outputs {
+		if output.S != "" {
+			kept = append(kept, output)
+		}
+	}
+	return kept
+}
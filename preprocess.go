@@ -0,0 +1,228 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FlagPreprocess is the preprocessing pipeline
+var FlagPreprocess = flag.String("preprocess", "", "comma separated preprocessing filters applied at build and query time: lower, nfc, space, control, ascii")
+
+// Preprocessor is a text preprocessing filter
+type Preprocessor func(data []byte) []byte
+
+// Preprocessors are the available preprocessing filters
+var Preprocessors = map[string]Preprocessor{
+	"lower":   bytes.ToLower,
+	"nfc":     norm.NFC.Bytes,
+	"space":   CollapseSpace,
+	"control": StripControl,
+	"ascii":   Transliterate,
+}
+
+// CollapseSpace replaces runs of white space with a single space, a run
+// containing a blank line becomes a blank line to preserve paragraphs
+func CollapseSpace(data []byte) []byte {
+	output := make([]byte, 0, len(data))
+	space, newlines := false, 0
+	for _, r := range string(data) {
+		if unicode.IsSpace(r) {
+			space = true
+			if r == '\n' {
+				newlines++
+			}
+			continue
+		}
+		if space {
+			if newlines > 1 {
+				output = append(output, '\n', '\n')
+			} else if newlines == 1 {
+				output = append(output, '\n')
+			} else {
+				output = append(output, ' ')
+			}
+			space, newlines = false, 0
+		}
+		output = utf8.AppendRune(output, r)
+	}
+	return output
+}
+
+// StripControl removes control characters other than tab and newline
+func StripControl(data []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' {
+			return -1
+		}
+		return r
+	}, data)
+}
+
+// Transliterations are replacements for common characters that don't
+// decompose into ascii
+var Transliterations = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'",
+	'“': "\"", '”': "\"", '„': "\"", '‟': "\"",
+	'–': "-", '—': "-", '―': "-", '‐': "-", '‑': "-",
+	'…': "...", '•': "*", '·': ".",
+	'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss",
+	'Ø': "O", 'ø': "o", 'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d",
+	'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d",
+	' ': " ",
+}
+
+// Transliterate converts text to ascii by removing diacritics and replacing
+// common punctuation, characters without an ascii form are dropped
+func Transliterate(data []byte) []byte {
+	output := make([]byte, 0, len(data))
+	for _, r := range string(norm.NFD.Bytes(data)) {
+		switch {
+		case r < utf8.RuneSelf:
+			output = append(output, byte(r))
+		case unicode.Is(unicode.Mn, r):
+		default:
+			if replacement, ok := Transliterations[r]; ok {
+				output = append(output, replacement...)
+			}
+		}
+	}
+	return output
+}
+
+// Pipeline is a sequence of preprocessing filters
+type Pipeline []string
+
+// NewPipeline parses a comma separated list of preprocessing filters
+func NewPipeline(spec string) (Pipeline, error) {
+	var pipeline Pipeline
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := Preprocessors[name]; !ok {
+			return nil, fmt.Errorf("unknown preprocessing filter %s", name)
+		}
+		pipeline = append(pipeline, name)
+	}
+	return pipeline, nil
+}
+
+// Apply applies the filters in order
+func (p Pipeline) Apply(data []byte) []byte {
+	for _, name := range p {
+		data = Preprocessors[name](data)
+	}
+	return data
+}
+
+// String returns the pipeline as a comma separated list
+func (p Pipeline) String() string {
+	return strings.Join(p, ",")
+}
+
+// CheckPipeline checks that the -preprocess flag, if given, agrees with the
+// pipeline a database was built with
+func CheckPipeline(recorded Pipeline) error {
+	if *FlagPreprocess == "" {
+		return nil
+	}
+	requested, err := NewPipeline(*FlagPreprocess)
+	if err != nil {
+		return err
+	}
+	if requested.String() != recorded.String() {
+		return fmt.Errorf("-preprocess %s doesn't match the pipeline the database was built with: %s",
+			requested, recorded)
+	}
+	return nil
+}
+
+// FlagSmooth are the classes of typographic variants smoothed in queries
+var FlagSmooth = flag.String("smooth", "", "comma separated classes of variants mapped to the forms found in the corpus when querying, recorded when building: quotes, dquotes, dashes, case")
+
+// SmoothingClasses are classes of interchangeable characters, case is
+// handled separately
+var SmoothingClasses = map[string][]rune{
+	"quotes":  {'\'', '‘', '’', '‚', '‛', '′'},
+	"dquotes": {'"', '“', '”', '„', '‟', '″'},
+	"dashes":  {'-', '‐', '‑', '‒', '–', '—', '―', '−'},
+}
+
+// Smoothing maps characters that don't occur in the corpus to a variant that
+// does
+type Smoothing map[string]string
+
+// NewSmoothing derives the smoothing rules of the classes from the counts of
+// the runes of a corpus, a character of a class that doesn't occur in the
+// corpus is mapped to the most frequent character of the class that does
+func NewSmoothing(classes []string, counts map[rune]int) (Smoothing, error) {
+	smoothing := make(Smoothing)
+	smooth := func(class []rune) {
+		canonical, max := rune(0), 0
+		for _, r := range class {
+			if counts[r] > max {
+				canonical, max = r, counts[r]
+			}
+		}
+		if max == 0 {
+			return
+		}
+		for _, r := range class {
+			if counts[r] == 0 {
+				smoothing[string(r)] = string(canonical)
+			}
+		}
+	}
+	for _, name := range classes {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case name == "case":
+			for r := range counts {
+				if !unicode.IsLetter(r) {
+					continue
+				}
+				class := []rune{r}
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					class = append(class, f)
+				}
+				smooth(class)
+			}
+		case SmoothingClasses[name] != nil:
+			smooth(SmoothingClasses[name])
+		default:
+			return nil, fmt.Errorf("unknown smoothing class %s", name)
+		}
+	}
+	if len(smoothing) == 0 {
+		return nil, nil
+	}
+	return smoothing, nil
+}
+
+// Apply maps the characters of a query to their smoothed forms
+func (s Smoothing) Apply(query []byte) []byte {
+	if len(s) == 0 {
+		return query
+	}
+	output := make([]byte, 0, len(query))
+	for _, r := range string(query) {
+		if replacement, ok := s[string(r)]; ok {
+			output = append(output, replacement...)
+			continue
+		}
+		output = utf8.AppendRune(output, r)
+	}
+	return output
+}
@@ -0,0 +1,66 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+// FlagProbeCache is the distance the mixer vector moves before the bucket
+// similarities are recomputed
+var FlagProbeCache = flag.Float64("probe-cache", 0, "cosine distance the mixer vector can move from the vector the similarities of all the buckets were computed for before they are recomputed, until then only the shortlist of the most similar buckets is rescored, 0 recomputes them every step")
+
+// ProbeShortlist is the number of buckets per probe the probe cache keeps
+// from the last full computation
+const ProbeShortlist = 4
+
+// ProbeCache caches the buckets most similar to the mixer vector of a
+// generation, consecutive steps have similar mixer vectors so the buckets they
+// probe are among the buckets most similar to an earlier vector
+type ProbeCache struct {
+	// Delta is the cosine distance from Anchor above which the similarities
+	// of all the buckets are recomputed
+	Delta float32
+	// Anchor is the vector the similarities of all the buckets were last
+	// computed for
+	Anchor []float32
+	// Shortlist are the buckets most similar to Anchor in bucket order
+	Shortlist []int
+}
+
+// NewProbeCache creates a probe cache, it is nil if delta is 0
+func NewProbeCache(delta float32) *ProbeCache {
+	if delta <= 0 {
+		return nil
+	}
+	return &ProbeCache{
+		Delta: delta,
+	}
+}
+
+// Probe returns the buckets to probe for the query like Header.Probe, the
+// shortlist is rescored if the query is within delta of the anchor, a nil
+// cache always scores all the buckets
+func (c *ProbeCache) Probe(h Header, sizes []uint64, query []float32, nprobe int, threshold float32) []int {
+	if c == nil {
+		return h.Probe(sizes, query, nprobe, threshold)
+	}
+	if c.Anchor != nil && len(c.Shortlist) >= nprobe && 1-CS(c.Anchor, query) <= c.Delta {
+		return Select(h.Similarities(sizes, query, c.Shortlist), nprobe, threshold)
+	}
+	similarities := h.Similarities(sizes, query, nil)
+	size := ProbeShortlist * nprobe
+	if len(similarities) < size {
+		size = len(similarities)
+	}
+	c.Anchor, c.Shortlist = append(c.Anchor[:0], query...), c.Shortlist[:0]
+	for _, similarity := range similarities[:size] {
+		c.Shortlist = append(c.Shortlist, similarity.Index)
+	}
+	// ties are probed in bucket order like the full computation
+	sort.Ints(c.Shortlist)
+	return Select(similarities, nprobe, threshold)
+}
@@ -0,0 +1,179 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// FlagQuiet disables progress reporting
+	FlagQuiet = flag.Bool("quiet", false, "disable progress reporting")
+	// FlagProgressJSON reports progress as json lines
+	FlagProgressJSON = flag.Bool("progress-json", false, "report progress as json lines")
+)
+
+// ProgressInterval is the minimum time between progress reports
+const ProgressInterval = time.Second
+
+// ProgressOutput is where progress is reported
+var ProgressOutput io.Writer = os.Stderr
+
+// ProgressEvent is a progress report
+type ProgressEvent struct {
+	Name    string  `json:"name"`
+	Done    int     `json:"done"`
+	Total   int     `json:"total"`
+	Percent float64 `json:"percent"`
+	Rate    float64 `json:"rate"`
+	Elapsed float64 `json:"elapsed"`
+	ETA     float64 `json:"eta"`
+	Message string  `json:"message,omitempty"`
+	Warning string  `json:"warning,omitempty"`
+	// Document is the title of the document being processed, if any
+	Document string `json:"document,omitempty"`
+	// Memory is the number of bytes of heap in use
+	Memory uint64 `json:"memory"`
+}
+
+// progressListener receives the events of every progress report, it is
+// nil if there is no listener
+var progressListener atomic.Pointer[func(event ProgressEvent)]
+
+// ListenProgress sends the events of every progress report to listener until
+// the returned function is called, there is one listener at a time
+func ListenProgress(listener func(event ProgressEvent)) func() {
+	progressListener.Store(&listener)
+	return func() {
+		progressListener.CompareAndSwap(&listener, nil)
+	}
+}
+
+// Progress reports the progress of a long running operation
+type Progress struct {
+	sync.Mutex
+	Name     string
+	Total    int
+	Start    time.Time
+	Last     time.Time
+	Listener func(event ProgressEvent)
+	// Document is the title of the document being processed
+	Document string
+}
+
+// NewProgress starts reporting the progress of an operation with total steps
+func NewProgress(name string, total int) *Progress {
+	now := time.Now()
+	return &Progress{
+		Name:  name,
+		Total: total,
+		Start: now,
+		Last:  now,
+	}
+}
+
+// Event computes the progress event for done steps
+func (p *Progress) Event(done int) ProgressEvent {
+	elapsed := time.Since(p.Start).Seconds()
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	event := ProgressEvent{
+		Name:     p.Name,
+		Done:     done,
+		Total:    p.Total,
+		Elapsed:  elapsed,
+		Document: p.Document,
+		Memory:   memory.HeapInuse,
+	}
+	if p.Total > 0 {
+		event.Percent = 100 * float64(done) / float64(p.Total)
+	}
+	if elapsed > 0 {
+		event.Rate = float64(done) / elapsed
+	}
+	if event.Rate > 0 && p.Total > done {
+		event.ETA = float64(p.Total-done) / event.Rate
+	}
+	return event
+}
+
+// At sets the title of the document being processed
+func (p *Progress) At(document string) {
+	p.Lock()
+	p.Document = document
+	p.Unlock()
+}
+
+// Update reports that done steps have completed, reports are rate limited
+func (p *Progress) Update(done int, message string) {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if now.Sub(p.Last) < ProgressInterval && done < p.Total {
+		return
+	}
+	p.Last = now
+	event := p.Event(done)
+	event.Message = message
+	p.report(event)
+}
+
+// Warn reports a warning immediately
+func (p *Progress) Warn(done int, warning string) {
+	p.Lock()
+	defer p.Unlock()
+	event := p.Event(done)
+	event.Warning = warning
+	p.report(event)
+}
+
+// Done reports that the operation has finished
+func (p *Progress) Done() {
+	p.Lock()
+	defer p.Unlock()
+	p.report(p.Event(p.Total))
+}
+
+func (p *Progress) report(event ProgressEvent) {
+	if p.Listener != nil {
+		p.Listener(event)
+	}
+	if listener := progressListener.Load(); listener != nil {
+		(*listener)(event)
+	}
+	if *FlagQuiet {
+		return
+	}
+	if *FlagProgressJSON {
+		data, err := json.Marshal(event)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintln(ProgressOutput, string(data))
+		return
+	}
+	line := fmt.Sprintf("%s %d/%d %.2f%% %.1f/s elapsed %s eta %s", event.Name, event.Done, event.Total,
+		event.Percent, event.Rate, Seconds(event.Elapsed), Seconds(event.ETA))
+	if event.Message != "" {
+		line += " " + event.Message
+	}
+	if event.Warning != "" {
+		line += " warning: " + event.Warning
+	}
+	fmt.Fprintln(ProgressOutput, line)
+}
+
+// Seconds formats a number of seconds as a duration
+func Seconds(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
@@ -0,0 +1,80 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+	"github.com/pointlander/soda/vector"
+)
+
+// FlagDimensions is the dimensionality of the database vectors
+var FlagDimensions = flag.Int("dims", 256, "dimensionality of the database vectors: 256, or 128 or 64 to randomly project the mixer outputs into a smaller database")
+
+// Dimensions are the supported dimensionalities of the database vectors
+var Dimensions = []int{256, 128, 64}
+
+// CheckDimensions checks that a dimensionality is supported
+func CheckDimensions(dimensions int) error {
+	for _, d := range Dimensions {
+		if d == dimensions {
+			return nil
+		}
+	}
+	return fmt.Errorf("dimensions must be one of %v", Dimensions)
+}
+
+// Projection is a fixed random projection of the mixer outputs, the rows
+// are the dimensions of the projected vectors
+type Projection struct {
+	Matrix
+}
+
+// NewProjection generates a random projection to dimensions dimensions
+func NewProjection(dimensions int) *Projection {
+	rng := rand.New(rand.NewSource(1))
+	m := NewMatrix(256, dimensions)
+	scale := 1 / sqrt(float32(dimensions))
+	for i := 0; i < 256*dimensions; i++ {
+		m.Data = append(m.Data, float32(rng.NormFloat64())*scale)
+	}
+	return &Projection{Matrix: m}
+}
+
+// Project writes the unit length projection of a mixed vector to output
+func (p *Projection) Project(output, mixed []float32) {
+	for i := 0; i < p.Rows; i++ {
+		output[i] = vector.Dot(p.Data[i*p.Cols:(i+1)*p.Cols], mixed)
+	}
+	unit(output[:p.Rows], output[:p.Rows])
+}
+
+// Write writes the projection section
+func (p *Projection) Write(out io.Writer) {
+	if p == nil {
+		return
+	}
+	_, err := out.Write(binaryvec.AppendFloat32s(nil, p.Data))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ReadProjection reads the projection section to dimensions dimensions at
+// offset
+func ReadProjection(db io.ReaderAt, offset int64, dimensions int) (*Projection, error) {
+	data := make([]byte, 4*256*dimensions)
+	n, err := db.ReadAt(data, offset)
+	if n != len(data) {
+		return nil, fmt.Errorf("the projection should be %d bytes not %d: %v", len(data), n, err)
+	}
+	p := &Projection{Matrix: NewMatrix(256, dimensions, make([]float32, 256*dimensions)...)}
+	binaryvec.Float32s(p.Data, data)
+	return p, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+const (
+	// TruncateTail keeps the end of a prompt
+	TruncateTail = "tail"
+	// TruncateHeadTail keeps the start and the end of a prompt
+	TruncateHeadTail = "headtail"
+	// TruncateSummary keeps the start and the end of a prompt and a sample
+	// of the dropped middle with the same symbol distribution
+	TruncateSummary = "summary"
+)
+
+var (
+	// FlagPromptBudget is the maximum number of prompt bytes mixed
+	FlagPromptBudget = flag.Int("prompt-budget", 1<<16, "maximum number of bytes of a prompt that are mixed, longer prompts are truncated, 0 is unlimited")
+	// FlagTruncation is how prompts over the budget are truncated
+	FlagTruncation = flag.String("truncation", TruncateTail, "how prompts over the budget are truncated: tail keeps the end, headtail keeps the start and the end, summary also keeps a sample of the dropped middle")
+)
+
+const (
+	// HeadFraction is the fraction of the budget kept from the start of a
+	// prompt by headtail and summary
+	HeadFraction = 4
+	// SummarySize is the largest sample of the dropped middle kept by summary,
+	// it is the window of the largest histogram
+	SummarySize = 128
+)
+
+// CheckTruncation checks that a truncation strategy is known
+func CheckTruncation(strategy string) error {
+	switch strategy {
+	case TruncateTail, TruncateHeadTail, TruncateSummary:
+		return nil
+	}
+	return fmt.Errorf("unknown truncation %s", strategy)
+}
+
+// Truncate truncates a prompt to budget bytes with a strategy, returning true
+// if it was truncated, cuts are made at rune boundaries
+func Truncate(prompt []byte, budget int, strategy string) ([]byte, bool) {
+	if budget <= 0 || len(prompt) <= budget {
+		return prompt, false
+	}
+	head, summary := 0, 0
+	switch strategy {
+	case TruncateHeadTail:
+		head = budget / HeadFraction
+	case TruncateSummary:
+		head = budget / HeadFraction
+		summary = min(SummarySize, budget/HeadFraction)
+	}
+	for head > 0 && !utf8.RuneStart(prompt[head]) {
+		head--
+	}
+	tail := len(prompt) - (budget - head - summary)
+	for tail < len(prompt) && !utf8.RuneStart(prompt[tail]) {
+		tail++
+	}
+	truncated := make([]byte, 0, budget)
+	truncated = append(truncated, prompt[:head]...)
+	truncated = append(truncated, Summarize(prompt[head:tail], summary)...)
+	return append(truncated, prompt[tail:]...), true
+}
+
+// Summarize returns a sample of size bytes with the byte distribution of
+// data, the bytes are interleaved so every window of the sample has about
+// the same distribution
+func Summarize(data []byte, size int) []byte {
+	if size <= 0 || len(data) == 0 {
+		return nil
+	}
+	var counts [256]int
+	for _, v := range data {
+		counts[v]++
+	}
+	type Share struct {
+		Symbol byte
+		Count  int
+		Taken  int
+	}
+	var shares []Share
+	for symbol, count := range counts {
+		if count > 0 {
+			shares = append(shares, Share{Symbol: byte(symbol), Count: count})
+		}
+	}
+	sort.SliceStable(shares, func(i, j int) bool {
+		return shares[i].Count > shares[j].Count
+	})
+	// each byte of the sample is the symbol furthest behind its share
+	sample := make([]byte, 0, size)
+	for i := 1; i <= size; i++ {
+		best, deficit := 0, -1.0
+		for j, share := range shares {
+			d := float64(share.Count)*float64(i)/float64(len(data)) - float64(share.Taken)
+			if d > deficit {
+				best, deficit = j, d
+			}
+		}
+		shares[best].Taken++
+		sample = append(sample, shares[best].Symbol)
+	}
+	return sample
+}
@@ -0,0 +1,107 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	// FlagRedact are the classes of identifiers masked in the corpus
+	FlagRedact = flag.String("redact", "", "comma separated classes of identifiers masked in the corpus before it is preprocessed when building: email, phone")
+	// FlagRedactPatterns is a file of patterns masked in the corpus
+	FlagRedactPatterns = flag.String("redact-patterns", "", "file of regular expressions, one per line, masked with [redacted] in the corpus before it is preprocessed when building")
+)
+
+// RedactionClasses are the patterns of the classes of identifiers
+var RedactionClasses = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`,
+	"phone": `(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\) ?|\b\d{2,4}[ .-])\d{3,4}[ .-]?\d{4}\b`,
+}
+
+// Rule is a pattern masked in the corpus and its mask
+type Rule struct {
+	Pattern string `json:"pattern"`
+	Mask    string `json:"mask"`
+}
+
+// Redaction are the rules masked in the corpus before it is preprocessed, the
+// rules are matched within each line in order
+type Redaction []Rule
+
+// compiled are the compiled patterns of redactions
+var compiled sync.Map
+
+// NewRedaction makes the rules of the classes and of the patterns in the file
+// at path, if it isn't empty
+func NewRedaction(classes []string, path string) (Redaction, error) {
+	var redaction Redaction
+	for _, class := range classes {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		pattern, ok := RedactionClasses[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction class %s", class)
+		}
+		redaction = append(redaction, Rule{Pattern: pattern, Mask: "[" + class + "]"})
+	}
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if pattern := strings.TrimSpace(scanner.Text()); pattern != "" {
+				redaction = append(redaction, Rule{Pattern: pattern, Mask: "[redacted]"})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range redaction {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %s: %w", rule.Pattern, err)
+		}
+	}
+	return redaction, nil
+}
+
+// regexp returns the compiled pattern of the rule
+func (r Rule) regexp() *regexp.Regexp {
+	if re, ok := compiled.Load(r.Pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(r.Pattern)
+	compiled.Store(r.Pattern, re)
+	return re
+}
+
+// Apply masks the rules in each line of data
+func (r Redaction) Apply(data []byte) []byte {
+	if len(r) == 0 {
+		return data
+	}
+	lines := bytes.SplitAfter(data, []byte{'\n'})
+	output := make([]byte, 0, len(data))
+	for _, line := range lines {
+		for _, rule := range r {
+			line = rule.regexp().ReplaceAllLiteral(line, []byte(rule.Mask))
+		}
+		output = append(output, line...)
+	}
+	return output
+}
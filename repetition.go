@@ -0,0 +1,114 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+)
+
+var (
+	// FlagRepetition is the number of occurrences of the last window of the
+	// output at which generation is cycling
+	FlagRepetition = flag.Int("repetition", 0, "number of times the last -repetition-window bytes of the output occur in its recent output when generation is cycling, 0 doesn't detect cycles")
+	// FlagRepetitionWindow is the number of bytes of the window
+	FlagRepetitionWindow = flag.Int("repetition-window", 16, "number of bytes at the end of the output that are looked for in its recent output to detect cycles")
+	// FlagRepetitionAction is what is done when generation is cycling
+	FlagRepetitionAction = flag.String("repetition-action", RepetitionStop, "what is done when generation is cycling: stop ends it with the finish reason repetition, resample samples the next steps at a raised temperature until the cycle is broken")
+)
+
+const (
+	// RepetitionStop stops a cycling generation
+	RepetitionStop = "stop"
+	// RepetitionResample resamples the steps of a cycling generation at a
+	// raised temperature
+	RepetitionResample = "resample"
+)
+
+// RepetitionSpan is the number of windows times the count of the recent output
+// the window is looked for in, a phrase that recurs across a long output
+// isn't a cycle
+const RepetitionSpan = 4
+
+// MaxRepetitionWindow is the largest window
+const MaxRepetitionWindow = 1024
+
+// RepetitionHeat is the factor the temperature is raised by at each step
+// that is still cycling, it is raised at most RepetitionMaxHeat times
+const (
+	RepetitionHeat    = 2
+	RepetitionMaxHeat = 8
+)
+
+// RepetitionTemperature is the temperature a greedy sampler without one
+// resamples at
+const RepetitionTemperature = 0.01
+
+// Repetition detects cycles in the output, generation is cycling when the
+// last Window bytes of the output occur Count times in its recent output
+type Repetition struct {
+	Count  int
+	Window int
+	Action string
+}
+
+// Validate checks the repetition parameters
+func (r Repetition) Validate() error {
+	if r.Count < 0 || r.Count == 1 {
+		return fmt.Errorf("repetition must be 0 or at least 2")
+	}
+	if r.Window <= 0 || r.Window > MaxRepetitionWindow {
+		return fmt.Errorf("repetition window must be between 1 and %d", MaxRepetitionWindow)
+	}
+	switch r.Action {
+	case RepetitionStop, RepetitionResample:
+	default:
+		return fmt.Errorf("unknown repetition action %s, it should be %s or %s", r.Action, RepetitionStop, RepetitionResample)
+	}
+	return nil
+}
+
+// Cycling is true if the last window of text occurs Count times in the recent
+// text, the occurrences can overlap so a cycle shorter than the window is
+// found after the window and Count-1 cycles
+func (r Repetition) Cycling(text []byte) bool {
+	if r.Count < 2 || len(text) < r.Window {
+		return false
+	}
+	if span := RepetitionSpan * r.Window * r.Count; len(text) > span {
+		text = text[len(text)-span:]
+	}
+	window, n := text[len(text)-r.Window:], 0
+	for rest := text; ; n++ {
+		if n == r.Count {
+			return true
+		}
+		i := bytes.Index(rest, window)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+1:]
+	}
+}
+
+// Heat returns the sampler of a step that has been cycling for steps steps,
+// a greedy sampler samples from the top k candidates and the temperature is
+// raised with each step
+func (r Repetition) Heat(sampler Sampler, steps int) Sampler {
+	if sampler.Decoder == "" || sampler.Decoder == DecoderGreedy {
+		sampler.Decoder = DecoderTopK
+		if sampler.TopK <= 0 {
+			sampler.TopK = *FlagTopK
+		}
+		if sampler.Temperature <= 0 {
+			sampler.Temperature = RepetitionTemperature
+		}
+	}
+	for i := 0; i < min(steps, RepetitionMaxHeat); i++ {
+		sampler.Temperature *= RepetitionHeat
+	}
+	return sampler
+}
@@ -0,0 +1,248 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// FlagModels are the databases served alongside the -db database
+var FlagModels = flag.String("models", "", "comma separated databases served with the -db database, a generation request that doesn't name a database with model is routed to the one whose buckets match its prompt best")
+
+// Routed are the routes whose requests are routed by their prompt, requests
+// to the other routes go to the first database unless they name another with
+// model in the body or the query string
+var Routed = map[string]bool{
+	"/infer":              true,
+	"/v1/generate":        true,
+	"/v1/generate/stream": true,
+	"/v1/jobs":            true,
+	"/v1/score":           true,
+	"/score":              true,
+	"/v1/sessions":        true,
+}
+
+// IDSeparator separates the name of the database that holds a stream,
+// session, or job from the random part of its id on a server serving several
+const IDSeparator = "."
+
+// IDModel returns the name of the database an id starts with, "" if it
+// doesn't start with one
+func IDModel(id string) string {
+	i := strings.LastIndex(id, IDSeparator)
+	if i < 0 {
+		return ""
+	}
+	return id[:i]
+}
+
+// Held are the paths of the routes of the streams, sessions, and jobs held by
+// a database, they are followed by an id that names it
+var Held = []string{"/v1/jobs/", "/v1/sessions/", "/v1/generate/stream/"}
+
+// ModelName is the name of the database at path that requests and keys
+// refer to it by
+func ModelName(path string) string {
+	return filepath.Base(path)
+}
+
+// RoutePositions is the number of positions of a prompt its affinity to a
+// database is measured at
+const RoutePositions = 16
+
+// Matches are how well the buckets of the database match the mixer vectors at
+// positions spread over the prompt, the mean similarity of the vector at each
+// position to the buckets it would probe
+func (m *Model) Matches(prompt []byte) []float32 {
+	prompt = m.Smoothing.Apply(m.Preprocess.Apply(prompt))
+	prompt, _ = Truncate(prompt, *FlagPromptBudget, *FlagTruncation)
+	sizes := m.Sizes
+	if m.Shards != nil {
+		sizes = m.Shards.Sizes
+	}
+	encoded, mixer := m.Coding().Encode(prompt), m.Settings.NewMixer()
+	vector, every := make([]float32, m.Width()), max(1, len(encoded)/RoutePositions)
+	var matches []float32
+	for i, symbol := range encoded {
+		mixer.Add(symbol)
+		if (len(encoded)-1-i)%every != 0 {
+			continue
+		}
+		var data [256]float32
+		mixer.Mix(&data)
+		m.Settings.Project(vector, data[:])
+		similarities := m.Header.Similarities(sizes, vector, nil)
+		if len(similarities) > *FlagNProbe {
+			similarities = similarities[:*FlagNProbe]
+		}
+		if len(similarities) == 0 {
+			continue
+		}
+		sum := float32(0)
+		for _, similarity := range similarities {
+			sum += similarity.Value
+		}
+		matches = append(matches, sum/float32(len(similarities)))
+	}
+	return matches
+}
+
+// RouteSamples is the number of windows of its corpus the baseline of a
+// database is measured with
+const RouteSamples = 32
+
+// Baseline is the mean and standard deviation of the matches of windows of the
+// corpus of the database, the similarities of databases built with different
+// settings aren't comparable so the matches of a prompt are standardized by
+// them. The deviation is 0 if the corpus isn't available
+func (m *Model) Baseline() (mean, deviation float32) {
+	if m.Metadata == nil || m.Metadata.Bytes == 0 {
+		return 0, 0
+	}
+	rng, sum, squares, n := rand.New(rand.NewSource(1)), 0.0, 0.0, 0
+	for i := 0; i < RouteSamples; i++ {
+		window, err := m.Snippet(uint64(rng.Intn(m.Metadata.Bytes)), EvalLength/2)
+		if err != nil {
+			return 0, 0
+		}
+		for _, match := range m.Matches([]byte(window)) {
+			sum, squares, n = sum+float64(match), squares+float64(match)*float64(match), n+1
+		}
+	}
+	if n < 2 {
+		return 0, 0
+	}
+	average := sum / float64(n)
+	return float32(average), float32(math.Sqrt(math.Max(squares/float64(n)-average*average, 0)))
+}
+
+// Affinity is how well the database matches the prompt, the mean of the
+// matches of the prompt standardized by the baseline of the database
+func (m *Model) Affinity(prompt []byte, mean, deviation float32) float32 {
+	matches := m.Matches(prompt)
+	if len(matches) == 0 {
+		return 0
+	}
+	sum := float32(0)
+	for _, match := range matches {
+		sum += match
+	}
+	sum /= float32(len(matches))
+	if deviation > 0 {
+		return (sum - mean) / deviation
+	}
+	return sum
+}
+
+// Router serves several databases, a request is served by the database it
+// names with model or by the one its prompt is routed to
+type Router struct {
+	Names    []string
+	Models   []*Model
+	Handlers []http.Handler
+	// Baselines are the means and deviations of the matches of the corpora
+	// of the databases
+	Baselines [][2]float32
+}
+
+// Add adds a database with the handler of its api, the first database added
+// serves the requests that aren't routed
+func (r *Router) Add(model *Model, handler http.Handler) error {
+	name := ModelName(model.Path)
+	for _, existing := range r.Names {
+		if existing == name {
+			return fmt.Errorf("two databases are named %s", name)
+		}
+	}
+	r.Names = append(r.Names, name)
+	r.Models = append(r.Models, model)
+	r.Handlers = append(r.Handlers, handler)
+	mean, deviation := model.Baseline()
+	r.Baselines = append(r.Baselines, [2]float32{mean, deviation})
+	return nil
+}
+
+// Route returns the database that serves the request, the body of a post is
+// read and replaced to find the model it names and its prompt. A request for
+// a stream, session, or job is served by the database its id names
+func (r *Router) Route(response http.ResponseWriter, request *http.Request) (int, error) {
+	for _, held := range Held {
+		if rest, ok := strings.CutPrefix(request.URL.Path, held); ok {
+			id, _, _ := strings.Cut(rest, "/")
+			if name := IDModel(id); name != "" {
+				return r.Index(name)
+			}
+		}
+	}
+	name := request.URL.Query().Get("model")
+	var prompt []byte
+	if request.Method == http.MethodPost {
+		body, err := io.ReadAll(Limit(response, request))
+		if err != nil {
+			return 0, BodyError(err)
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+			// the handler reports malformed requests
+			var fields struct {
+				Model string `json:"model"`
+				Query string `json:"query"`
+			}
+			json.Unmarshal(body, &fields)
+			if fields.Model != "" {
+				name = fields.Model
+			}
+			prompt = []byte(fields.Query)
+		} else {
+			prompt = body
+		}
+		if !Routed[request.URL.Path] {
+			prompt = nil
+		}
+	}
+	if name != "" {
+		return r.Index(name)
+	}
+	best, affinity := 0, float32(0)
+	if len(prompt) > 0 && len(r.Models) > 1 {
+		for i, model := range r.Models {
+			if a := model.Affinity(prompt, r.Baselines[i][0], r.Baselines[i][1]); i == 0 || a > affinity {
+				best, affinity = i, a
+			}
+		}
+	}
+	return best, nil
+}
+
+// Index returns the index of the database named name
+func (r *Router) Index(name string) (int, error) {
+	for i, existing := range r.Names {
+		if existing == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown model %s", name)
+}
+
+// ServeHTTP serves the request with the database it is routed to, the name
+// of the database is returned in the X-Model header
+func (r *Router) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	index, err := r.Route(response, request)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response.Header().Set("X-Model", r.Names[index])
+	r.Handlers[index].ServeHTTP(response, request)
+}
@@ -0,0 +1,292 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var (
+	// FlagDecoder is the decoding strategy
+	FlagDecoder = flag.String("decoder", DecoderGreedy, "decoder: greedy, topk, or topp")
+	// FlagTemperature is the sampling temperature
+	FlagTemperature = flag.Float64("temperature", 0.01, "temperature applied to the candidate cosine similarities")
+	// FlagTopK is the number of candidates for top-k sampling
+	FlagTopK = flag.Int("topk", 8, "number of candidates for top-k sampling")
+	// FlagTopP is the nucleus mass for top-p sampling
+	FlagTopP = flag.Float64("topp", 0.9, "probability mass of the nucleus for top-p sampling")
+	// FlagSeed is the seed for sampling
+	FlagSeed = flag.Int64("seed", 1, "seed for sampling")
+	// FlagCalibrated samples from the calibrated probabilities
+	FlagCalibrated = flag.Bool("calibrated", false, "sample from the calibrated probabilities of the candidates of a database built with -calibrate instead of the softmax of their scores, the temperature is applied to the log probabilities so 1 samples them as they are")
+	// FlagTempSchedule is the temperature schedule across the generation
+	FlagTempSchedule = flag.String("temp-schedule", "", "temperature schedule across the generation as comma separated step:temperature points, the temperature is interpolated between the points and held before the first and after the last, e.g. 0:0.2,64:0.8")
+)
+
+const (
+	// DecoderGreedy always selects the best candidate
+	DecoderGreedy = "greedy"
+	// DecoderTopK samples from the k best candidates
+	DecoderTopK = "topk"
+	// DecoderTopP samples from the smallest set of best candidates whose mass exceeds p
+	DecoderTopP = "topp"
+)
+
+// Sampler selects the next candidate from candidate scores
+type Sampler struct {
+	// Decoder is the decoding strategy
+	Decoder string `json:"decoder"`
+	// Temperature is applied to the candidate scores before the softmax
+	Temperature float32 `json:"temperature"`
+	// TopK is the number of candidates for top-k sampling
+	TopK int `json:"top_k"`
+	// TopP is the probability mass of the nucleus for top-p sampling
+	TopP float32 `json:"top_p"`
+	// Schedule replaces the temperature at each step if it isn't empty
+	Schedule Schedule `json:"schedule,omitempty"`
+	// Calibrated samples from the calibrated probabilities of the
+	// candidates, the temperature is applied to their logs
+	Calibrated bool `json:"calibrated,omitempty"`
+	// Calibration is the calibration of the database that is sampled
+	Calibration *Calibration `json:"-"`
+}
+
+// Point is the temperature of a step of a schedule
+type Point struct {
+	Step        int     `json:"step"`
+	Temperature float32 `json:"temperature"`
+}
+
+// Schedule is the temperature across a generation, the points are in
+// ascending order of step
+type Schedule []Point
+
+// ParseSchedule parses a schedule of comma separated step:temperature points
+func ParseSchedule(spec string) (Schedule, error) {
+	var schedule Schedule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		step, temperature, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule point %s, it should be step:temperature", part)
+		}
+		s, err := strconv.Atoi(strings.TrimSpace(step))
+		if err != nil || s < 0 {
+			return nil, fmt.Errorf("invalid schedule step %s", step)
+		}
+		t, err := strconv.ParseFloat(strings.TrimSpace(temperature), 32)
+		if err != nil || !(t > 0) {
+			return nil, fmt.Errorf("invalid schedule temperature %s, it should be positive", temperature)
+		}
+		if len(schedule) > 0 && s <= schedule[len(schedule)-1].Step {
+			return nil, fmt.Errorf("the steps of a schedule should be ascending")
+		}
+		schedule = append(schedule, Point{Step: s, Temperature: float32(t)})
+	}
+	return schedule, nil
+}
+
+// String formats the schedule as it is parsed
+func (s Schedule) String() string {
+	points := make([]string, len(s))
+	for i, point := range s {
+		points[i] = fmt.Sprintf("%d:%g", point.Step, point.Temperature)
+	}
+	return strings.Join(points, ",")
+}
+
+// Temperature is the temperature of the schedule at step
+func (s Schedule) Temperature(step int) float32 {
+	if step <= s[0].Step {
+		return s[0].Temperature
+	}
+	for i := 1; i < len(s); i++ {
+		if step < s[i].Step {
+			a, b := s[i-1], s[i]
+			t := float32(step-a.Step) / float32(b.Step-a.Step)
+			return a.Temperature + t*(b.Temperature-a.Temperature)
+		}
+	}
+	return s[len(s)-1].Temperature
+}
+
+// At returns the sampler of a step with the temperature of the schedule
+func (s Sampler) At(step int) Sampler {
+	if len(s.Schedule) == 0 {
+		return s
+	}
+	s.Temperature = s.Schedule.Temperature(step)
+	return s
+}
+
+// DefaultSampler returns the sampler configured by the flags
+func DefaultSampler() Sampler {
+	return Sampler{
+		Decoder:     *FlagDecoder,
+		Temperature: float32(*FlagTemperature),
+		TopK:        *FlagTopK,
+		TopP:        float32(*FlagTopP),
+		Calibrated:  *FlagCalibrated,
+	}
+}
+
+// Merge fills in the unset parameters of the sampler from defaults
+func (s Sampler) Merge(defaults Sampler) Sampler {
+	if s.Decoder == "" {
+		s.Decoder = defaults.Decoder
+	}
+	if s.Temperature == 0 {
+		s.Temperature = defaults.Temperature
+	}
+	if s.TopK == 0 {
+		s.TopK = defaults.TopK
+	}
+	if s.TopP == 0 {
+		s.TopP = defaults.TopP
+	}
+	if s.Schedule == nil {
+		s.Schedule = defaults.Schedule
+	}
+	if !s.Calibrated {
+		s.Calibrated = defaults.Calibrated
+	}
+	return s
+}
+
+// Validate checks the sampler parameters
+func (s Sampler) Validate() error {
+	switch s.Decoder {
+	case "", DecoderGreedy:
+	case DecoderTopK:
+		if s.TopK <= 0 {
+			return fmt.Errorf("top_k must be positive for the %s decoder", s.Decoder)
+		}
+	case DecoderTopP:
+		if s.TopP <= 0 || s.TopP > 1 {
+			return fmt.Errorf("top_p must be in (0, 1] for the %s decoder", s.Decoder)
+		}
+	default:
+		return fmt.Errorf("unknown decoder %s", s.Decoder)
+	}
+	if s.Decoder != "" && s.Decoder != DecoderGreedy && s.Temperature <= 0 {
+		return fmt.Errorf("temperature must be positive for the %s decoder", s.Decoder)
+	}
+	return nil
+}
+
+// Probabilities computes the softmax of the scores at the temperature, if the
+// sampler is calibrated it is the softmax of the calibrated log probabilities
+func (s Sampler) Probabilities(scores []float32) []float32 {
+	probabilities := make([]float32, len(scores))
+	for i, score := range scores {
+		if s.Calibrated && s.Calibration != nil {
+			score = float32(s.Calibration.LogProbability(score))
+		}
+		probabilities[i] = score / s.Temperature
+	}
+	softmax(probabilities)
+	return probabilities
+}
+
+// Sample selects a candidate given scores sorted in descending order,
+// returning the index of the candidate and its probability
+func (s Sampler) Sample(rng *rand.Rand, scores []float32) (int, float32) {
+	if len(scores) == 0 {
+		return -1, 0
+	}
+	switch s.Decoder {
+	case DecoderTopK:
+		if s.TopK < len(scores) {
+			scores = scores[:s.TopK]
+		}
+	case DecoderTopP:
+		probabilities, sum := s.Probabilities(scores), float32(0.0)
+		for i, p := range probabilities {
+			sum += p
+			if sum >= s.TopP {
+				scores = scores[:i+1]
+				break
+			}
+		}
+	default:
+		return 0, 1
+	}
+	probabilities := s.Probabilities(scores)
+	sum, selection := float32(0.0), rng.Float32()
+	for i, p := range probabilities {
+		sum += p
+		if selection < sum {
+			return i, p
+		}
+	}
+	return len(probabilities) - 1, probabilities[len(probabilities)-1]
+}
+
+// CountingSource is a random source that counts its draws, its state is the
+// seed and the number of draws so it can be saved and restored
+type CountingSource struct {
+	// Initial is the seed of the source
+	Initial int64
+	Draws   uint64
+	source  rand.Source64
+}
+
+// MaxDraws is the most draws a source can be restored after, the draws are
+// replayed to restore it
+const MaxDraws = 1 << 24
+
+// NewCountingSource creates the source of seed after draws draws
+func NewCountingSource(seed int64, draws uint64) *CountingSource {
+	c := &CountingSource{}
+	c.Seed(seed)
+	for c.Draws < draws {
+		c.Uint64()
+	}
+	return c
+}
+
+// Seed seeds the source and resets the draws
+func (c *CountingSource) Seed(seed int64) {
+	c.Initial, c.Draws = seed, 0
+	c.source = rand.NewSource(seed).(rand.Source64)
+}
+
+// Int63 draws a non negative int64
+func (c *CountingSource) Int63() int64 {
+	c.Draws++
+	return c.source.Int63()
+}
+
+// Uint64 draws a uint64
+func (c *CountingSource) Uint64() uint64 {
+	c.Draws++
+	return c.source.Uint64()
+}
+
+// Copy copies the source at its state
+func (c *CountingSource) Copy() *CountingSource {
+	return NewCountingSource(c.Initial, c.Draws)
+}
+
+// Hash is a hash of the state of the source
+func (c *CountingSource) Hash() string {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.LittleEndian, [2]uint64{uint64(c.Initial), c.Draws})
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// Rand is a random number generator drawing from the source
+func (c *CountingSource) Rand() *rand.Rand {
+	return rand.New(c)
+}
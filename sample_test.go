@@ -0,0 +1,120 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestSamplerDeterminism(t *testing.T) {
+	scores := []float32{.99, .98, .97, .95, .9, .8, .7, .6}
+	samplers := []Sampler{
+		{Decoder: DecoderGreedy},
+		{Decoder: DecoderTopK, Temperature: .05, TopK: 4},
+		{Decoder: DecoderTopP, Temperature: .05, TopP: .9},
+	}
+	for _, sampler := range samplers {
+		if err := sampler.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		sample := func(seed int64) []int {
+			rng := rand.New(rand.NewSource(seed))
+			indexes := make([]int, 128)
+			for i := range indexes {
+				indexes[i], _ = sampler.Sample(rng, scores)
+			}
+			return indexes
+		}
+		a, b := sample(1), sample(1)
+		for i := range a {
+			if a[i] != b[i] {
+				t.Fatalf("%s decoder is not deterministic for a fixed seed", sampler.Decoder)
+			}
+		}
+	}
+}
+
+func TestSamplerBounds(t *testing.T) {
+	scores := []float32{.99, .98, .97, .95, .9, .8, .7, .6}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 128; i++ {
+		if index, _ := (Sampler{Decoder: DecoderGreedy}).Sample(rng, scores); index != 0 {
+			t.Fatalf("greedy decoder selected %d", index)
+		}
+		if index, _ := (Sampler{Decoder: DecoderTopK, Temperature: 1, TopK: 3}).Sample(rng, scores); index >= 3 {
+			t.Fatalf("top-k decoder selected %d outside of k", index)
+		}
+		if index, _ := (Sampler{Decoder: DecoderTopP, Temperature: .01, TopP: .5}).Sample(rng, scores); index != 0 {
+			t.Fatalf("top-p decoder selected %d outside of the nucleus", index)
+		}
+	}
+	if index, _ := (Sampler{Decoder: DecoderTopP, Temperature: 1, TopP: 1}).Sample(rng, nil); index != -1 {
+		t.Fatalf("sampling no candidates selected %d", index)
+	}
+}
+
+func TestSamplerValidate(t *testing.T) {
+	invalid := []Sampler{
+		{Decoder: "beam"},
+		{Decoder: DecoderTopK, Temperature: 1},
+		{Decoder: DecoderTopP, Temperature: 1, TopP: 1.5},
+		{Decoder: DecoderTopP, TopP: .9},
+	}
+	for _, sampler := range invalid {
+		if sampler.Validate() == nil {
+			t.Fatalf("%+v should be invalid", sampler)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("0:0.2, 64:0.8,128:0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := schedule.String(); s != "0:0.2,64:0.8,128:0.4" {
+		t.Fatalf("the schedule should format as it is parsed not %s", s)
+	}
+	expected := map[int]float32{0: .2, 32: .5, 64: .8, 96: .6, 128: .4, 1000: .4}
+	for step, temperature := range expected {
+		if actual := (Sampler{Schedule: schedule}).At(step).Temperature; math.Abs(float64(actual-temperature)) > 1e-6 {
+			t.Fatalf("the temperature at step %d should be %f not %f", step, temperature, actual)
+		}
+	}
+	if sampler := (Sampler{Temperature: .3}).At(10); sampler.Temperature != .3 {
+		t.Fatalf("a sampler without a schedule should keep its temperature not %f", sampler.Temperature)
+	}
+	for _, spec := range []string{"0", "a:1", "-1:1", "0:0", "64:1,0:1", "0:1,0:2"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Fatalf("%s should be an invalid schedule", spec)
+		}
+	}
+}
+
+func TestFitPlatt(t *testing.T) {
+	// the labels are drawn from a known logistic function of the scores
+	rng, a, b := rand.New(rand.NewSource(1)), 8.0, -6.0
+	scores, labels := make([]float32, 20000), make([]bool, 20000)
+	for i := range scores {
+		scores[i] = rng.Float32()
+		labels[i] = rng.Float64() < 1/(1+math.Exp(-(a*float64(scores[i])+b)))
+	}
+	fa, fb, ok := FitPlatt(scores, labels)
+	if !ok {
+		t.Fatal("the fit failed")
+	}
+	if math.Abs(fa-a) > .5 || math.Abs(fb-b) > .5 {
+		t.Fatalf("fit %f %f, expected %f %f", fa, fb, a, b)
+	}
+	c := Calibration{A: float32(fa), B: float32(fb)}
+	if p := c.Probability(1); math.Abs(float64(p)-1/(1+math.Exp(-(a+b)))) > .05 {
+		t.Fatalf("probability %f", p)
+	}
+	if _, _, ok := FitPlatt(scores, make([]bool, len(scores))); ok {
+		t.Fatal("labels without positives shouldn't fit")
+	}
+}
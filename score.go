@@ -0,0 +1,166 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/pointlander/soda/client"
+)
+
+// FlagScoreMax is the maximum number of bytes of text scored per request
+var FlagScoreMax = flag.Int("score-max", 4096, "maximum number of bytes of text scored by a score request")
+
+// MissProbability is the probability of a symbol that wasn't retrieved
+const MissProbability = 1e-6
+
+// Score scores text after the prompt by how highly each symbol ranks among
+// the candidates retrieved for its position, the probability of a symbol is
+// the softmax mass of its candidates at the temperature of the sampler at
+// the position
+func (h Header) Score(sizes []uint64, prompt, text []byte, options Options, scan Scanner) client.ScoreResponse {
+	m := options.Settings.NewMixer()
+	for _, v := range prompt {
+		m.Add(v)
+	}
+	response := client.ScoreResponse{
+		Symbols: make([]client.SymbolScore, len(text)),
+	}
+	reciprocal, vector, cache := 0.0, make([]float32, options.Settings.Width()), NewProbeCache(options.ProbeCache)
+	for i, symbol := range text {
+		var data [256]float32
+		m.Mix(&data)
+		options.Settings.Project(vector, data[:])
+		probes := cache.Probe(h, sizes, vector, options.NProbe, options.ProbeThreshold)
+		results := scan(probes, Query{
+			Vector:  vector,
+			Entropy: Entropy(data[:]),
+		})
+		if options.Reranker != nil {
+			results = options.Reranker(Context{
+				Query:  prompt,
+				Text:   text[:i],
+				Step:   i,
+				Vector: data[:],
+			}, results)
+		}
+		SortCandidates(results)
+		if options.Quota > 0 {
+			results = Quota(results, options.Quota)
+		}
+
+		// the probabilities are at the temperature of the schedule at the
+		// symbol
+		temperature := options.Sampler.At(i).Temperature
+		if !(temperature > 0) {
+			temperature = 1
+		}
+		sampler := Sampler{
+			Temperature: temperature,
+			Calibrated:  options.Sampler.Calibrated,
+			Calibration: options.Settings.Calibration,
+		}
+		score := client.SymbolScore{
+			Offset:     i,
+			Symbol:     symbol,
+			Candidates: len(results),
+		}
+		scores := make([]float32, len(results))
+		for r := range results {
+			scores[r] = results[r].Score
+		}
+		for r, p := range sampler.Probabilities(scores) {
+			if results[r].Symbol == symbol {
+				if score.Rank == 0 {
+					score.Rank = r + 1
+				}
+				score.Probability += p
+			}
+		}
+		if score.Rank > 0 {
+			response.Hits++
+			reciprocal += 1 / float64(score.Rank)
+		}
+		probability := float64(score.Probability)
+		if probability < MissProbability {
+			probability = MissProbability
+		}
+		response.LogLikelihood += math.Log(probability)
+		response.Symbols[i] = score
+		m.Add(symbol)
+	}
+	if len(text) > 0 {
+		response.MeanReciprocalRank = reciprocal / float64(len(text))
+		response.Perplexity = math.Exp(-response.LogLikelihood / float64(len(text)))
+	}
+	return response
+}
+
+// Score preprocesses the prompt and text with the pipeline of the model and
+// scores the text by the symbols of the alphabet of the model
+func (m *Model) Score(prompt, text []byte, options Options) client.ScoreResponse {
+	options.Settings = m.Settings
+	if m.Reranker != nil {
+		options.Reranker = m.Reranker
+	}
+	if m.Lexical != nil {
+		options.Reranker = m.Lexical.Reranker(options.Reranker, m.Coding().Expansions())
+	}
+	if options.Weights == nil {
+		options.Weights = m.Weights
+	}
+	if options.Quota == 0 {
+		options.Quota = m.Quota
+	}
+	prompt, text = m.Preprocess.Apply(prompt), m.Preprocess.Apply(text)
+	if !options.Raw {
+		prompt = m.Smoothing.Apply(prompt)
+	}
+	prompt, _ = Truncate(prompt, options.PromptBudget, options.Truncation)
+	prompt, encoded := m.Coding().Encode(prompt), m.Coding().Encode(text)
+	var response client.ScoreResponse
+	if m.Shards != nil {
+		degraded := false
+		response = m.Header.Score(m.Shards.Sizes, prompt, encoded, options, m.Shards.Scanner(options, &degraded))
+		response.Degraded = degraded
+	} else {
+		response = m.Header.Score(m.Sizes, prompt, encoded, options, m.Header.Scanner(m.Store, m.Sizes, options))
+	}
+	for i, offset := range m.Coding().Offsets(text, encoded) {
+		response.Symbols[i].Offset = int(offset)
+	}
+	return response
+}
+
+// Score reports how highly each symbol of the text of the request ranks
+// among the candidates retrieved for it
+func (h Handler) Score(response http.ResponseWriter, request *http.Request) {
+	var req client.ScoreRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	if len(req.Text) > *FlagScoreMax {
+		http.Error(response, fmt.Sprintf("at most %d bytes of text can be scored at once", *FlagScoreMax), http.StatusBadRequest)
+		return
+	}
+	options, err := Request(req.Request).Options()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prompt, err := Request(req.Request).Prefix()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options.Count = len(req.Text)
+	if !h.Admit(response, request, options) {
+		return
+	}
+	Reply(response, h.Model.Score(prompt, []byte(req.Text), options))
+}
@@ -0,0 +1,64 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+)
+
+var (
+	// FlagAddr is the address the server listens on
+	FlagAddr = flag.String("addr", ":8080", "address the server listens on")
+	// FlagReadTimeout is the time allowed to read a request
+	FlagReadTimeout = flag.Duration("read-timeout", 10*time.Minute, "time allowed to read a request including its body, 0 is no limit")
+	// FlagReadHeaderTimeout is the time allowed to read the headers of a request
+	FlagReadHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "time allowed to read the headers of a request, 0 uses the read timeout")
+	// FlagWriteTimeout is the time allowed to write a response
+	FlagWriteTimeout = flag.Duration("write-timeout", 10*time.Minute, "time allowed to write a response that isn't streamed, 0 is no limit")
+	// FlagStreamWriteTimeout is the time allowed to write each event of a stream
+	FlagStreamWriteTimeout = flag.Duration("stream-write-timeout", time.Minute, "time allowed to write each event of a streamed response, the deadline is extended after every event so long generations aren't cut off, 0 is no limit")
+	// FlagIdleTimeout is how long an idle keep-alive connection is kept open
+	FlagIdleTimeout = flag.Duration("idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is kept open, 0 uses the read timeout")
+	// FlagKeepAlive enables keep-alive connections
+	FlagKeepAlive = flag.Bool("keep-alive", true, "keep connections open between requests")
+	// FlagMaxBody is the maximum size of a request body
+	FlagMaxBody = flag.Int64("max-body", 16<<20, "maximum number of bytes of a request body, 0 is no limit")
+	// FlagMaxPrompt is the maximum size of the query of a request
+	FlagMaxPrompt = flag.Int("max-prompt", 1<<20, "maximum number of bytes of the query of a request, 0 is no limit")
+	// FlagMaxCount is the maximum number of symbols a request can generate
+	FlagMaxCount = flag.Int("max-count", 1<<16, "maximum number of symbols a request can generate, 0 is no limit")
+)
+
+// NewServer creates the http server of handler configured by the flags
+func NewServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              *FlagAddr,
+		Handler:           handler,
+		ReadTimeout:       *FlagReadTimeout,
+		ReadHeaderTimeout: *FlagReadHeaderTimeout,
+		WriteTimeout:      *FlagWriteTimeout,
+		IdleTimeout:       *FlagIdleTimeout,
+		MaxHeaderBytes:    1 << 20,
+	}
+	server.SetKeepAlivesEnabled(*FlagKeepAlive)
+	return server
+}
+
+// ExtendWriteDeadline moves the write deadline of a streamed response to
+// the stream write timeout from now, replacing the write timeout of the
+// server
+func ExtendWriteDeadline(response http.ResponseWriter) {
+	deadline := time.Time{}
+	if *FlagStreamWriteTimeout > 0 {
+		deadline = time.Now().Add(*FlagStreamWriteTimeout)
+	}
+	err := http.NewResponseController(response).SetWriteDeadline(deadline)
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		panic(err)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pointlander/soda/client"
+)
+
+// FlagSessions is the maximum number of generation sessions of the server
+var FlagSessions = flag.Int("sessions", 0, "maximum number of generation sessions the server keeps, the least recently used is dropped when there are more, 0 disables the session api")
+
+// Session is a mixer state that generations continue from
+type Session struct {
+	sync.Mutex
+	// Symbols are the symbols of the alphabet mixed into the mixer in order
+	Symbols []byte
+	Mixer   Mixer
+	// Source is the random state of the sampler, it is carried from each
+	// generation to the next so replaying the generations of a session
+	// gives the same text
+	Source *CountingSource
+	Used   time.Time
+}
+
+// Add mixes symbols into the session
+func (s *Session) Add(symbols []byte) {
+	for _, symbol := range symbols {
+		s.Mixer.Add(symbol)
+	}
+	s.Symbols = append(s.Symbols, symbols...)
+}
+
+// Rollback removes the last n symbols, the mixer is reset and the remaining
+// symbols are mixed again, the random state isn't rolled back
+func (s *Session) Rollback(n int) {
+	s.Symbols = s.Symbols[:len(s.Symbols)-n]
+	s.Mixer.Reset()
+	for _, symbol := range s.Symbols {
+		s.Mixer.Add(symbol)
+	}
+}
+
+// Branch copies the session
+func (s *Session) Branch() *Session {
+	return &Session{
+		Symbols: append([]byte(nil), s.Symbols...),
+		Mixer:   s.Mixer.Copy(),
+		Source:  s.Source.Copy(),
+	}
+}
+
+// Text is the text of the symbols of the session, expansions are the bytes of
+// the symbols
+func (s *Session) Text(expansions *[256][]byte) []byte {
+	text := []byte{}
+	for _, symbol := range s.Symbols {
+		text = append(text, expansions[symbol]...)
+	}
+	return text
+}
+
+// Snapshot describes the session id, expansions are the bytes of the symbols
+func (s *Session) Snapshot(id string, expansions *[256][]byte) client.Session {
+	return client.Session{
+		ID:      id,
+		Text:    string(s.Text(expansions)),
+		Symbols: len(s.Symbols),
+		Seed:    s.Source.Initial,
+		Draws:   s.Source.Draws,
+		State:   s.Source.Hash(),
+	}
+}
+
+// Sessions are the generation sessions of a server
+type Sessions struct {
+	sync.Mutex
+	Max      int
+	Sessions map[string]*Session
+	// Prefix starts the ids of the sessions
+	Prefix string
+}
+
+// NewSessions creates a registry of at most max sessions
+func NewSessions(max int) *Sessions {
+	return &Sessions{
+		Max:      max,
+		Sessions: make(map[string]*Session),
+	}
+}
+
+// Add registers a session and returns its id, the least recently used session
+// is dropped if there are too many
+func (s *Sessions) Add(session *Session) string {
+	key := NewID(s.Prefix)
+	s.Lock()
+	defer s.Unlock()
+	for len(s.Sessions) >= s.Max {
+		oldest := ""
+		for id, session := range s.Sessions {
+			if oldest == "" || session.Used.Before(s.Sessions[oldest].Used) {
+				oldest = id
+			}
+		}
+		delete(s.Sessions, oldest)
+	}
+	session.Used = time.Now()
+	s.Sessions[key] = session
+	return key
+}
+
+// Get returns the session id and marks it used, nil if it doesn't exist
+func (s *Sessions) Get(id string) *Session {
+	s.Lock()
+	defer s.Unlock()
+	session := s.Sessions[id]
+	if session != nil {
+		session.Used = time.Now()
+	}
+	return session
+}
+
+// Remove removes the session id
+func (s *Sessions) Remove(id string) {
+	s.Lock()
+	delete(s.Sessions, id)
+	s.Unlock()
+}
+
+// Symbolize preprocesses text, smooths it unless raw, and encodes it with the
+// alphabet of the model
+func (m *Model) Symbolize(text []byte, raw bool) []byte {
+	text = m.Preprocess.Apply(text)
+	if !raw {
+		text = m.Smoothing.Apply(text)
+	}
+	return m.Coding().Encode(text)
+}
+
+// session returns the session of the request replying with a 404 if it
+// doesn't exist
+func (h Handler) session(response http.ResponseWriter, request *http.Request) (string, *Session) {
+	id := request.PathValue("id")
+	session := h.Sessions.Get(id)
+	if session == nil {
+		http.Error(response, fmt.Sprintf("session %s does not exist", id), http.StatusNotFound)
+	}
+	return id, session
+}
+
+// CreateSession creates a session from a prompt
+func (h Handler) CreateSession(response http.ResponseWriter, request *http.Request) {
+	var req client.SessionRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	if req.Draws > MaxDraws {
+		http.Error(response, fmt.Sprintf("draws is %d but at most %d draws can be replayed", req.Draws, MaxDraws), http.StatusBadRequest)
+		return
+	}
+	seed := *FlagSeed
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	session := &Session{
+		Mixer:  h.NewMixer(),
+		Source: NewCountingSource(seed, req.Draws),
+	}
+	session.Add(h.Symbolize([]byte(req.Query), false))
+	id := h.Sessions.Add(session)
+	session.Lock()
+	defer session.Unlock()
+	Reply(response, session.Snapshot(id, h.Coding().Expansions()))
+}
+
+// SessionSnapshot describes a session
+func (h Handler) SessionSnapshot(response http.ResponseWriter, request *http.Request) {
+	id, session := h.session(response, request)
+	if session == nil {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	Reply(response, session.Snapshot(id, h.Coding().Expansions()))
+}
+
+// SessionGenerate mixes the query of a request into a session and generates
+// from it, the generated symbols are added to the session. The sampler draws
+// from the random state of the session, a seed in the request reseeds it
+func (h Handler) SessionGenerate(response http.ResponseWriter, request *http.Request) {
+	_, session := h.session(response, request)
+	if session == nil {
+		return
+	}
+	query, options, ok := h.Parse(response, request)
+	if !ok {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	session.Add(h.Symbolize(query, options.Raw))
+	before := session.Text(h.Coding().Expansions())
+	options.Mixer = session.Mixer
+	if options.Request.Seed != nil {
+		session.Source.Seed(*options.Request.Seed)
+	}
+	options.Rand = session.Source.Rand()
+	searches := h.generate(nil, options)
+	options.Account.Refund(time.Now(), uint64(options.Count-len(searches[0].Symbols)))
+	session.Add(searches[0].Symbols)
+	search := options.Postprocess.Search(before, searches[0])
+	Reply(response, client.Response{
+		Text:         Text(search.Result),
+		Output:       Outputs(search.Result),
+		Truncated:    search.Truncated,
+		Steps:        search.Steps,
+		State:        session.Source.Hash(),
+		FinishReason: search.FinishReason,
+	})
+}
+
+// Branch copies a session to a new session
+func (h Handler) Branch(response http.ResponseWriter, request *http.Request) {
+	_, session := h.session(response, request)
+	if session == nil {
+		return
+	}
+	session.Lock()
+	branch := session.Branch()
+	session.Unlock()
+	id := h.Sessions.Add(branch)
+	branch.Lock()
+	defer branch.Unlock()
+	Reply(response, branch.Snapshot(id, h.Coding().Expansions()))
+}
+
+// Rollback removes the last symbols of a session
+func (h Handler) Rollback(response http.ResponseWriter, request *http.Request) {
+	id, session := h.session(response, request)
+	if session == nil {
+		return
+	}
+	var req client.RollbackRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	session.Lock()
+	defer session.Unlock()
+	if req.Symbols < 0 || req.Symbols > len(session.Symbols) {
+		http.Error(response, fmt.Sprintf("symbols should be between 0 and %d", len(session.Symbols)), http.StatusBadRequest)
+		return
+	}
+	session.Rollback(req.Symbols)
+	Reply(response, session.Snapshot(id, h.Coding().Expansions()))
+}
+
+// DeleteSession deletes a session
+func (h Handler) DeleteSession(response http.ResponseWriter, request *http.Request) {
+	id, session := h.session(response, request)
+	if session == nil {
+		return
+	}
+	h.Sessions.Remove(id)
+	response.WriteHeader(http.StatusNoContent)
+}
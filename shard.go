@@ -0,0 +1,589 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagShards are the shard servers a coordinator fans bucket scans out to
+var FlagShards = flag.String("shards", "", "comma separated urls of the shard servers that hold the buckets, the server becomes a coordinator")
+
+// FlagShardKey is the key shared by a coordinator and its shards
+var FlagShardKey = flag.String("shard-key", "", "key a coordinator sends to its shards in the X-Shard-Key header and shards require on the shard routes, which don't need an api key")
+
+var (
+	// FlagShardTimeout is the timeout of each attempt of a shard scan
+	FlagShardTimeout = flag.Duration("shard-timeout", 2*time.Second, "timeout of each attempt to scan a shard, 0 waits indefinitely")
+	// FlagShardRetries is the number of times a failed shard scan is retried
+	FlagShardRetries = flag.Int("shard-retries", 2, "number of times a shard scan that failed or timed out is retried")
+	// FlagShardBackoff is the backoff before the first retry of a shard scan
+	FlagShardBackoff = flag.Duration("shard-backoff", 50*time.Millisecond, "maximum backoff before the first retry of a shard scan, it doubles for each retry and is jittered")
+	// FlagShardHedge is the delay after which a shard scan is hedged
+	FlagShardHedge = flag.Duration("shard-hedge", 0, "send a second copy of a shard scan that hasn't replied after the delay and use the first reply, 0 doesn't hedge")
+	// FlagShardDeadline is the deadline of the scans of a symbol
+	FlagShardDeadline = flag.Duration("shard-deadline", 0, "deadline for the shard scans of a symbol after which the candidates that arrived are used, 0 waits for every shard")
+)
+
+// ShardInfo describes the buckets held by a shard
+type ShardInfo struct {
+	Sizes []uint64 `json:"sizes"`
+}
+
+// ShardRequest is a request to scan buckets of a shard
+type ShardRequest struct {
+	Probes        []int      `json:"probes"`
+	Vector        []float32  `json:"vector"`
+	Entropy       float32    `json:"entropy"`
+	Allowed       *SymbolSet `json:"allowed,omitempty"`
+	Filter        *Filter    `json:"filter,omitempty"`
+	Weights       Weights    `json:"weights,omitempty"`
+	Hamming       int        `json:"hamming"`
+	EntropyWeight float32    `json:"entropy_weight"`
+	Lambda        *float32   `json:"mmr_lambda,omitempty"`
+	SubProbe      int        `json:"subprobe"`
+	// Temperature weighs the entries of a distilled shard by their counts
+	Temperature float32 `json:"temperature,omitempty"`
+}
+
+// ShardCandidate is a candidate found by a shard
+type ShardCandidate struct {
+	Index    uint64  `json:"index"`
+	Document uint64  `json:"document"`
+	Symbol   uint8   `json:"symbol"`
+	Score    float32 `json:"score"`
+	Bucket   int     `json:"bucket"`
+}
+
+// ShardKey checks the shard key of a request to a shard, replying with a 401 if
+// it is wrong
+func ShardKey(response http.ResponseWriter, request *http.Request) bool {
+	if *FlagShardKey == "" {
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get("X-Shard-Key")), []byte(*FlagShardKey)) != 1 {
+		http.Error(response, "a valid shard key is required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ShardInfo reports the bucket sizes of the model
+func (h Handler) ShardInfo(response http.ResponseWriter, request *http.Request) {
+	if !ShardKey(response, request) {
+		return
+	}
+	Reply(response, ShardInfo{
+		Sizes: h.Sizes,
+	})
+}
+
+// ShardScan scans the buckets of the model for a coordinator
+func (h Handler) ShardScan(response http.ResponseWriter, request *http.Request) {
+	if !ShardKey(response, request) {
+		return
+	}
+	var req ShardRequest
+	if !Decode(response, request, &req) {
+		return
+	}
+	if width := h.Width(); len(req.Vector) != width {
+		http.Error(response, fmt.Sprintf("the vector should have %d dimensions", width), http.StatusBadRequest)
+		return
+	}
+	for _, probe := range req.Probes {
+		if probe < 0 || probe >= len(h.Header) {
+			http.Error(response, fmt.Sprintf("bucket %d does not exist", probe), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Hamming <= 0 {
+		req.Hamming = SignatureBits
+	}
+	lambda := float32(1)
+	if req.Lambda != nil {
+		lambda = *req.Lambda
+	}
+	if !(lambda >= 0 && lambda <= 1) {
+		http.Error(response, "mmr lambda must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	if req.SubProbe < 0 {
+		http.Error(response, "subprobe must not be negative", http.StatusBadRequest)
+		return
+	}
+	options := Options{
+		Filter:        req.Filter,
+		Weights:       req.Weights,
+		Hamming:       req.Hamming,
+		EntropyWeight: req.EntropyWeight,
+		Lambda:        lambda,
+		SubProbe:      req.SubProbe,
+		Sampler:       Sampler{Temperature: req.Temperature},
+	}
+	scan := h.Header.Scanner(h.Store, h.Sizes, options)
+	results := scan(req.Probes, Query{
+		Vector:  req.Vector,
+		Entropy: req.Entropy,
+		Allowed: req.Allowed,
+	})
+	candidates := make([]ShardCandidate, len(results))
+	for i, result := range results {
+		candidates[i] = ShardCandidate{
+			Index:    result.Index,
+			Document: result.Document,
+			Symbol:   result.Symbol,
+			Score:    result.Score,
+			Bucket:   result.Bucket,
+		}
+	}
+	Reply(response, candidates)
+}
+
+// Shards are the shard servers of a coordinator
+type Shards struct {
+	URLs []string
+	HTTP *http.Client
+	// Key is sent to the shards in the X-Shard-Key header if it isn't empty
+	Key string
+	// Owners is the shard holding each bucket
+	Owners []int
+	// Sizes are the number of entries of each bucket across the shards
+	Sizes []uint64
+	// Timeout is the timeout of each attempt of a scan, Retries is the number
+	// of times a failed scan is retried after a jittered backoff that starts
+	// at Backoff and doubles, and Hedge is the delay after which a second
+	// copy of an attempt is sent
+	Timeout, Backoff, Hedge time.Duration
+	Retries                 int
+	// Deadline is the time the scans of a symbol have, the candidates that
+	// arrived are used after it, 0 waits for every shard
+	Deadline time.Duration
+	// Failures are the number of scans of each shard that failed and were
+	// skipped
+	Failures []atomic.Uint64
+}
+
+// ShardError is a shard scan that was rejected by the shard
+type ShardError struct {
+	URL     string
+	Status  int
+	Message string
+}
+
+// Error describes the rejection
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %s: %d %s: %s", e.URL, e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Retryable is true if the shard could accept the scan on a retry
+func (e *ShardError) Retryable() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// NewShards connects to the shard servers at urls, each bucket must be held
+// by at most one shard
+func NewShards(urls []string, buckets int) (*Shards, error) {
+	shards := Shards{
+		URLs:     urls,
+		HTTP:     http.DefaultClient,
+		Key:      *FlagShardKey,
+		Owners:   make([]int, buckets),
+		Sizes:    make([]uint64, buckets),
+		Timeout:  *FlagShardTimeout,
+		Retries:  *FlagShardRetries,
+		Backoff:  *FlagShardBackoff,
+		Hedge:    *FlagShardHedge,
+		Deadline: *FlagShardDeadline,
+		Failures: make([]atomic.Uint64, len(urls)),
+	}
+	if shards.Retries < 0 || shards.Timeout < 0 || shards.Backoff < 0 || shards.Hedge < 0 || shards.Deadline < 0 {
+		return nil, fmt.Errorf("the shard retries, timeout, backoff, hedge, and deadline must not be negative")
+	}
+	for i := range shards.Owners {
+		shards.Owners[i] = -1
+	}
+	for i, url := range urls {
+		request, err := http.NewRequest(http.MethodGet, url+"/v1/shard", nil)
+		if err != nil {
+			return nil, err
+		}
+		if shards.Key != "" {
+			request.Header.Set("X-Shard-Key", shards.Key)
+		}
+		response, err := shards.HTTP.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			return nil, &ShardError{URL: url, Status: response.StatusCode, Message: strings.TrimSpace(string(message))}
+		}
+		var info ShardInfo
+		err = json.NewDecoder(response.Body).Decode(&info)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %w", url, err)
+		}
+		if len(info.Sizes) != buckets {
+			return nil, fmt.Errorf("shard %s has %d buckets instead of %d", url, len(info.Sizes), buckets)
+		}
+		for bucket, size := range info.Sizes {
+			if size == 0 {
+				continue
+			}
+			if owner := shards.Owners[bucket]; owner >= 0 {
+				return nil, fmt.Errorf("bucket %d is held by %s and %s", bucket, urls[owner], url)
+			}
+			shards.Owners[bucket], shards.Sizes[bucket] = i, size
+		}
+	}
+	return &shards, nil
+}
+
+// Scanner scans the probed buckets on the shards that hold them in parallel,
+// the candidates of the shards that replied before the deadline are returned
+// if there is one, the shards that fail are skipped and degraded is set
+func (s *Shards) Scanner(options Options, degraded *bool) Scanner {
+	return func(probes []int, query Query) []Candidate {
+		requests := make(map[int]*ShardRequest)
+		for _, probe := range probes {
+			owner := s.Owners[probe]
+			if owner < 0 {
+				continue
+			}
+			if requests[owner] == nil {
+				requests[owner] = &ShardRequest{
+					Vector:        query.Vector,
+					Entropy:       query.Entropy,
+					Allowed:       query.Allowed,
+					Filter:        options.Filter,
+					Weights:       options.Weights,
+					Hamming:       options.Hamming,
+					EntropyWeight: options.EntropyWeight,
+					Lambda:        &options.Lambda,
+					SubProbe:      options.SubProbe,
+					Temperature:   options.Sampler.Temperature,
+				}
+			}
+			requests[owner].Probes = append(requests[owner].Probes, probe)
+		}
+		type Reply struct {
+			Shard      int
+			Candidates []ShardCandidate
+			Err        error
+		}
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if s.Deadline > 0 {
+			ctx, cancel = context.WithTimeout(ctx, s.Deadline)
+		}
+		defer cancel()
+		done := make(chan Reply, len(requests))
+		for owner, request := range requests {
+			go func(owner int, request *ShardRequest) {
+				reply := Reply{Shard: owner}
+				err := Recover(func() {
+					reply.Candidates, reply.Err = s.scan(ctx, s.URLs[owner], request)
+				})
+				if err != nil {
+					reply.Err = err
+				}
+				done <- reply
+			}(owner, request)
+		}
+		var results []Candidate
+		for range requests {
+			reply := <-done
+			if reply.Err != nil {
+				s.Failures[reply.Shard].Add(1)
+				*degraded = true
+				continue
+			}
+			for _, candidate := range reply.Candidates {
+				results = append(results, Candidate{
+					Output: Output{
+						Index:    candidate.Index,
+						Document: candidate.Document,
+						Symbol:   candidate.Symbol,
+					},
+					Score:  candidate.Score,
+					Bucket: candidate.Bucket,
+				})
+			}
+		}
+		return results
+	}
+}
+
+// ShardStatus is the number of failed scans of a shard
+type ShardStatus struct {
+	URL      string `json:"url"`
+	Failures uint64 `json:"failures"`
+}
+
+// ServeHTTP reports the number of failed scans of each shard
+func (s *Shards) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	status := make([]ShardStatus, len(s.URLs))
+	for i, url := range s.URLs {
+		status[i] = ShardStatus{URL: url, Failures: s.Failures[i].Load()}
+	}
+	Reply(response, status)
+}
+
+// scan scans buckets of the shard at url, a failed attempt is retried after
+// a jittered exponential backoff unless the shard rejected the request
+func (s *Shards) scan(ctx context.Context, url string, request *ShardRequest) ([]ShardCandidate, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		var candidates []ShardCandidate
+		candidates, err = s.attempt(ctx, url, data)
+		if err == nil {
+			return candidates, nil
+		}
+		var rejected *ShardError
+		if attempt == s.Retries || ctx.Err() != nil || (errors.As(err, &rejected) && !rejected.Retryable()) {
+			return nil, err
+		}
+		backoff := s.Backoff << attempt
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff) + 1))):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("shard %s: %w", url, ctx.Err())
+		}
+	}
+}
+
+// attempt scans buckets of the shard at url within the timeout, a second copy
+// of the request is sent if it hasn't replied after the hedge delay and the
+// first successful reply is used
+func (s *Shards) attempt(ctx context.Context, url string, data []byte) ([]ShardCandidate, error) {
+	cancel := context.CancelFunc(func() {})
+	if s.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+	}
+	defer cancel()
+	type Reply struct {
+		Candidates []ShardCandidate
+		Err        error
+	}
+	replies := make(chan Reply, 2)
+	send := func() {
+		var reply Reply
+		err := Recover(func() {
+			reply.Candidates, reply.Err = s.post(ctx, url, data)
+		})
+		if err != nil {
+			reply.Err = err
+		}
+		replies <- reply
+	}
+	go send()
+	var hedge <-chan time.Time
+	if s.Hedge > 0 {
+		timer := time.NewTimer(s.Hedge)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	var err error
+	for pending := 1; pending > 0; {
+		select {
+		case reply := <-replies:
+			pending--
+			if reply.Err == nil {
+				return reply.Candidates, nil
+			}
+			err = reply.Err
+		case <-hedge:
+			hedge, pending = nil, pending+1
+			go send()
+		}
+	}
+	return nil, err
+}
+
+// post sends a scan request to the shard at url
+func (s *Shards) post(ctx context.Context, url string, data []byte) ([]ShardCandidate, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/v1/shard/scan", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if s.Key != "" {
+		request.Header.Set("X-Shard-Key", s.Key)
+	}
+	response, err := s.HTTP.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return nil, &ShardError{URL: url, Status: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	var candidates []ShardCandidate
+	err = json.NewDecoder(response.Body).Decode(&candidates)
+	return candidates, err
+}
+
+// ShardPath is the path of shard i of the database at path
+func ShardPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d.bin", strings.TrimSuffix(path, ".bin"), i)
+}
+
+// DBShard splits the database given by -db into the number of shards given
+// as an argument, bucket i is held by shard i modulo the number of shards
+func DBShard(args []string) {
+	if len(args) != 1 {
+		fmt.Println("usage: db shard <shards>")
+		return
+	}
+	count, err := strconv.Atoi(args[0])
+	if err != nil || count < 1 {
+		fmt.Println("the number of shards should be a positive integer")
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	for shard := 0; shard < count; shard++ {
+		path := ShardPath(*FlagDB, shard)
+		err := model.WriteShard(path, shard, count)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("wrote", path)
+	}
+}
+
+// WriteShard writes the buckets of shard of count shards to a database at path
+func (m *Model) WriteShard(path string, shard, count int) error {
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	db := bufio.NewWriter(file)
+
+	owned := func(bucket int) bool {
+		return bucket%count == shard
+	}
+	writer := binaryvec.NewWriter(db)
+	entries := uint64(0)
+	for i := range m.Header {
+		size := uint64(0)
+		if owned(i) {
+			size = m.Sizes[i]
+		}
+		entries += size
+		err := writer.WriteRecord(&binaryvec.Bucket{
+			Vector: m.Header[i].Vector,
+			Count:  size,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := range m.Header {
+		if !owned(i) || m.Sizes[i] == 0 {
+			continue
+		}
+		block, err := m.Store.Entries(i, 0, m.Sizes[i])
+		if err != nil {
+			return err
+		}
+		data := block.Data
+		if m.Metadata == nil {
+			// a database without metadata is read as records
+			data = nil
+			for j := 0; j < block.Len; j++ {
+				entry := block.Entry(j)
+				data = entry.Append(data)
+			}
+		}
+		_, err = db.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range m.Header {
+		for _, count := range m.Header[i].Symbols {
+			if !owned(i) {
+				count = 0
+			}
+			err := writer.WriteUint64(count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	m.Projection.Write(db)
+	if m.Metadata != nil {
+		metadata := *m.Metadata
+		metadata.Entries, metadata.Shard, metadata.Shards = entries, shard, count
+		metadata.Encoding = binaryvec.Version
+		metadata.Write(db)
+	}
+	if m.Counts != nil {
+		var counts []uint32
+		for i := range m.Header {
+			if owned(i) {
+				counts = append(counts, m.Counts[m.Sums[i]:m.Sums[i]+m.Sizes[i]]...)
+			}
+		}
+		err := WriteCounts(db, counts)
+		if err != nil {
+			return err
+		}
+	}
+	err = m.WriteEmbedded(db)
+	if err != nil {
+		return err
+	}
+	err = m.WriteTransform(db)
+	if err != nil {
+		return err
+	}
+	if m.Subclusters > 0 {
+		subclusters := m.Header.Subclusters()
+		for i := range subclusters {
+			if !owned(i) {
+				subclusters[i] = nil
+			}
+		}
+		err = WriteSubclusters(db, subclusters, m.Width())
+		if err != nil {
+			return err
+		}
+	}
+	err = db.Flush()
+	if err != nil {
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,146 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+	"github.com/pointlander/soda/vector"
+)
+
+// FlagHamming is the signature distance above which entries are skipped
+var FlagHamming = flag.Int("hamming", SignatureBits, "signature hamming distance above which entries are skipped without computing the cosine similarity, lower is faster with less recall")
+
+// SignatureBits is the number of bits in an entry signature
+const SignatureBits = 256
+
+// SignatureSize is the number of bytes in an entry signature
+const SignatureSize = SignatureBits / 8
+
+// Signature is the sign bits of random projections of a vector minus the
+// centroid of its bucket, the hamming distance between two signatures
+// estimates the angle between the vectors as seen from the centroid
+type Signature [SignatureBits / 64]uint64
+
+// Projections are the random hyperplanes of the signatures, they are
+// generated from a fixed seed so they are the same at build and query time
+var Projections = NewProjections()
+
+// NewProjections generates the random hyperplanes of the signatures
+func NewProjections() Matrix {
+	rng := rand.New(rand.NewSource(1))
+	projections := NewMatrix(256, SignatureBits)
+	for i := 0; i < 256*SignatureBits; i++ {
+		projections.Data = append(projections.Data, float32(rng.NormFloat64()))
+	}
+	return projections
+}
+
+// NewSignature computes the signature of an entry vector relative to a centroid
+func NewSignature(entry, centroid []float32) Signature {
+	difference := make([]float32, len(entry))
+	for i, v := range entry {
+		difference[i] = v - centroid[i]
+	}
+	var signature Signature
+	for i := 0; i < SignatureBits; i++ {
+		projection := Projections.Data[i*Projections.Cols : i*Projections.Cols+len(difference)]
+		if vector.Dot(projection, difference) > 0 {
+			signature[i/64] |= 1 << (i % 64)
+		}
+	}
+	return signature
+}
+
+// ReadSignature decodes a little endian signature
+func ReadSignature(data []byte) Signature {
+	var signature Signature
+	for i := range signature {
+		signature[i] = binaryvec.Order.Uint64(data[8*i:])
+	}
+	return signature
+}
+
+// Bytes encodes the signature as little endian
+func (s Signature) Bytes() []byte {
+	data := make([]byte, 0, SignatureSize)
+	for _, v := range s {
+		data = binaryvec.Order.AppendUint64(data, v)
+	}
+	return data
+}
+
+// Distance is the hamming distance between two signatures
+func (s Signature) Distance(t Signature) int {
+	distance := 0
+	for i := range s {
+		distance += bits.OnesCount64(s[i] ^ t[i])
+	}
+	return distance
+}
+
+// Prefilter measures the recall and speed of generation at several signature
+// distance bounds against generation without the prefilter
+func Prefilter(args []string) {
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	documents := Documents()
+	if model.Metadata != nil {
+		documents = model.Metadata.Corpus
+	}
+	input, _ := LoadCorpus(documents, model.Redact, model.Preprocess)
+	const (
+		Queries = 16
+		Length  = 128
+		Count   = 16
+	)
+	if len(input) <= Length {
+		fmt.Println("the corpus is too small to sample queries from")
+		return
+	}
+	rng := rand.New(rand.NewSource(1))
+	queries := make([][]byte, Queries)
+	for i := range queries {
+		start := rng.Intn(len(input) - Length)
+		queries[i] = input[start : start+Length]
+	}
+	generate := func(hamming int) ([][]Output, time.Duration) {
+		options, err := Request{}.Options()
+		if err != nil {
+			panic(err)
+		}
+		options.Count, options.Hamming = Count, hamming
+		outputs, start := make([][]Output, len(queries)), time.Now()
+		for i, query := range queries {
+			outputs[i] = model.Soda(query, options)[0].Result
+		}
+		return outputs, time.Since(start)
+	}
+	exact, duration := generate(SignatureBits)
+	fmt.Printf("hamming %d recall 1.000 time %s\n", SignatureBits, duration)
+	for _, hamming := range []int{128, 112, 96, 80, 64} {
+		outputs, elapsed := generate(hamming)
+		matched, total := 0, 0
+		for i := range outputs {
+			for j := range exact[i] {
+				total++
+				if j < len(outputs[i]) && outputs[i][j].Index == exact[i][j].Index {
+					matched++
+				}
+			}
+		}
+		fmt.Printf("hamming %d recall %.3f time %s speedup %.2f\n", hamming,
+			float64(matched)/float64(total), elapsed, duration.Seconds()/elapsed.Seconds())
+	}
+}
@@ -5,61 +5,39 @@
 package main
 
 import (
-	"compress/bzip2"
+	"bytes"
 	"fmt"
 	"io"
-	"math"
 	"math/rand"
-	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
-	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
-	"github.com/pointlander/gradient/tf32"
+	"github.com/pointlander/soda/client"
+	"github.com/pointlander/soda/encoding/binaryvec"
 	"github.com/pointlander/soda/vector"
-
-	//"github.com/alixaxel/pagerank"
-	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/plotter"
-	"gonum.org/v1/plot/vg"
-	"gonum.org/v1/plot/vg/draw"
 )
 
 const (
 	// ModelSize is the model size
 	ModelSize = 8
 	// HeaderLineSize is the size of a header line
-	HeaderLineSize = 4*256 + 1*8
-	// EntryLineSize is the size of an entry line
-	EntryLineSize = 4*256 + 1 + 8
+	HeaderLineSize = binaryvec.BucketSize
 	// Offset is the offset to the entries
 	Offset = ModelSize * 1024 * HeaderLineSize
 )
 
-const (
-	// B1 exponential decay of the rate for the first moment estimates
-	B1 = 0.8
-	// B2 exponential decay rate for the second-moment estimates
-	B2 = 0.89
-	// Eta is the learning rate
-	Eta = 1.0e-3
-)
-
-const (
-	// StateM is the state for the mean
-	StateM = iota
-	// StateV is the state for the variance
-	StateV
-	// StateTotal is the total number of states
-	StateTotal
-)
-
-// Vector is a vector
-type Vector struct {
-	Vector [256]float32
-	Symbol uint64
-	Next   uint64
+// Item is the bookkeeping of a vector of a build, the vector is held by a VectorPool
+type Item struct {
+	Next uint64
+	// Index is the rune index in the corpus of the symbol of the entry
+	Index    uint64
+	Entropy  float32
+	Document uint32
+	Symbol   uint8
 }
 
 // Bucket is a bucket of vectors
@@ -67,618 +45,1200 @@ type Bucket struct {
 	Vector  [256]float32
 	Vectors uint64
 	Count   int
+	// Symbols is the number of entries for each symbol, the entries of a
+	// bucket are sorted by symbol unless it has sub-clusters
+	Symbols [256]uint64
+	// Subclusters are the sub-clusters of a big bucket, nil if it isn't
+	// sub-clustered
+	Subclusters *Subclusters
 }
 
 // Output is the output of the model
 type Output struct {
-	Index  uint64 `json:"index"`
-	Symbol uint8  `json:"-"`
-	S      string `json:"symbol"`
+	Index    uint64 `json:"index"`
+	Document uint64 `json:"document"`
+	Symbol   uint8  `json:"-"`
+	S        string `json:"symbol"`
+	Context  string `json:"context,omitempty"`
+	// Entropy is the entropy of the context the output was generated in
+	Entropy float32 `json:"entropy"`
+	// Probability is the calibrated probability of the candidate the output
+	// is from, 0 if the database isn't calibrated
+	Probability float32 `json:"probability,omitempty"`
 }
 
-// Result is an index search result
-type Result struct {
-	Index  int
-	Vector uint64
+// Options are the generation options
+type Options struct {
+	// Count is the number of symbols to generate
+	Count int
+	// Filter restricts the candidates to documents or corpus ranges
+	Filter *Filter
+	// Latest restricts the candidates to the latest version of each document
+	Latest bool
+	// Weights multiply the softmax mass of the candidates from documents
+	Weights Weights
+	// Quota is the maximum number of candidates of a step from one document,
+	// 0 is no limit
+	Quota int
+	// NProbe is the maximum number of buckets to probe per symbol
+	NProbe int
+	// Fanout is the probing policy, FanoutFixed or FanoutAuto
+	Fanout string
+	// Stats are the bucket statistics the probes and winners are recorded
+	// in, nil if they aren't recorded
+	Stats *BucketStats
+	// ProbeThreshold is the bucket similarity below which buckets aren't probed
+	ProbeThreshold float32
+	// ProbeCache is the distance the mixer vector moves before the bucket
+	// similarities are recomputed, 0 recomputes them every step
+	ProbeCache float32
+	// SubProbe is the number of sub-clusters of a sub-clustered bucket that
+	// are scanned, 0 scans every entry of the bucket
+	SubProbe int
+	// Hamming is the signature distance above which entries are skipped
+	Hamming int
+	// EntropyWeight penalizes candidates by the difference between the
+	// entropy of their context and the entropy of the current context
+	EntropyWeight float32
+	// Locality is the weight of the closeness in the corpus of candidates to
+	// where the recent outputs continue
+	Locality float32
+	// Attention is the weight of the attention over the prompt positions in
+	// the vector the buckets are probed and the candidates are scored with
+	Attention float32
+	// Lambda weighs the score of the candidates of a bucket against their
+	// dissimilarity to the candidates already selected, 1 selects by score
+	Lambda float32
+	// Symbols restricts the symbols that can start a generated rune
+	Symbols *SymbolSet
+	// Sampler selects the next candidate
+	Sampler Sampler
+	// Seed seeds the random number generator of the sampler
+	Seed int64
+	// Rand is the random number generator of the sampler, it is advanced by
+	// the generation, nil uses a new generator seeded with Seed
+	Rand *rand.Rand
+	// Request is the request the options were made from, it is recorded in
+	// the generation log
+	Request *client.Request
+	// Account is refunded the symbols of Count that aren't generated, nil if
+	// the request has no key
+	Account *Account
+	// Settings are the build settings of the database, they select the mixer
+	Settings Settings
+	// Raw skips the smoothing of the query
+	Raw bool
+	// PromptBudget is the maximum number of query bytes mixed, 0 is unlimited
+	PromptBudget int
+	// Truncation is how a query over the budget is truncated
+	Truncation string
+	// Stop ends generation when the generated text ends with one of the
+	// sequences, the sequence is removed from the result
+	Stop []string
+	// Repetition stops or resamples generation when it is cycling
+	Repetition Repetition
+	// Vocabulary restricts the generated symbols to the symbols of the top
+	// candidates of the recent steps
+	Vocabulary Vocabulary
+	// Control adjusts the sampler and stop sequences during generation
+	Control *Control
+	// Reranker rescores the candidates before sampling
+	Reranker Reranker
+	// Context is the number of runes of the corpus on each side of an output
+	// that are returned with it
+	Context int
+	// Timeout stops generation when it has run for the duration, the partial
+	// result is returned as truncated
+	Timeout time.Duration
+	// Progress is called after each symbol is generated with the partial result
+	Progress func(symbols int, result []Output)
+	// Probed is called after the buckets of each step are scanned with the
+	// buckets and the number of candidates retrieved from them
+	Probed func(probes []int, candidates int)
+	// Trace records the probes, candidates, and choice of each step if it
+	// isn't nil
+	Trace *Trace
+	// Mixer is the state generation continues from before the query is
+	// mixed, it isn't changed, nil starts from a new mixer
+	Mixer Mixer
+	// Alternatives is the number of alternative symbols of each step returned
+	// in the search
+	Alternatives int
+	// Cancel stops generation at the next symbol when it is closed, the
+	// partial result is returned as truncated and canceled
+	Cancel <-chan struct{}
+	// Postprocess are the stages applied to the results before they are
+	// returned, the progress is reported before post-processing
+	Postprocess Postprocess
 }
 
-func process(done chan Result, model []Bucket, pool []Vector, vector uint64) {
-	query, index, max := pool[vector].Vector[:], 0, float32(0.0)
-	for i := range model {
-		cs := CS(query, model[i].Vector[:])
-		if cs > max {
-			max, index = cs, i
-		}
+// Canceled is true if the generation has been canceled through the cancel
+// channel or the control of the options
+func (o Options) Canceled() bool {
+	if o.Control != nil && o.Control.Canceled() {
+		return true
 	}
-	done <- Result{
-		Index:  index,
-		Vector: vector,
+	select {
+	case <-o.Cancel:
+		return true
+	default:
+		return false
 	}
 }
 
 // Header is an index
 type Header []Bucket
 
-// NewHeader generates a new header
-func NewHeader(data []byte) Header {
-	model := make(Header, ModelSize*1024)
-	rng := rand.New(rand.NewSource(1))
-
-	avg := make([]float32, 256)
-	m := NewMixer()
-	m.Add(0)
-	for _, v := range data {
-		var vector [256]float32
-		m.Mix(&vector)
-		for i, v := range vector {
-			avg[i] += v
+// Nearest returns the bucket most similar to the query
+func (h Header) Nearest(query []float32) int {
+	index, max := 0, float32(0.0)
+	for i := range h {
+		cs := CS(query, h[i].Vector[:len(query)])
+		if cs > max {
+			max, index = cs, i
 		}
-		m.Add(v)
-	}
-	for i := range avg {
-		avg[i] /= float32(len(data))
 	}
-	cov := [256][256]float32{}
-	m = NewMixer()
-	m.Add(0)
-	for _, v := range data {
-		var vector [256]float32
-		m.Mix(&vector)
-		for i, v := range vector {
-			for ii, vv := range vector {
-				diff1 := avg[i] - v
-				diff2 := avg[ii] - vv
-				cov[i][ii] += diff1 * diff2
-			}
-		}
-		m.Add(v)
+	return index
+}
+
+// BuildBatch is the number of vectors assigned to buckets by a build worker
+// at a time
+const BuildBatch = 1024
+
+// Partition splits the items [start, end) between the mergers by the buckets
+// they are assigned to, a merger owns the buckets with its index modulo the
+// number of mergers. The items of each merger stay in order
+func Partition(assignments []uint32, start, end, mergers int) [][]int {
+	owned := make([][]int, mergers)
+	for item := start; item < end; item++ {
+		owner := assignments[item] % uint32(mergers)
+		owned[owner] = append(owned[owner], item)
 	}
-	for i := range cov {
-		for j := range cov[i] {
-			cov[i][j] = cov[i][j] / float32(len(data))
-		}
+	return owned
+}
+
+// Merge pushes the owned items onto the lists of the buckets they are
+// assigned to
+func (h Header) Merge(items []Item, assignments []uint32, owned []int) {
+	for _, item := range owned {
+		index := assignments[item]
+		items[item].Next = h[index].Vectors
+		h[index].Vectors = uint64(item)
+		h[index].Count++
 	}
-	fmt.Println(avg)
+}
 
-	set := tf32.NewSet()
-	set.Add("A", 256, 256)
+// Similarity is the similarity of a bucket to a query
+type Similarity struct {
+	Index int
+	Value float32
+}
 
-	for i := range set.Weights {
-		w := set.Weights[i]
-		if strings.HasPrefix(w.N, "b") {
-			w.X = w.X[:cap(w.X)]
-			w.States = make([][]float32, StateTotal)
-			for i := range w.States {
-				w.States[i] = make([]float32, len(w.X))
-			}
-			continue
+// Similarities returns the similarities of the non empty buckets to the query
+// from the most similar, all the buckets are scored if buckets is nil
+func (h Header) Similarities(sizes []uint64, query []float32, buckets []int) []Similarity {
+	similarities, squared := make([]Similarity, 0, len(h)), vector.Dot(query, query)
+	score := func(i int) {
+		if sizes[i] == 0 {
+			return
 		}
-		factor := math.Sqrt(2.0 / float64(w.S[0]))
-		for i := 0; i < cap(w.X); i++ {
-			w.X = append(w.X, float32(rng.NormFloat64()*factor))
+		dot, norm := vector.DotNorm(query, h[i].Vector[:len(query)])
+		similarities = append(similarities, Similarity{
+			Index: i,
+			Value: vector.Cosine(dot, squared, norm),
+		})
+	}
+	if buckets == nil {
+		for i := range h {
+			score(i)
 		}
-		w.States = make([][]float32, StateTotal)
-		for i := range w.States {
-			w.States[i] = make([]float32, len(w.X))
+	} else {
+		for _, i := range buckets {
+			score(i)
 		}
 	}
+	// the similarities are in bucket order so ties are probed in bucket order
+	sort.SliceStable(similarities, func(i, j int) bool {
+		return similarities[i].Value > similarities[j].Value
+	})
+	return similarities
+}
 
-	others := tf32.NewSet()
-	others.Add("E", 256, 256)
-	E := others.ByName["E"]
-	for i := range cov {
-		for j := range cov[i] {
-			E.X = append(E.X, cov[i][j])
+// Select returns the buckets of the most similar similarities, at most nprobe
+// buckets are returned and buckets with a similarity below threshold are
+// skipped, the most similar bucket is always returned
+func Select(similarities []Similarity, nprobe int, threshold float32) []int {
+	probes := make([]int, 0, nprobe)
+	for i, similarity := range similarities {
+		if len(probes) >= nprobe || (i > 0 && similarity.Value < threshold) {
+			break
 		}
+		probes = append(probes, similarity.Index)
 	}
+	return probes
+}
 
-	loss := tf32.Sum(tf32.Quadratic(others.Get("E"), tf32.Mul(set.Get("A"), set.Get("A"))))
+// Probe returns the non empty buckets most similar to the query, at most
+// nprobe buckets are returned and buckets with a similarity below threshold are
+// skipped, the most similar bucket is always returned
+func (h Header) Probe(sizes []uint64, query []float32, nprobe int, threshold float32) []int {
+	return Select(h.Similarities(sizes, query, nil), nprobe, threshold)
+}
 
-	points := make(plotter.XYs, 0, 8)
-	for i := 0; i < 1024; i++ {
-		pow := func(x float32) float32 {
-			y := math.Pow(float64(x), float64(i+1))
-			if math.IsNaN(y) || math.IsInf(y, 0) {
-				return 0
-			}
-			return float32(y)
-		}
+// MaxSkew is the ratio of the largest bucket to the average bucket above
+// which the buckets are considered unbalanced
+const MaxSkew = 64
 
-		set.Zero()
-		others.Zero()
-		cost := tf32.Gradient(loss).X[0]
-		if math.IsNaN(float64(cost)) || math.IsInf(float64(cost), 0) {
-			fmt.Println(i, cost)
-			break
+// Skew is the ratio of the largest bucket to the average bucket
+func (h Header) Skew() float64 {
+	max, total := 0, 0
+	for i := range h {
+		if h[i].Count > max {
+			max = h[i].Count
 		}
+		total += h[i].Count
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(max) * float64(len(h)) / float64(total)
+}
 
-		norm := float32(0.0)
-		for _, p := range set.Weights {
-			for _, d := range p.D {
-				norm += d * d
-			}
-		}
-		norm = sqrt(norm)
-		b1, b2 := pow(B1), pow(B2)
-		scaling := float32(1.0)
-		if norm > 1 {
-			scaling = 1 / norm
-		}
-		for _, w := range set.Weights {
-			for l, d := range w.D {
-				g := d * scaling
-				m := B1*w.States[StateM][l] + (1-B1)*g
-				v := B2*w.States[StateV][l] + (1-B2)*g*g
-				w.States[StateM][l] = m
-				w.States[StateV][l] = v
-				mhat := m / (1 - b1)
-				vhat := v / (1 - b2)
-				if vhat < 0 {
-					vhat = 0
-				}
-				w.X[l] -= Eta * mhat / (sqrt(vhat) + 1e-8)
-			}
+// ReadHeader reads the header from the start of a database
+func ReadHeader(in io.Reader) (Header, []uint64, []uint64) {
+	model := make(Header, ModelSize*1024)
+	sizes := make([]uint64, ModelSize*1024)
+	buffer, bucket := make([]byte, HeaderLineSize), binaryvec.Bucket{}
+	for i := range model {
+		_, err := io.ReadFull(in, buffer)
+		if err != nil {
+			panic(err)
 		}
-		points = append(points, plotter.XY{X: float64(i), Y: float64(cost)})
-		fmt.Println(i, cost)
+		bucket.Decode(buffer)
+		model[i].Vector, sizes[i] = bucket.Vector, bucket.Count
+	}
+	sums, sum := make([]uint64, len(sizes)), uint64(0)
+	for i, v := range sizes {
+		sums[i] = sum
+		sum += v
 	}
+	return model, sizes, sums
+}
 
-	p := plot.New()
+// EntriesEnd is the offset of the end of the entries of a database built with
+// settings, the symbol index follows them
+func EntriesEnd(sizes, sums []uint64, settings Settings) int64 {
+	last := len(sizes) - 1
+	return int64(Offset + (sums[last]+sizes[last])*settings.EntrySize())
+}
 
-	p.Title.Text = "epochs vs cost"
-	p.X.Label.Text = "epochs"
-	p.Y.Label.Text = "cost"
+// ProjectionOffset is the offset of the projection section which follows the
+// symbol index
+func ProjectionOffset(sizes, sums []uint64, settings Settings) int64 {
+	return EntriesEnd(sizes, sums, settings) + int64(len(sizes))*256*8
+}
 
-	scatter, err := plotter.NewScatter(points)
-	if err != nil {
-		panic(err)
+// ReadSymbols reads the symbol index that follows the entries, returning
+// false if the database doesn't have one
+func (h Header) ReadSymbols(db io.ReaderAt, sizes, sums []uint64, settings Settings) bool {
+	offset := EntriesEnd(sizes, sums, settings)
+	buffer := make([]byte, len(h)*256*8)
+	n, _ := db.ReadAt(buffer, offset)
+	if n != len(buffer) {
+		return false
 	}
-	scatter.GlyphStyle.Radius = vg.Length(1)
-	scatter.GlyphStyle.Shape = draw.CircleGlyph{}
-	p.Add(scatter)
-
-	err = p.Save(8*vg.Inch, 8*vg.Inch, "epochs.png")
-	if err != nil {
-		panic(err)
+	for i := range h {
+		total := uint64(0)
+		for j := range h[i].Symbols {
+			count := binaryvec.Order.Uint64(buffer[(i*256+j)*8:])
+			h[i].Symbols[j] = count
+			total += count
+		}
+		if total != sizes[i] {
+			for j := range h {
+				h[j].Symbols = [256]uint64{}
+			}
+			return false
+		}
 	}
+	return true
+}
 
-	A := NewMatrix(256, 256)
-	for _, v := range set.ByName["A"].X {
-		A.Data = append(A.Data, v)
-	}
-	u := NewMatrix(256, 1, avg...)
-	fmt.Println(ModelSize * 1024 * 512 * 4.0 / (1024.0 * 1024.0 * 1024.0))
-	for i := range model {
-		z := NewMatrix(256, 1)
-		for j := 0; j < 256; j++ {
-			z.Data = append(z.Data, float32(rng.NormFloat64()))
+// BuildOptions are the options of a build that aren't recorded in the
+// database
+type BuildOptions struct {
+	// MaxMemory is the memory budget in bytes of the vectors held by the
+	// build, 0 for no budget
+	MaxMemory int64
+	// Transform is the transform the header is sampled with instead of one
+	// trained on the corpus, nil to train one
+	Transform *Transform
+	// Differential rebuilds the database at the path reusing the vectors of
+	// its previous build
+	Differential bool
+	// Checkpoint is the bytes of corpus between the mixer checkpoints
+	// recorded for differential builds, 0 records none
+	Checkpoint int
+	// Calibrate is the number of holdout positions the calibration is fit
+	// at, 0 doesn't calibrate
+	Calibrate int
+}
+
+// Build builds a database at path from documents with settings, the document
+// id of an entry is the index of its document in documents, several
+// documents are processed in a shuffled order
+func Build(path string, documents []Document, settings Settings, options BuildOptions) error {
+	cpus, start := runtime.NumCPU(), time.Now()
+	documents = NumberVersions(documents)
+	// a differential build reads the vectors of the unchanged start of the
+	// corpus from the previous build of the database
+	var differential *Differential
+	if options.Differential {
+		var err error
+		differential, err = OpenDifferential(path)
+		if err != nil {
+			return err
 		}
-		x := A.MulT(z).Add(u)
-		aa := sqrt(vector.Dot(x.Data, x.Data))
-		for j, v := range x.Data {
-			model[i].Vector[j] = v / aa
+		defer differential.Close()
+		settings, err = differential.Match(settings)
+		if err != nil {
+			return err
 		}
 	}
-	return model
-}
+	if settings.Merges > 0 && settings.Alphabet == nil {
+		// the merges are learned from the whole corpus in memory
+		input, _ := LoadCorpus(documents, settings.Redact, settings.Preprocess)
+		settings.Alphabet = LearnAlphabet(input, settings.Merges)
+	}
+	if settings.Fold > 0 && settings.Folding == nil {
+		input, _ := LoadCorpus(documents, settings.Redact, settings.Preprocess)
+		settings.Folding = LearnFolding(input, settings.Fold)
+	}
 
-// LoadHeader loads the header
-func LoadHeader() (Header, []uint64, []uint64) {
-	model := make(Header, ModelSize*1024)
-	sizes := make([]uint64, ModelSize*1024)
-	in, err := os.Open("db.bin")
+	// the corpus is decoded again for each pass over it instead of being held
+	// in memory, the first pass measures it and writes the compressed corpus
+	corpus, err := CreateCorpus(path, settings.EmbedCorpus)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer in.Close()
-
-	buffer32 := make([]byte, 4)
-	buffer64 := make([]byte, 8)
-	for i := range model {
-		for j := range model[i].Vector {
-			n, err := in.Read(buffer32)
-			if err != nil {
-				panic(err)
-			}
-			if n != len(buffer32) {
-				panic("4 bytes should have been read")
-			}
-			var bits uint32
-			for i := range buffer32 {
-				bits |= uint32(buffer32[i]) << (8 * i)
+	defer corpus.Close()
+	order, lengths := DocumentOrder(len(documents)), make([]int, len(documents))
+	size, length, runes := 0, 0, make(map[rune]int)
+	err = StreamCorpus(documents, order, settings.Redact, settings.Preprocess, CorpusChunk, func(chunk Chunk) error {
+		if len(settings.Smooth) > 0 {
+			for _, r := range string(chunk.Input) {
+				runes[r]++
 			}
-			model[i].Vector[j] = math.Float32frombits(bits)
 		}
-		var count uint64
-		n, err := in.Read(buffer64)
+		size += len(chunk.Input)
+		symbols := len(settings.Coding().Encode(chunk.Input))
+		length += symbols
+		lengths[chunk.Document] += symbols
+		if differential != nil {
+			differential.Compare(chunk.Input)
+		}
+		_, err := corpus.Write(chunk.Input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	smoothing, err := NewSmoothing(settings.Smooth, runes)
+	if err != nil {
+		return err
+	}
+	settings.Smoothing = smoothing
+	// pass calls fn with each chunk of the corpus and its symbols of the
+	// alphabet, offsets are where the symbols start in the chunk, a symbol
+	// doesn't span chunks
+	pass := func(fn func(chunk Chunk, data []byte, offsets []uint64)) {
+		err := StreamCorpus(documents, order, settings.Redact, settings.Preprocess, CorpusChunk, func(chunk Chunk) error {
+			coding := settings.Coding()
+			data := coding.Encode(chunk.Input)
+			fn(chunk, data, coding.Offsets(chunk.Input, data))
+			return nil
+		})
 		if err != nil {
+			// the corpus was decoded once already
 			panic(err)
 		}
-		if n != len(buffer64) {
-			panic("4 bytes should have been read")
-		}
-		for i := range buffer64 {
-			count |= uint64(buffer64[i]) << (8 * i)
-		}
-		sizes[i] = count
 	}
-	sums, sum := make([]uint64, len(sizes)), uint64(0)
-	for i, v := range sizes {
-		sums[i] = sum
-		sum += v
+	if settings.Dimensions > 0 && settings.Projection == nil {
+		settings.Projection = NewProjection(settings.Dimensions)
 	}
-	return model, sizes, sums
-}
+	width := settings.Width()
 
-// Build builds the model
-func Build() {
-	cpus := runtime.NumCPU()
-	file, err := Data.Open("books/10.txt.utf-8.bz2")
-	if err != nil {
-		panic(err)
+	transform := options.Transform
+	if transform == nil && differential != nil && differential.Transform && settings.Header == "" {
+		transform, err = differential.LoadTransform()
+		if err != nil {
+			return err
+		}
 	}
-	defer file.Close()
-	reader := bzip2.NewReader(file)
-	input, err := io.ReadAll(reader)
+	model, transform := NewHeader(func(fn func(data []byte)) {
+		pass(func(_ Chunk, data []byte, _ []uint64) {
+			fn(data)
+		})
+	}, length, HeaderSamples(lengths, order), settings, transform)
+	settings.Transform = transform != nil
+	// positions are the indexed positions of data, every position is indexed
+	// if it is nil
+	positions, total := StridePositions(length, settings.Stride), length
+	if positions != nil {
+		total = len(positions)
+	}
+	pool, err := NewVectorPool(total+1, width, options.MaxMemory, filepath.Dir(path))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if *FlagMoar {
-		for _, f := range Moar {
-			file, err := Data.Open(f)
-			if err != nil {
-				panic(err)
+	defer pool.Close()
+	items := make([]Item, total+1)
+	// a differential build keeps recording checkpoints for the next one
+	every := options.Checkpoint
+	if every == 0 && differential != nil {
+		every = int(differential.Checkpoints.Every)
+	}
+	recorder, resume := NewRecorder(every, len(items), settings), (*Checkpoint)(nil)
+	if differential != nil {
+		resume = differential.Resume()
+	}
+	// the reused items keep their buckets if the header is the same
+	assigned := 0
+	if resume != nil {
+		recorder.Keep(differential.Checkpoints.Points, resume)
+		if differential.Same(model) {
+			assigned = int(resume.Item)
+		}
+		NewProgress("reuse", int(resume.Item)-1).Done()
+	}
+
+	// the vectors are mixed in order and assigned to buckets by workers in
+	// batches of items [start, end), item 0 terminates the bucket lists. The
+	// workers partition the items of a batch between the mergers
+	type assignment struct {
+		start, end int
+		owned      [][]int
+	}
+	work, done := make(chan [2]int, cpus), make(chan assignment, cpus)
+	assignments := make([]uint32, len(items))
+	for i := 0; i < cpus; i++ {
+		go func() {
+			for batch := range work {
+				for item := max(batch[0], assigned); item < batch[1]; item++ {
+					assignments[item] = uint32(model.Nearest(pool.Vector(item)))
+				}
+				done <- assignment{batch[0], batch[1], Partition(assignments, batch[0], batch[1], cpus)}
 			}
-			defer file.Close()
-			reader := bzip2.NewReader(file)
-			data, err := io.ReadAll(reader)
-			if err != nil {
-				panic(err)
+		}()
+	}
+	go func() {
+		m, mixed := settings.NewMixer(), [256]float32{}
+		m.Add(0)
+		item, begin, index := 1, 1, 0
+		pass(func(chunk Chunk, data []byte, offsets []uint64) {
+			indexes := chunk.RuneIndexes()
+			for i, symbol := range data {
+				offset := i
+				if offsets != nil {
+					offset = int(offsets[i])
+				}
+				// every position is mixed into the context but only the
+				// indexed positions are mixed into vectors
+				indexed := positions == nil || item <= total && positions[item-1] == index
+				if resume != nil && uint64(index) < resume.Symbol {
+					if indexed {
+						var bucket int
+						items[item], bucket = differential.Reuse(item, pool.Reserve(item))
+						if item < assigned {
+							assignments[item] = uint32(bucket)
+						}
+						item++
+						if item-begin == BuildBatch || item > total {
+							work <- [2]int{begin, item}
+							begin = item
+						}
+					}
+					index++
+					continue
+				}
+				if resume != nil && uint64(index) == resume.Symbol {
+					err := m.UnmarshalBinary(resume.Mixer)
+					if err != nil {
+						panic(err)
+					}
+				}
+				recorder.Mark(chunk, offset, index, item, m)
+				if indexed {
+					m.Mix(&mixed)
+					items[item] = Item{
+						Entropy:  Entropy(mixed[:]),
+						Symbol:   symbol,
+						Index:    indexes[offset],
+						Document: uint32(chunk.Document),
+					}
+					settings.Project(pool.Reserve(item), mixed[:])
+					item++
+					if item-begin == BuildBatch || item > total {
+						work <- [2]int{begin, item}
+						begin = item
+					}
+				}
+				m.Add(symbol)
+				index++
+			}
+			recorder.Next(chunk)
+		})
+		close(work)
+	}()
+
+	// the batches are merged into the buckets in order so the build is
+	// deterministic, each merger owns the buckets with its index modulo the
+	// number of mergers so the lists are updated without locks. A nil batch
+	// is a barrier the mergers report reaching to barrier
+	mergers, barrier := make([]chan []int, cpus), sync.WaitGroup{}
+	var merging sync.WaitGroup
+	for i := range mergers {
+		mergers[i] = make(chan []int, cpus)
+		merging.Add(1)
+		go func(batches <-chan []int) {
+			defer merging.Done()
+			for batch := range batches {
+				if batch == nil {
+					barrier.Done()
+					continue
+				}
+				model.Merge(items, assignments, batch)
+			}
+		}(mergers[i])
+	}
+	merge := func(owned [][]int) {
+		for i, merger := range mergers {
+			if len(owned[i]) > 0 {
+				merger <- owned[i]
 			}
-			input = append(input, data...)
 		}
 	}
-	data := input
-	counts := make([]uint64, len(data))
-	{
-		str := string(data)
-		runes := []rune(str)
-		index := 0
-		for j, r := range runes {
-			size := utf8.RuneLen(r)
-			for i := 0; i < size; i++ {
-				counts[index] = uint64(j)
-				index++
+	progress, warned := NewProgress("build", total), false
+	completed, next := make(map[int]assignment), 1
+	for next <= total {
+		batch := <-done
+		completed[batch.start] = batch
+		for batch, ok := completed[next]; ok; batch, ok = completed[next] {
+			delete(completed, next)
+			merge(batch.owned)
+			next = batch.end
+			pool.Spill(next)
+			merged := next - 1
+			progress.At(documents[items[merged].Document].Title)
+			progress.Update(merged, "")
+			if merged%(1<<20) == 0 {
+				pool.Sample()
+			}
+			if !warned && merged%(1<<20) == 0 {
+				// the counts are read after the mergers reach the barrier
+				barrier.Add(len(mergers))
+				for _, merger := range mergers {
+					merger <- nil
+				}
+				barrier.Wait()
+				if skew := model.Skew(); skew > MaxSkew {
+					progress.Warn(merged, fmt.Sprintf("bucket fill skew %.1f exceeds %.1f", skew, float64(MaxSkew)))
+					warned = true
+				}
 			}
 		}
 	}
-
-	model := NewHeader(data)
-	pool, item := make([]Vector, len(data)+1), uint64(1)
-
-	done, m, index, flight := make(chan Result, cpus), NewMixer(), 0, 0
-	m.Add(0)
-	for index < len(data) && flight < cpus {
-		symbol := data[index]
-		m.Mix(&pool[item].Vector)
-		pool[item].Symbol = uint64(index)
-		go process(done, model, pool, item)
-		item++
-		m.Add(symbol)
-		flight++
-		index++
+	for _, merger := range mergers {
+		close(merger)
+	}
+	merging.Wait()
+	progress.Done()
+	pool.Sample()
+	if skew := model.Skew(); skew > MaxSkew {
+		progress.Warn(total, fmt.Sprintf("bucket fill skew %.1f exceeds %.1f", skew, float64(MaxSkew)))
 	}
-	for index < len(data) {
-		result := <-done
-		flight--
-		pool[result.Vector].Next = model[result.Index].Vectors
-		model[result.Index].Vectors = result.Vector
-		model[result.Index].Count++
 
-		symbol := data[index]
-		m.Mix(&pool[item].Vector)
-		pool[item].Symbol = uint64(index)
-		go process(done, model, pool, item)
-		item++
-		m.Add(symbol)
-		flight++
-		index++
-		if index%8 == 0 {
-			fmt.Println(index, "/", len(data), "=", float64(index)/float64(len(data)))
+	// a database at a path ending in .head is split, its entries are written
+	// to their own file
+	db, entries := (*AtomicFile)(nil), (*AtomicFile)(nil)
+	if IsSplit(path) {
+		headPath, entriesPath := SplitPaths(path)
+		db, err = CreateAtomic(headPath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		entries, err = CreateAtomic(entriesPath)
+		if err != nil {
+			return err
 		}
-		if index%128 == 0 {
-			runtime.GC()
+		defer entries.Close()
+	} else {
+		db, err = CreateAtomic(path)
+		if err != nil {
+			return err
 		}
-	}
-	for i := 0; i < flight; i++ {
-		result := <-done
-		pool[result.Vector].Next = model[result.Index].Vectors
-		model[result.Index].Vectors = result.Vector
-		model[result.Index].Count++
+		defer db.Close()
+		entries = db
 	}
 
-	db, err := os.Create("db.bin")
-	if err != nil {
-		panic(err)
+	writer, entriesWriter := binaryvec.NewWriter(db), binaryvec.NewWriter(entries)
+	for i := range model {
+		err := writer.WriteRecord(&binaryvec.Bucket{
+			Vector: model[i].Vector,
+			Count:  uint64(model[i].Count),
+		})
+		if err != nil {
+			panic(err)
+		}
 	}
-	defer db.Close()
 
-	buffer32 := make([]byte, 4)
-	buffer64 := make([]byte, 8)
+	progress, buffer, entry := NewProgress("write", len(model)), make([]float32, width), uint64(0)
+	rng := rand.New(rand.NewSource(1))
 	for i := range model {
-		for _, v := range model[i].Vector {
-			bits := math.Float32bits(v)
-			for i := range buffer32 {
-				buffer32[i] = byte((bits >> (8 * i)) & 0xFF)
+		progress.Update(i, "")
+		var vectors []uint64
+		for vector := model[i].Vectors; vector != 0; vector = items[vector].Next {
+			vectors = append(vectors, vector)
+		}
+		sort.SliceStable(vectors, func(a, b int) bool {
+			return items[vectors[a]].Symbol < items[vectors[b]].Symbol
+		})
+		// the entries of a big bucket are sorted by sub-cluster, they stay
+		// sorted by symbol within each sub-cluster
+		if settings.Subclusters > 0 && len(vectors) >= settings.SubclusterMin {
+			points := make([][]float32, len(vectors))
+			for j, vector := range vectors {
+				points[j] = append([]float32(nil), pool.Read(int(vector), buffer)...)
 			}
-			n, err := db.Write(buffer32)
+			subclusters, assignments := Subcluster(points, settings.Subclusters, rng)
+			model[i].Subclusters = subclusters
+			of := make(map[uint64]int, len(vectors))
+			for j, vector := range vectors {
+				of[vector] = assignments[j]
+			}
+			sort.SliceStable(vectors, func(a, b int) bool {
+				return of[vectors[a]] < of[vectors[b]]
+			})
+		}
+		// the vectors are written as they are read from the pool and the
+		// fields of the entries follow them
+		fields := make(binaryvec.Fields, len(vectors))
+		for j, vector := range vectors {
+			item := items[vector]
+			model[i].Symbols[item.Symbol]++
+			v := pool.Read(int(vector), buffer)
+			fields[j] = binaryvec.Entry{
+				Symbol:   item.Symbol,
+				Index:    item.Index,
+				Document: uint64(item.Document),
+				Entropy:  item.Entropy,
+			}
+			copy(fields[j].Signature[:], NewSignature(v, model[i].Vector[:width]).Bytes())
+			if recorder != nil {
+				recorder.Entries[vector] = entry
+			}
+			entry++
+			err := entriesWriter.WriteRecord(binaryvec.Vector(v))
 			if err != nil {
 				panic(err)
 			}
-			if n != len(buffer32) {
-				panic("4 bytes should be been written")
-			}
 		}
-		count := uint64(model[i].Count)
-		for i := range buffer64 {
-			buffer64[i] = byte((count >> (8 * i)) & 0xFF)
-		}
-		n, err := db.Write(buffer64)
+		err := entriesWriter.WriteRecord(fields)
 		if err != nil {
 			panic(err)
 		}
-		if n != len(buffer64) {
-			panic("8 bytes should be been written")
-		}
 	}
+	pool.Sample()
+	progress.Update(len(model), pool.String())
 
-	symbol := make([]byte, 1)
 	for i := range model {
-		vector := model[i].Vectors
-		for vector != 0 {
-			for _, v := range pool[vector].Vector {
-				bits := math.Float32bits(v)
-				for i := range buffer32 {
-					buffer32[i] = byte((bits >> (8 * i)) & 0xFF)
-				}
-				n, err := db.Write(buffer32)
-				if err != nil {
-					panic(err)
-				}
-				if n != len(buffer32) {
-					panic("4 bytes should be been written")
-				}
-			}
-			symbol[0] = data[pool[vector].Symbol]
-			n, err := db.Write(symbol)
+		for _, count := range model[i].Symbols {
+			err := writer.WriteUint64(count)
 			if err != nil {
 				panic(err)
 			}
-			if n != len(symbol) {
-				panic("1 bytes should be been written")
-			}
+		}
+	}
+	settings.Projection.Write(db)
 
-			for i := range buffer64 {
-				buffer64[i] = byte((counts[pool[vector].Symbol] >> (8 * i)) & 0xFF)
-			}
-			n, err = db.Write(buffer64)
-			if err != nil {
-				panic(err)
-			}
-			if n != len(buffer64) {
-				panic("8 bytes should be been written")
+	// the calibration is fit against the entries written so far
+	if options.Calibrate > 0 {
+		reader := io.ReaderAt(db.File)
+		if entries != db {
+			reader = &SplitDB{Head: db.File, Entries: entries.File, Size: int64(entry * settings.EntrySize())}
+		}
+		sizes, sums := make([]uint64, len(model)), make([]uint64, len(model))
+		for i := range model {
+			sizes[i] = uint64(model[i].Count)
+			if i > 0 {
+				sums[i] = sums[i-1] + sizes[i-1]
 			}
-			vector = pool[vector].Next
 		}
+		store := &FlatStore{DB: reader, Sizes: sizes, Sums: sums, Width: width}
+		settings.Calibration = model.Calibrate(store, sizes, SampleHoldouts(options.Calibrate, length, pass), settings)
+	}
+	NewMetadata(start, size, model, documents, settings).Write(db)
+	if settings.EmbedCorpus {
+		err = corpus.Embed(db)
+		if err != nil {
+			return err
+		}
+	}
+	transform.Write(db)
+	if settings.Subclusters > 0 {
+		err = WriteSubclusters(db, model.Subclusters(), width)
+		if err != nil {
+			return err
+		}
+	}
+	if entries != db {
+		err = entries.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		return err
+	}
+	err = recorder.Commit(path)
+	if err != nil {
+		return err
 	}
+	if settings.EmbedCorpus {
+		// the corpus file is removed when it is closed
+		return nil
+	}
+	return corpus.Commit()
 }
 
 // Search is a search of the tree
 type Search struct {
 	Result []Output
 	Rank   float64
+	// Truncated is true if generation ran out of time or was canceled
+	Truncated bool
+	// Canceled is true if generation was canceled
+	Canceled bool
+	// PromptTruncated is true if the prompt was over the prompt budget
+	PromptTruncated bool
+	// Degraded is true if shards failed and their candidates are missing
+	Degraded bool
+	// ID identifies the generation in the generation log, empty if it isn't
+	// logged
+	ID string
+	// Symbols are the symbols of the alphabet chosen at each step
+	Symbols []byte
+	// Steps are the alternatives of each step if they were requested
+	Steps []client.Step
+	// FinishReason is why generation ended
+	FinishReason string
 }
 
-// Soda is the soda model
-func (h Header) Soda(sizes, sums []uint64, query []byte) (searches []Search) {
-	cpus := runtime.NumCPU()
-	//rng := rand.New(rand.NewSource(1))
-	in := make([]*os.File, cpus)
-	for i := range in {
-		var err error
-		in[i], err = os.Open("db.bin")
-		if err != nil {
-			panic(err)
+const (
+	// FinishLength is the finish reason of a generation of count symbols
+	FinishLength = "length"
+	// FinishStop is the finish reason of a generation ended by a stop
+	// sequence
+	FinishStop = "stop"
+	// FinishRepetition is the finish reason of a generation stopped because
+	// it was cycling
+	FinishRepetition = "repetition"
+	// FinishTimeout is the finish reason of a generation that ran out of time
+	FinishTimeout = "timeout"
+	// FinishCanceled is the finish reason of a canceled generation
+	FinishCanceled = "canceled"
+	// FinishExhausted is the finish reason of a generation that ran out of
+	// candidates
+	FinishExhausted = "exhausted"
+)
+
+// Candidate is an entry that could be generated next
+type Candidate struct {
+	Output
+	Score float32
+	// Bucket is the bucket the candidate was found in
+	Bucket int
+}
+
+// MaxCandidates is the number of candidates kept per bucket
+const MaxCandidates = 64
+
+// Query is the generation state the probed buckets are scanned with
+type Query struct {
+	Vector  []float32
+	Entropy float32
+	// Allowed restricts the symbols of the candidates, nil allows every symbol
+	Allowed *SymbolSet
+}
+
+// Scanner scans the probed buckets for the best candidates of a query
+type Scanner func(probes []int, query Query) []Candidate
+
+// Context is the state of generation when the candidates are reranked
+type Context struct {
+	// Query is the prompt
+	Query []byte
+	// Text is the text generated so far
+	Text []byte
+	// Pending are the symbols of a rune that isn't complete
+	Pending []byte
+	// Step is the number of symbols generated so far
+	Step int
+	// Vector is the mixed vector the candidates were retrieved with
+	Vector []float32
+}
+
+// Reranker rescores the retrieved candidates before sampling, it can also
+// remove or reorder them, the candidates are sorted with SortCandidates
+// afterwards
+type Reranker func(ctx Context, candidates []Candidate) []Candidate
+
+// Scan returns the best candidates of the bucket index, the entries are read
+// from store
+func (h Header) Scan(store Store, sizes []uint64, index int, query Query, options Options) []Candidate {
+	allowed := query.Allowed
+	runs := [][2]uint64{{0, sizes[index]}}
+	if subclusters := h[index].Subclusters; subclusters != nil {
+		// the entries of a sub-clustered bucket aren't sorted by symbol, the
+		// allowed symbols are filtered entry by entry
+		if options.SubProbe > 0 {
+			runs = subclusters.Runs(query.Vector, options.SubProbe)
 		}
-	}
-	defer func() {
-		for i := range in {
-			in[i].Close()
+	} else if allowed != nil {
+		if r, ok := h[index].Runs(sizes[index], allowed); ok {
+			runs = r
 		}
-	}()
-
-	vectors := []*[256]float32{}
-	cp := func() []*[256]float32 {
-		vec := make([]*[256]float32, len(vectors))
-		copy(vec, vectors)
-		return vec
 	}
-	m := NewMixer()
-	for _, v := range query {
-		m.Add(v)
-		var vector [256]float32
-		vec := &vector
-		vectors = append(vectors, vec)
-		m.Mix(vec)
-	}
-
-	type Result struct {
-		Output
-		CS     float32
-		Vector []float32
+	width := len(query.Vector)
+	prefilter := options.Hamming < SignatureBits
+	var signature Signature
+	if prefilter {
+		signature = NewSignature(query.Vector, h[index].Vector[:width])
 	}
-	done := make(chan []Result, 8)
-	search := func(r, index int, data []float32) {
-		buffer := make([]byte, sizes[index]*EntryLineSize)
-		_, err := in[r].Seek(int64(Offset+sums[index]*EntryLineSize), io.SeekStart)
+	// the small columns are filtered first, then the vectors of the selected
+	// entries are decoded together and scored in a batch
+	diversify := options.Lambda < 1
+	var candidates []Candidate
+	var vectors []float32
+	for _, run := range runs {
+		block, err := store.Entries(index, run[0], run[1])
 		if err != nil {
 			panic(err)
 		}
-		n, err := in[r].Read(buffer)
-		if err != nil {
-			panic(err)
-		}
-		if n != len(buffer) {
-			panic(fmt.Sprintf("%d bytes should have been read", len(buffer)))
-		}
-		candidates := make([]Result, sizes[index])
-		for j := 0; j < int(sizes[index]); j++ {
-			vector := make([]float32, 256)
-			for k := range vector {
-				var bits uint32
-				for l := 0; l < 4; l++ {
-					bits |= uint32(buffer[j*EntryLineSize+4*k+l]) << (8 * l)
-				}
-				vector[k] = math.Float32frombits(bits)
+		var selected []int
+		for j := 0; j < block.Len; j++ {
+			symbol := block.Symbol(j)
+			if allowed != nil && !allowed[symbol] {
+				continue
+			}
+			symbolIndex, document := block.Index(j), block.Document(j)
+			if !options.Filter.Allow(document, symbolIndex) {
+				continue
+			}
+			if options.Weights != nil && options.Weights.Weight(document) == 0 {
+				continue
 			}
-			cs := CS(vector, data)
-			max, symbolIndex, symbol := cs, uint64(0), buffer[(j+1)*EntryLineSize-1-8]
-			for k := 0; k < 8; k++ {
-				symbolIndex |= uint64(buffer[(j+1)*EntryLineSize-8+k]) << (8 * k)
+			if prefilter && signature.Distance(ReadSignature(block.Signature(j))) > options.Hamming {
+				continue
+			}
+			var score float32
+			if options.EntropyWeight > 0 {
+				difference := block.Entropy(j) - query.Entropy
+				if difference < 0 {
+					difference = -difference
+				}
+				score = -options.EntropyWeight * difference
 			}
-			candidates[j] = Result{
+			candidates = append(candidates, Candidate{
 				Output: Output{
-					Index:  symbolIndex,
-					Symbol: symbol,
+					Index:    symbolIndex,
+					Document: document,
+					Symbol:   symbol,
 				},
-				CS:     max,
-				Vector: vector,
+				Score:  score,
+				Bucket: index,
+			})
+			selected = append(selected, j)
+		}
+		batch, scores := make([]float32, len(selected)*width), make([]float32, len(selected))
+		for i, j := range selected {
+			block.Vector(j, batch[i*width:])
+		}
+		CSBatch(scores, batch, query.Vector)
+		// the entry of a distilled database stands for count entries, so its
+		// softmax mass at the temperature of the sampler is multiplied by it
+		counts := store.Counts(index, run[0], run[1])
+		first := len(candidates) - len(selected)
+		for i, score := range scores {
+			candidate := &candidates[first+i]
+			candidate.Score += score
+			if options.Weights != nil {
+				candidate.Score += log(options.Weights.Weight(candidate.Document))
+			}
+			if counts != nil && options.Sampler.Temperature > 0 {
+				candidate.Score += options.Sampler.Temperature * log(float32(counts[selected[i]]))
 			}
 		}
-		sort.Slice(candidates, func(i, j int) bool {
-			return candidates[i].CS > candidates[j].CS
-		})
-		size := uint64(64)
-		if sizes[index] < size {
-			size = sizes[index]
+		if diversify {
+			vectors = append(vectors, batch...)
+		}
+	}
+	if diversify {
+		return Diversify(candidates, vectors, width, options.Lambda)
+	}
+	SortCandidates(candidates)
+	size := MaxCandidates
+	if len(candidates) < size {
+		size = len(candidates)
+	}
+	results := make([]Candidate, size)
+	copy(results, candidates[:size])
+	return results
+}
+
+// Scanner scans the probed buckets of db in parallel, a panic of a scan is
+// raised in the caller after the other scans are done
+func (h Header) Scanner(store Store, sizes []uint64, options Options) Scanner {
+	cpus := runtime.NumCPU()
+	return func(probes []int, query Query) []Candidate {
+		type Result struct {
+			Candidates []Candidate
+			Err        error
+		}
+		work, done := make(chan int, len(probes)), make(chan Result, len(probes))
+		for _, probe := range probes {
+			work <- probe
+		}
+		close(work)
+		workers := cpus
+		if len(probes) < workers {
+			workers = len(probes)
+		}
+		for j := 0; j < workers; j++ {
+			go func() {
+				for probe := range work {
+					var result Result
+					result.Err = Recover(func() {
+						result.Candidates = h.Scan(store, sizes, probe, query, options)
+					})
+					done <- result
+				}
+			}()
+		}
+		var results []Candidate
+		var err error
+		for j := 0; j < len(probes); j++ {
+			result := <-done
+			if result.Err != nil && err == nil {
+				err = result.Err
+			}
+			results = append(results, result.Candidates...)
+		}
+		if err != nil {
+			panic(err)
+		}
+		return results
+	}
+}
+
+// Soda is the soda model, the entries are read from store
+func (h Header) Soda(store Store, sizes []uint64, query []byte, options Options) []Search {
+	return h.Generate(sizes, query, options, h.Scanner(store, sizes, options))
+}
+
+// Generate generates from the query with the candidates found by scan in the
+// buckets probed, sizes are the number of entries of each bucket
+func (h Header) Generate(sizes []uint64, query []byte, options Options, scan Scanner) (searches []Search) {
+	deadline := time.Now().Add(options.Timeout)
+	rng := options.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewSource(options.Seed))
+	}
+
+	var m Mixer
+	if options.Mixer != nil {
+		m = options.Mixer.Copy()
+	} else {
+		m = options.Settings.NewMixer()
+	}
+	var attention *Attention
+	if options.Attention > 0 && len(query) > 0 {
+		attention = NewAttention(len(query))
+	}
+	for i, v := range query {
+		m.Add(v)
+		if attention != nil {
+			attention.Record(m, options.Settings, i, len(query))
 		}
-		results := make([]Result, size)
-		copy(results, candidates[:size])
-		done <- results
 	}
+	expansions := options.Settings.Coding().Expansions()
 
 	for s := 0; s < 1; s++ {
-		fmt.Println("s=", s)
-		m, vectors := m.Copy(), cp()
-		result, rank := make([]Output, 0, 8), 0.0
+		m := m.Copy()
+		result, rank, truncated, canceled, chosen := make([]Output, 0, 8), 0.0, false, false, []byte{}
+		var steps []client.Step
+		sampler, stop, text := options.Sampler, options.Stop, []byte{}
+		vector, cache := make([]float32, options.Settings.Width()), NewProbeCache(options.ProbeCache)
 		var symbols []byte
-		for i := 0; i < *FlagCount; i++ {
+		// cycling is the number of steps the output has been cycling
+		finish, cycling := FinishLength, 0
+		observed := options.Vocabulary.Observer()
+		for i := 0; i < options.Count; i++ {
+			if options.Timeout > 0 && time.Now().After(deadline) {
+				truncated, finish = true, FinishTimeout
+				break
+			}
+			if options.Canceled() {
+				truncated, canceled, finish = true, true, FinishCanceled
+				break
+			}
+			if options.Control != nil {
+				sampler, stop = options.Control.Apply(sampler, stop)
+			}
 			var data [256]float32
-			vec := &data
-			vectors = append(vectors, vec)
-			m.Mix(vec)
-			type Index struct {
-				Index int
-				Value float32
-			}
-			indexes := make([]Index, len(h))
-			for i := range h {
-				if sizes[i] == 0 {
-					continue
-				}
-				indexes[i].Index = i
-				indexes[i].Value = CS(h[i].Vector[:], data[:])
+			m.Mix(&data)
+			options.Settings.Project(vector, data[:])
+			if attention != nil {
+				attention.Attend(vector, vector, options.Attention)
 			}
-			sort.Slice(indexes, func(i, j int) bool {
-				return indexes[i].Value > indexes[j].Value
-			})
-
-			var results []Result
-			for j := 0; j < cpus; j++ {
-				go search(j, indexes[j].Index, data[:])
+			// auto fanout considers more buckets than -nprobe and probes the
+			// prefix of them that likely holds the winner
+			auto, nprobe := options.Fanout == FanoutAuto && options.Stats != nil, options.NProbe
+			if auto {
+				nprobe *= FanoutExpand
 			}
-			for j := 0; j < cpus; j++ {
-				result := <-done
-				results = append(results, result...)
+			probes, complete := cache.Probe(h, sizes, vector, nprobe, options.ProbeThreshold), true
+			if auto {
+				probes, complete = options.Stats.Fanout(probes)
 			}
-			sort.Slice(results, func(i, j int) bool {
-				return results[i].CS > results[j].CS
-			})
 
-			size := 8
-			if len(results) < size {
-				size = len(results)
-			}
-			results = results[:size]
-
-			/*length := len(vectors) + len(results)
-			graph := pagerank.NewGraph()
-			for j := 0; j < length; j++ {
-				for k := 0; k < length; k++ {
-					var x, y []float32
-					if j < len(vectors) {
-						x = (*vectors[j])[:]
-					} else {
-						x = results[j-len(vectors)].Vector
-					}
-					if k < len(vectors) {
-						y = (*vectors[k])[:]
-					} else {
-						y = results[k-len(vectors)].Vector
-					}
-					cs := CS(x, y)
-					graph.Link(uint32(i), uint32(j), float64(cs))
-				}
+			var allowed *SymbolSet
+			if len(symbols) == 0 {
+				allowed = options.Symbols
 			}
-			ranks := make([]float64, length)
-			graph.Rank(1.0, 1e-3, func(node uint32, rank float64) {
-				ranks[node] = rank
+			entropy := Entropy(data[:])
+			results := scan(probes, Query{
+				Vector:  vector,
+				Entropy: entropy,
+				Allowed: allowed,
 			})
-			index, total := 0, 0.0
-			for j := len(vectors); j < length; j++ {
-				total += ranks[j]
-			}
-			sum, selection := 0.0, rng.Float64()
-			for j := len(vectors); j < length; j++ {
-				sum += ranks[j] / total
-				if selection < sum {
-					index = j
-					break
+			if options.Probed != nil {
+				options.Probed(probes, len(results))
+			}
+			if options.Reranker != nil {
+				results = options.Reranker(Context{
+					Query:   query,
+					Text:    text,
+					Pending: symbols,
+					Step:    i,
+					Vector:  data[:],
+				}, results)
+			}
+			if options.Locality > 0 {
+				Locality(results, result, options.Locality)
+			}
+			SortCandidates(results)
+			if options.Quota > 0 {
+				results = Quota(results, options.Quota)
+			}
+			if observed != nil {
+				observed.Observe(results)
+				if len(symbols) == 0 {
+					results = observed.Restrict(results)
 				}
 			}
-			rank += ranks[index] / total
-			index -= len(vectors)*/
 
-			/*index, total := 0, float32(0.0)
-			for r := range results {
-				total += results[r].CS
+			if len(results) == 0 {
+				finish = FinishExhausted
+				break
 			}
-			sum, selection := float32(0.0), rng.Float32()
+
+			scores := make([]float32, len(results))
 			for r := range results {
-				sum += results[r].CS / total
-				if selection < sum {
-					index = r
+				scores[r] = results[r].Score
+			}
+			// the temperature of the schedule at the step
+			current := sampler.At(i)
+			current.Calibration = options.Settings.Calibration
+			if cycling > 0 {
+				current = options.Repetition.Heat(current, cycling)
+			}
+			index, probability := current.Sample(rng, scores)
+			rank += float64(probability)
+			if options.Trace != nil {
+				options.Trace.Record(m, probes, results, index, probability, expansions)
+			}
+			if options.Alternatives > 0 {
+				steps = append(steps, client.Step{
+					Offset:       len(result),
+					Symbol:       results[index].Symbol,
+					Alternatives: Alternatives(results, current, options.Alternatives, expansions),
+				})
+			}
+			// a bucket can only win where every considered bucket was probed,
+			// otherwise the buckets kept by the fanout would always win
+			if options.Stats != nil && complete {
+				options.Stats.Record(probes, results[index].Bucket)
+			}
+			m.Add(results[index].Symbol)
+			chosen = append(chosen, results[index].Symbol)
+			// a symbol of the alphabet can complete several runes, the k-th
+			// is the k-th rune of the corpus from the entry
+			stopped, completed := false, uint64(0)
+			for _, b := range expansions[results[index].Symbol] {
+				symbols = append(symbols, b)
+				if !utf8.FullRune(symbols) {
+					continue
+				}
+				output := results[index].Output
+				output.Index += completed
+				output.S, output.Entropy = string(symbols), entropy
+				if calibration := options.Settings.Calibration; calibration != nil {
+					output.Probability = calibration.Probability(results[index].Score)
+				}
+				symbols, completed = []byte{}, completed+1
+				result = append(result, output)
+				text = append(text, output.S...)
+				for _, sequence := range stop {
+					if sequence != "" && bytes.HasSuffix(text, []byte(sequence)) {
+						result = result[:len(result)-utf8.RuneCountInString(sequence)]
+						stopped, finish = true, FinishStop
+						break
+					}
+				}
+				if stopped {
 					break
 				}
 			}
-			rank += float64(results[index].CS / total)*/
-
-			index := 0
-			m.Add(results[index].Symbol)
-			symbols = append(symbols, results[index].Symbol)
-			if utf8.FullRune(symbols) {
-				results[index].S = string(symbols)
-				symbols = []byte{}
-				result = append(result, results[index].Output)
+			if !stopped && options.Repetition.Cycling(text) {
+				if options.Repetition.Action == RepetitionStop {
+					stopped, finish = true, FinishRepetition
+				}
+				cycling++
+			} else {
+				cycling = 0
+			}
+			if options.Progress != nil {
+				options.Progress(i+1, result)
+			}
+			if stopped {
+				break
 			}
 		}
 		searches = append(searches, Search{
-			Result: result,
-			Rank:   rank,
+			Result:       result,
+			Rank:         rank,
+			Truncated:    truncated,
+			Canceled:     canceled,
+			Symbols:      chosen,
+			Steps:        steps,
+			FinishReason: finish,
 		})
 	}
 
-	sort.Slice(searches, func(i, j int) bool {
+	sort.SliceStable(searches, func(i, j int) bool {
 		return searches[i].Rank > searches[j].Rank
 	})
 
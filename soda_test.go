@@ -0,0 +1,65 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func BenchmarkMerge(b *testing.B) {
+	const count = 1 << 16
+	rng, mergers := rand.New(rand.NewSource(1)), runtime.NumCPU()
+	assignments := make([]uint32, count+1)
+	for i := 1; i < len(assignments); i++ {
+		assignments[i] = uint32(rng.Intn(1024))
+	}
+	items := make([]Item, len(assignments))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		model := make(Header, 1024)
+		var merging sync.WaitGroup
+		for start := 1; start < len(assignments); start += BuildBatch {
+			owned := Partition(assignments, start, min(start+BuildBatch, len(assignments)), mergers)
+			merging.Add(mergers)
+			for _, batch := range owned {
+				go func(batch []int) {
+					defer merging.Done()
+					model.Merge(items, assignments, batch)
+				}(batch)
+			}
+			merging.Wait()
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	assignments := make([]uint32, 3*BuildBatch+1)
+	for i := 1; i < len(assignments); i++ {
+		assignments[i] = uint32(rng.Intn(64))
+	}
+	items, model := make([]Item, len(assignments)), make(Header, 64)
+	for start := 1; start < len(assignments); start += BuildBatch {
+		for _, owned := range Partition(assignments, start, min(start+BuildBatch, len(assignments)), 3) {
+			model.Merge(items, assignments, owned)
+		}
+	}
+	for i := range model {
+		count, previous := 0, uint64(len(items))
+		for item := model[i].Vectors; item != 0; item = items[item].Next {
+			if assignments[item] != uint32(i) || item >= previous {
+				t.Fatalf("item %d is out of order in the list of bucket %d", item, i)
+			}
+			count, previous = count+1, item
+		}
+		if count != model[i].Count {
+			t.Fatalf("bucket %d has %d items but counted %d", i, count, model[i].Count)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// HeadSuffix is the suffix of the head of a split database, it holds the
+	// buckets, the symbol index, the projection, and the metadata
+	HeadSuffix = ".head"
+	// EntriesSuffix is the suffix of the entries of a split database
+	EntriesSuffix = ".entries"
+)
+
+// IsSplit is true if path is the head of a split database
+func IsSplit(path string) bool {
+	return strings.HasSuffix(path, HeadSuffix)
+}
+
+// SplitPaths are the paths of the head and entries of the split database of
+// the database at path
+func SplitPaths(path string) (head, entries string) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".bin"), HeadSuffix)
+	return base + HeadSuffix, base + EntriesSuffix
+}
+
+// SplitDB reads a split database as one database, the entries are placed
+// after the buckets of the head
+type SplitDB struct {
+	Head    *os.File
+	Entries *os.File
+	// Size is the size of the entries
+	Size int64
+}
+
+// OpenSplit opens the split database with the head at path
+func OpenSplit(path string) (*SplitDB, error) {
+	headPath, entriesPath := SplitPaths(path)
+	for _, path := range []string{headPath, entriesPath} {
+		err := CheckTemp(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	head, err := os.Open(headPath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.Open(entriesPath)
+	if err != nil {
+		head.Close()
+		return nil, err
+	}
+	info, err := entries.Stat()
+	if err != nil {
+		head.Close()
+		entries.Close()
+		return nil, err
+	}
+	return &SplitDB{
+		Head:    head,
+		Entries: entries,
+		Size:    info.Size(),
+	}, nil
+}
+
+// ReadAt reads the database at offset
+func (s *SplitDB) ReadAt(data []byte, offset int64) (int, error) {
+	n := 0
+	for len(data) > 0 {
+		file, at, chunk := s.Head, offset, data
+		switch {
+		case offset < Offset:
+			if remaining := Offset - offset; int64(len(chunk)) > remaining {
+				chunk = chunk[:remaining]
+			}
+		case offset < Offset+s.Size:
+			file, at = s.Entries, offset-Offset
+			if remaining := Offset + s.Size - offset; int64(len(chunk)) > remaining {
+				chunk = chunk[:remaining]
+			}
+		default:
+			at = offset - s.Size
+		}
+		m, err := file.ReadAt(chunk, at)
+		n, offset, data = n+m, offset+int64(m), data[m:]
+		if m < len(chunk) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close closes the head and entries
+func (s *SplitDB) Close() error {
+	err := s.Entries.Close()
+	if e := s.Head.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// DBSplit splits the database given by -db into a head and entries, so the
+// head can be rewritten or distributed without the entries
+func DBSplit(args []string) {
+	if len(args) != 0 || IsSplit(*FlagDB) {
+		fmt.Println("usage: -db <db.bin> db split")
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	info, err := os.Stat(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	end := EntriesEnd(model.FileSizes, model.FileSums, model.Settings)
+	headPath, entriesPath := SplitPaths(*FlagDB)
+	err = CopyRanges(entriesPath, model.DB, [][2]int64{{Offset, end}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = CopyRanges(headPath, model.DB, [][2]int64{{0, Offset}, {end, info.Size()}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", headPath, "and", entriesPath)
+}
+
+// CopyRanges writes the [start, end) ranges of db to a file at path
+func CopyRanges(path string, db io.ReaderAt, ranges [][2]int64) error {
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, r := range ranges {
+		_, err := io.Copy(file, io.NewSectionReader(db, r[0], r[1]-r[0]))
+		if err != nil {
+			return err
+		}
+	}
+	return file.Commit()
+}
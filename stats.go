@@ -0,0 +1,145 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// SegmentSize is the size of the segments checked for duplicates
+const SegmentSize = 64
+
+// CorpusStats reports statistics of the documents named by the arguments, or
+// of the corpus being used, after redacting with -redact and -redact-patterns
+// and preprocessing with -preprocess
+func CorpusStats(args []string) {
+	documents := Documents()
+	if len(args) > 0 {
+		documents = nil
+		corpus := Corpus()
+		for _, name := range args {
+			ids, err := FindDocuments(name)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			for _, id := range ids {
+				documents = append(documents, corpus[id])
+			}
+		}
+	}
+	pipeline, err := NewPipeline(*FlagPreprocess)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	redaction, err := NewRedaction(strings.Split(*FlagRedact, ","), *FlagRedactPatterns)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	data, _ := LoadCorpus(documents, redaction, pipeline)
+
+	fmt.Println("documents", len(documents))
+	for _, document := range documents {
+		fmt.Println(" ", document.Title)
+	}
+	fmt.Println("bytes", len(data))
+	fmt.Println("runes", utf8.RuneCount(data))
+	fmt.Println("lines", bytes.Count(data, []byte{'\n'}))
+	fmt.Println("words", len(bytes.Fields(data)))
+
+	var symbols [256]int
+	for _, symbol := range data {
+		symbols[symbol]++
+	}
+	distinct := 0
+	for _, count := range symbols {
+		if count > 0 {
+			distinct++
+		}
+	}
+	runes := make(map[rune]int)
+	for _, r := range string(data) {
+		runes[r]++
+	}
+	type Frequency struct {
+		Rune  rune
+		Count int
+	}
+	frequencies := make([]Frequency, 0, len(runes))
+	for r, count := range runes {
+		frequencies = append(frequencies, Frequency{Rune: r, Count: count})
+	}
+	sort.Slice(frequencies, func(i, j int) bool {
+		if frequencies[i].Count == frequencies[j].Count {
+			return frequencies[i].Rune < frequencies[j].Rune
+		}
+		return frequencies[i].Count > frequencies[j].Count
+	})
+	fmt.Println("distinct bytes", distinct)
+	fmt.Println("distinct runes", len(runes))
+	fmt.Println("most frequent runes")
+	for i := 0; i < len(frequencies) && i < 16; i++ {
+		fmt.Printf("  %q %d %.2f%%\n", frequencies[i].Rune, frequencies[i].Count,
+			100*float64(frequencies[i].Count)/float64(len(data)))
+	}
+
+	// the entropy of order k is the entropy of the next byte given the
+	// previous k bytes, H(k+1 grams) - H(k grams)
+	fmt.Println("entropy bits per byte")
+	previous := 0.0
+	for order := 0; order <= Order; order++ {
+		grams := make(map[uint64]int)
+		var gram uint64
+		for i, symbol := range data {
+			gram = gram<<8 | uint64(symbol)
+			if i >= order {
+				grams[gram&(math.MaxUint64>>(8*(7-order)))]++
+			}
+		}
+		total, entropy := float64(len(data)-order), 0.0
+		for _, count := range grams {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+		fmt.Printf("  order %d %.3f\n", order, entropy-previous)
+		previous = entropy
+	}
+
+	segments, duplicates := make(map[uint64]bool), 0
+	for i := 0; i+SegmentSize <= len(data); i += SegmentSize {
+		hash := fnv.New64a()
+		hash.Write(data[i : i+SegmentSize])
+		sum := hash.Sum64()
+		if segments[sum] {
+			duplicates++
+		}
+		segments[sum] = true
+	}
+	if total := len(data) / SegmentSize; total > 0 {
+		fmt.Printf("duplicate %d byte segments %.2f%%\n", SegmentSize, 100*float64(duplicates)/float64(total))
+	}
+
+	for _, width := range Dimensions {
+		settings := Settings{}
+		if width != 256 {
+			settings.Dimensions = width
+		}
+		size := int64(Offset) + int64(len(data))*int64(settings.EntrySize()) + ModelSize*1024*256*8 + settings.ProjectionSize()
+		fmt.Printf("estimated database size with %d dimensions %.1f MB\n", width, float64(size)/(1<<20))
+	}
+	for _, width := range Dimensions {
+		fmt.Printf("estimated build memory with %d dimensions %.1f MB\n", width,
+			float64(len(data))*float64(4*width+int(unsafe.Sizeof(Item{})))/(1<<20))
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagBackend is the storage backend of the entries
+var FlagBackend = flag.String("backend", "flat", "storage backend of the entries of the database: flat, or bolt to read them from the store imported with db bolt, which documents can be appended to with db append")
+
+// Store is the storage of the entries of a database
+type Store interface {
+	// Entries returns the entries [start, end) of a bucket
+	Entries(bucket int, start, end uint64) (binaryvec.Block, error)
+	// Counts returns the number of original entries each of the entries
+	// [start, end) of a bucket represents, nil if the database isn't
+	// distilled
+	Counts(bucket int, start, end uint64) []uint32
+}
+
+// FlatStore is the entries of a flat database file, they follow the header
+// in bucket order with the entries of each bucket stored as a block
+type FlatStore struct {
+	DB    io.ReaderAt
+	Sizes []uint64
+	Sums  []uint64
+	Width int
+	// Interleaved is true if the database stores entries as consecutive
+	// records, they are transposed to a block when they are read
+	Interleaved bool
+	// Distilled are the counts of the entries of a distilled database
+	Distilled []uint32
+}
+
+// Entries reads the entries [start, end) of a bucket from the file, each
+// column of the block is read with its own read
+func (f *FlatStore) Entries(bucket int, start, end uint64) (binaryvec.Block, error) {
+	entrySize := uint64(binaryvec.EntrySizeOf(f.Width))
+	data := make([]byte, (end-start)*entrySize)
+	offset := Offset + f.Sums[bucket]*entrySize
+	if f.Interleaved {
+		n, err := f.DB.ReadAt(data, int64(offset+start*entrySize))
+		if n != len(data) {
+			return binaryvec.Block{}, fmt.Errorf("%d bytes should have been read: %v", len(data), err)
+		}
+		return binaryvec.Transpose(f.Width, data), nil
+	}
+	column := uint64(0)
+	for _, size := range binaryvec.Columns(f.Width) {
+		size := uint64(size)
+		part := data[column : column+(end-start)*size]
+		n, err := f.DB.ReadAt(part, int64(offset+start*size))
+		if n != len(part) {
+			return binaryvec.Block{}, fmt.Errorf("%d bytes should have been read: %v", len(part), err)
+		}
+		offset += f.Sizes[bucket] * size
+		column += uint64(len(part))
+	}
+	return binaryvec.NewBlock(f.Width, data), nil
+}
+
+// Counts returns the counts of the entries [start, end) of a bucket
+func (f *FlatStore) Counts(bucket int, start, end uint64) []uint32 {
+	if f.Distilled == nil {
+		return nil
+	}
+	return f.Distilled[f.Sums[bucket]+start : f.Sums[bucket]+end]
+}
+
+// Backends open the entry store of a model
+var Backends = map[string]func(m *Model) (Store, error){
+	"flat": func(m *Model) (Store, error) {
+		return &FlatStore{
+			DB:          m.DB,
+			Sizes:       m.Sizes,
+			Sums:        m.Sums,
+			Width:       m.Width(),
+			Interleaved: m.Metadata == nil || m.Metadata.Encoding <= binaryvec.Interleaved,
+			Distilled:   m.Counts,
+		}, nil
+	},
+}
+
+// OpenStore opens the entry store of a model with a backend
+func OpenStore(m *Model, backend string) (Store, error) {
+	open, ok := Backends[backend]
+	if !ok {
+		var names []string
+		for name := range Backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown backend %s, the backends are %s", backend, strings.Join(names, ", "))
+	}
+	return open(m)
+}
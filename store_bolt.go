@@ -0,0 +1,409 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltTimeout is how long opening a bolt store waits for another process
+// holding it
+const BoltTimeout = time.Second
+
+// the top level buckets of a bolt store
+var (
+	boltMeta      = []byte("meta")
+	boltEntries   = []byte("entries")
+	boltDocuments = []byte("documents")
+	boltText      = []byte("text")
+)
+
+func init() {
+	Backends["bolt"] = func(m *Model) (Store, error) {
+		return OpenBolt(m)
+	}
+	Commands["db bolt"] = DBBolt
+}
+
+// BoltPath is the path of the bolt store of the database at path
+func BoltPath(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, ".bin"), HeadSuffix) + ".bolt"
+}
+
+// boltKey is the key of an entry, the entries of a bucket sorted by symbol
+// are keyed by their symbol then their sequence number so appended entries
+// join the run of their symbol. The entries of a sub-clustered bucket keep
+// the order of the database file with a 0 prefix
+func boltKey(prefix byte, sequence uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = prefix
+	binary.BigEndian.PutUint64(key[1:], sequence)
+	return key
+}
+
+// boltBucket is the name of the bolt bucket of the entries of bucket
+func boltBucket(bucket int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(bucket))
+}
+
+// BoltStore stores the entries of a database in a bolt database at BoltPath,
+// documents are appended to it in transactions. The store is held by one
+// process at a time
+type BoltStore struct {
+	sync.Mutex
+	DB    *bolt.DB
+	Width int
+	// Symbols are the number of entries of each symbol of each bucket
+	Symbols [][256]uint64
+	// Subclustered are the buckets with sub-clusters
+	Subclustered []bool
+	// Sums and Distilled are the counts of the entries of a distilled
+	// database, they aren't stored in bolt as nothing is appended to it
+	Sums      []uint64
+	Distilled []uint32
+	// Text is the preprocessed text of the appended documents
+	Text []byte
+}
+
+// OpenBolt opens the bolt store of a model imported with db bolt, the sizes
+// of the buckets and the documents of the model include the appended ones
+func OpenBolt(m *Model) (*BoltStore, error) {
+	path := BoltPath(m.Path)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("%s: %w, import the entries with db bolt", path, err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BoltTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is open in another process", path)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &BoltStore{
+		DB:           db,
+		Width:        m.Width(),
+		Symbols:      make([][256]uint64, len(m.Header)),
+		Subclustered: make([]bool, len(m.Header)),
+		Sums:         m.FileSums,
+		Distilled:    m.Counts,
+	}
+	var documents []Document
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMeta)
+		if meta == nil {
+			return fmt.Errorf("%s isn't a bolt store of a database", path)
+		}
+		entries := uint64(0)
+		for i := range m.Header {
+			entries += m.FileSizes[i]
+		}
+		if width := binaryvec.Order.Uint64(meta.Get([]byte("width"))); int(width) != s.Width {
+			return fmt.Errorf("%s has width %d instead of %d", path, width, s.Width)
+		}
+		if imported := binaryvec.Order.Uint64(meta.Get([]byte("entries"))); imported != entries {
+			return fmt.Errorf("%s was imported from a database with %d entries instead of %d", path, imported, entries)
+		}
+		symbols := meta.Get([]byte("symbols"))
+		if len(symbols) != len(m.Header)*256*8 {
+			return fmt.Errorf("%s has %d buckets instead of %d", path, len(symbols)/(256*8), len(m.Header))
+		}
+		for i := range s.Symbols {
+			for j := range s.Symbols[i] {
+				s.Symbols[i][j] = binaryvec.Order.Uint64(symbols[(i*256+j)*8:])
+			}
+		}
+		err := tx.Bucket(boltDocuments).ForEach(func(_, value []byte) error {
+			var document Document
+			err := json.Unmarshal(value, &document)
+			documents = append(documents, document)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltText).ForEach(func(_, value []byte) error {
+			s.Text = append(s.Text, value...)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(documents) > 0 && m.Metadata == nil {
+		db.Close()
+		return nil, fmt.Errorf("%s has appended documents but the database has no metadata", path)
+	}
+	m.Sizes, m.Sums = make([]uint64, len(m.Header)), make([]uint64, len(m.Header))
+	for i := range m.Header {
+		s.Subclustered[i] = m.Header[i].Subclusters != nil
+		m.Header[i].Symbols = s.Symbols[i]
+		for _, count := range s.Symbols[i] {
+			m.Sizes[i] += count
+		}
+		if i > 0 {
+			m.Sums[i] = m.Sums[i-1] + m.Sizes[i-1]
+		}
+	}
+	if m.Metadata != nil {
+		m.Metadata.Corpus = append(m.Metadata.Corpus[:len(m.Metadata.Corpus):len(m.Metadata.Corpus)], documents...)
+	}
+	return s, nil
+}
+
+// Entries reads the entries [start, end) of a bucket, the cursor seeks to the
+// run of the symbol of entry start
+func (s *BoltStore) Entries(bucket int, start, end uint64) (binaryvec.Block, error) {
+	var data []byte
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltEntries).Bucket(boltBucket(bucket)).Cursor()
+		var key, value []byte
+		skip := uint64(0)
+		if s.Subclustered[bucket] {
+			key, value = cursor.Seek(boltKey(0, start))
+		} else {
+			symbol, run := 0, uint64(0)
+			for ; symbol < 255 && run+s.Symbols[bucket][symbol] <= start; symbol++ {
+				run += s.Symbols[bucket][symbol]
+			}
+			key, value = cursor.Seek([]byte{byte(symbol)})
+			skip = start - run
+		}
+		for ; key != nil && skip > 0; skip-- {
+			key, value = cursor.Next()
+		}
+		data = make([]byte, 0, (end-start)*uint64(binaryvec.EntrySizeOf(s.Width)))
+		for i := start; i < end; i++ {
+			if key == nil {
+				return fmt.Errorf("bucket %d has %d entries instead of %d", bucket, i, end)
+			}
+			data = append(data, value...)
+			key, value = cursor.Next()
+		}
+		return nil
+	})
+	if err != nil {
+		return binaryvec.Block{}, err
+	}
+	return binaryvec.Transpose(s.Width, data), nil
+}
+
+// Counts returns the counts of the entries [start, end) of a bucket
+func (s *BoltStore) Counts(bucket int, start, end uint64) []uint32 {
+	if s.Distilled == nil {
+		return nil
+	}
+	return s.Distilled[s.Sums[bucket]+start : s.Sums[bucket]+end]
+}
+
+// Append appends a document, its text, and its entries in one transaction,
+// the sizes of the model are those it was loaded with until it is loaded
+// again
+func (s *BoltStore) Append(document Document, text []byte, entries map[int][]binaryvec.Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.Distilled != nil {
+		return errors.New("entries can't be appended to a distilled database")
+	}
+	symbols := append([][256]uint64(nil), s.Symbols...)
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		for bucket, bucketEntries := range entries {
+			if s.Subclustered[bucket] {
+				return fmt.Errorf("entries can't be appended to the sub-clustered bucket %d", bucket)
+			}
+			b := tx.Bucket(boltEntries).Bucket(boltBucket(bucket))
+			for i := range bucketEntries {
+				sequence, err := b.NextSequence()
+				if err != nil {
+					return err
+				}
+				err = b.Put(boltKey(bucketEntries[i].Symbol, sequence), bucketEntries[i].Append(nil))
+				if err != nil {
+					return err
+				}
+				symbols[bucket][bucketEntries[i].Symbol]++
+			}
+		}
+		err := tx.Bucket(boltMeta).Put([]byte("symbols"), appendSymbols(nil, symbols))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(document)
+		if err != nil {
+			return err
+		}
+		documents := tx.Bucket(boltDocuments)
+		sequence, err := documents.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = documents.Put(boltKey(0, sequence), data)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltText).Put(boltKey(0, sequence), text)
+	})
+	if err != nil {
+		return err
+	}
+	s.Symbols, s.Text = symbols, append(s.Text, text...)
+	return nil
+}
+
+// Appended is the preprocessed text of the appended documents
+func (s *BoltStore) Appended() []byte {
+	s.Lock()
+	defer s.Unlock()
+	return s.Text
+}
+
+// Close closes the bolt database
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+// appendSymbols appends the symbol counts of every bucket to data
+func appendSymbols(data []byte, symbols [][256]uint64) []byte {
+	for i := range symbols {
+		for _, count := range symbols[i] {
+			data = binaryvec.Order.AppendUint64(data, count)
+		}
+	}
+	return data
+}
+
+// ImportBolt imports the entries of a model into a new bolt store at path,
+// it is written to a temporary file that is renamed into place when it is
+// complete
+func (m *Model) ImportBolt(path string) error {
+	temp := path + TempSuffix
+	os.Remove(temp)
+	db, err := bolt.Open(temp, 0600, &bolt.Options{Timeout: BoltTimeout})
+	if err != nil {
+		return err
+	}
+	symbols := make([][256]uint64, len(m.Header))
+	for i := range m.Header {
+		symbols[i] = m.Header[i].Symbols
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(boltMeta)
+		if err != nil {
+			return err
+		}
+		entries := uint64(0)
+		for _, size := range m.FileSizes {
+			entries += size
+		}
+		err = meta.Put([]byte("width"), binaryvec.Order.AppendUint64(nil, uint64(m.Width())))
+		if err != nil {
+			return err
+		}
+		err = meta.Put([]byte("entries"), binaryvec.Order.AppendUint64(nil, entries))
+		if err != nil {
+			return err
+		}
+		err = meta.Put([]byte("symbols"), appendSymbols(nil, symbols))
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltEntries, boltDocuments, boltText} {
+			_, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	// each bucket is imported in its own transaction so the transactions stay
+	// small, the file is only renamed into place once they are all committed
+	progress := NewProgress("import", len(m.Header))
+	for i := range m.Header {
+		progress.Update(i, "")
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket(boltEntries).CreateBucket(boltBucket(i))
+			if err != nil {
+				return err
+			}
+			if m.FileSizes[i] == 0 {
+				return nil
+			}
+			block, err := m.Store.Entries(i, 0, m.FileSizes[i])
+			if err != nil {
+				return err
+			}
+			subclustered := m.Header[i].Subclusters != nil
+			for j := 0; j < block.Len; j++ {
+				entry := block.Entry(j)
+				prefix := entry.Symbol
+				if subclustered {
+					prefix = 0
+				}
+				err := b.Put(boltKey(prefix, uint64(j)), entry.Append(nil))
+				if err != nil {
+					return err
+				}
+			}
+			return b.SetSequence(m.FileSizes[i])
+		})
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+	progress.Done()
+	err = db.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// DBBolt imports the entries of the database given by -db into a bolt store
+// next to it, the store is used with -backend bolt and documents can then be
+// appended with db append
+func DBBolt(args []string) {
+	if len(args) != 0 {
+		fmt.Println("usage: db bolt")
+		return
+	}
+	if *FlagBackend != "flat" {
+		fmt.Println("db bolt imports the entries of the database file, run it with -backend flat")
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	path := BoltPath(*FlagDB)
+	if _, err := os.Stat(path); err == nil {
+		fmt.Println(path, "exists, remove it to import the database again")
+		return
+	}
+	err = model.ImportBolt(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", path)
+}
@@ -0,0 +1,278 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CorpusChunk is the number of bytes decoded at a time when a corpus is
+// streamed
+const CorpusChunk = 1 << 20
+
+// Chunk is a preprocessed chunk of a document of a streamed corpus
+type Chunk struct {
+	// Document is the index of the document
+	Document int
+	// Input is the preprocessed text, it is only valid until the next chunk
+	Input []byte
+	// Offset is the number of bytes of the corpus before the chunk
+	Offset uint64
+	// Runes is the number of runes of the corpus before the chunk
+	Runes uint64
+}
+
+// RuneIndexes returns the index in the corpus of the rune of each byte of the
+// chunk
+func (c Chunk) RuneIndexes() []uint64 {
+	indexes, index := make([]uint64, len(c.Input)), c.Runes
+	for i := 0; i < len(c.Input); index++ {
+		_, size := utf8.DecodeRune(c.Input[i:])
+		for j := 0; j < size; j++ {
+			indexes[i+j] = index
+		}
+		i += size
+	}
+	return indexes
+}
+
+// Separable is true if a chunk can end before or after the byte, no filter of
+// a pipeline joins printable ascii that isn't space with its neighbors
+func Separable(b byte) bool {
+	return b > ' ' && b < utf8.RuneSelf-1
+}
+
+// SplitPoint is the end of the longest prefix of data that is preprocessed
+// the same on its own as it is followed by the rest, 0 if there isn't one
+func SplitPoint(data []byte) int {
+	for i := len(data) - 1; i > 0; i-- {
+		if Separable(data[i-1]) && Separable(data[i]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// StreamCorpus decodes the documents in order, or in their order if it is
+// nil, in chunks of about size bytes and calls fn with each chunk after
+// redacting its lines and preprocessing it with the pipeline, fn is called at
+// least once for every document
+func StreamCorpus(documents []Document, order []int, redaction Redaction, pipeline Pipeline, size int, fn func(chunk Chunk) error) error {
+	read, buffer, lines := make([]byte, size), []byte{}, []byte{}
+	offset, runes := uint64(0), uint64(0)
+	stream := func(document int) error {
+		reader, err := OpenDocument(documents[document])
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		buffer, lines = buffer[:0], lines[:0]
+		for {
+			n, err := io.ReadFull(reader, read)
+			eof := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !eof {
+				return err
+			}
+			if len(redaction) == 0 {
+				buffer = append(buffer, read[:n]...)
+			} else {
+				// only complete lines are redacted
+				lines = append(lines, read[:n]...)
+				end := len(lines)
+				if !eof {
+					end = bytes.LastIndexByte(lines, '\n') + 1
+				}
+				buffer = append(buffer, redaction.Apply(lines[:end])...)
+				lines = append(lines[:0], lines[end:]...)
+			}
+			split := len(buffer)
+			if !eof {
+				split = SplitPoint(buffer)
+				if split == 0 {
+					continue
+				}
+			}
+			input := pipeline.Apply(buffer[:split])
+			err = fn(Chunk{
+				Document: document,
+				Input:    input,
+				Offset:   offset,
+				Runes:    runes,
+			})
+			if err != nil {
+				return err
+			}
+			offset += uint64(len(input))
+			runes += uint64(utf8.RuneCount(input))
+			buffer = append(buffer[:0], buffer[split:]...)
+			if eof {
+				return nil
+			}
+		}
+	}
+	for i := range documents {
+		document := i
+		if order != nil {
+			document = order[i]
+		}
+		err := stream(document)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CorpusMemberSize is the number of bytes of the corpus compressed in each
+// member of the compressed corpus, a member of an embedded corpus is
+// decompressed on its own
+const CorpusMemberSize = 1 << 16
+
+// CorpusMember is the start of a member of the compressed corpus
+type CorpusMember struct {
+	// Rune is the rune index of the corpus the member starts at
+	Rune uint64
+	// Offset is the offset of the member in the compressed corpus
+	Offset uint64
+}
+
+// CorpusWriter writes the compressed corpus of a database as it is streamed,
+// the corpus is compressed in members of about CorpusMemberSize bytes that
+// start on rune boundaries. The corpus file is gzip members and the embedded
+// corpus is zstd frames of the same members
+type CorpusWriter struct {
+	file   *AtomicFile
+	gzip   *gzip.Writer
+	buffer []byte
+	// Index are the members written so far
+	Index []CorpusMember
+	// Runes and Size are the runes and compressed bytes written so far
+	Runes, Size uint64
+	// frames are the zstd frames of the members if the corpus is embedded,
+	// Frames are their offsets and FramesSize their size
+	frames     *os.File
+	zstd       *zstd.Encoder
+	Frames     []uint64
+	FramesSize uint64
+}
+
+// CreateCorpus creates the compressed corpus of the database at path, it
+// replaces the corpus on commit. The zstd frames of an embedded corpus are
+// written to a temporary file next to the database
+func CreateCorpus(path string, embed bool) (*CorpusWriter, error) {
+	file, err := CreateAtomic(CorpusPath(path))
+	if err != nil {
+		return nil, err
+	}
+	c := &CorpusWriter{
+		file: file,
+	}
+	c.gzip = gzip.NewWriter(countingWriter{c})
+	if embed {
+		c.zstd, err = zstd.NewWriter(nil)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		c.frames, err = os.CreateTemp(filepath.Dir(path), "soda-corpus-*")
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// member compresses data as a member
+func (c *CorpusWriter) member(data []byte) error {
+	c.Index = append(c.Index, CorpusMember{
+		Rune:   c.Runes,
+		Offset: c.Size,
+	})
+	c.gzip.Reset(countingWriter{c})
+	_, err := c.gzip.Write(data)
+	if err != nil {
+		return err
+	}
+	c.Runes += uint64(utf8.RuneCount(data))
+	err = c.gzip.Close()
+	if err != nil || c.frames == nil {
+		return err
+	}
+	c.Frames = append(c.Frames, c.FramesSize)
+	n, err := c.frames.Write(c.zstd.EncodeAll(data, nil))
+	c.FramesSize += uint64(n)
+	return err
+}
+
+// countingWriter writes the compressed bytes to the file of a corpus writer
+type countingWriter struct {
+	c *CorpusWriter
+}
+
+// Write writes to the file and counts the bytes
+func (w countingWriter) Write(data []byte) (int, error) {
+	n, err := w.c.file.Write(data)
+	w.c.Size += uint64(n)
+	return n, err
+}
+
+// Write writes preprocessed corpus text, a member is compressed for every
+// CorpusMemberSize bytes
+func (c *CorpusWriter) Write(data []byte) (int, error) {
+	c.buffer = append(c.buffer, data...)
+	for len(c.buffer) > CorpusMemberSize {
+		end := CorpusMemberSize
+		for end > 0 && !utf8.RuneStart(c.buffer[end]) {
+			end--
+		}
+		if end == 0 {
+			end = CorpusMemberSize
+		}
+		err := c.member(c.buffer[:end])
+		if err != nil {
+			return 0, err
+		}
+		c.buffer = append(c.buffer[:0], c.buffer[end:]...)
+	}
+	return len(data), nil
+}
+
+// Flush compresses the rest of the corpus, a corpus always has a member
+func (c *CorpusWriter) Flush() error {
+	if len(c.buffer) == 0 && len(c.Index) > 0 {
+		return nil
+	}
+	err := c.member(c.buffer)
+	c.buffer = c.buffer[:0]
+	return err
+}
+
+// Commit flushes the corpus and replaces the corpus of the database with it
+func (c *CorpusWriter) Commit() error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	return c.file.Commit()
+}
+
+// Close removes the corpus if it wasn't committed and the frames of an
+// embedded corpus
+func (c *CorpusWriter) Close() error {
+	if c.frames != nil {
+		c.zstd.Close()
+		c.frames.Close()
+		os.Remove(c.frames.Name())
+	}
+	return c.file.Close()
+}
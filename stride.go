@@ -0,0 +1,174 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+// FlagStride is the spacing of the positions of the corpus that are indexed
+var FlagStride = flag.Int("stride", 1, "index one position of the corpus in every window of stride positions at a seeded random offset, larger strides build smaller databases with less recall")
+
+// CheckStride checks the stride of a build
+func CheckStride(stride int) error {
+	if stride < 1 {
+		return fmt.Errorf("stride must be positive")
+	}
+	return nil
+}
+
+// StridePositions are the indexed positions of a corpus of n symbols, one in
+// each window of stride symbols at an offset drawn from a fixed seed, nil if
+// every position is indexed
+func StridePositions(n, stride int) []int {
+	if stride <= 1 {
+		return nil
+	}
+	rng := rand.New(rand.NewSource(1))
+	positions := make([]int, 0, n/stride+1)
+	for window := 0; window < n; window += stride {
+		if position := window + rng.Intn(stride); position < n {
+			positions = append(positions, position)
+		}
+	}
+	return positions
+}
+
+// EvalQueries and EvalLength are the number and length of the queries
+// sampled from the corpus of a database to measure recall, EvalText is the
+// length of the text after each query that is scored
+const (
+	EvalQueries = 64
+	EvalLength  = 128
+	EvalText    = 16
+)
+
+// SampleQueries samples queries and the text that follows them from the corpus
+// of the database with a fixed seed
+func (m *Model) SampleQueries() ([][2][]byte, error) {
+	documents := Documents()
+	if m.Metadata != nil {
+		documents = m.Metadata.Corpus
+	}
+	input, _ := LoadCorpus(documents, m.Redact, nil)
+	if len(input) <= EvalLength+EvalText {
+		return nil, fmt.Errorf("the corpus is too small to sample queries from")
+	}
+	rng := rand.New(rand.NewSource(1))
+	var samples [][2][]byte
+	for j := 0; j < EvalQueries; j++ {
+		start := rng.Intn(len(input) - EvalLength - EvalText)
+		samples = append(samples, [2][]byte{input[start : start+EvalLength], input[start+EvalLength : start+EvalLength+EvalText]})
+	}
+	return samples, nil
+}
+
+// Recall is the fraction of the symbols of the samples that rank first among
+// the candidates retrieved for them and their mean reciprocal rank
+func (m *Model) Recall(samples [][2][]byte) (recall, mrr float64) {
+	options, err := Request{}.Options()
+	if err != nil {
+		panic(err)
+	}
+	hits, reciprocal, symbols := 0, 0.0, 0
+	for _, sample := range samples {
+		score := m.Score(sample[0], sample[1], options)
+		for _, s := range score.Symbols {
+			if s.Rank == 1 {
+				hits++
+			}
+		}
+		reciprocal += score.MeanReciprocalRank * float64(len(score.Symbols))
+		symbols += len(score.Symbols)
+	}
+	return float64(hits) / float64(symbols), reciprocal / float64(symbols)
+}
+
+// Entries is the number of entries of the database
+func (m *Model) Entries() uint64 {
+	entries := uint64(0)
+	for _, size := range m.Sizes {
+		entries += size
+	}
+	return entries
+}
+
+// Eval describes the size of the database and its recall of the samples
+func (m *Model) Eval(samples [][2][]byte) string {
+	size := int64(0)
+	if info, err := os.Stat(m.Path); err == nil {
+		size = info.Size()
+	}
+	recall, mrr := m.Recall(samples)
+	return fmt.Sprintf("entries %d size %.1f MB recall@1 %.3f mrr %.3f", m.Entries(), float64(size)/(1<<20), recall, mrr)
+}
+
+// BenchStride measures the next symbol recall of the database given by -db
+// and of the databases given as arguments, typically built from the same
+// corpus with larger strides
+func BenchStride(args []string) {
+	paths := append([]string{*FlagDB}, args...)
+	if len(args) == 0 {
+		fmt.Println("usage: -db <db> bench stride <db>...")
+		return
+	}
+	var samples [][2][]byte
+	for i, path := range paths {
+		model, err := LoadModel(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if i == 0 {
+			samples, err = model.SampleQueries()
+			if err != nil {
+				model.Close()
+				fmt.Println(err)
+				return
+			}
+		}
+		stride := model.Stride
+		if stride == 0 {
+			stride = 1
+		}
+		fmt.Printf("%s stride %d %s\n", path, stride, model.Eval(samples))
+		model.Close()
+	}
+}
+
+// EvalCommand compares the header initialization, bucket balance, and next
+// symbol recall of the database given by -db and of the databases given as
+// arguments, the samples are drawn from the corpus of the first
+func EvalCommand(args []string) {
+	paths := append([]string{*FlagDB}, args...)
+	var samples [][2][]byte
+	for i, path := range paths {
+		model, err := LoadModel(path)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if i == 0 {
+			samples, err = model.SampleQueries()
+			if err != nil {
+				model.Close()
+				fmt.Println(err)
+				return
+			}
+		}
+		header := model.Settings.Header
+		if header == "" {
+			header = HeaderGaussian
+		}
+		for j := range model.Header {
+			model.Header[j].Count = int(model.Sizes[j])
+		}
+		fmt.Printf("%s header %s skew %.1f %s\n", path, header, model.Header.Skew(), model.Eval(samples))
+		model.Close()
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+	"github.com/pointlander/soda/vector"
+)
+
+var (
+	// FlagSubclusters is the number of sub-clusters of the big buckets of a
+	// build
+	FlagSubclusters = flag.Int("subclusters", 0, "number of sub-clusters the entries of each bucket with at least -subcluster-min entries are clustered into at build time, a scan of the bucket only scans the -subprobe sub-clusters most similar to the query, 0 doesn't sub-cluster")
+	// FlagSubclusterMin is the number of entries of the buckets that are
+	// sub-clustered
+	FlagSubclusterMin = flag.Int("subcluster-min", 1024, "minimum number of entries of a bucket that is sub-clustered")
+	// FlagSubProbe is the number of sub-clusters scanned in each bucket
+	FlagSubProbe = flag.Int("subprobe", 4, "number of the sub-clusters of a sub-clustered bucket that are scanned, 0 scans every entry of the bucket")
+)
+
+// MaxSubclusters is the largest number of sub-clusters of a bucket
+const MaxSubclusters = 256
+
+// CheckSubclusters checks the sub-clustering of a build, the buckets with at
+// least minimum entries are sub-clustered
+func CheckSubclusters(subclusters, minimum int) error {
+	if subclusters < 0 || subclusters == 1 || subclusters > MaxSubclusters {
+		return fmt.Errorf("subclusters must be 0 or between 2 and %d", MaxSubclusters)
+	}
+	if minimum < subclusters {
+		return fmt.Errorf("subcluster min must be at least the number of subclusters")
+	}
+	return nil
+}
+
+// Subclusters are the second level of the index of a big bucket, the entries
+// of the bucket are sorted by sub-cluster and then by symbol so each
+// sub-cluster is a run of entries
+type Subclusters struct {
+	// Centroids are the unit centroids of the sub-clusters
+	Centroids [][]float32
+	// Sizes are the number of entries of each sub-cluster
+	Sizes []uint64
+}
+
+// Subcluster clusters the vectors of the entries of a bucket into k
+// sub-clusters, the clusters found by bisection are refined by assigning each
+// vector to its nearest centroid. It returns the sub-cluster of each vector
+func Subcluster(vectors [][]float32, k int, rng *rand.Rand) (*Subclusters, []int) {
+	subclusters := &Subclusters{}
+	for _, members := range Bisect(vectors, k, rng) {
+		subclusters.Centroids = append(subclusters.Centroids, Centroid(vectors, members))
+	}
+	assignments := make([]int, len(vectors))
+	members := make([][]int, len(subclusters.Centroids))
+	for i, v := range vectors {
+		assignments[i] = subclusters.Nearest(v)
+		members[assignments[i]] = append(members[assignments[i]], i)
+	}
+	subclusters.Sizes = make([]uint64, len(members))
+	for i := range members {
+		subclusters.Sizes[i] = uint64(len(members[i]))
+		if len(members[i]) > 0 {
+			subclusters.Centroids[i] = Centroid(vectors, members[i])
+		}
+	}
+	return subclusters, assignments
+}
+
+// Nearest returns the sub-cluster whose centroid is most similar to the vector
+func (s *Subclusters) Nearest(v []float32) int {
+	best, max := 0, float32(-2)
+	for i, centroid := range s.Centroids {
+		if cs := CS(v, centroid); cs > max {
+			best, max = i, cs
+		}
+	}
+	return best
+}
+
+// Runs returns the runs of entries of the subprobe non empty sub-clusters most
+// similar to the query in the order of the entries
+func (s *Subclusters) Runs(query []float32, subprobe int) [][2]uint64 {
+	type Match struct {
+		Start, End uint64
+		Value      float32
+	}
+	matches, start, squared := make([]Match, 0, len(s.Sizes)), uint64(0), vector.Dot(query, query)
+	for i, size := range s.Sizes {
+		if size > 0 {
+			dot, norm := vector.DotNorm(query, s.Centroids[i])
+			matches = append(matches, Match{
+				Start: start,
+				End:   start + size,
+				Value: vector.Cosine(dot, squared, norm),
+			})
+		}
+		start += size
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Value > matches[j].Value
+	})
+	if len(matches) > subprobe {
+		matches = matches[:subprobe]
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Start < matches[j].Start
+	})
+	var runs [][2]uint64
+	for _, match := range matches {
+		if last := len(runs) - 1; last >= 0 && runs[last][1] == match.Start {
+			runs[last][1] = match.End
+		} else {
+			runs = append(runs, [2]uint64{match.Start, match.End})
+		}
+	}
+	return runs
+}
+
+// Subclusters are the sub-clusters of each bucket
+func (h Header) Subclusters() []*Subclusters {
+	subclusters := make([]*Subclusters, len(h))
+	for i := range h {
+		subclusters[i] = h[i].Subclusters
+	}
+	return subclusters
+}
+
+// WriteSubclusters writes the sub-cluster section, the number of sub-clusters
+// of each bucket followed by their centroids and sizes, a bucket without
+// sub-clusters has none
+func WriteSubclusters(out io.Writer, subclusters []*Subclusters, width int) error {
+	writer := binaryvec.NewWriter(out)
+	for _, s := range subclusters {
+		if s == nil {
+			s = &Subclusters{}
+		}
+		err := writer.WriteUint64(uint64(len(s.Sizes)))
+		if err != nil {
+			return err
+		}
+		for j, size := range s.Sizes {
+			err := writer.WriteRecord(binaryvec.Vector(s.Centroids[j][:width]))
+			if err != nil {
+				return err
+			}
+			err = writer.WriteUint64(size)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadSubclusters reads the sub-cluster section at offset into the buckets of
+// the header, the sizes of the sub-clusters of a bucket add up to its size
+func (h Header) ReadSubclusters(db io.ReaderAt, offset int64, sizes []uint64, width int) error {
+	in := bufio.NewReader(io.NewSectionReader(db, offset, 1<<62))
+	buffer := make([]byte, 4*width)
+	for i := range h {
+		_, err := io.ReadFull(in, buffer[:8])
+		if err != nil {
+			return fmt.Errorf("the sub-cluster section is truncated: %v", err)
+		}
+		k := binaryvec.Order.Uint64(buffer)
+		if k == 0 {
+			h[i].Subclusters = nil
+			continue
+		}
+		if k > MaxSubclusters {
+			return fmt.Errorf("bucket %d has %d sub-clusters", i, k)
+		}
+		s, total := &Subclusters{Centroids: make([][]float32, k), Sizes: make([]uint64, k)}, uint64(0)
+		for j := range s.Sizes {
+			_, err := io.ReadFull(in, buffer)
+			if err != nil {
+				return fmt.Errorf("the sub-cluster section is truncated: %v", err)
+			}
+			s.Centroids[j] = make([]float32, width)
+			binaryvec.Float32s(s.Centroids[j], buffer)
+			_, err = io.ReadFull(in, buffer[:8])
+			if err != nil {
+				return fmt.Errorf("the sub-cluster section is truncated: %v", err)
+			}
+			s.Sizes[j] = binaryvec.Order.Uint64(buffer)
+			total += s.Sizes[j]
+		}
+		if total != sizes[i] {
+			return fmt.Errorf("the sub-clusters of bucket %d have %d entries, not %d", i, total, sizes[i])
+		}
+		h[i].Subclusters = s
+	}
+	return nil
+}
+
+// SubclustersOffset is the offset of the sub-cluster section, it is the last
+// section of the database
+func (m *Model) SubclustersOffset() (int64, error) {
+	offset, err := m.TransformOffset()
+	if err != nil {
+		return 0, err
+	}
+	if m.Transform {
+		offset += TransformSize
+	}
+	return offset, nil
+}
+
+// LoadSubclusters reads the sub-clusters of a database built with them into
+// its header
+func (m *Model) LoadSubclusters() error {
+	if m.Subclusters == 0 {
+		return nil
+	}
+	offset, err := m.SubclustersOffset()
+	if err != nil {
+		return err
+	}
+	return m.Header.ReadSubclusters(m.DB, offset, m.Sizes, m.Width())
+}
@@ -0,0 +1,61 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SymbolSet is a set of allowed symbols
+type SymbolSet [256]bool
+
+// NewSymbolSet creates a symbol set from a regular expression character class
+// such as [a-zA-Z ], bytes that aren't ascii are matched as U+FFFD
+func NewSymbolSet(class string) (*SymbolSet, error) {
+	if class == "" {
+		return nil, nil
+	}
+	expression, err := regexp.Compile("^" + class + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid symbol class %s: %w", class, err)
+	}
+	var set SymbolSet
+	empty := true
+	for i := range set {
+		set[i] = expression.Match([]byte{byte(i)})
+		if set[i] {
+			empty = false
+		}
+	}
+	if empty {
+		return nil, fmt.Errorf("symbol class %s matches no symbols", class)
+	}
+	return &set, nil
+}
+
+// Runs returns the ranges of entries in a bucket that have an allowed symbol,
+// false is returned if the bucket doesn't have a symbol index
+func (b *Bucket) Runs(size uint64, allowed *SymbolSet) ([][2]uint64, bool) {
+	var runs [][2]uint64
+	start := uint64(0)
+	for symbol, count := range b.Symbols {
+		if count == 0 {
+			continue
+		}
+		if allowed[symbol] {
+			if last := len(runs) - 1; last >= 0 && runs[last][1] == start {
+				runs[last][1] += count
+			} else {
+				runs = append(runs, [2]uint64{start, start + count})
+			}
+		}
+		start += count
+	}
+	if start != size {
+		return nil, false
+	}
+	return runs, true
+}
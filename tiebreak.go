@@ -0,0 +1,68 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+const (
+	// TieBreakEarliest orders candidates with equal scores by ascending
+	// corpus index
+	TieBreakEarliest = "earliest"
+	// TieBreakLatest orders candidates with equal scores by descending
+	// corpus index, later text of the corpus wins
+	TieBreakLatest = "latest"
+)
+
+// FlagTieBreak is how candidates with equal scores are ordered
+var FlagTieBreak = flag.String("tie-break", TieBreakEarliest, "order of candidates with equal scores: earliest or latest corpus index first")
+
+// CheckTieBreak checks a tie breaking order
+func CheckTieBreak(tieBreak string) error {
+	switch tieBreak {
+	case TieBreakEarliest, TieBreakLatest:
+		return nil
+	}
+	return fmt.Errorf("unknown tie break %s", tieBreak)
+}
+
+// Ahead is true if a score at corpus index i is ordered before the score b
+// at corpus index j, higher scores come first and ties are broken by
+// -tie-break
+func Ahead(a float32, i uint64, b float32, j uint64) bool {
+	if a != b {
+		return a > b
+	}
+	if *FlagTieBreak == TieBreakLatest {
+		return i > j
+	}
+	return i < j
+}
+
+// Before is true if the candidate is ordered before d, candidates at the same
+// corpus index are ordered by document, symbol, and bucket so the order only
+// depends on the candidates and not on the order they were scanned in
+func (c Candidate) Before(d Candidate) bool {
+	if c.Score != d.Score || c.Index != d.Index {
+		return Ahead(c.Score, c.Index, d.Score, d.Index)
+	}
+	if c.Document != d.Document {
+		return c.Document < d.Document
+	}
+	if c.Symbol != d.Symbol {
+		return c.Symbol < d.Symbol
+	}
+	return c.Bucket < d.Bucket
+}
+
+// SortCandidates sorts candidates by score with deterministic tie breaking
+func SortCandidates(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+}
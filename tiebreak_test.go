@@ -0,0 +1,128 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// memoryStore is a store of the entries of each bucket in memory
+type memoryStore []binaryvec.Block
+
+func (s memoryStore) Entries(bucket int, start, end uint64) (binaryvec.Block, error) {
+	return s[bucket], nil
+}
+
+func (s memoryStore) Counts(bucket int, start, end uint64) []uint32 {
+	return nil
+}
+
+// tiedDatabase makes a database where every bucket and entry has the same
+// vector so every candidate has the same score
+func tiedDatabase(buckets, entries int) (Header, memoryStore, []uint64) {
+	vector := make([]float32, 256)
+	for i := range vector {
+		vector[i] = 1 / float32(16)
+	}
+	header, store, sizes := make(Header, buckets), make(memoryStore, buckets), make([]uint64, buckets)
+	for i := range header {
+		copy(header[i].Vector[:], vector)
+		block := make([]binaryvec.Entry, entries)
+		for j := range block {
+			// the entries are stored in reverse index order
+			block[j] = binaryvec.Entry{
+				Vector:   vector,
+				Symbol:   byte('a' + j%4),
+				Index:    uint64((buckets-i)*entries - j),
+				Document: uint64(i % 2),
+			}
+		}
+		store[i] = binaryvec.NewBlock(256, binaryvec.AppendBlock(nil, block))
+		sizes[i] = uint64(entries)
+	}
+	return header, store, sizes
+}
+
+func TestSortCandidatesTieBreak(t *testing.T) {
+	defer func(tieBreak string) { *FlagTieBreak = tieBreak }(*FlagTieBreak)
+	rng := rand.New(rand.NewSource(1))
+	candidates := make([]Candidate, 64)
+	for i := range candidates {
+		candidates[i] = Candidate{Output: Output{Index: uint64(i / 2), Document: uint64(i % 2)}, Score: .5}
+	}
+	candidates[40].Score = .9
+	for _, tieBreak := range []string{TieBreakEarliest, TieBreakLatest} {
+		*FlagTieBreak = tieBreak
+		rng.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		SortCandidates(candidates)
+		if candidates[0].Index != 20 || candidates[0].Document != 0 {
+			t.Fatalf("the best candidate should be first with %s tie breaking, not %+v", tieBreak, candidates[0])
+		}
+		for i := 2; i < len(candidates); i++ {
+			a, b := candidates[i-1], candidates[i]
+			if a.Index == b.Index && a.Document > b.Document {
+				t.Fatalf("candidates at the same index should be ordered by document: %+v %+v", a, b)
+			}
+			if a.Index != b.Index && (a.Index < b.Index) != (tieBreak == TieBreakEarliest) {
+				t.Fatalf("candidates with equal scores are out of %s order: %+v %+v", tieBreak, a, b)
+			}
+		}
+	}
+	if CheckTieBreak("random") == nil {
+		t.Fatal("random should be an invalid tie break")
+	}
+}
+
+func TestScannerDeterminism(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	header, store, sizes := tiedDatabase(16, 8)
+	options := Options{
+		Count:   16,
+		NProbe:  len(header),
+		Hamming: SignatureBits,
+		Lambda:  1,
+		Sampler: Sampler{Decoder: DecoderGreedy},
+	}
+	var candidates []Candidate
+	var result []Output
+	for _, procs := range []int{1, 2, 4, 8} {
+		runtime.GOMAXPROCS(procs)
+		for i := 0; i < 8; i++ {
+			scanned := header.Scanner(store, sizes, options)(header.Probe(sizes, header[0].Vector[:], len(header), 0), Query{
+				Vector: header[0].Vector[:],
+			})
+			SortCandidates(scanned)
+			if candidates == nil {
+				candidates = scanned
+			}
+			for j := range scanned {
+				if scanned[j] != candidates[j] {
+					t.Fatalf("candidate %d with GOMAXPROCS %d is %+v not %+v", j, procs, scanned[j], candidates[j])
+				}
+			}
+			searches := header.Generate(sizes, []byte("tie"), options, header.Scanner(store, sizes, options))
+			if result == nil {
+				result = searches[0].Result
+			}
+			if len(searches[0].Result) != len(result) {
+				t.Fatalf("generated %d outputs with GOMAXPROCS %d not %d", len(searches[0].Result), procs, len(result))
+			}
+			for j := range result {
+				if searches[0].Result[j] != result[j] {
+					t.Fatalf("output %d with GOMAXPROCS %d is %+v not %+v", j, procs, searches[0].Result[j], result[j])
+				}
+			}
+		}
+	}
+	if candidates[0].Index != 1 {
+		t.Fatalf("the earliest candidate should be first not %+v", candidates[0])
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// TraceCandidates is the number of the highest scoring candidates of each
+// step kept in a trace
+const TraceCandidates = 16
+
+// TraceCandidate is a candidate of a traced step
+type TraceCandidate struct {
+	Index    uint64  `json:"index"`
+	Document uint64  `json:"document"`
+	Symbol   string  `json:"symbol"`
+	Score    float32 `json:"score"`
+	Bucket   int     `json:"bucket"`
+	Chosen   bool    `json:"chosen,omitempty"`
+}
+
+// TraceStep is a step of a traced generation
+type TraceStep struct {
+	// Probes are the buckets probed in order of similarity, Bucket is the
+	// bucket of the chosen candidate
+	Probes []int `json:"probes"`
+	Bucket int   `json:"bucket"`
+	// Candidates are the highest scoring candidates and the chosen one,
+	// Retrieved is the number of candidates retrieved
+	Candidates []TraceCandidate `json:"candidates"`
+	Retrieved  int              `json:"retrieved"`
+	// Symbol is the chosen symbol and Probability the probability it was
+	// sampled with
+	Symbol      string  `json:"symbol"`
+	Probability float32 `json:"probability"`
+	// Weights are the pagerank weights of the histograms of the mixer, they
+	// are only computed for the histogram mixer
+	Weights []float32 `json:"weights,omitempty"`
+}
+
+// Trace records the steps of a generation
+type Trace struct {
+	Steps []TraceStep `json:"steps"`
+}
+
+// Record records a step with the mixer before the chosen candidate is added,
+// the candidates are sorted by score
+func (t *Trace) Record(m Mixer, probes []int, candidates []Candidate, chosen int, probability float32, expansions *[256][]byte) {
+	step := TraceStep{
+		Probes:      append([]int(nil), probes...),
+		Bucket:      candidates[chosen].Bucket,
+		Retrieved:   len(candidates),
+		Symbol:      string(expansions[candidates[chosen].Symbol]),
+		Probability: probability,
+	}
+	for i, candidate := range candidates {
+		if i >= TraceCandidates && i != chosen {
+			continue
+		}
+		step.Candidates = append(step.Candidates, TraceCandidate{
+			Index:    candidate.Index,
+			Document: candidate.Document,
+			Symbol:   string(expansions[candidate.Symbol]),
+			Score:    candidate.Score,
+			Bucket:   candidate.Bucket,
+			Chosen:   i == chosen,
+		})
+	}
+	if histogram, ok := m.(*HistogramMixer); ok {
+		var rank [Size]float32
+		histogram.MixRank(&rank)
+		step.Weights = rank[:min(len(histogram.Histograms), Size)]
+	}
+	t.Steps = append(t.Steps, step)
+}
+
+// GenerationTrace is the trace of a replayed generation of the generation log
+type GenerationTrace struct {
+	ID    string `json:"id"`
+	Query string `json:"query"`
+	// Text is the logged text and Replayed is the text of the replay
+	Text     string `json:"text"`
+	Replayed string `json:"replayed"`
+	// Diverged is the first step the replay differs from the log at, -1 if
+	// it doesn't
+	Diverged int `json:"diverged"`
+	Trace
+}
+
+// TraceTemplate renders a generation trace
+var TraceTemplate = template.Must(template.New("trace").Funcs(template.FuncMap{
+	"width": func(v float32) float32 {
+		return 16 * v
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+ <head>
+  <meta charset="UTF-8">
+  <title>Soda Trace {{.ID}}</title>
+ </head>
+ <body>
+  <h3>query</h3>
+  <pre>{{.Query}}</pre>
+  <h3>text</h3>
+  <pre>{{.Text}}</pre>
+  {{if ge .Diverged 0}}
+  <p>the replay diverged from the log at step {{.Diverged}}:</p>
+  <pre>{{.Replayed}}</pre>
+  {{end}}
+  {{range $i, $step := .Steps}}
+  <h3>step {{$i}} {{printf "%q" $step.Symbol}} p={{printf "%.3f" $step.Probability}}</h3>
+  <p>probed buckets {{$step.Probes}}, chose from bucket {{$step.Bucket}} among {{$step.Retrieved}} candidates</p>
+  <table>
+   {{range $step.Candidates}}
+   <tr{{if .Chosen}} style="font-weight: bold;"{{end}}>
+    <td>{{printf "%q" .Symbol}}</td>
+    <td>{{printf "%.4f" .Score}}</td>
+    <td>bucket {{.Bucket}}</td>
+    <td>doc {{.Document}} rune {{.Index}}</td>
+    <td><div style="background: steelblue; height: 1em; width: {{width .Score}}em;"></div></td>
+   </tr>
+   {{end}}
+  </table>
+  {{if $step.Weights}}
+  <p>histogram weights</p>
+  <table>
+   {{range $j, $weight := $step.Weights}}
+   <tr>
+    <td>{{$j}}</td>
+    <td>{{printf "%.4f" $weight}}</td>
+    <td><div style="background: darkorange; height: 1em; width: {{width $weight}}em;"></div></td>
+   </tr>
+   {{end}}
+  </table>
+  {{end}}
+  {{end}}
+ </body>
+</html>
+`))
+
+// Trace replays the logged generation given by id with tracing and renders
+// the probes, candidates, and histogram weights of each step, or returns
+// them as json with format=json
+func (h Handler) Trace(response http.ResponseWriter, request *http.Request) {
+	if h.Log == nil {
+		http.Error(response, "generations aren't logged, start the server with -generation-log", http.StatusNotFound)
+		return
+	}
+	id := request.PathValue("id")
+	entry, err := h.Log.Find(id)
+	if err != nil {
+		panic(err)
+	}
+	if entry == nil {
+		http.NotFound(response, request)
+		return
+	}
+	options, err := entry.Options()
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the replay doesn't count towards the probe statistics of the model
+	options.Trace, options.Stats = &Trace{}, NewBucketStats(len(h.Header))
+	result := h.generate(entry.Prompt(), options)[0].Result
+	trace := GenerationTrace{
+		ID:       id,
+		Query:    string(entry.Prompt()),
+		Text:     entry.Text,
+		Replayed: Text(result),
+		Diverged: entry.Diverged(result),
+		Trace:    *options.Trace,
+	}
+	if request.FormValue("format") == "json" {
+		Reply(response, trace)
+		return
+	}
+	response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = TraceTemplate.Execute(response, trace)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagTransform is the header transform a database is built with
+var FlagTransform = flag.String("transform", "", "json file of a header transform exported with db transform, the buckets of a built database are sampled with it instead of a transform trained on the corpus")
+
+// TransformSize is the size of the transform section of a database
+const TransformSize = 4 * (256 + 256*256)
+
+// Transform is the learned transform the bucket vectors of the header are
+// sampled with, a bucket vector is the unit vector of A z + Mean for a
+// standard normal z, A is trained so its square approximates the covariance
+// of the mixer vectors of the corpus
+type Transform struct {
+	// Mean is the mean of the mixer vectors
+	Mean []float32 `json:"mean"`
+	// A is the 256x256 matrix in row major order
+	A []float32 `json:"a"`
+}
+
+// Check checks the sizes of the transform
+func (t *Transform) Check() error {
+	if len(t.Mean) != 256 || len(t.A) != 256*256 {
+		return fmt.Errorf("the transform should have a mean of 256 values and a matrix of %d not %d and %d", 256*256, len(t.Mean), len(t.A))
+	}
+	return nil
+}
+
+// Sample writes a bucket vector sampled with rng to vector
+func (t *Transform) Sample(rng *rand.Rand, vector []float32) {
+	z := NewMatrix(256, 1)
+	for j := 0; j < 256; j++ {
+		z.Data = append(z.Data, float32(rng.NormFloat64()))
+	}
+	x := NewMatrix(256, 256, t.A...).MulT(z).Add(NewMatrix(256, 1, t.Mean...))
+	unit(vector, x.Data)
+}
+
+// Write writes the transform section, the mean followed by the matrix
+func (t *Transform) Write(out io.Writer) {
+	if t == nil {
+		return
+	}
+	_, err := out.Write(binaryvec.AppendFloat32s(binaryvec.AppendFloat32s(nil, t.Mean), t.A))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ReadTransform reads the transform section at offset
+func ReadTransform(db io.ReaderAt, offset int64) (*Transform, error) {
+	data := make([]byte, TransformSize)
+	n, err := db.ReadAt(data, offset)
+	if n != len(data) {
+		return nil, fmt.Errorf("the transform should be %d bytes not %d: %v", len(data), n, err)
+	}
+	t := &Transform{
+		Mean: make([]float32, 256),
+		A:    make([]float32, 256*256),
+	}
+	binaryvec.Float32s(t.Mean, data[:4*256])
+	binaryvec.Float32s(t.A, data[4*256:])
+	return t, nil
+}
+
+// ReadTransformFile reads a transform exported as json
+func ReadTransformFile(path string) (*Transform, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Transform
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = t.Check()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// TransformOffset is the offset of the transform section, it follows the
+// embedded corpus or the metadata and counts
+func (m *Model) TransformOffset() (int64, error) {
+	offset, err := MetadataEnd(m.DB, m.FileSizes, m.FileSums, m.Settings)
+	if err != nil {
+		return 0, err
+	}
+	offset += 4 * int64(len(m.Counts))
+	if m.EmbedCorpus {
+		embedded, err := m.Embedded()
+		if err != nil {
+			return 0, err
+		}
+		offset = embedded.Offset + embedded.Length
+	}
+	return offset, nil
+}
+
+// LoadTransform reads the transform section of a database built with its
+// header transform
+func (m *Model) LoadTransform() (*Transform, error) {
+	if !m.Transform {
+		return nil, fmt.Errorf("%s was built without storing its header transform", m.Path)
+	}
+	offset, err := m.TransformOffset()
+	if err != nil {
+		return nil, err
+	}
+	return ReadTransform(m.DB, offset)
+}
+
+// WriteTransform copies the transform section of a database built with its
+// header transform to out, it does nothing for other databases
+func (m *Model) WriteTransform(out io.Writer) error {
+	if !m.Transform {
+		return nil
+	}
+	t, err := m.LoadTransform()
+	if err != nil {
+		return err
+	}
+	t.Write(out)
+	return nil
+}
+
+// DBTransform exports the header transform of the database as json
+func DBTransform(args []string) {
+	set := flag.NewFlagSet("db transform", flag.ContinueOnError)
+	out := set.String("o", "", "json file the transform is written to, stdout by default")
+	if err := set.Parse(args); err != nil {
+		return
+	}
+	if set.NArg() != 0 {
+		fmt.Println("usage: -db <db> db transform [-o <transform.json>]")
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	t, err := model.LoadTransform()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	if *out == "" {
+		fmt.Println(string(data))
+		return
+	}
+	file, err := CreateAtomic(*out)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -15,3 +15,17 @@ func Dot(x, y []float32) (z float32) {
 	_mm256_dot(unsafe.Pointer(&x[0]), unsafe.Pointer(&y[0]), unsafe.Pointer(uintptr(len(x))), unsafe.Pointer(&z))
 	return z
 }
+
+//go:noescape
+func dotNormAVX(x, y *float32, n int) (dot, norm float32)
+
+// DotNorm returns the dot product of x and y and the squared norm of y in
+// one pass over the vectors, y is normalized with the norm without being
+// read again
+func DotNorm(x, y []float32) (dot, norm float32) {
+	if len(x) == 0 {
+		return 0, 0
+	}
+	y = y[:len(x)]
+	return dotNormAVX(&x[0], &y[0], len(x))
+}
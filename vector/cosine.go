@@ -0,0 +1,73 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vector
+
+import (
+	"math"
+)
+
+// Epsilon is the norm below which a vector is treated as zero
+const Epsilon = 1e-12
+
+// dotNorm returns the dot product of x and y and the squared norm of y in one
+// pass over the vectors
+func dotNorm(x, y []float32) (dot, norm float32) {
+	y = y[:len(x)]
+	var d0, d1, d2, d3, n0, n1, n2, n3 float32
+	i := 0
+	for ; i+4 <= len(x); i += 4 {
+		a0, a1, a2, a3 := y[i], y[i+1], y[i+2], y[i+3]
+		d0 += x[i] * a0
+		d1 += x[i+1] * a1
+		d2 += x[i+2] * a2
+		d3 += x[i+3] * a3
+		n0 += a0 * a0
+		n1 += a1 * a1
+		n2 += a2 * a2
+		n3 += a3 * a3
+	}
+	for ; i < len(x); i++ {
+		d0 += x[i] * y[i]
+		n0 += y[i] * y[i]
+	}
+	return (d0 + d1) + (d2 + d3), (n0 + n1) + (n2 + n3)
+}
+
+// Cosine returns the cosine similarity of a dot product of two vectors with
+// squared norms a and b, it is 0 if either vector is zero
+func Cosine(dot, a, b float32) float32 {
+	norm := float32(math.Sqrt(float64(a) * float64(b)))
+	if !(norm > Epsilon) {
+		return 0
+	}
+	return dot / norm
+}
+
+// DotBatch writes the dot product of the query with each row of the matrix
+// to out, the matrix has len(out) rows of len(query) values
+func DotBatch(query, matrix, out []float32) {
+	width := len(query)
+	for i := range out {
+		out[i] = Dot(query, matrix[i*width:(i+1)*width])
+	}
+}
+
+// CosineBatch writes the cosine similarity of the query with each row of the
+// matrix to out, the matrix has len(out) rows of len(query) values. The norm
+// of the query is computed once and each row is read once by DotNorm
+func CosineBatch(query, matrix, out []float32) {
+	width := len(query)
+	if width == 0 {
+		for i := range out {
+			out[i] = 0
+		}
+		return
+	}
+	squared := Dot(query, query)
+	for i := range out {
+		dot, norm := DotNorm(query, matrix[i*width:(i+1)*width])
+		out[i] = Cosine(dot, squared, norm)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !noasm && amd64
+
+#include "textflag.h"
+
+// func dotNormAVX(x, y *float32, n int) (dot, norm float32)
+// the products are accumulated 16 values at a time in two pairs of
+// registers, then 8 at a time, and the rest one at a time
+TEXT ·dotNormAVX(SB), NOSPLIT, $0-32
+	MOVQ   x+0(FP), SI
+	MOVQ   y+8(FP), DI
+	MOVQ   n+16(FP), CX
+	VXORPS Y0, Y0, Y0
+	VXORPS Y1, Y1, Y1
+	VXORPS Y4, Y4, Y4
+	VXORPS Y5, Y5, Y5
+
+loop16:
+	CMPQ    CX, $16
+	JL      loop8
+	VMOVUPS (DI), Y2
+	VMOVUPS 32(DI), Y6
+	VMULPS  (SI), Y2, Y3
+	VADDPS  Y3, Y0, Y0
+	VMULPS  Y2, Y2, Y3
+	VADDPS  Y3, Y1, Y1
+	VMULPS  32(SI), Y6, Y7
+	VADDPS  Y7, Y4, Y4
+	VMULPS  Y6, Y6, Y7
+	VADDPS  Y7, Y5, Y5
+	ADDQ    $64, SI
+	ADDQ    $64, DI
+	SUBQ    $16, CX
+	JMP     loop16
+
+loop8:
+	CMPQ    CX, $8
+	JL      reduce
+	VMOVUPS (DI), Y2
+	VMULPS  (SI), Y2, Y3
+	VADDPS  Y3, Y0, Y0
+	VMULPS  Y2, Y2, Y3
+	VADDPS  Y3, Y1, Y1
+	ADDQ    $32, SI
+	ADDQ    $32, DI
+	SUBQ    $8, CX
+
+reduce:
+	VADDPS       Y4, Y0, Y0
+	VADDPS       Y5, Y1, Y1
+	VEXTRACTF128 $1, Y0, X2
+	VADDPS       X2, X0, X0
+	VEXTRACTF128 $1, Y1, X3
+	VADDPS       X3, X1, X1
+	VHADDPS      X0, X0, X0
+	VHADDPS      X0, X0, X0
+	VHADDPS      X1, X1, X1
+	VHADDPS      X1, X1, X1
+
+tail:
+	CMPQ   CX, $0
+	JE     done
+	VMOVSS (DI), X2
+	VMULSS (SI), X2, X3
+	VADDSS X3, X0, X0
+	VMULSS X2, X2, X3
+	VADDSS X3, X1, X1
+	ADDQ   $4, SI
+	ADDQ   $4, DI
+	DECQ   CX
+	JMP    tail
+
+done:
+	VZEROUPPER
+	MOVSS X0, dot+24(FP)
+	MOVSS X1, norm+28(FP)
+	RET
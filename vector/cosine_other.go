@@ -0,0 +1,15 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build noasm || !amd64
+// +build noasm !amd64
+
+package vector
+
+// DotNorm returns the dot product of x and y and the squared norm of y in
+// one pass over the vectors, y is normalized with the norm without being
+// read again
+func DotNorm(x, y []float32) (dot, norm float32) {
+	return dotNorm(x, y)
+}
@@ -0,0 +1,106 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vector
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Width and Rows are the shape of the matrices of the batch benchmarks, the
+// width of a database vector and the rows of a bucket scan
+const (
+	Width = 256
+	Rows  = 1024
+)
+
+func random(rng *rand.Rand, n int) []float32 {
+	x := make([]float32, n)
+	for i := range x {
+		x[i] = float32(rng.NormFloat64())
+	}
+	return x
+}
+
+// cosine is the scalar cosine similarity of x and y
+func cosine(x, y []float32) float32 {
+	xx, yy := dot(x, x), dot(y, y)
+	if xx == 0 || yy == 0 {
+		return 0
+	}
+	return dot(x, y) / float32(math.Sqrt(float64(xx)*float64(yy)))
+}
+
+func TestDotNorm(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 3, 4, 7, 8, 17, 31, 256} {
+		x, y := random(rng, n), random(rng, n)
+		d, norm := DotNorm(x, y)
+		if math.Abs(float64(d-dot(x, y))) > 1e-3 || math.Abs(float64(norm-dot(y, y))) > 1e-3 {
+			t.Fatalf("DotNorm of %d values is %f %f not %f %f", n, d, norm, dot(x, y), dot(y, y))
+		}
+	}
+}
+
+func TestCosineBatch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	query, matrix := random(rng, Width), random(rng, 8*Width)
+	// a zero row has no direction
+	for i := 0; i < Width; i++ {
+		matrix[3*Width+i] = 0
+	}
+	out, dots := make([]float32, 8), make([]float32, 8)
+	CosineBatch(query, matrix, out)
+	DotBatch(query, matrix, dots)
+	for i := range out {
+		row := matrix[i*Width : (i+1)*Width]
+		if math.Abs(float64(out[i]-cosine(query, row))) > 1e-5 {
+			t.Fatalf("the cosine of row %d is %f not %f", i, out[i], cosine(query, row))
+		}
+		if math.Abs(float64(dots[i]-dot(query, row))) > 1e-3 {
+			t.Fatalf("the dot product of row %d is %f not %f", i, dots[i], dot(query, row))
+		}
+	}
+	if out[3] != 0 {
+		t.Fatalf("the cosine of a zero row should be 0 not %f", out[3])
+	}
+}
+
+func benchmarkBatch(b *testing.B, batch func(query, matrix, out []float32)) {
+	rng := rand.New(rand.NewSource(1))
+	query, matrix, out := random(rng, Width), random(rng, Rows*Width), make([]float32, Rows)
+	b.SetBytes(4 * Rows * Width)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch(query, matrix, out)
+	}
+}
+
+func BenchmarkCosineScalar(b *testing.B) {
+	benchmarkBatch(b, func(query, matrix, out []float32) {
+		for i := range out {
+			out[i] = cosine(query, matrix[i*Width:(i+1)*Width])
+		}
+	})
+}
+
+func BenchmarkCosineDot(b *testing.B) {
+	benchmarkBatch(b, func(query, matrix, out []float32) {
+		squared := Dot(query, query)
+		for i := range out {
+			row := matrix[i*Width : (i+1)*Width]
+			out[i] = Cosine(Dot(query, row), squared, Dot(row, row))
+		}
+	})
+}
+
+func BenchmarkCosineBatch(b *testing.B) {
+	benchmarkBatch(b, CosineBatch)
+}
+
+func BenchmarkDotBatch(b *testing.B) {
+	benchmarkBatch(b, DotBatch)
+}
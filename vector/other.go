@@ -2,8 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build 386
-// +build 386
+//go:build noasm || !(amd64 || arm || arm64)
+// +build noasm !amd64,!arm,!arm64
 
 package vector
 
@@ -0,0 +1,145 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagMaxMemory is the memory budget of the vectors held by a build
+var FlagMaxMemory = flag.Int("max-memory", 0, "memory budget in MB of the vectors held by a build, older vectors are spilled to a temporary file next to the database when it is exceeded, 0 for no budget")
+
+// VectorPool holds the vectors of a build in a ring of slots, when the vectors
+// don't fit in the ring the merged vectors are spilled to a temporary file
+// and read back when the database is written
+type VectorPool struct {
+	Width int
+	// Items is the number of vectors
+	Items int
+	// Slots is the number of vectors held in memory
+	Slots int
+	Ring  []float32
+	// Spilled is the number of vectors written to the spill file
+	Spilled int
+	// Peak is the largest heap in use that was sampled
+	Peak   uint64
+	cond   *sync.Cond
+	file   *os.File
+	buffer []byte
+}
+
+// NewVectorPool creates a pool of items vectors of width within budget bytes, the
+// spill file is created in dir if the vectors don't fit, a budget of 0 holds
+// every vector in memory
+func NewVectorPool(items, width int, budget int64, dir string) (*VectorPool, error) {
+	slots := items
+	if budget > 0 && budget/int64(4*width) < int64(items) {
+		// the producer waits for the slot of a vector of an earlier batch,
+		// so a batch has to fit in the ring
+		slots = max(int(budget/int64(4*width)), 2*BuildBatch)
+	}
+	p := VectorPool{
+		Width: width,
+		Items: items,
+		Slots: slots,
+		Ring:  make([]float32, slots*width),
+		cond:  sync.NewCond(&sync.Mutex{}),
+	}
+	if slots < items {
+		file, err := os.CreateTemp(dir, "soda-pool-*")
+		if err != nil {
+			return nil, err
+		}
+		p.file = file
+	}
+	return &p, nil
+}
+
+// Vector is the vector of item in memory
+func (p *VectorPool) Vector(item int) []float32 {
+	slot := item % p.Slots
+	return p.Ring[slot*p.Width : (slot+1)*p.Width]
+}
+
+// Reserve waits until the slot of item is free and returns it
+func (p *VectorPool) Reserve(item int) []float32 {
+	if p.file != nil {
+		p.cond.L.Lock()
+		for item-p.Slots >= p.Spilled {
+			p.cond.Wait()
+		}
+		p.cond.L.Unlock()
+	}
+	return p.Vector(item)
+}
+
+// Spill writes the vectors of the items before end to the spill file, freeing
+// their slots
+func (p *VectorPool) Spill(end int) {
+	if p.file == nil || end <= p.Spilled {
+		return
+	}
+	p.buffer = p.buffer[:0]
+	for item := p.Spilled; item < end; item++ {
+		p.buffer = binaryvec.AppendFloat32s(p.buffer, p.Vector(item))
+	}
+	_, err := p.file.Write(p.buffer)
+	if err != nil {
+		panic(err)
+	}
+	p.cond.L.Lock()
+	p.Spilled = end
+	p.cond.L.Unlock()
+	p.cond.Broadcast()
+}
+
+// Read returns the vector of item, reading it from the spill file into
+// vector if it is no longer in memory
+func (p *VectorPool) Read(item int, vector []float32) []float32 {
+	if p.file == nil || item+p.Slots >= p.Items {
+		return p.Vector(item)
+	}
+	size := 4 * p.Width
+	if cap(p.buffer) < size {
+		p.buffer = make([]byte, size)
+	}
+	data := p.buffer[:size]
+	_, err := p.file.ReadAt(data, int64(item)*int64(size))
+	if err != nil {
+		panic(err)
+	}
+	binaryvec.Float32s(vector, data)
+	return vector
+}
+
+// Sample records the heap in use if it is the largest seen
+func (p *VectorPool) Sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapInuse > p.Peak {
+		p.Peak = stats.HeapInuse
+	}
+}
+
+// String reports the memory use of the pool
+func (p *VectorPool) String() string {
+	return fmt.Sprintf("pool resident %.1f MB spilled %.1f MB peak heap %.1f MB",
+		float64(4*p.Width*p.Slots)/(1<<20), float64(4*p.Width*p.Spilled)/(1<<20), float64(p.Peak)/(1<<20))
+}
+
+// Close removes the spill file
+func (p *VectorPool) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
@@ -0,0 +1,274 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pointlander/soda/encoding/binaryvec"
+)
+
+// FlagLatest restricts generation to the latest versions of the documents
+var FlagLatest = flag.Bool("latest", false, "only draw candidates from the latest version of each document of the corpus")
+
+// Superseded returns the ids of the documents that are superseded, documents
+// with the same title are versions of one document and every version but the
+// highest is superseded, documents without a title have no versions. Of the
+// versions with the same number the one listed last is the latest
+func Superseded(documents []Document) map[uint64]bool {
+	latest := make(map[string]int)
+	for i, document := range documents {
+		if document.Title == "" {
+			continue
+		}
+		if j, ok := latest[document.Title]; !ok || document.Version >= documents[j].Version {
+			latest[document.Title] = i
+		}
+	}
+	superseded := make(map[uint64]bool)
+	for i, document := range documents {
+		if document.Title != "" && latest[document.Title] != i {
+			superseded[uint64(i)] = true
+		}
+	}
+	if len(superseded) == 0 {
+		return nil
+	}
+	return superseded
+}
+
+// NumberVersions returns a copy of the documents where each document with a
+// title and no version is numbered one more than the highest version of its
+// title listed before it, so a document listed later is a later version
+func NumberVersions(documents []Document) []Document {
+	numbered, highest := make([]Document, len(documents)), make(map[string]int)
+	for i, document := range documents {
+		if document.Title != "" {
+			if document.Version == 0 {
+				document.Version = highest[document.Title] + 1
+			}
+			highest[document.Title] = max(highest[document.Title], document.Version)
+		}
+		numbered[i] = document
+	}
+	return numbered
+}
+
+// Documents returns the documents the database was built from
+func (m *Model) Documents() []Document {
+	if m.Metadata != nil {
+		return m.Metadata.Corpus
+	}
+	return Documents()
+}
+
+// Superseded returns the ids of the superseded documents of the database
+func (m *Model) Superseded() map[uint64]bool {
+	return Superseded(m.Documents())
+}
+
+// Exclude returns a copy of the filter that also rejects the documents
+func (f *Filter) Exclude(documents map[uint64]bool) *Filter {
+	if len(documents) == 0 {
+		return f
+	}
+	filter := Filter{Excluded: documents}
+	if f != nil {
+		filter.Documents, filter.Ranges = f.Documents, f.Ranges
+	}
+	return &filter
+}
+
+// Purge writes the database without the entries of superseded documents to
+// path, the document ids and the corpus are unchanged. It returns the number
+// of entries removed
+func (m *Model) Purge(path string) (uint64, error) {
+	superseded := m.Superseded()
+	if len(superseded) == 0 {
+		return 0, fmt.Errorf("%s has no superseded documents", m.Path)
+	}
+	for i := range m.Header {
+		total := uint64(0)
+		for _, count := range m.Header[i].Symbols {
+			total += count
+		}
+		if total != m.Sizes[i] {
+			return 0, fmt.Errorf("%s has no symbol index", m.Path)
+		}
+	}
+
+	// the entries are counted first so the header can be written with the
+	// new bucket sizes, then they are filtered again as they are written
+	symbols, sizes, removed := make([][256]uint64, len(m.Header)), make([]uint64, len(m.Header)), uint64(0)
+	for i := range m.Header {
+		if m.Sizes[i] == 0 {
+			continue
+		}
+		block, err := m.Store.Entries(i, 0, m.Sizes[i])
+		if err != nil {
+			return 0, err
+		}
+		for j := 0; j < block.Len; j++ {
+			if superseded[block.Document(j)] {
+				removed++
+				continue
+			}
+			symbols[i][block.Symbol(j)]++
+			sizes[i]++
+		}
+	}
+	if removed == 0 {
+		return 0, fmt.Errorf("%s has no entries of superseded documents", m.Path)
+	}
+
+	file, err := CreateAtomic(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	db := bufio.NewWriter(file)
+	writer := binaryvec.NewWriter(db)
+	entries := uint64(0)
+	for i := range m.Header {
+		entries += sizes[i]
+		err := writer.WriteRecord(&binaryvec.Bucket{
+			Vector: m.Header[i].Vector,
+			Count:  sizes[i],
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var counts []uint32
+	// the sub-clusters keep their centroids and lose the purged entries
+	purged := make([]*Subclusters, len(m.Header))
+	progress := NewProgress("purge", len(m.Header))
+	for i := range m.Header {
+		progress.Update(i, "")
+		var subclusters *Subclusters
+		if s := m.Header[i].Subclusters; s != nil {
+			subclusters = &Subclusters{Centroids: s.Centroids, Sizes: make([]uint64, len(s.Sizes))}
+			purged[i] = subclusters
+		}
+		if sizes[i] == 0 {
+			continue
+		}
+		block, err := m.Store.Entries(i, 0, m.Sizes[i])
+		if err != nil {
+			return 0, err
+		}
+		kept, subcluster, end := make([]binaryvec.Entry, 0, sizes[i]), 0, uint64(0)
+		for j := 0; j < block.Len; j++ {
+			if subclusters != nil {
+				for uint64(j) >= end {
+					end += m.Header[i].Subclusters.Sizes[subcluster]
+					subcluster++
+				}
+			}
+			if superseded[block.Document(j)] {
+				continue
+			}
+			if subclusters != nil {
+				subclusters.Sizes[subcluster-1]++
+			}
+			kept = append(kept, block.Entry(j))
+			if m.Counts != nil {
+				counts = append(counts, m.Counts[m.Sums[i]+uint64(j)])
+			}
+		}
+		_, err = db.Write(binaryvec.AppendBlock(nil, kept))
+		if err != nil {
+			return 0, err
+		}
+	}
+	progress.Done()
+	for i := range symbols {
+		for _, count := range symbols[i] {
+			err := writer.WriteUint64(count)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	m.Projection.Write(db)
+	if m.Metadata != nil {
+		metadata := *m.Metadata
+		metadata.Entries, metadata.Encoding = entries, binaryvec.Version
+		metadata.Created = time.Now().UTC()
+		metadata.Purged += removed
+		metadata.Write(db)
+	}
+	if m.Counts != nil {
+		err := WriteCounts(db, counts)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = m.WriteEmbedded(db)
+	if err != nil {
+		return 0, err
+	}
+	err = m.WriteTransform(db)
+	if err != nil {
+		return 0, err
+	}
+	if m.Subclusters > 0 {
+		err = WriteSubclusters(db, purged, m.Width())
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = db.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return removed, file.Commit()
+}
+
+// DBPurge removes the entries of superseded documents from the database given
+// by -db
+func DBPurge(args []string) {
+	set := flag.NewFlagSet("db purge", flag.ContinueOnError)
+	out := set.String("o", "", "path of the purged database, the database path with .purged by default")
+	if err := set.Parse(args); err != nil {
+		return
+	}
+	if set.NArg() != 0 {
+		fmt.Println("usage: -db <db> db purge [-o <purged db>]")
+		return
+	}
+	path := *out
+	if path == "" {
+		path = strings.TrimSuffix(*FlagDB, ".bin") + ".purged.bin"
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	removed, err := model.Purge(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", path)
+	fmt.Println("removed", removed, "entries of superseded documents")
+	if corpus, err := os.Open(CorpusPath(*FlagDB)); err == nil {
+		info, err := corpus.Stat()
+		if err == nil {
+			err = CopyRanges(CorpusPath(path), corpus, [][2]int64{{0, info.Size()}})
+		}
+		corpus.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
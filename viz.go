@@ -0,0 +1,704 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// VizPCA projects the centroids onto their two principal components
+	VizPCA = "pca"
+	// VizTSNE embeds the centroids in two dimensions with t-SNE
+	VizTSNE = "tsne"
+)
+
+const (
+	// VizSamples is the number of entries sampled from the database to show
+	// the data the buckets should cover
+	VizSamples = 1024
+	// VizSize is the width and height of the bucket map in pixels
+	VizSize = 800
+	// Perplexity is the t-SNE perplexity, it is lowered for few points
+	Perplexity = 30
+	// TSNEIterations is the number of t-SNE gradient steps
+	TSNEIterations = 500
+	// TSNEDimensions is the number of principal components the points are
+	// reduced to before t-SNE
+	TSNEDimensions = 50
+	// TSNETheta is the Barnes-Hut accuracy, cells smaller than theta times
+	// their distance are treated as one point
+	TSNETheta = .5
+)
+
+// CheckViz checks the reduction method of a bucket map
+func CheckViz(method string) error {
+	switch method {
+	case VizPCA, VizTSNE:
+		return nil
+	}
+	return fmt.Errorf("unknown reduction %s", method)
+}
+
+// PCA projects the points onto their first k principal components, found by
+// power iteration on the covariance matrix
+func PCA(points [][]float64, k int, rng *rand.Rand) [][]float64 {
+	n, d := len(points), len(points[0])
+	if k > d {
+		k = d
+	}
+	mean := make([]float64, d)
+	for _, point := range points {
+		for j, value := range point {
+			mean[j] += value / float64(n)
+		}
+	}
+	covariance := make([]float64, d*d)
+	centered := make([]float64, d)
+	for _, point := range points {
+		for j := range centered {
+			centered[j] = point[j] - mean[j]
+		}
+		for j, a := range centered {
+			row := covariance[j*d : (j+1)*d]
+			for l, b := range centered {
+				row[l] += a * b
+			}
+		}
+	}
+	components := make([][]float64, k)
+	for c := range components {
+		component := make([]float64, d)
+		for j := range component {
+			component[j] = rng.NormFloat64()
+		}
+		next := make([]float64, d)
+		for iteration := 0; iteration < 128; iteration++ {
+			for j := range next {
+				sum := 0.0
+				for l, value := range covariance[j*d : (j+1)*d] {
+					sum += value * component[l]
+				}
+				next[j] = sum
+			}
+			// each component is kept orthogonal to the ones before it
+			for _, previous := range components[:c] {
+				dot := 0.0
+				for j := range next {
+					dot += next[j] * previous[j]
+				}
+				for j := range next {
+					next[j] -= dot * previous[j]
+				}
+			}
+			norm := 0.0
+			for _, value := range next {
+				norm += value * value
+			}
+			norm = math.Sqrt(norm)
+			if norm == 0 {
+				break
+			}
+			for j := range next {
+				component[j] = next[j] / norm
+			}
+		}
+		components[c] = component
+	}
+	projected := make([][]float64, n)
+	for i, point := range points {
+		projected[i] = make([]float64, k)
+		for c, component := range components {
+			for j, value := range point {
+				projected[i][c] += (value - mean[j]) * component[j]
+			}
+		}
+	}
+	return projected
+}
+
+// parallel calls fn with the rows [0, n) split across the cpus
+func parallel(n int, fn func(i int)) {
+	var wait sync.WaitGroup
+	cpus := runtime.NumCPU()
+	for c := 0; c < cpus; c++ {
+		wait.Add(1)
+		go func(c int) {
+			defer wait.Done()
+			for i := c; i < n; i += cpus {
+				fn(i)
+			}
+		}(c)
+	}
+	wait.Wait()
+}
+
+// neighbor is a point near another point and their squared distance
+type neighbor struct {
+	Index    int
+	Distance float64
+}
+
+// Neighborhood returns the k nearest points to each point
+func Neighborhood(points [][]float64, k int) [][]neighbor {
+	neighborhoods := make([][]neighbor, len(points))
+	parallel(len(points), func(i int) {
+		nearest, worst := make([]neighbor, 0, k), 0
+		for j, point := range points {
+			if j == i {
+				continue
+			}
+			distance := 0.0
+			for l, value := range point {
+				d := value - points[i][l]
+				distance += d * d
+			}
+			if len(nearest) < k {
+				nearest = append(nearest, neighbor{Index: j, Distance: distance})
+			} else if distance < nearest[worst].Distance {
+				nearest[worst] = neighbor{Index: j, Distance: distance}
+			} else {
+				continue
+			}
+			for l := range nearest {
+				if nearest[l].Distance > nearest[worst].Distance {
+					worst = l
+				}
+			}
+		}
+		neighborhoods[i] = nearest
+	})
+	return neighborhoods
+}
+
+// affinity is the t-SNE input similarity of a point to another point
+type affinity struct {
+	Index int
+	P     float64
+}
+
+// Affinities are the symmetric t-SNE input similarities of pairs of points
+// that are neighbors, each pair is listed under both points in order
+type Affinities [][]affinity
+
+// NewAffinities computes the affinities of the points with the precision of
+// each point bisected to give its neighborhood the perplexity
+func NewAffinities(points [][]float64, perplexity float64) Affinities {
+	n := len(points)
+	neighborhoods := Neighborhood(points, int(math.Min(3*perplexity, float64(n-1))))
+	conditional := make([][]float64, n)
+	parallel(n, func(i int) {
+		neighbors := neighborhoods[i]
+		row := make([]float64, len(neighbors))
+		beta, low, high := 1.0, 0.0, math.Inf(1)
+		// the distances are relative to the nearest so the exponentials don't
+		// underflow
+		nearest := math.Inf(1)
+		for _, neighbor := range neighbors {
+			nearest = math.Min(nearest, neighbor.Distance)
+		}
+		for iteration := 0; iteration < 64; iteration++ {
+			sum, weighted := 0.0, 0.0
+			for j, neighbor := range neighbors {
+				row[j] = math.Exp(-beta * (neighbor.Distance - nearest))
+				sum += row[j]
+				weighted += row[j] * (neighbor.Distance - nearest)
+			}
+			entropy := math.Log(sum) + beta*weighted/sum
+			for j := range row {
+				row[j] /= sum
+			}
+			difference := entropy - math.Log(perplexity)
+			if math.Abs(difference) < 1e-5 {
+				break
+			}
+			if difference > 0 {
+				low = beta
+				if math.IsInf(high, 1) {
+					beta *= 2
+				} else {
+					beta = (beta + high) / 2
+				}
+			} else {
+				high = beta
+				beta = (beta + low) / 2
+			}
+		}
+		conditional[i] = row
+	})
+	pairs := make(map[[2]int]float64)
+	for i, neighbors := range neighborhoods {
+		for j, neighbor := range neighbors {
+			a, b := i, neighbor.Index
+			if a > b {
+				a, b = b, a
+			}
+			pairs[[2]int{a, b}] += conditional[i][j] / (2 * float64(n))
+		}
+	}
+	affinities := make(Affinities, n)
+	for pair, p := range pairs {
+		affinities[pair[0]] = append(affinities[pair[0]], affinity{Index: pair[1], P: p})
+		affinities[pair[1]] = append(affinities[pair[1]], affinity{Index: pair[0], P: p})
+	}
+	for _, row := range affinities {
+		sort.Slice(row, func(i, j int) bool {
+			return row[i].Index < row[j].Index
+		})
+	}
+	return affinities
+}
+
+// quadtree is a node of the Barnes-Hut tree of the embedded points
+type quadtree struct {
+	// Center and Size are the center and half width of the cell
+	Center [2]float64
+	Size   float64
+	// Mass is the center of mass of the Count points in the cell
+	Mass     [2]float64
+	Count    int
+	Point    int
+	Children *[4]quadtree
+}
+
+// insert adds point i at y to the cell
+func (q *quadtree) insert(y [][2]float64, i, depth int) {
+	q.Mass[0] = (q.Mass[0]*float64(q.Count) + y[i][0]) / float64(q.Count+1)
+	q.Mass[1] = (q.Mass[1]*float64(q.Count) + y[i][1]) / float64(q.Count+1)
+	q.Count++
+	if q.Count == 1 {
+		q.Point = i
+		return
+	}
+	// coincident points stay in one leaf
+	if depth > 48 {
+		return
+	}
+	if q.Children == nil {
+		q.Children = new([4]quadtree)
+		for c := range q.Children {
+			child := &q.Children[c]
+			child.Size = q.Size / 2
+			child.Center = q.Center
+			if c&1 == 0 {
+				child.Center[0] -= child.Size
+			} else {
+				child.Center[0] += child.Size
+			}
+			if c&2 == 0 {
+				child.Center[1] -= child.Size
+			} else {
+				child.Center[1] += child.Size
+			}
+		}
+		q.child(y[q.Point]).insert(y, q.Point, depth+1)
+	}
+	q.child(y[i]).insert(y, i, depth+1)
+}
+
+// child is the child cell holding the position
+func (q *quadtree) child(position [2]float64) *quadtree {
+	c := 0
+	if position[0] > q.Center[0] {
+		c |= 1
+	}
+	if position[1] > q.Center[1] {
+		c |= 2
+	}
+	return &q.Children[c]
+}
+
+// repulse accumulates the repulsive force on point i and its contribution
+// to the normalization of the similarities of the embedding
+func (q *quadtree) repulse(y [][2]float64, i int, force *[2]float64, sum *float64) {
+	if q.Count == 0 || (q.Children == nil && q.Count == 1 && q.Point == i) {
+		return
+	}
+	dx, dy := y[i][0]-q.Mass[0], y[i][1]-q.Mass[1]
+	distance := dx*dx + dy*dy
+	if q.Children == nil || 4*q.Size*q.Size < TSNETheta*TSNETheta*distance {
+		count := float64(q.Count)
+		if q.Children == nil && q.Point == i {
+			// a leaf of coincident points holds point i
+			count--
+		}
+		similarity := 1 / (1 + distance)
+		*sum += count * similarity
+		force[0] += count * similarity * similarity * dx
+		force[1] += count * similarity * similarity * dy
+		return
+	}
+	for c := range q.Children {
+		q.Children[c].repulse(y, i, force, sum)
+	}
+}
+
+// TSNE embeds the points in two dimensions with Barnes-Hut t-SNE, the points
+// are reduced to TSNEDimensions with PCA first and the embedding starts from
+// their first two principal components
+func TSNE(points [][]float64, rng *rand.Rand) [][2]float64 {
+	n := len(points)
+	reduced := PCA(points, TSNEDimensions, rng)
+	y := make([][2]float64, n)
+	for i, point := range reduced {
+		y[i] = [2]float64{point[0], point[1]}
+	}
+	if n < 4 {
+		return y
+	}
+	affinities := NewAffinities(reduced, math.Min(Perplexity, float64(n-1)/3))
+	std := 0.0
+	for _, point := range y {
+		std += point[0]*point[0] + point[1]*point[1]
+	}
+	std = math.Sqrt(std / float64(2*n))
+	for i := range y {
+		for c := range y[i] {
+			if std > 0 {
+				y[i][c] *= 1e-4 / std
+			} else {
+				y[i][c] = 1e-4 * rng.NormFloat64()
+			}
+		}
+	}
+	velocity, gains := make([][2]float64, n), make([][2]float64, n)
+	for i := range gains {
+		gains[i] = [2]float64{1, 1}
+	}
+	attractive, repulsive, sums := make([][2]float64, n), make([][2]float64, n), make([]float64, n)
+	for iteration := 0; iteration < TSNEIterations; iteration++ {
+		exaggeration, momentum := 1.0, .8
+		if iteration < 100 {
+			exaggeration, momentum = 12, .5
+		}
+		min, max := y[0], y[0]
+		for _, point := range y {
+			for c := range point {
+				min[c], max[c] = math.Min(min[c], point[c]), math.Max(max[c], point[c])
+			}
+		}
+		root := quadtree{
+			Center: [2]float64{(min[0] + max[0]) / 2, (min[1] + max[1]) / 2},
+			Size:   math.Max(max[0]-min[0], max[1]-min[1])/2 + 1e-9,
+		}
+		for i := range y {
+			root.insert(y, i, 0)
+		}
+		parallel(n, func(i int) {
+			var force [2]float64
+			for _, affinity := range affinities[i] {
+				dx, dy := y[i][0]-y[affinity.Index][0], y[i][1]-y[affinity.Index][1]
+				weight := affinity.P / (1 + dx*dx + dy*dy)
+				force[0] += weight * dx
+				force[1] += weight * dy
+			}
+			attractive[i] = force
+			repulsive[i], sums[i] = [2]float64{}, 0
+			root.repulse(y, i, &repulsive[i], &sums[i])
+		})
+		total := 0.0
+		for _, sum := range sums {
+			total += sum
+		}
+		for i := range y {
+			for c := range y[i] {
+				gradient := 4 * (exaggeration*attractive[i][c] - repulsive[i][c]/total)
+				if (gradient > 0) != (velocity[i][c] > 0) {
+					gains[i][c] += .2
+				} else {
+					gains[i][c] = math.Max(gains[i][c]*.8, .01)
+				}
+				velocity[i][c] = momentum*velocity[i][c] - 200*gains[i][c]*gradient
+				y[i][c] += velocity[i][c]
+			}
+		}
+	}
+	return y
+}
+
+// BucketPoint is a bucket of a bucket map
+type BucketPoint struct {
+	Bucket int `json:"bucket"`
+	// Entries is the number of entries of the bucket
+	Entries uint64 `json:"entries"`
+	// Probes and Wins are the probe statistics of the bucket on a server
+	Probes uint32 `json:"probes"`
+	Wins   uint32 `json:"wins"`
+	// X and Y are the position of the centroid in the map
+	X        float64   `json:"x"`
+	Y        float64   `json:"y"`
+	Centroid []float32 `json:"centroid"`
+}
+
+// SamplePoint is an entry of the database sampled for a bucket map
+type SamplePoint struct {
+	Bucket int     `json:"bucket"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+}
+
+// BucketMap is a two dimensional map of the bucket centroids of a database
+// with a sample of its entries, the positions are scaled to [0, VizSize]
+type BucketMap struct {
+	Method  string        `json:"method"`
+	Buckets []BucketPoint `json:"buckets"`
+	Samples []SamplePoint `json:"samples"`
+	// Empty is the number of buckets without entries
+	Empty int `json:"empty"`
+}
+
+// BucketMap reduces the bucket centroids and samples entries of the database
+// to two dimensions with method, the entries are sampled with a fixed seed
+func (m *Model) BucketMap(method string, samples int) (*BucketMap, error) {
+	err := CheckViz(method)
+	if err != nil {
+		return nil, err
+	}
+	width, rng := m.Width(), rand.New(rand.NewSource(1))
+	bucketMap := BucketMap{Method: method, Buckets: make([]BucketPoint, len(m.Header))}
+	var points [][]float64
+	for i := range m.Header {
+		point := make([]float64, width)
+		for j, value := range m.Header[i].Vector[:width] {
+			point[j] = float64(value)
+		}
+		points = append(points, point)
+		bucketMap.Buckets[i] = BucketPoint{
+			Bucket:   i,
+			Entries:  m.Sizes[i],
+			Centroid: append([]float32(nil), m.Header[i].Vector[:width]...),
+		}
+		if m.Sizes[i] == 0 {
+			bucketMap.Empty++
+		}
+	}
+	// the entries of a sharded database aren't local
+	total := uint64(0)
+	for _, size := range m.Sizes {
+		total += size
+	}
+	if m.Shards == nil && total > 0 {
+		positions := make([]uint64, samples)
+		for i := range positions {
+			positions[i] = uint64(rng.Int63n(int64(total)))
+		}
+		sort.Slice(positions, func(i, j int) bool {
+			return positions[i] < positions[j]
+		})
+		vector := make([]float32, width)
+		for _, position := range positions {
+			bucket := sort.Search(len(m.Sums), func(i int) bool {
+				return m.Sums[i]+m.Sizes[i] > position
+			})
+			block, err := m.Store.Entries(bucket, position-m.Sums[bucket], position-m.Sums[bucket]+1)
+			if err != nil {
+				return nil, err
+			}
+			block.Vector(0, vector)
+			point := make([]float64, width)
+			for j, value := range vector {
+				point[j] = float64(value)
+			}
+			points = append(points, point)
+			bucketMap.Samples = append(bucketMap.Samples, SamplePoint{Bucket: bucket})
+		}
+	}
+
+	var reduced [][2]float64
+	switch method {
+	case VizPCA:
+		for _, point := range PCA(points, 2, rng) {
+			reduced = append(reduced, [2]float64{point[0], point[1]})
+		}
+	case VizTSNE:
+		reduced = TSNE(points, rng)
+	}
+	min, max := [2]float64{math.Inf(1), math.Inf(1)}, [2]float64{math.Inf(-1), math.Inf(-1)}
+	for _, point := range reduced {
+		for c, value := range point {
+			min[c], max[c] = math.Min(min[c], value), math.Max(max[c], value)
+		}
+	}
+	scale := func(value float64, c int) float64 {
+		if max[c] == min[c] {
+			return VizSize / 2
+		}
+		return VizSize * (value - min[c]) / (max[c] - min[c])
+	}
+	for i, point := range reduced {
+		x, y := scale(point[0], 0), scale(point[1], 1)
+		if i < len(m.Header) {
+			bucketMap.Buckets[i].X, bucketMap.Buckets[i].Y = x, y
+		} else {
+			bucketMap.Samples[i-len(m.Header)].X, bucketMap.Samples[i-len(m.Header)].Y = x, y
+		}
+	}
+	return &bucketMap, nil
+}
+
+// Radius is the radius of the circle of a bucket in the map, its area is
+// proportional to the number of entries
+func (b BucketPoint) Radius(max uint64) float64 {
+	if b.Entries == 0 || max == 0 {
+		return 3
+	}
+	return 3 + 12*math.Sqrt(float64(b.Entries)/float64(max))
+}
+
+// BucketMapTemplate renders a bucket map as svg
+var BucketMapTemplate = template.Must(template.New("buckets").Parse(`<!DOCTYPE html>
+<html>
+ <head>
+  <meta charset="UTF-8">
+  <title>Soda Buckets</title>
+ </head>
+ <body>
+  <p>{{len .Map.Buckets}} buckets, {{.Map.Empty}} empty, {{len .Map.Samples}} sampled entries, reduced with {{.Map.Method}}.
+  Circles are bucket centroids sized by their entries, hollow circles are empty buckets, and gray dots are sampled entries.</p>
+  <svg width="{{.Size}}" height="{{.Size}}" viewBox="-20 -20 {{.Size}} {{.Size}}">
+   {{range .Map.Samples}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="1.5" fill="gray" fill-opacity="0.5"/>
+   {{end}}
+   {{range .Map.Buckets}}<circle cx="{{printf "%.1f" .X}}" cy="{{printf "%.1f" .Y}}" r="{{printf "%.1f" (.Radius $.Max)}}"
+    {{if .Entries}}fill="steelblue" fill-opacity="0.6"{{else}}fill="none" stroke="crimson"{{end}}><title>bucket {{.Bucket}}: {{.Entries}} entries, {{.Probes}} probes, {{.Wins}} wins</title></circle>
+   {{end}}
+  </svg>
+ </body>
+</html>
+`))
+
+// Write writes the bucket map as html, or as json if format is json
+func (b *BucketMap) Write(out io.Writer, format string) error {
+	if format == "json" {
+		return json.NewEncoder(out).Encode(b)
+	}
+	max := uint64(0)
+	for _, bucket := range b.Buckets {
+		if bucket.Entries > max {
+			max = bucket.Entries
+		}
+	}
+	return BucketMapTemplate.Execute(out, struct {
+		Map  *BucketMap
+		Max  uint64
+		Size int
+	}{b, max, VizSize + 40})
+}
+
+// BucketMaps serves the bucket maps of a model, a map is computed once for
+// each method and the probe statistics are filled in when it is served
+type BucketMaps struct {
+	sync.Mutex
+	Model *Model
+	Maps  map[string]*BucketMap
+}
+
+// NewBucketMaps makes the bucket maps of a model
+func NewBucketMaps(model *Model) *BucketMaps {
+	return &BucketMaps{
+		Model: model,
+		Maps:  make(map[string]*BucketMap),
+	}
+}
+
+// ServeHTTP serves the bucket map with the reduction given by method, pca by
+// default, as html or as json if the format is json
+func (b *BucketMaps) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	method := request.FormValue("method")
+	if method == "" {
+		method = VizPCA
+	}
+	if err := CheckViz(method); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Lock()
+	bucketMap, ok := b.Maps[method]
+	if !ok {
+		var err error
+		bucketMap, err = b.Model.BucketMap(method, VizSamples)
+		if err != nil {
+			b.Unlock()
+			http.Error(response, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.Maps[method] = bucketMap
+	}
+	b.Unlock()
+	served := *bucketMap
+	served.Buckets = append([]BucketPoint(nil), bucketMap.Buckets...)
+	if stats := b.Model.Stats; stats != nil {
+		stats.Lock()
+		for i := range served.Buckets {
+			served.Buckets[i].Probes, served.Buckets[i].Wins = stats.Probes[i], stats.Wins[i]
+		}
+		stats.Unlock()
+	}
+	format := request.FormValue("format")
+	if format == "json" {
+		response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	} else {
+		response.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	served.Write(response, format)
+}
+
+// DBViz exports the bucket map of the database given by -db
+func DBViz(args []string) {
+	set := flag.NewFlagSet("db viz", flag.ContinueOnError)
+	method := set.String("method", VizPCA, "reduction of the centroids to two dimensions: pca or tsne")
+	samples := set.Int("samples", VizSamples, "number of entries sampled to show the data the buckets should cover")
+	out := set.String("o", "", "path of the map, json if it ends in .json and html otherwise")
+	if err := set.Parse(args); err != nil {
+		return
+	}
+	if *out == "" || *samples < 0 || set.NArg() != 0 {
+		fmt.Println("usage: -db <db> db viz -o <buckets.html|buckets.json> [-method pca|tsne] [-samples n]")
+		return
+	}
+	if err := CheckViz(*method); err != nil {
+		fmt.Println(err)
+		return
+	}
+	model, err := LoadModel(*FlagDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer model.Close()
+	bucketMap, err := model.BucketMap(*method, *samples)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	format := "html"
+	if strings.HasSuffix(*out, ".json") {
+		format = "json"
+	}
+	file, err := os.Create(*out)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer file.Close()
+	err = bucketMap.Write(file, format)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("wrote", *out)
+	fmt.Println("buckets", len(bucketMap.Buckets), "empty", bucketMap.Empty, "samples", len(bucketMap.Samples))
+}
@@ -0,0 +1,93 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	// FlagVocabulary is the number of previous steps whose top candidates
+	// are the symbols that can be generated
+	FlagVocabulary = flag.Int("vocabulary", 0, "restrict the symbol that starts each generated rune to the symbols of the top -vocabulary-k candidates of the step and of the vocabulary steps before it, so generation only emits symbols the corpus has after similar contexts, 0 doesn't restrict them")
+	// FlagVocabularyK is the number of top candidates of each step whose
+	// symbols are observed
+	FlagVocabularyK = flag.Int("vocabulary-k", 8, "number of the highest scoring candidates of each step whose symbols are observed for -vocabulary")
+)
+
+// MaxVocabulary is the largest number of steps and candidates of a vocabulary
+const MaxVocabulary = 1024
+
+// Vocabulary restricts the generated symbols to the symbols observed among
+// the top K candidates of the step and the Steps steps before it, the top
+// candidates of the step are always allowed
+type Vocabulary struct {
+	Steps int
+	K     int
+}
+
+// Validate checks the vocabulary parameters
+func (v Vocabulary) Validate() error {
+	if v.Steps < 0 || v.Steps > MaxVocabulary {
+		return fmt.Errorf("vocabulary must be between 0 and %d", MaxVocabulary)
+	}
+	if v.K <= 0 || v.K > MaxVocabulary {
+		return fmt.Errorf("vocabulary k must be between 1 and %d", MaxVocabulary)
+	}
+	return nil
+}
+
+// Observed are the symbols of the top candidates of the recent steps of a
+// generation
+type Observed struct {
+	Vocabulary
+	// steps are the symbols of each recent step and counts the number of
+	// recent steps each symbol is in
+	steps  [][]uint8
+	counts [256]int
+}
+
+// Observer returns the observed symbols of a generation, nil if the symbols
+// aren't restricted
+func (v Vocabulary) Observer() *Observed {
+	if v.Steps == 0 {
+		return nil
+	}
+	return &Observed{Vocabulary: v}
+}
+
+// Observe records the symbols of the top K of the sorted candidates of a step
+// and forgets the step Steps+1 steps before it
+func (o *Observed) Observe(candidates []Candidate) {
+	var seen [256]bool
+	symbols := []uint8{}
+	for _, candidate := range candidates[:min(o.K, len(candidates))] {
+		if !seen[candidate.Symbol] {
+			seen[candidate.Symbol] = true
+			symbols = append(symbols, candidate.Symbol)
+			o.counts[candidate.Symbol]++
+		}
+	}
+	o.steps = append(o.steps, symbols)
+	if len(o.steps) > o.Steps+1 {
+		for _, symbol := range o.steps[0] {
+			o.counts[symbol]--
+		}
+		o.steps = o.steps[1:]
+	}
+}
+
+// Restrict removes the candidates with symbols that weren't observed, the
+// candidates stay sorted
+func (o *Observed) Restrict(candidates []Candidate) []Candidate {
+	kept := candidates[:0]
+	for _, candidate := range candidates {
+		if o.counts[candidate.Symbol] > 0 {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// candidates are sorted candidates of the symbols with descending scores
+func candidates(symbols string) []Candidate {
+	c := make([]Candidate, len(symbols))
+	for i := range symbols {
+		c[i] = Candidate{
+			Output: Output{Index: uint64(i), Symbol: symbols[i]},
+			Score:  1 - float32(i)/float32(len(symbols)),
+		}
+	}
+	SortCandidates(c)
+	return c
+}
+
+// symbols are the symbols of the candidates in order
+func symbols(c []Candidate) string {
+	s := make([]byte, len(c))
+	for i := range c {
+		s[i] = c[i].Symbol
+	}
+	return string(s)
+}
+
+func TestVocabularyObserved(t *testing.T) {
+	if (Vocabulary{Steps: 0, K: 8}).Observer() != nil {
+		t.Fatal("a vocabulary of 0 steps shouldn't restrict the symbols")
+	}
+	observed := Vocabulary{Steps: 1, K: 2}.Observer()
+	// the symbols outside of the top k of the step are dropped
+	observed.Observe(candidates("abcd"))
+	if s := symbols(observed.Restrict(candidates("dcba"))); s != "ba" {
+		t.Fatalf("only the top 2 symbols should be kept not %q", s)
+	}
+	// the step before is still observed
+	observed.Observe(candidates("cdef"))
+	if s := symbols(observed.Restrict(candidates("fedcbax"))); s != "dcba" {
+		t.Fatalf("the symbols of the last 2 steps should be kept not %q", s)
+	}
+	// the first step is forgotten, a symbol repeated in a step is forgotten
+	// with it
+	observed.Observe(candidates("eexy"))
+	if s := symbols(observed.Restrict(candidates("abcdefx"))); s != "cde" {
+		t.Fatalf("the symbols of the first step should be forgotten not %q", s)
+	}
+	observed.Observe(candidates("xy"))
+	observed.Observe(candidates("xy"))
+	if s := symbols(observed.Restrict(candidates("abcdexy"))); s != "xy" {
+		t.Fatalf("only the symbols of the last 2 steps should be kept not %q", s)
+	}
+}
+
+func TestVocabularyRestrictSorted(t *testing.T) {
+	observed := Vocabulary{Steps: 2, K: 3}.Observer()
+	for _, step := range []string{"aceg", "bdfh", "acij"} {
+		observed.Observe(candidates(step))
+	}
+	restricted := observed.Restrict(candidates("jihgfedcba"))
+	if s := symbols(restricted); s != "ifedcba" {
+		t.Fatalf("the candidates of the observed symbols should be kept in order not %q", s)
+	}
+	if !slices.IsSortedFunc(restricted, func(a, b Candidate) int {
+		switch {
+		case a.Before(b):
+			return -1
+		case b.Before(a):
+			return 1
+		}
+		return 0
+	}) {
+		t.Fatal("the restricted candidates should stay sorted")
+	}
+}
+
+func TestVocabularyValidate(t *testing.T) {
+	invalid := []Vocabulary{
+		{Steps: -1, K: 8},
+		{Steps: MaxVocabulary + 1, K: 8},
+		{Steps: 4, K: 0},
+		{Steps: 4, K: MaxVocabulary + 1},
+	}
+	for _, vocabulary := range invalid {
+		if vocabulary.Validate() == nil {
+			t.Fatalf("%+v should be invalid", vocabulary)
+		}
+	}
+	if err := (Vocabulary{Steps: 0, K: 8}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
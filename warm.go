@@ -0,0 +1,90 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"unsafe"
+)
+
+var (
+	// FlagLazy starts the server before the model is loaded
+	FlagLazy = flag.Bool("lazy", false, "start serving before the database is loaded, the database is loaded and its entries read into the page cache in the background and requests get 503 until then")
+	// FlagMlock locks the header in memory
+	FlagMlock = flag.Bool("mlock", false, "lock the header of the database in memory so it is never swapped out")
+)
+
+// WarmBuffer is the size of the reads that warm the entries
+const WarmBuffer = 1 << 20
+
+// Warm reads the entries of the database so they are in the page cache when
+// the first queries arrive
+func (m *Model) Warm() error {
+	size := EntriesEnd(m.FileSizes, m.FileSums, m.Settings) - Offset
+	progress := NewProgress("warm", int(size/WarmBuffer)+1)
+	section, buffer := io.NewSectionReader(m.DB, Offset, size), make([]byte, WarmBuffer)
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(section, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		progress.Update(i+1, "")
+	}
+	progress.Done()
+	return nil
+}
+
+// Mlock locks the header of the model in memory
+func (m *Model) Mlock() error {
+	if len(m.Header) == 0 {
+		return nil
+	}
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&m.Header[0])), len(m.Header)*int(unsafe.Sizeof(m.Header[0])))
+	err := mlock(data)
+	if err != nil {
+		return fmt.Errorf("mlock of the header failed: %w", err)
+	}
+	return nil
+}
+
+// Gate serves the liveness and readiness probes and gates the other requests
+// until the handler is opened
+type Gate struct {
+	Handler atomic.Pointer[http.Handler]
+}
+
+// Open opens the gate to handler
+func (g *Gate) Open(handler http.Handler) {
+	g.Handler.Store(&handler)
+}
+
+// ServeHTTP serves /healthz and /readyz and the requests of an open gate
+func (g *Gate) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	handler := g.Handler.Load()
+	switch request.URL.Path {
+	case "/healthz":
+		response.Write([]byte("ok\n"))
+		return
+	case "/readyz":
+		if handler == nil {
+			http.Error(response, "loading", http.StatusServiceUnavailable)
+			return
+		}
+		response.Write([]byte("ok\n"))
+		return
+	}
+	if handler == nil {
+		response.Header().Set("Retry-After", "5")
+		http.Error(response, "the database is loading", http.StatusServiceUnavailable)
+		return
+	}
+	(*handler).ServeHTTP(response, request)
+}
@@ -0,0 +1,81 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build js && wasm
+// +build js,wasm
+
+// Build the browser target with:
+//
+//	GOOS=js GOARCH=wasm go build -o soda.wasm
+//	cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" .
+//
+// and load it with assets/soda.js
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"syscall/js"
+)
+
+func init() {
+	Entry = Browser
+}
+
+// NewHeader is not supported in the browser
+func NewHeader(pass func(fn func(data []byte)), length int, samples []int, settings Settings, transform *Transform) (Header, *Transform) {
+	panic("building a header is not supported in the browser")
+}
+
+// Browser exposes the model to javascript as the global soda object with the
+// functions load(Uint8Array) and generate(query, options) -> Promise
+func Browser() {
+	var model *Model
+	soda := js.Global().Get("Object").New()
+	soda.Set("load", js.FuncOf(func(this js.Value, args []js.Value) any {
+		data := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(data, args[0])
+		model = ReadModel(bytes.NewReader(data))
+		return nil
+	}))
+	soda.Set("generate", js.FuncOf(func(this js.Value, args []js.Value) any {
+		request := Request{Query: args[0].String()}
+		if len(args) > 1 && args[1].Type() == js.TypeObject {
+			options := js.Global().Get("JSON").Call("stringify", args[1]).String()
+			err := json.Unmarshal([]byte(options), &request)
+			if err != nil {
+				return js.Global().Get("Promise").Call("reject", err.Error())
+			}
+		}
+		// the executor is released once the promise is settled
+		var handler js.Func
+		handler = js.FuncOf(func(this js.Value, args []js.Value) any {
+			resolve, reject := args[0], args[1]
+			go func() {
+				defer handler.Release()
+				if model == nil {
+					reject.Invoke("the database has not been loaded")
+					return
+				}
+				options, err := request.Options()
+				if err != nil {
+					reject.Invoke(err.Error())
+					return
+				}
+				searches := model.Soda([]byte(request.Query), options)
+				data, err := json.Marshal(searches[0].Result)
+				if err != nil {
+					reject.Invoke(err.Error())
+					return
+				}
+				resolve.Invoke(string(data))
+			}()
+			return nil
+		})
+		return js.Global().Get("Promise").New(handler)
+	}))
+	js.Global().Set("soda", soda)
+	select {}
+}
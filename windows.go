@@ -0,0 +1,230 @@
+// Copyright 2025 The Soda Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FlagWindows are the histogram windows of a build
+var FlagWindows = flag.String("windows", "", "comma separated windows of the histograms of the histogram mixer of a build such as those bench windows writes to the -config file, empty for 1,2,4,8,16,32,64,128")
+
+// MaxWindow is the largest window of a histogram
+const MaxWindow = len(Histogram{}.Buffer)
+
+// ParseWindows parses comma separated histogram windows, empty is the
+// default windows
+func ParseWindows(spec string) ([]int, error) {
+	var windows []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		window, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %s", part)
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	return windows, CheckWindows(windows)
+}
+
+// CheckWindows checks that the windows are ascending and between 1 and
+// MaxWindow
+func CheckWindows(windows []int) error {
+	for i, window := range windows {
+		if window < 1 || window > MaxWindow {
+			return fmt.Errorf("window %d must be between 1 and %d", window, MaxWindow)
+		}
+		if i > 0 && window <= windows[i-1] {
+			return fmt.Errorf("the windows must be ascending without repeats")
+		}
+	}
+	return nil
+}
+
+// FormatWindows formats windows as they are parsed by ParseWindows
+func FormatWindows(windows []int) string {
+	parts := make([]string, len(windows))
+	for i, window := range windows {
+		parts[i] = strconv.Itoa(window)
+	}
+	return strings.Join(parts, ",")
+}
+
+// WindowCorpus, WindowIndexed, and WindowHoldouts are the number of symbols
+// at the start of the corpus the windows are evaluated on, and the number of
+// its positions that are indexed and held out
+const (
+	WindowCorpus   = 1 << 20
+	WindowIndexed  = 1 << 13
+	WindowHoldouts = 1 << 9
+)
+
+// WindowSample is the corpus and positions the windows are evaluated on
+type WindowSample struct {
+	Data []byte
+	// Indexed and Holdouts are disjoint sorted positions of the data
+	Indexed, Holdouts []int
+}
+
+// NewWindowSample samples the indexed and held out positions of data with a
+// fixed seed, the first EvalLength positions have too little context
+func NewWindowSample(data []byte) (*WindowSample, error) {
+	if len(data) > WindowCorpus {
+		data = data[:WindowCorpus]
+	}
+	if len(data) < EvalLength+WindowHoldouts+2 {
+		return nil, fmt.Errorf("the corpus is too small to evaluate windows on")
+	}
+	rng, positions := rand.New(rand.NewSource(1)), len(data)-EvalLength
+	perm := rng.Perm(positions)
+	holdouts := perm[:WindowHoldouts]
+	indexed := perm[WindowHoldouts:min(len(perm), WindowHoldouts+WindowIndexed)]
+	for _, positions := range [][]int{holdouts, indexed} {
+		for i := range positions {
+			positions[i] += EvalLength
+		}
+		sort.Ints(positions)
+	}
+	return &WindowSample{Data: data, Indexed: indexed, Holdouts: holdouts}, nil
+}
+
+// HitRate is the fraction of the held out positions whose nearest indexed
+// position by the cosine of their vectors is followed by the same symbol, the
+// vectors are mixed with the windows and the rest of the settings
+func (w *WindowSample) HitRate(windows []int, settings Settings) float64 {
+	settings.Windows = windows
+	width := settings.Width()
+	m, mixed := settings.NewMixer(), [256]float32{}
+	indexed, holdouts := make([]float32, 0, len(w.Indexed)*width), make([]float32, 0, len(w.Holdouts)*width)
+	vector, i, h := make([]float32, width), 0, 0
+	for position, symbol := range w.Data {
+		isIndexed := i < len(w.Indexed) && w.Indexed[i] == position
+		isHoldout := h < len(w.Holdouts) && w.Holdouts[h] == position
+		if isIndexed || isHoldout {
+			m.Mix(&mixed)
+			settings.Project(vector, mixed[:])
+			if isIndexed {
+				indexed, i = append(indexed, vector...), i+1
+			} else {
+				holdouts, h = append(holdouts, vector...), h+1
+			}
+		}
+		m.Add(symbol)
+	}
+	hits, scores := 0, make([]float32, len(w.Indexed))
+	for j, position := range w.Holdouts {
+		CSBatch(scores, indexed, holdouts[j*width:(j+1)*width])
+		best := 0
+		for k, score := range scores {
+			if score > scores[best] {
+				best = k
+			}
+		}
+		if w.Data[w.Indexed[best]] == w.Data[position] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(w.Holdouts))
+}
+
+// WindowStep is a step of the ablation of the windows
+type WindowStep struct {
+	Windows []int
+	// Removed is the window removed by the step, 0 for the initial windows
+	Removed int
+	HitRate float64
+}
+
+// Ablate removes the windows one at a time while the hit rate stays within
+// tolerance of the hit rate of all of them, each step removes the window
+// whose removal keeps the highest hit rate. It returns the steps taken
+func (w *WindowSample) Ablate(windows []int, settings Settings, tolerance float64, progress func(step WindowStep)) []WindowStep {
+	current := append([]int(nil), windows...)
+	steps := []WindowStep{{Windows: current, HitRate: w.HitRate(current, settings)}}
+	progress(steps[0])
+	for len(current) > 1 {
+		best := WindowStep{HitRate: -1}
+		for i, window := range current {
+			without := append(append([]int(nil), current[:i]...), current[i+1:]...)
+			if rate := w.HitRate(without, settings); rate > best.HitRate {
+				best = WindowStep{Windows: without, Removed: window, HitRate: rate}
+			}
+		}
+		if best.HitRate < steps[0].HitRate-tolerance {
+			break
+		}
+		current, steps = best.Windows, append(steps, best)
+		progress(best)
+	}
+	return steps
+}
+
+// BenchWindows evaluates which histogram windows contribute to retrieval on
+// the corpus of the build flags by ablation and writes the windows to build
+// with to the -config file
+func BenchWindows(args []string) {
+	set := flag.NewFlagSet("bench windows", flag.ContinueOnError)
+	tolerance := set.Float64("tolerance", 0.005, "hit rate below the hit rate of every window the ablation can lose")
+	if ParseCommand(set, args) != nil {
+		return
+	}
+	if *FlagConfig == "" {
+		fmt.Println("set -config to the config file the windows are written to")
+		return
+	}
+	settings, err := BuildSettings()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if settings.Mixer != "" {
+		fmt.Println("the windows are those of the histogram mixer")
+		return
+	}
+	windows := settings.Windows
+	if len(windows) == 0 {
+		windows = DefaultWindows
+	}
+	input, _ := LoadCorpus(Documents(), settings.Redact, settings.Preprocess)
+	if settings.Merges > 0 {
+		settings.Alphabet = LearnAlphabet(input, settings.Merges)
+	}
+	if settings.Fold > 0 {
+		settings.Folding = LearnFolding(input, settings.Fold)
+	}
+	if settings.Dimensions > 0 {
+		settings.Projection = NewProjection(settings.Dimensions)
+	}
+	sample, err := NewWindowSample(settings.Coding().Encode(input))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	steps := sample.Ablate(windows, settings, *tolerance, func(step WindowStep) {
+		if step.Removed == 0 {
+			fmt.Printf("windows %s hit rate %.4f\n", FormatWindows(step.Windows), step.HitRate)
+			return
+		}
+		fmt.Printf("without %d windows %s hit rate %.4f\n", step.Removed, FormatWindows(step.Windows), step.HitRate)
+	})
+	windows = steps[len(steps)-1].Windows
+	err = WriteConfig(*FlagConfig, "windows", "["+strings.ReplaceAll(FormatWindows(windows), ",", ", ")+"]")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("wrote windows %s to %s\n", FormatWindows(windows), *FlagConfig)
+}